@@ -41,6 +41,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tmpim/casket/casketfile"
@@ -191,6 +192,7 @@ func (i *Instance) Restart(newCasketfile Input) (*Instance, error) {
 	defer func() {
 		r := recover()
 		if err != nil || r != nil {
+			atomic.AddInt64(&reloads.failed, 1)
 			for _, fn := range i.OnRestartFailed {
 				if err := fn(); err != nil {
 					log.Printf("[ERROR] Restart failed callback returned error: %v", err)
@@ -263,11 +265,42 @@ func (i *Instance) Restart(newCasketfile Input) (*Instance, error) {
 	// Execute instantiation events
 	EmitEvent(InstanceStartupEvent, newInst)
 
+	atomic.AddInt64(&reloads.succeeded, 1)
 	log.Println("[INFO] Reloading complete")
 
 	return newInst, nil
 }
 
+// reloads counts the outcomes of calls to Instance.Restart.
+var reloads struct {
+	succeeded, failed int64
+}
+
+// Reload restarts i with newCasketfile the way the USR1 signal does:
+// the event hooks are reset so that plugins can register them again,
+// and restored if the restart fails.
+func (i *Instance) Reload(newCasketfile Input) (*Instance, error) {
+	// Backup old event hooks
+	oldEventHooks := cloneEventHooks()
+
+	// Purge the old event hooks
+	purgeEventHooks()
+
+	// Kick off the restart
+	EmitEvent(InstanceRestartEvent, nil)
+	inst, err := i.Restart(newCasketfile)
+	if err != nil {
+		restoreEventHooks(oldEventHooks)
+	}
+	return inst, err
+}
+
+// Reloads returns the number of successful and failed
+// instance restarts since the process started.
+func Reloads() (succeeded, failed int64) {
+	return atomic.LoadInt64(&reloads.succeeded), atomic.LoadInt64(&reloads.failed)
+}
+
 // SaveServer adds s and its associated listener ln to the
 // internally-kept list of servers that is running. For
 // saved servers, graceful restarts will be provided.
@@ -2,13 +2,8 @@ package casketmain
 
 import (
 	_ "github.com/tmpim/casket-plugins/chuieauth"
-	_ "github.com/tmpim/casket-plugins/cors/casket"
 	_ "github.com/tmpim/casket-plugins/forwardproxy"
 	_ "github.com/tmpim/casket-plugins/geoip"
-	_ "github.com/tmpim/casket-plugins/ipfilter"
-	_ "github.com/tmpim/casket-plugins/prometheus"
-	_ "github.com/tmpim/casket-plugins/rate-limit"
-	_ "github.com/tmpim/casket-plugins/realip"
 	_ "github.com/tmpim/casket-plugins/tmpauth"
 	_ "github.com/tmpim/casket-plugins/webdav"
 	_ "github.com/tmpim/dnsproviders/acmedns"
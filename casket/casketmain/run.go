@@ -24,6 +24,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -34,8 +35,9 @@ import (
 	"github.com/caddyserver/certmagic"
 	"github.com/tmpim/casket"
 	"github.com/tmpim/casket/casketfile"
+	"github.com/tmpim/casket/caskethttp/admin"
+	"github.com/tmpim/casket/caskethttp/httpserver"
 	"github.com/tmpim/casket/caskettls"
-	"gopkg.in/natefinch/lumberjack.v2"
 
 	_ "github.com/tmpim/casket/caskethttp" // plug in the HTTP server type
 	// This is where other plugins get plugged in (imported)
@@ -44,6 +46,7 @@ import (
 func init() {
 	casket.TrapSignals()
 
+	flag.StringVar(&adminAddr, "admin", "", "Serve the admin API on this loopback address or unix:/path socket (disabled by default)")
 	flag.BoolVar(&certmagic.DefaultACME.Agreed, "agree", true, "Agree to the CA's Subscriber Agreement")
 	flag.StringVar(&certmagic.DefaultACME.CA, "ca", certmagic.DefaultACME.CA, "URL to certificate authority's ACME server directory")
 	flag.StringVar(&certmagic.Default.DefaultServerName, "default-sni", certmagic.Default.DefaultServerName, "If a ClientHello ServerName is empty, use this ServerName to choose a TLS certificate")
@@ -61,6 +64,9 @@ func init() {
 	flag.BoolVar(&logTimestamps, "log-timestamps", true, "Enable timestamps for the process log")
 	flag.IntVar(&logRollMB, "log-roll-mb", 100, "Roll process log when it reaches this many megabytes (0 to disable rolling)")
 	flag.BoolVar(&logRollCompress, "log-roll-compress", true, "Gzip-compress rolled process log files")
+	flag.StringVar(&logRollEvery, "log-roll-every", "", "Also roll process log "+httpserver.RotateDaily+" or "+httpserver.RotateHourly)
+	flag.IntVar(&logRollTotalMB, "log-roll-total-mb", 0, "Remove the oldest rolled process log files when all of them exceed this many megabytes (0 for no limit)")
+	flag.StringVar(&logPostRotate, "log-post-rotate", "", "Command to run after the process log is rolled by time, with the rolled file as last argument")
 	flag.StringVar(&casket.PidFile, "pidfile", "", "Path to write pid file")
 	flag.BoolVar(&casket.Quiet, "quiet", false, "Quiet mode (no initialization output)")
 	flag.StringVar(&revoke, "revoke", "", "Hostname for which to revoke the certificate")
@@ -110,14 +116,25 @@ func Run() {
 	case "":
 		log.SetOutput(ioutil.Discard)
 	default:
-		if logRollMB > 0 {
-			log.SetOutput(&lumberjack.Logger{
-				Filename:   logfile,
-				MaxSize:    logRollMB,
-				MaxAge:     14,
-				MaxBackups: 10,
-				Compress:   logRollCompress,
-			})
+		if logRollMB > 0 || logRollEvery != "" {
+			roller := httpserver.DefaultLogRoller()
+			roller.Filename = logfile
+			roller.MaxSize = logRollMB
+			if logRollMB == 0 {
+				// lumberjack rolls at 100 MB if MaxSize is 0,
+				// so make it too large to ever be reached
+				roller.MaxSize = math.MaxInt32
+			}
+			roller.Compress = logRollCompress
+			roller.LocalTime = false
+			if logRollEvery != "" {
+				if err := httpserver.ParseRoller(roller, "rotate_every", logRollEvery); err != nil {
+					mustLogFatalf("%v", err)
+				}
+			}
+			roller.MaxTotalSize = logRollTotalMB
+			roller.PostRotate = strings.Fields(logPostRotate)
+			log.SetOutput(roller.GetLogWriter())
 		} else {
 			err := os.MkdirAll(filepath.Dir(logfile), 0755)
 			if err != nil {
@@ -204,6 +221,13 @@ func Run() {
 		mustLogFatalf("%v", err)
 	}
 
+	// Serve the admin API, if enabled
+	if adminAddr != "" {
+		if _, err := admin.Start(adminAddr); err != nil {
+			mustLogFatalf("%v", err)
+		}
+	}
+
 	// Twiddle your thumbs
 	instance.Wait()
 }
@@ -506,6 +530,9 @@ var (
 	logTimestamps   bool
 	logRollMB       int
 	logRollCompress bool
+	logRollEvery    string
+	logRollTotalMB  int
+	logPostRotate   string
 	revoke          string
 	toJSON          bool
 	version         bool
@@ -513,4 +540,5 @@ var (
 	printEnv        bool
 	validate        bool
 	disabledMetrics string
+	adminAddr       string
 )
@@ -104,11 +104,21 @@ func TestCasketRestartCallbacks(t *testing.T) {
 			return nil
 		})
 
+		succeeded, failed := Reloads()
 		_, err := c.instance.Restart(CasketfileInput{Contents: []byte(""), ServerTypeName: serverName})
 		if err != nil {
 			log.Printf("[ERROR] Restart failed: %v", err)
 		}
 
+		if test.restartFail {
+			failed++
+		} else {
+			succeeded++
+		}
+		if s, f := Reloads(); s != succeeded || f != failed {
+			t.Errorf("Test %d: Expected %d successful and %d failed reloads, got %d and %d", i, succeeded, failed, s, f)
+		}
+
 		if !reflect.DeepEqual(calls, test.expectedCalls) {
 			t.Errorf("Test %d: Callbacks expected: %v, got: %v", i, test.expectedCalls, calls)
 		}
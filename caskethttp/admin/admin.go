@@ -0,0 +1,313 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package admin implements an HTTP API to inspect and
+// reload the running instance. It is disabled unless
+// started with an address to listen on.
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+	"github.com/tmpim/casket/caskethttp/proxy"
+	"github.com/tmpim/casket/caskettls"
+)
+
+// maxCasketfileSize is the largest Casketfile that can be loaded.
+const maxCasketfileSize = 10 << 20
+
+// Server is a running admin API.
+type Server struct {
+	listener net.Listener
+	server   *http.Server
+	socket   string // path of the unix socket, if any
+}
+
+// Start starts the admin API on addr, which is either a loopback
+// address like localhost:2019 or a unix socket like unix:/run/casket.sock.
+// Other addresses are refused, since the API is not authenticated.
+func Start(addr string) (*Server, error) {
+	s := new(Server)
+	var err error
+	if strings.HasPrefix(addr, "unix:") {
+		s.socket = strings.TrimPrefix(addr, "unix:")
+		// remove a socket left behind by a previous process
+		if info, err := os.Stat(s.socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(s.socket)
+		}
+		s.listener, err = net.Listen("unix", s.socket)
+	} else {
+		if !casket.IsLoopback(addr) {
+			return nil, fmt.Errorf("admin address %s is not a loopback address or unix socket", addr)
+		}
+		s.listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.server = &http.Server{
+		Handler:           newHandler(s.socket == ""),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := s.server.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("[ERROR] Admin API: %v", err)
+		}
+	}()
+	log.Printf("[INFO] Admin API listening on %s", addr)
+	return s, nil
+}
+
+// Addr returns the address the admin API is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Stop stops the admin API.
+func (s *Server) Stop() error {
+	err := s.server.Close()
+	if s.socket != "" {
+		os.Remove(s.socket)
+	}
+	return err
+}
+
+type handler struct {
+	mux      *http.ServeMux
+	checkTCP bool
+	reloadMu sync.Mutex
+}
+
+func newHandler(checkTCP bool) *handler {
+	h := &handler{mux: http.NewServeMux(), checkTCP: checkTCP}
+	h.mux.HandleFunc("/casketfile", h.get(handleCasketfile))
+	h.mux.HandleFunc("/sites", h.get(handleSites))
+	h.mux.HandleFunc("/listeners", h.get(handleListeners))
+	h.mux.HandleFunc("/upstreams", h.get(handleUpstreams))
+	h.mux.HandleFunc("/certificates", h.get(handleCertificates))
+	h.mux.HandleFunc("/load", h.handleLoad)
+	return h
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// browsers may be tricked into sending requests to local
+	// addresses, so refuse cross-origin requests and, over TCP,
+	// requests for other hosts (DNS rebinding)
+	if r.Header.Get("Origin") != "" {
+		writeError(w, http.StatusForbidden, errors.New("cross-origin requests are not allowed"))
+		return
+	}
+	if h.checkTCP && !casket.IsLoopback(r.Host) {
+		writeError(w, http.StatusForbidden, fmt.Errorf("host %s is not allowed", r.Host))
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// get adapts f into a handler of GET requests
+// about the current instance.
+func (h *handler) get(f func(*casket.Instance) interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		inst, err := currentInstance()
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, f(inst))
+	}
+}
+
+// handleLoad validates the Casketfile in the request body and
+// restarts the current instance with it. If the Casketfile is
+// invalid, the instance keeps running with its old one.
+func (h *handler) handleLoad(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxCasketfileSize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+
+	inst, err := currentInstance()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	input := casket.CasketfileInput{
+		Contents:       body,
+		Filepath:       "admin",
+		ServerTypeName: "http",
+	}
+	if current := inst.Casketfile(); current != nil {
+		// keep the path so that imports are relative to it
+		input.Filepath = current.Path()
+		input.ServerTypeName = current.ServerType()
+	}
+
+	if _, err := inst.Reload(input); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+// currentInstance returns the running instance.
+func currentInstance() (*casket.Instance, error) {
+	instances := casket.Instances()
+	if len(instances) == 0 {
+		return nil, errors.New("no server instances are fully running")
+	}
+	return instances[0], nil
+}
+
+// casketfileInfo describes the Casketfile of an instance.
+type casketfileInfo struct {
+	Path       string `json:"path"`
+	ServerType string `json:"server_type"`
+	Contents   string `json:"contents"`
+}
+
+func handleCasketfile(inst *casket.Instance) interface{} {
+	input := inst.Casketfile()
+	if input == nil {
+		return nil
+	}
+	return casketfileInfo{
+		Path:       input.Path(),
+		ServerType: input.ServerType(),
+		Contents:   string(input.Body()),
+	}
+}
+
+// siteInfo describes a site being served.
+type siteInfo struct {
+	Address string `json:"address"`
+	Listen  string `json:"listen"`
+	Root    string `json:"root,omitempty"`
+	TLS     bool   `json:"tls"`
+}
+
+func handleSites(inst *casket.Instance) interface{} {
+	sites := []siteInfo{}
+	for _, sl := range inst.Servers() {
+		srv, ok := sl.Server().(*httpserver.Server)
+		if !ok {
+			continue
+		}
+		for _, site := range srv.Sites() {
+			sites = append(sites, siteInfo{
+				Address: site.Addr.String(),
+				Listen:  srv.Address(),
+				Root:    site.Root,
+				TLS:     site.TLS != nil && site.TLS.Enabled,
+			})
+		}
+	}
+	return sites
+}
+
+// listenerInfo describes the listeners of a server.
+type listenerInfo struct {
+	Address string `json:"address"`
+	Network string `json:"network,omitempty"`
+	Packet  string `json:"packet,omitempty"`
+}
+
+func handleListeners(inst *casket.Instance) interface{} {
+	listeners := []listenerInfo{}
+	for _, sl := range inst.Servers() {
+		var info listenerInfo
+		if gs, ok := sl.Server().(casket.GracefulServer); ok {
+			info.Address = gs.Address()
+		}
+		if addr := sl.Addr(); addr != nil {
+			info.Address = addr.String()
+			info.Network = addr.Network()
+		}
+		if addr := sl.LocalAddr(); addr != nil {
+			info.Packet = addr.String()
+		}
+		listeners = append(listeners, info)
+	}
+	return listeners
+}
+
+func handleUpstreams(inst *casket.Instance) interface{} {
+	stats := proxy.Stats()
+	if stats == nil {
+		return []proxy.UpstreamStats{}
+	}
+	return stats
+}
+
+// certificateInfo describes a managed certificate.
+type certificateInfo struct {
+	Name      string    `json:"name"`
+	NotAfter  time.Time `json:"not_after"`
+	ExpiresIn int64     `json:"expires_in_seconds"`
+	Expired   bool      `json:"expired"`
+}
+
+func handleCertificates(inst *casket.Instance) interface{} {
+	certs := []certificateInfo{}
+	now := time.Now()
+	for name, notAfter := range caskettls.CertificateExpirations(inst) {
+		certs = append(certs, certificateInfo{
+			Name:      name,
+			NotAfter:  notAfter,
+			ExpiresIn: int64(notAfter.Sub(now) / time.Second),
+			Expired:   now.After(notAfter),
+		})
+	}
+	sort.Slice(certs, func(i, j int) bool { return certs[i].Name < certs[j].Name })
+	return certs
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,138 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tmpim/casket"
+	_ "github.com/tmpim/casket/caskethttp/httpserver"
+	_ "github.com/tmpim/casket/caskethttp/root"
+)
+
+func TestStartRefusesPublicAddress(t *testing.T) {
+	if _, err := Start("0.0.0.0:0"); err == nil {
+		t.Error("Expected an error for a non-loopback address")
+	}
+}
+
+func TestAdminRejectsUnsafeRequests(t *testing.T) {
+	h := newHandler(true)
+	for i, test := range []struct {
+		host, origin string
+		expected     int
+	}{
+		{"localhost:2019", "", http.StatusServiceUnavailable},
+		{"localhost:2019", "http://example.com", http.StatusForbidden},
+		{"example.com", "", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("GET", "/casketfile", nil)
+		r.Host = test.host
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.expected {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expected, w.Code)
+		}
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	casket.Quiet = true
+
+	_, err := casket.Start(casket.CasketfileInput{
+		Contents:       []byte("http://127.0.0.1:0 {\n\troot /srv\n}\n"),
+		Filepath:       "Casketfile",
+		ServerTypeName: "http",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error starting casket, got %v", err)
+	}
+	defer func() {
+		for _, inst := range casket.Instances() {
+			inst.Stop()
+		}
+	}()
+
+	h := newHandler(true)
+	do := func(method, path, body string, v interface{}) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Host = "localhost:2019"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if v != nil {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatalf("%s %s: Expected JSON, got %q: %v", method, path, w.Body.String(), err)
+			}
+		}
+		return w.Code
+	}
+
+	var cf casketfileInfo
+	if status := do("GET", "/casketfile", "", &cf); status != http.StatusOK {
+		t.Fatalf("Expected status 200 for casketfile, got %d", status)
+	}
+	if cf.Path != "Casketfile" || cf.ServerType != "http" || !strings.Contains(cf.Contents, "root /srv") {
+		t.Errorf("Unexpected casketfile: %+v", cf)
+	}
+
+	var sites []siteInfo
+	do("GET", "/sites", "", &sites)
+	if len(sites) != 1 || sites[0].Root != "/srv" || sites[0].TLS {
+		t.Errorf("Unexpected sites: %+v", sites)
+	}
+
+	var listeners []listenerInfo
+	do("GET", "/listeners", "", &listeners)
+	if len(listeners) != 1 || listeners[0].Network != "tcp" {
+		t.Errorf("Unexpected listeners: %+v", listeners)
+	}
+
+	var certs []certificateInfo
+	if status := do("GET", "/certificates", "", &certs); status != http.StatusOK || len(certs) != 0 {
+		t.Errorf("Expected no certificates, got %d %+v", status, certs)
+	}
+
+	if status := do("POST", "/casketfile", "", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for POST to casketfile, got %d", status)
+	}
+
+	var result map[string]string
+	if status := do("POST", "/load", "http://127.0.0.1:0 {\n\tbogus\n}\n", &result); status != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid Casketfile, got %d", status)
+	}
+	if !strings.Contains(result["error"], "bogus") {
+		t.Errorf("Expected parse error mentioning the directive, got %v", result)
+	}
+	do("GET", "/casketfile", "", &cf)
+	if !strings.Contains(cf.Contents, "root /srv") {
+		t.Errorf("Expected the old Casketfile to remain after a failed load, got %q", cf.Contents)
+	}
+
+	result = nil
+	if status := do("POST", "/load", "http://127.0.0.1:0 {\n\troot /var/www\n}\n", &result); status != http.StatusOK {
+		t.Fatalf("Expected status 200 for valid Casketfile, got %d: %v", status, result)
+	}
+	do("GET", "/sites", "", &sites)
+	if len(sites) != 1 || sites[0].Root != "/var/www" {
+		t.Errorf("Expected the new Casketfile to be applied, got sites %+v", sites)
+	}
+}
@@ -0,0 +1,416 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache implements a middleware that caches responses
+// in memory and/or on disk.
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+// Cache status values, which are set in the status header
+// and the {cache_status} placeholder.
+const (
+	StatusHit    = "HIT"
+	StatusMiss   = "MISS"
+	StatusStale  = "STALE"
+	StatusBypass = "BYPASS"
+)
+
+// Cache is a middleware which serves responses from a cache.
+type Cache struct {
+	Next  httpserver.Handler
+	Rules []*Rule
+}
+
+// Rule configures caching for requests under a base path.
+type Rule struct {
+	// Path is the base path of requests to cache.
+	Path string
+
+	// DefaultMaxAge is the freshness lifetime of responses which
+	// don't specify one. Zero means such responses aren't cached.
+	DefaultMaxAge time.Duration
+
+	// StaleWhileRevalidate is how long a stale response may be served
+	// while it is refreshed in the background, unless the response
+	// specifies otherwise.
+	StaleWhileRevalidate time.Duration
+
+	// StaleIfError is how long a stale response may be served if the
+	// next handler fails, unless the response specifies otherwise.
+	StaleIfError time.Duration
+
+	// MaxEntrySize is the largest response body that is cached.
+	MaxEntrySize int64
+
+	// StatusHeader is the response header which reports the cache
+	// status. If empty, no header is added.
+	StatusHeader string
+
+	storage storage
+
+	mu           sync.Mutex
+	inflight     map[string]*call
+	revalidating map[string]struct{}
+}
+
+// call is a request to the next handler that
+// concurrent misses for the same key wait on.
+type call struct {
+	done chan struct{}
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (c Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	i := httpserver.Path(r.URL.Path).LongestMatch(len(c.Rules), func(i int) []string {
+		return []string{c.Rules[i].Path}
+	})
+	if i < 0 {
+		return c.Next.ServeHTTP(w, r)
+	}
+	return c.Rules[i].serve(c.Next, w, r)
+}
+
+func (rule *Rule) serve(next httpserver.Handler, w http.ResponseWriter, r *http.Request) (int, error) {
+	reqDirectives := parseCacheControl(r.Header["Cache-Control"])
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+		r.Header.Get("Upgrade") != "" || reqDirectives.has("no-store") {
+		rule.setStatus(w, StatusBypass)
+		return next.ServeHTTP(w, r)
+	}
+
+	key := cacheKey(r)
+	now := time.Now()
+
+	// the client may ask for the response to be fetched
+	// anew, which is then still stored for others
+	var entry *Entry
+	if !reqDirectives.has("no-cache") && reqDirectives["max-age"] != "0" &&
+		r.Header.Get("Pragma") != "no-cache" {
+		entry = rule.lookup(key, r, now)
+	}
+
+	if entry != nil {
+		if entry.fresh(now) {
+			return rule.serveEntry(w, r, entry, StatusHit, now)
+		}
+		if entry.staleWhileRevalidate(now) {
+			rule.revalidate(next, r, key)
+			return rule.serveEntry(w, r, entry, StatusStale, now)
+		}
+	}
+
+	if r.Method == http.MethodHead {
+		rule.setStatus(w, StatusBypass)
+		return next.ServeHTTP(w, r)
+	}
+
+	if entry != nil && entry.staleIfError(now) {
+		return rule.serveOrStale(next, w, r, key, entry)
+	}
+
+	return rule.fetch(next, w, r, key)
+}
+
+// fetch gets the response from the next handler, storing it if it
+// can be cached. Concurrent misses for the same key wait for the
+// first one and are then served from the cache.
+func (rule *Rule) fetch(next httpserver.Handler, w http.ResponseWriter, r *http.Request, key string) (int, error) {
+	rule.mu.Lock()
+	if c, ok := rule.inflight[key]; ok {
+		rule.mu.Unlock()
+		select {
+		case <-c.done:
+		case <-r.Context().Done():
+			return http.StatusServiceUnavailable, r.Context().Err()
+		}
+		now := time.Now()
+		if entry := rule.lookup(key, r, now); entry != nil && entry.fresh(now) {
+			return rule.serveEntry(w, r, entry, StatusHit, now)
+		}
+		rule.setStatus(w, StatusMiss)
+		return next.ServeHTTP(w, r)
+	}
+	c := &call{done: make(chan struct{})}
+	rule.inflight[key] = c
+	rule.mu.Unlock()
+
+	defer func() {
+		rule.mu.Lock()
+		delete(rule.inflight, key)
+		rule.mu.Unlock()
+		close(c.done)
+	}()
+
+	rule.setStatus(w, StatusMiss)
+	tee := &teeWriter{
+		ResponseWriterWrapper: &httpserver.ResponseWriterWrapper{ResponseWriter: w},
+		limit:                 rule.MaxEntrySize,
+		statusHeader:          rule.StatusHeader,
+	}
+	status, err := next.ServeHTTP(tee, r)
+	if err == nil && tee.wroteHeader && !tee.overflow {
+		rule.store(key, r, tee.status, tee.header, tee.body.Bytes(), time.Now())
+	}
+	return status, err
+}
+
+// serveOrStale gets the response from the next handler, but serves
+// the stale entry instead if the next handler fails. Only the status
+// is waited for; a successful response is streamed like in fetch.
+func (rule *Rule) serveOrStale(next httpserver.Handler, w http.ResponseWriter, r *http.Request, key string, entry *Entry) (int, error) {
+	header := w.Header().Clone()
+	rule.setStatus(w, StatusMiss)
+	tee := &teeWriter{
+		ResponseWriterWrapper: &httpserver.ResponseWriterWrapper{ResponseWriter: w},
+		limit:                 rule.MaxEntrySize,
+		statusHeader:          rule.StatusHeader,
+		holdErrors:            true,
+	}
+	status, err := next.ServeHTTP(tee, r)
+	if tee.failed || (!tee.wroteHeader && (err != nil || status >= 500)) {
+		// drop the headers the failed response set
+		for field := range w.Header() {
+			delete(w.Header(), field)
+		}
+		for field, values := range header {
+			w.Header()[field] = values
+		}
+		return rule.serveEntry(w, r, entry, StatusStale, time.Now())
+	}
+	if err == nil && tee.wroteHeader && !tee.overflow {
+		rule.store(key, r, tee.status, tee.header, tee.body.Bytes(), time.Now())
+	}
+	return status, err
+}
+
+// revalidate refreshes the entry for key in the background,
+// unless that is already in progress.
+func (rule *Rule) revalidate(next httpserver.Handler, r *http.Request, key string) {
+	rule.mu.Lock()
+	if _, ok := rule.revalidating[key]; ok {
+		rule.mu.Unlock()
+		return
+	}
+	rule.revalidating[key] = struct{}{}
+	rule.mu.Unlock()
+
+	// the request must outlive the one which triggered it
+	req := r.Clone(context.WithoutCancel(r.Context()))
+	req.Method = http.MethodGet
+	req.Body = http.NoBody
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+
+	go func() {
+		defer func() {
+			rule.mu.Lock()
+			delete(rule.revalidating, key)
+			rule.mu.Unlock()
+		}()
+		buf := newBufferWriter(rule.MaxEntrySize)
+		_, err := next.ServeHTTP(buf, req)
+		if err == nil && buf.wroteHeader && !buf.overflow && buf.status < 500 {
+			rule.store(key, req, buf.status, buf.header, buf.body.Bytes(), time.Now())
+		}
+	}()
+}
+
+// serveEntry writes entry as the response to r.
+func (rule *Rule) serveEntry(w http.ResponseWriter, r *http.Request, entry *Entry, cacheStatus string, now time.Time) (int, error) {
+	header := w.Header()
+	for field, values := range entry.Header {
+		header[field] = append([]string(nil), values...)
+	}
+	header.Set("Age", strconv.FormatInt(int64(entry.age(now)/time.Second), 10))
+	rule.setStatus(w, cacheStatus)
+
+	if entry.Status == http.StatusOK && notModified(r, entry.Header) {
+		w.WriteHeader(http.StatusNotModified)
+		return 0, nil
+	}
+	w.WriteHeader(entry.Status)
+	if r.Method != http.MethodHead {
+		w.Write(entry.Body)
+	}
+	return 0, nil
+}
+
+// setStatus reports the cache status in the status
+// header and the {cache_status} placeholder.
+func (rule *Rule) setStatus(w http.ResponseWriter, cacheStatus string) {
+	if rule.StatusHeader != "" {
+		w.Header().Set(rule.StatusHeader, cacheStatus)
+	}
+	if rr, ok := w.(*httpserver.ResponseRecorder); ok && rr.Replacer != nil {
+		rr.Replacer.Set("cache_status", cacheStatus)
+	}
+}
+
+// notModified returns true if the conditional headers of r
+// match a response with the given header.
+func notModified(r *http.Request, header http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := header.Get("ETag")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range splitList(inm) {
+			if candidate == "*" || trimWeak(candidate) == trimWeak(etag) {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(header.Get("Last-Modified"))
+		return err == nil && !modified.After(since)
+	}
+	return false
+}
+
+func trimWeak(etag string) string {
+	if len(etag) > 2 && etag[:2] == "W/" {
+		return etag[2:]
+	}
+	return etag
+}
+
+// teeWriter passes a response through while keeping a copy of it,
+// up to limit bytes of body, so that it can be cached. If holdErrors
+// is set, responses with a 5xx status are discarded instead, so that
+// a stale response can be served in their place.
+type teeWriter struct {
+	*httpserver.ResponseWriterWrapper
+	limit        int64
+	statusHeader string
+	holdErrors   bool
+	wroteHeader  bool
+	failed       bool
+	overflow     bool
+	status       int
+	header       http.Header
+	body         bytes.Buffer
+}
+
+// WriteHeader records the status and a copy of the headers.
+func (w *teeWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = status
+		w.failed = w.holdErrors && status >= 500
+		w.header = w.Header().Clone()
+		if w.statusHeader != "" {
+			w.header.Del(w.statusHeader)
+		}
+	}
+	if !w.failed {
+		w.ResponseWriterWrapper.WriteHeader(status)
+	}
+}
+
+// Write keeps a copy of buf unless the body grew too large.
+func (w *teeWriter) Write(buf []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.failed {
+		return len(buf), nil
+	}
+	if !w.overflow {
+		if int64(w.body.Len()+len(buf)) > w.limit {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(buf)
+		}
+	}
+	return w.ResponseWriterWrapper.Write(buf)
+}
+
+// Hijack hijacks the connection, after which
+// the response can no longer be cached.
+func (w *teeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.overflow = true
+	return w.ResponseWriterWrapper.Hijack()
+}
+
+// bufferWriter is a http.ResponseWriter which only records the
+// response, up to limit bytes of body, for requests that aren't
+// answered right away.
+type bufferWriter struct {
+	header      http.Header
+	limit       int64
+	wroteHeader bool
+	overflow    bool
+	status      int
+	body        bytes.Buffer
+}
+
+func newBufferWriter(limit int64) *bufferWriter {
+	return &bufferWriter{header: make(http.Header), limit: limit}
+}
+
+func (w *bufferWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = status
+		w.header = w.header.Clone()
+	}
+}
+
+// Write keeps buf unless the body grew too large, in
+// which case the rest of the response is discarded.
+func (w *bufferWriter) Write(buf []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.overflow {
+		if int64(w.body.Len()+len(buf)) > w.limit {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(buf)
+		}
+	}
+	return len(buf), nil
+}
+
+// Flush implements http.Flusher; there is nothing to flush.
+func (w *bufferWriter) Flush() {}
+
+// CloseNotify implements http.CloseNotifier. The recorded
+// response has no client that could go away.
+func (w *bufferWriter) CloseNotify() <-chan bool {
+	return nil
+}
@@ -0,0 +1,396 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func newTestCache(next httpserver.Handler) Cache {
+	return Cache{
+		Next: next,
+		Rules: []*Rule{{
+			Path:         "/",
+			MaxEntrySize: 1 << 20,
+			StatusHeader: "X-Cache",
+			storage:      newMemoryStorage(1 << 20),
+			inflight:     make(map[string]*call),
+			revalidating: make(map[string]struct{}),
+		}},
+	}
+}
+
+// countingHandler responds with the body and Cache-Control
+// header given, counting how often it was called.
+func countingHandler(calls *int32, body, cacheControl string) httpserver.Handler {
+	return httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		atomic.AddInt32(calls, 1)
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		w.Write([]byte(body))
+		return http.StatusOK, nil
+	})
+}
+
+func doRequest(t *testing.T, c Cache, method, path string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	for field, values := range header {
+		r.Header[field] = values
+	}
+	w := httptest.NewRecorder()
+	if _, err := c.ServeHTTP(w, r); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return w
+}
+
+func expectResponse(t *testing.T, w *httptest.ResponseRecorder, cacheStatus, body string) {
+	t.Helper()
+	if got := w.Header().Get("X-Cache"); got != cacheStatus {
+		t.Errorf("Expected cache status %s, got %s", cacheStatus, got)
+	}
+	if got := w.Body.String(); got != body {
+		t.Errorf("Expected body %q, got %q", body, got)
+	}
+}
+
+func TestCacheHitMiss(t *testing.T) {
+	var calls int32
+	c := newTestCache(countingHandler(&calls, "hello", "max-age=60"))
+
+	expectResponse(t, doRequest(t, c, "GET", "/a", nil), StatusMiss, "hello")
+	w := doRequest(t, c, "GET", "/a", nil)
+	expectResponse(t, w, StatusHit, "hello")
+	if w.Header().Get("Age") != "0" || w.Header().Get("Cache-Control") != "max-age=60" {
+		t.Errorf("Expected cached headers and Age, got %v", w.Header())
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 call to next handler, got %d", calls)
+	}
+
+	// HEAD is served from the GET entry
+	w = doRequest(t, c, "HEAD", "/a", nil)
+	expectResponse(t, w, StatusHit, "")
+
+	// other paths and query strings are different entries
+	expectResponse(t, doRequest(t, c, "GET", "/a?b=c", nil), StatusMiss, "hello")
+	expectResponse(t, doRequest(t, c, "HEAD", "/b", nil), StatusBypass, "hello")
+
+	// the client may ask for a fresh response
+	expectResponse(t, doRequest(t, c, "GET", "/a", http.Header{"Cache-Control": {"no-cache"}}), StatusMiss, "hello")
+	expectResponse(t, doRequest(t, c, "GET", "/a", http.Header{"Cache-Control": {"no-store"}}), StatusBypass, "hello")
+	expectResponse(t, doRequest(t, c, "POST", "/a", nil), StatusBypass, "hello")
+
+	// conditional requests are answered from the cache
+	entry, _ := c.Rules[0].storage.Get("example.com/a")
+	entry.Header.Set("ETag", `"v1"`)
+	w = doRequest(t, c, "GET", "/a", http.Header{"If-None-Match": {`W/"v1"`}})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected status 304, got %d", w.Code)
+	}
+}
+
+func TestCacheLongestPath(t *testing.T) {
+	var calls int32
+	c := newTestCache(countingHandler(&calls, "hello", "max-age=60"))
+	c.Rules = append(c.Rules, &Rule{
+		Path:         "/api",
+		MaxEntrySize: 1 << 20,
+		StatusHeader: "X-API-Cache",
+		storage:      newMemoryStorage(1 << 20),
+		inflight:     make(map[string]*call),
+		revalidating: make(map[string]struct{}),
+	})
+
+	w := doRequest(t, c, "GET", "/api/a", nil)
+	if w.Header().Get("X-API-Cache") != StatusMiss || w.Header().Get("X-Cache") != "" {
+		t.Errorf("Expected the /api rule to be used, got %v", w.Header())
+	}
+	w = doRequest(t, c, "GET", "/a", nil)
+	if w.Header().Get("X-Cache") != StatusMiss || w.Header().Get("X-API-Cache") != "" {
+		t.Errorf("Expected the / rule to be used, got %v", w.Header())
+	}
+}
+
+func TestCacheNotStored(t *testing.T) {
+	for _, test := range []struct {
+		cacheControl string
+		header       http.Header
+		status       int
+	}{
+		{cacheControl: ""},
+		{cacheControl: "no-store, max-age=60"},
+		{cacheControl: "private, max-age=60"},
+		{cacheControl: "max-age=60", header: http.Header{"Set-Cookie": {"a=b"}}},
+		{cacheControl: "max-age=60", header: http.Header{"Vary": {"*"}}},
+		{cacheControl: "max-age=60", status: http.StatusInternalServerError},
+	} {
+		var calls int32
+		c := newTestCache(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			calls++
+			for field, values := range test.header {
+				w.Header()[field] = values
+			}
+			w.Header().Set("Cache-Control", test.cacheControl)
+			if test.status != 0 {
+				w.WriteHeader(test.status)
+			}
+			w.Write([]byte("hello"))
+			return 0, nil
+		}))
+		doRequest(t, c, "GET", "/", nil)
+		doRequest(t, c, "GET", "/", nil)
+		if calls != 2 {
+			t.Errorf("Expected %q %v to not be cached, got %d calls", test.cacheControl, test.header, calls)
+		}
+	}
+
+	// responses with an error status which weren't written aren't cached
+	var calls int32
+	c := newTestCache(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		calls++
+		return http.StatusNotFound, nil
+	}))
+	c.Rules[0].DefaultMaxAge = time.Minute
+	r := httptest.NewRequest("GET", "/", nil)
+	for i := 0; i < 2; i++ {
+		if status, _ := c.ServeHTTP(httptest.NewRecorder(), r); status != http.StatusNotFound {
+			t.Errorf("Expected status 404 to be passed on, got %d", status)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("Expected unwritten response to not be cached, got %d calls", calls)
+	}
+
+	// responses larger than the entry size limit aren't cached
+	calls = 0
+	c = newTestCache(countingHandler(&calls, "hello", "max-age=60"))
+	c.Rules[0].MaxEntrySize = 4
+	expectResponse(t, doRequest(t, c, "GET", "/", nil), StatusMiss, "hello")
+	expectResponse(t, doRequest(t, c, "GET", "/", nil), StatusMiss, "hello")
+}
+
+func TestCacheVary(t *testing.T) {
+	var calls int32
+	c := newTestCache(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte(r.Header.Get("Accept-Language")))
+		return http.StatusOK, nil
+	}))
+
+	en := http.Header{"Accept-Language": {"en"}}
+	de := http.Header{"Accept-Language": {"de"}}
+	expectResponse(t, doRequest(t, c, "GET", "/", en), StatusMiss, "en")
+	expectResponse(t, doRequest(t, c, "GET", "/", de), StatusMiss, "de")
+	expectResponse(t, doRequest(t, c, "GET", "/", en), StatusHit, "en")
+	expectResponse(t, doRequest(t, c, "GET", "/", de), StatusHit, "de")
+	if calls != 2 {
+		t.Errorf("Expected 2 calls to next handler, got %d", calls)
+	}
+}
+
+// age makes the entry stored under key older by d.
+func age(t *testing.T, c Cache, key string, d time.Duration) {
+	entry, ok := c.Rules[0].storage.Get(key)
+	if !ok {
+		t.Fatalf("Expected entry for %s", key)
+	}
+	entry.Stored = entry.Stored.Add(-d)
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	var calls int32
+	body := "v1"
+	var mu sync.Mutex
+	c := newTestCache(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		atomic.AddInt32(&calls, 1)
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Cache-Control", "max-age=60, stale-while-revalidate=30")
+		w.Write([]byte(body))
+		return http.StatusOK, nil
+	}))
+
+	expectResponse(t, doRequest(t, c, "GET", "/", nil), StatusMiss, "v1")
+	mu.Lock()
+	body = "v2"
+	mu.Unlock()
+	age(t, c, "example.com/", 70*time.Second)
+
+	expectResponse(t, doRequest(t, c, "GET", "/", nil), StatusStale, "v1")
+	for i := 0; ; i++ {
+		if w := doRequest(t, c, "GET", "/", nil); w.Body.String() == "v2" {
+			expectResponse(t, w, StatusHit, "v2")
+			break
+		}
+		if i == 100 {
+			t.Fatal("Expected entry to be revalidated in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("Expected 2 calls to next handler, got %d", n)
+	}
+
+	// once past the stale window, the entry is fetched right away
+	age(t, c, "example.com/", 100*time.Second)
+	expectResponse(t, doRequest(t, c, "GET", "/", nil), StatusMiss, "v2")
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	fail := false
+	c := newTestCache(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		if fail {
+			return http.StatusBadGateway, errors.New("upstream down")
+		}
+		w.Header().Set("Cache-Control", "max-age=60, stale-if-error=3600")
+		w.Write([]byte("ok"))
+		return http.StatusOK, nil
+	}))
+
+	expectResponse(t, doRequest(t, c, "GET", "/", nil), StatusMiss, "ok")
+	age(t, c, "example.com/", 70*time.Second)
+	fail = true
+	expectResponse(t, doRequest(t, c, "GET", "/", nil), StatusStale, "ok")
+
+	// a successful response replaces the stale entry
+	fail = false
+	expectResponse(t, doRequest(t, c, "GET", "/", nil), StatusMiss, "ok")
+	expectResponse(t, doRequest(t, c, "GET", "/", nil), StatusHit, "ok")
+
+	// without a usable stale entry, the error is passed on
+	age(t, c, "example.com/", 2*time.Hour)
+	fail = true
+	r := httptest.NewRequest("GET", "/", nil)
+	if status, err := c.ServeHTTP(httptest.NewRecorder(), r); status != http.StatusBadGateway || err == nil {
+		t.Errorf("Expected status 502 and error, got %d and %v", status, err)
+	}
+}
+
+func TestCacheStaleIfErrorWritten(t *testing.T) {
+	var status int32 = http.StatusOK
+	body := "ok"
+	c := newTestCache(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		if code := int(atomic.LoadInt32(&status)); code != http.StatusOK {
+			w.Header().Set("X-Error", "yes")
+			w.WriteHeader(code)
+			w.Write([]byte("unavailable"))
+			return 0, nil
+		}
+		w.Header().Set("Cache-Control", "max-age=60, stale-if-error=3600")
+		w.Write([]byte(body))
+		return http.StatusOK, nil
+	}))
+
+	expectResponse(t, doRequest(t, c, "GET", "/", nil), StatusMiss, "ok")
+	age(t, c, "example.com/", 70*time.Second)
+
+	// a written error response is replaced by the stale entry
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	w := doRequest(t, c, "GET", "/", nil)
+	expectResponse(t, w, StatusStale, "ok")
+	if w.Code != http.StatusOK || w.Header().Get("X-Error") != "" {
+		t.Errorf("Expected nothing of the error response, got %d and %v", w.Code, w.Header())
+	}
+
+	// a successful response is passed on in full, but
+	// only cached if it fits the entry size limit
+	atomic.StoreInt32(&status, http.StatusOK)
+	body = "too large"
+	c.Rules[0].MaxEntrySize = 4
+	expectResponse(t, doRequest(t, c, "GET", "/", nil), StatusMiss, "too large")
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	expectResponse(t, doRequest(t, c, "GET", "/", nil), StatusStale, "ok")
+}
+
+func TestBufferWriterLimit(t *testing.T) {
+	buf := newBufferWriter(4)
+	buf.Write([]byte("ok"))
+	if buf.overflow || buf.body.String() != "ok" {
+		t.Errorf("Expected the body to be kept, got %q", buf.body.String())
+	}
+	if n, err := buf.Write([]byte("too large")); n != 9 || err != nil {
+		t.Errorf("Expected the write to succeed, got %d and %v", n, err)
+	}
+	if !buf.overflow || buf.body.Len() != 0 {
+		t.Errorf("Expected the body to be dropped, got %q", buf.body.String())
+	}
+}
+
+func TestCacheCoalescesMisses(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	c := newTestCache(httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+		return http.StatusOK, nil
+	}))
+
+	var wg sync.WaitGroup
+	results := make([]*httptest.ResponseRecorder, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = doRequest(t, c, "GET", "/", nil)
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("Expected 1 call to next handler, got %d", calls)
+	}
+	for i, w := range results {
+		if w.Body.String() != "hello" {
+			t.Errorf("Request %d: Expected body hello, got %q", i, w.Body.String())
+		}
+	}
+}
+
+func TestCacheStatusPlaceholder(t *testing.T) {
+	var calls int32
+	c := newTestCache(countingHandler(&calls, "hello", "max-age=60"))
+	c.Rules[0].StatusHeader = ""
+
+	for _, expected := range []string{StatusMiss, StatusHit} {
+		r := httptest.NewRequest("GET", "/", nil)
+		rr := httpserver.NewResponseRecorder(httptest.NewRecorder())
+		rr.Replacer = httpserver.NewReplacer(r, rr, "")
+		if _, err := c.ServeHTTP(rr, r); err != nil {
+			t.Fatal(err)
+		}
+		if got := rr.Replacer.Replace("{cache_status}"); got != expected {
+			t.Errorf("Expected {cache_status} %s, got %s", expected, got)
+		}
+		if got := rr.Header().Get("X-Cache"); got != "" {
+			t.Errorf("Expected no status header, got %s", got)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry is a cached response. An entry without a status is a marker
+// recording which request headers the responses for its key vary by.
+type Entry struct {
+	Status int
+	Header http.Header
+	Body   []byte
+
+	// Vary lists the canonical names of the request
+	// headers the response varies by.
+	Vary []string
+
+	// Stored is when the response was received, and InitialAge
+	// is how old it already was at that time.
+	Stored     time.Time
+	InitialAge time.Duration
+
+	// MaxAge is the freshness lifetime of the response.
+	MaxAge time.Duration
+
+	// StaleWhileRevalidate and StaleIfError are how long after
+	// becoming stale the response may still be served.
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+}
+
+func (e *Entry) age(now time.Time) time.Duration {
+	return e.InitialAge + now.Sub(e.Stored)
+}
+
+func (e *Entry) fresh(now time.Time) bool {
+	return e.age(now) < e.MaxAge
+}
+
+func (e *Entry) staleWhileRevalidate(now time.Time) bool {
+	return e.age(now) < e.MaxAge+e.StaleWhileRevalidate
+}
+
+func (e *Entry) staleIfError(now time.Time) bool {
+	return e.age(now) < e.MaxAge+e.StaleIfError
+}
+
+// expired returns true once the entry can't be served at all anymore.
+func (e *Entry) expired(now time.Time) bool {
+	return !e.staleWhileRevalidate(now) && !e.staleIfError(now)
+}
+
+// size estimates the memory used by the entry.
+func (e *Entry) size() int64 {
+	n := int64(len(e.Body))
+	for field, values := range e.Header {
+		n += int64(len(field))
+		for _, v := range values {
+			n += int64(len(v))
+		}
+	}
+	return n
+}
+
+// cacheableStatus holds the status codes which are cacheable by
+// default, as defined by RFC 7231, section 6.1.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// newEntry returns the entry for a response to r, or nil if the
+// response must not be cached, following the rules for shared
+// caches in RFC 7234 and the stale extensions of RFC 5861.
+func (rule *Rule) newEntry(r *http.Request, status int, header http.Header, body []byte, now time.Time) *Entry {
+	if !cacheableStatus[status] {
+		return nil
+	}
+	directives := parseCacheControl(header["Cache-Control"])
+	if directives.has("no-store") || directives.has("private") || directives.has("no-cache") {
+		return nil
+	}
+	if r.Header.Get("Authorization") != "" &&
+		!directives.has("public") && !directives.has("s-maxage") && !directives.has("must-revalidate") {
+		return nil
+	}
+	if header.Get("Set-Cookie") != "" {
+		return nil
+	}
+
+	var vary []string
+	for _, field := range splitList(strings.Join(header["Vary"], ",")) {
+		if field == "*" {
+			return nil
+		}
+		vary = append(vary, http.CanonicalHeaderKey(field))
+	}
+	sort.Strings(vary)
+
+	entry := &Entry{
+		Status:               status,
+		Header:               header,
+		Body:                 body,
+		Vary:                 vary,
+		Stored:               now,
+		StaleWhileRevalidate: rule.StaleWhileRevalidate,
+		StaleIfError:         rule.StaleIfError,
+	}
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		entry.InitialAge = time.Duration(age) * time.Second
+	}
+
+	if maxAge, ok := directives.seconds("s-maxage"); ok {
+		entry.MaxAge = maxAge
+	} else if maxAge, ok := directives.seconds("max-age"); ok {
+		entry.MaxAge = maxAge
+	} else if expires := header.Get("Expires"); expires != "" {
+		// an invalid Expires header means already expired
+		if t, err := http.ParseTime(expires); err == nil {
+			date, err := http.ParseTime(header.Get("Date"))
+			if err != nil {
+				date = now
+			}
+			entry.MaxAge = t.Sub(date)
+		}
+	} else {
+		entry.MaxAge = rule.DefaultMaxAge
+	}
+
+	if d, ok := directives.seconds("stale-while-revalidate"); ok {
+		entry.StaleWhileRevalidate = d
+	}
+	if d, ok := directives.seconds("stale-if-error"); ok {
+		entry.StaleIfError = d
+	}
+	if directives.has("must-revalidate") || directives.has("proxy-revalidate") {
+		entry.StaleWhileRevalidate = 0
+		entry.StaleIfError = 0
+	}
+
+	if entry.expired(now) {
+		return nil
+	}
+	return entry
+}
+
+// cacheControl holds the directives of a Cache-Control header.
+type cacheControl map[string]string
+
+func parseCacheControl(headers []string) cacheControl {
+	directives := make(cacheControl)
+	for _, part := range splitList(strings.Join(headers, ",")) {
+		name, value := part, ""
+		if i := strings.Index(part, "="); i >= 0 {
+			name, value = part[:i], strings.Trim(part[i+1:], `"`)
+		}
+		directives[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+	return directives
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns the value of a delta-seconds directive.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	value, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// splitList splits a comma-separated header value into its
+// trimmed, non-empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			list = append(list, part)
+		}
+	}
+	return list
+}
+
+// cacheKey returns the key responses to r are stored under.
+func cacheKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// variantKey returns the key of the variant of the response
+// for key which matches the vary headers of r.
+func variantKey(key string, vary []string, r *http.Request) string {
+	var sb strings.Builder
+	sb.WriteString(key)
+	for _, field := range vary {
+		sb.WriteByte(0)
+		sb.WriteString(field)
+		sb.WriteByte('=')
+		sb.WriteString(strings.Join(r.Header.Values(field), ","))
+	}
+	return sb.String()
+}
+
+// lookup returns the usable entry for r, if any.
+func (rule *Rule) lookup(key string, r *http.Request, now time.Time) *Entry {
+	entry, ok := rule.storage.Get(key)
+	if !ok {
+		return nil
+	}
+	if entry.Status == 0 {
+		if entry.expired(now) {
+			rule.storage.Delete(key)
+			return nil
+		}
+		key = variantKey(key, entry.Vary, r)
+		if entry, ok = rule.storage.Get(key); !ok {
+			return nil
+		}
+	}
+	if entry.expired(now) {
+		rule.storage.Delete(key)
+		return nil
+	}
+	return entry
+}
+
+// store caches the response to r under key, if it may be cached.
+func (rule *Rule) store(key string, r *http.Request, status int, header http.Header, body []byte, now time.Time) {
+	entry := rule.newEntry(r, status, header, body, now)
+	if entry == nil {
+		return
+	}
+	if len(entry.Vary) > 0 {
+		rule.storage.Put(key, &Entry{
+			Vary:                 entry.Vary,
+			Stored:               entry.Stored,
+			InitialAge:           entry.InitialAge,
+			MaxAge:               entry.MaxAge,
+			StaleWhileRevalidate: entry.StaleWhileRevalidate,
+			StaleIfError:         entry.StaleIfError,
+		})
+		key = variantKey(key, entry.Vary, r)
+	}
+	rule.storage.Put(key, entry)
+}
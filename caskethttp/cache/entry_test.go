@@ -0,0 +1,112 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewEntry(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	rule := &Rule{
+		DefaultMaxAge:        time.Minute,
+		StaleWhileRevalidate: 5 * time.Second,
+		StaleIfError:         time.Hour,
+	}
+
+	tests := []struct {
+		status        int
+		header        http.Header
+		authorization bool
+		stored        bool
+		maxAge        time.Duration
+		swr, sie      time.Duration
+	}{
+		{200, http.Header{}, false, true, time.Minute, 5 * time.Second, time.Hour},
+		{200, http.Header{"Cache-Control": {"max-age=10"}}, false, true, 10 * time.Second, 5 * time.Second, time.Hour},
+		{200, http.Header{"Cache-Control": {"max-age=10, s-maxage=20"}}, false, true, 20 * time.Second, 5 * time.Second, time.Hour},
+		{200, http.Header{"Cache-Control": {"max-age=10, stale-while-revalidate=1, stale-if-error=2"}}, false, true, 10 * time.Second, time.Second, 2 * time.Second},
+		{200, http.Header{"Cache-Control": {"max-age=10, must-revalidate"}}, false, true, 10 * time.Second, 0, 0},
+		{200, http.Header{
+			"Date":    {now.Add(-time.Hour).Format(http.TimeFormat)},
+			"Expires": {now.Format(http.TimeFormat)},
+		}, false, true, time.Hour, 5 * time.Second, time.Hour},
+		{200, http.Header{"Cache-Control": {"max-age=60"}}, true, false, 0, 0, 0},
+		{200, http.Header{"Cache-Control": {"public, max-age=60"}}, true, true, time.Minute, 5 * time.Second, time.Hour},
+		{200, http.Header{"Cache-Control": {"no-cache"}}, false, false, 0, 0, 0},
+		{200, http.Header{"Cache-Control": {`private="Set-Cookie"`}}, false, false, 0, 0, 0},
+		{206, http.Header{"Cache-Control": {"max-age=60"}}, false, false, 0, 0, 0},
+		{404, http.Header{"Cache-Control": {"max-age=60"}}, false, true, time.Minute, 5 * time.Second, time.Hour},
+		{200, http.Header{"Cache-Control": {"max-age=0, must-revalidate"}}, false, false, 0, 0, 0},
+	}
+
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.authorization {
+			r.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+		}
+		entry := rule.newEntry(r, test.status, test.header, nil, now)
+		if (entry != nil) != test.stored {
+			t.Errorf("Test %d: Expected stored to be %v, got %v", i, test.stored, entry != nil)
+			continue
+		}
+		if entry == nil {
+			continue
+		}
+		if entry.MaxAge != test.maxAge || entry.StaleWhileRevalidate != test.swr || entry.StaleIfError != test.sie {
+			t.Errorf("Test %d: Expected max age %v, swr %v and sie %v, got %v, %v and %v",
+				i, test.maxAge, test.swr, test.sie, entry.MaxAge, entry.StaleWhileRevalidate, entry.StaleIfError)
+		}
+	}
+}
+
+func TestEntryAge(t *testing.T) {
+	now := time.Now()
+	r := httptest.NewRequest("GET", "/", nil)
+	header := http.Header{"Cache-Control": {"max-age=60, stale-while-revalidate=10, stale-if-error=20"}, "Age": {"30"}}
+	entry := (&Rule{}).newEntry(r, 200, header, nil, now)
+
+	for _, test := range []struct {
+		after                 time.Duration
+		fresh, swr, sie, gone bool
+	}{
+		{0, true, true, true, false},
+		{35 * time.Second, false, true, true, false},
+		{45 * time.Second, false, false, true, false},
+		{55 * time.Second, false, false, false, true},
+	} {
+		at := now.Add(test.after)
+		if entry.fresh(at) != test.fresh || entry.staleWhileRevalidate(at) != test.swr ||
+			entry.staleIfError(at) != test.sie || entry.expired(at) != test.gone {
+			t.Errorf("After %v: Expected fresh=%v swr=%v sie=%v expired=%v", test.after, test.fresh, test.swr, test.sie, test.gone)
+		}
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	cc := parseCacheControl([]string{`max-age=60, No-Cache`, `private="Set-Cookie, X-Foo"`})
+	if cc["max-age"] != "60" || !cc.has("no-cache") || !cc.has("private") {
+		t.Errorf("Unexpected directives: %v", cc)
+	}
+	if d, ok := cc.seconds("max-age"); !ok || d != time.Minute {
+		t.Errorf("Expected max-age of 1m, got %v", d)
+	}
+	if _, ok := parseCacheControl([]string{"max-age=-1"}).seconds("max-age"); ok {
+		t.Error("Expected negative max-age to be invalid")
+	}
+}
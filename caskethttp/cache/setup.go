@@ -0,0 +1,189 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"os"
+	"time"
+
+	"github.com/inhies/go-bytesize"
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+const (
+	defaultMemoryLimit  = 64 * bytesize.MB
+	defaultDiskLimit    = 1 * bytesize.GB
+	defaultMaxEntrySize = 1 * bytesize.MB
+	defaultStatusHeader = "X-Cache"
+)
+
+func init() {
+	casket.RegisterPlugin("cache", casket.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new Cache middleware instance.
+func setup(c *casket.Controller) error {
+	rules, err := cacheParse(c)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		var disk *diskStorage
+		switch storage := rule.storage.(type) {
+		case *diskStorage:
+			disk = storage
+		case tieredStorage:
+			disk = storage.disk
+		}
+		if disk != nil {
+			c.OnStartup(disk.Start)
+			c.OnShutdown(disk.Stop)
+		}
+	}
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return Cache{Next: next, Rules: rules}
+	})
+
+	return nil
+}
+
+func cacheParse(c *casket.Controller) ([]*Rule, error) {
+	var rules []*Rule
+
+	for c.Next() {
+		rule := &Rule{
+			Path:         "/",
+			MaxEntrySize: int64(defaultMaxEntrySize),
+			StatusHeader: defaultStatusHeader,
+			inflight:     make(map[string]*call),
+			revalidating: make(map[string]struct{}),
+		}
+		memoryLimit := int64(defaultMemoryLimit)
+		diskLimit := int64(defaultDiskLimit)
+		var dir string
+
+		args := c.RemainingArgs()
+		switch len(args) {
+		case 0:
+		case 1:
+			rule.Path = args[0]
+		default:
+			return rules, c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "default_max_age", "stale_while_revalidate", "stale_if_error":
+				name := c.Val()
+				if !c.NextArg() {
+					return rules, c.ArgErr()
+				}
+				dur, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return rules, c.Err(err.Error())
+				}
+				if dur < 0 {
+					return rules, c.Errf("%s must not be negative", name)
+				}
+				switch name {
+				case "default_max_age":
+					rule.DefaultMaxAge = dur
+				case "stale_while_revalidate":
+					rule.StaleWhileRevalidate = dur
+				case "stale_if_error":
+					rule.StaleIfError = dur
+				}
+			case "max_entry_size", "memory_limit":
+				name := c.Val()
+				if !c.NextArg() {
+					return rules, c.ArgErr()
+				}
+				var size bytesize.ByteSize
+				if c.Val() != "0" {
+					var err error
+					size, err = bytesize.Parse(c.Val())
+					if err != nil {
+						return rules, c.Err(err.Error())
+					}
+				}
+				if name == "max_entry_size" {
+					rule.MaxEntrySize = int64(size)
+				} else {
+					memoryLimit = int64(size)
+				}
+			case "disk":
+				if !c.NextArg() {
+					return rules, c.ArgErr()
+				}
+				dir = c.Val()
+				if c.NextArg() {
+					size, err := bytesize.Parse(c.Val())
+					if err != nil {
+						return rules, c.Err(err.Error())
+					}
+					if size == 0 {
+						return rules, c.Err("disk cache limit must be above 0")
+					}
+					diskLimit = int64(size)
+				}
+			case "status_header":
+				if !c.NextArg() {
+					return rules, c.ArgErr()
+				}
+				rule.StatusHeader = c.Val()
+				if rule.StatusHeader == "off" {
+					rule.StatusHeader = ""
+				}
+			default:
+				return rules, c.ArgErr()
+			}
+			if c.NextArg() {
+				return rules, c.ArgErr()
+			}
+		}
+
+		var disk *diskStorage
+		if dir != "" {
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return rules, c.Errf("creating cache directory: %v", err)
+			}
+			var err error
+			if disk, err = newDiskStorage(dir, diskLimit); err != nil {
+				return rules, c.Errf("loading cache directory: %v", err)
+			}
+		}
+
+		switch {
+		case disk != nil && memoryLimit > 0:
+			rule.storage = tieredStorage{memory: newMemoryStorage(memoryLimit), disk: disk}
+		case disk != nil:
+			rule.storage = disk
+		case memoryLimit > 0:
+			rule.storage = newMemoryStorage(memoryLimit)
+		default:
+			return rules, c.Err("cache needs a memory_limit above 0 or a disk directory")
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := casket.NewTestController("http", `cache`)
+	err := setup(c)
+	if err != nil {
+		t.Errorf("Expected no errors, but got: %v", err)
+	}
+
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, had 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(Cache)
+	if !ok {
+		t.Fatalf("Expected handler to be type Cache, got: %#v", handler)
+	}
+
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+}
+
+func TestCacheParse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "casket_cache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	diskDir := filepath.Join(dir, "entries")
+
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  *Rule
+		storage   string
+	}{
+		{`cache`, false, &Rule{
+			Path:         "/",
+			MaxEntrySize: 1 << 20,
+			StatusHeader: "X-Cache",
+		}, "memory"},
+		{`cache /api {
+			default_max_age 1m
+			stale_while_revalidate 10s
+			stale_if_error 1h
+			max_entry_size 10MB
+			status_header X-Cache-Status
+		}`, false, &Rule{
+			Path:                 "/api",
+			DefaultMaxAge:        time.Minute,
+			StaleWhileRevalidate: 10 * time.Second,
+			StaleIfError:         time.Hour,
+			MaxEntrySize:         10 << 20,
+			StatusHeader:         "X-Cache-Status",
+		}, "memory"},
+		{`cache {
+			disk ` + diskDir + `
+			status_header off
+		}`, false, &Rule{
+			Path:         "/",
+			MaxEntrySize: 1 << 20,
+		}, "tiered"},
+		{`cache {
+			disk ` + diskDir + `
+			memory_limit 0
+		}`, false, &Rule{
+			Path:         "/",
+			MaxEntrySize: 1 << 20,
+			StatusHeader: "X-Cache",
+		}, "disk"},
+		{`cache {
+			disk ` + diskDir + ` 10MB
+			memory_limit 0
+		}`, false, &Rule{
+			Path:         "/",
+			MaxEntrySize: 1 << 20,
+			StatusHeader: "X-Cache",
+		}, "disk"},
+		{`cache {
+			disk ` + diskDir + ` lots
+		}`, true, nil, ""},
+		{`cache / /other`, true, nil, ""},
+		{`cache {
+			memory_limit 0
+		}`, true, nil, ""},
+		{`cache {
+			default_max_age -1s
+		}`, true, nil, ""},
+		{`cache {
+			max_entry_size big
+		}`, true, nil, ""},
+		{`cache {
+			stale_if_error 1m 2m
+		}`, true, nil, ""},
+		{`cache {
+			unknown
+		}`, true, nil, ""},
+	}
+
+	for i, test := range tests {
+		rules, err := cacheParse(casket.NewTestController("http", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error but found nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error but found %v", i, err)
+			continue
+		}
+		if len(rules) != 1 {
+			t.Fatalf("Test %d: Expected 1 rule, got %d", i, len(rules))
+		}
+		rule := rules[0]
+		if rule.Path != test.expected.Path ||
+			rule.DefaultMaxAge != test.expected.DefaultMaxAge ||
+			rule.StaleWhileRevalidate != test.expected.StaleWhileRevalidate ||
+			rule.StaleIfError != test.expected.StaleIfError ||
+			rule.MaxEntrySize != test.expected.MaxEntrySize ||
+			rule.StatusHeader != test.expected.StatusHeader {
+			t.Errorf("Test %d: Expected rule %+v, got %+v", i, test.expected, rule)
+		}
+
+		var storage string
+		switch rule.storage.(type) {
+		case *memoryStorage:
+			storage = "memory"
+		case *diskStorage:
+			storage = "disk"
+		case tieredStorage:
+			storage = "tiered"
+		}
+		if storage != test.storage {
+			t.Errorf("Test %d: Expected %s storage, got %T", i, test.storage, rule.storage)
+		}
+	}
+}
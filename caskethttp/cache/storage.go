@@ -0,0 +1,356 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storage stores cache entries by key.
+type storage interface {
+	Get(key string) (*Entry, bool)
+	Put(key string, entry *Entry)
+	Delete(key string)
+}
+
+// memoryStorage keeps entries in memory, evicting the least
+// recently used ones once their total size exceeds the limit.
+type memoryStorage struct {
+	limit int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+	size  int64
+}
+
+func newMemoryStorage(limit int64) *memoryStorage {
+	return &memoryStorage{
+		limit:   limit,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (s *memoryStorage) Get(key string) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	s.lru.MoveToFront(elem)
+	return elem.Value.(*memoryItem).entry, true
+}
+
+func (s *memoryStorage) Put(key string, entry *Entry) {
+	size := entry.size() + int64(len(key))
+	if size > s.limit {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+	s.entries[key] = s.lru.PushFront(&memoryItem{key: key, entry: entry, size: size})
+	s.size += size
+	for s.size > s.limit {
+		s.remove(s.lru.Back().Value.(*memoryItem).key)
+	}
+}
+
+func (s *memoryStorage) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+}
+
+// remove removes the entry for key. s.mu must be held.
+func (s *memoryStorage) remove(key string) {
+	elem, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	s.lru.Remove(elem)
+	delete(s.entries, key)
+	s.size -= elem.Value.(*memoryItem).size
+}
+
+// diskStorage keeps each entry in its own file in a directory,
+// removing the least recently used files once their total size
+// exceeds the limit. Expired entries are removed by a periodic
+// sweep between Start and Stop.
+type diskStorage struct {
+	dir   string
+	limit int64
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	files map[string]*list.Element
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+type diskFile struct {
+	name string
+	size int64
+}
+
+// diskSweepInterval is how often expired entries are removed from disk.
+var diskSweepInterval = 10 * time.Minute
+
+// newDiskStorage returns the storage for the entries in dir,
+// taking over the files left by an earlier run.
+func newDiskStorage(dir string, limit int64) (*diskStorage, error) {
+	s := &diskStorage{
+		dir:   dir,
+		limit: limit,
+		lru:   list.New(),
+		files: make(map[string]*list.Element),
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// the most recently modified file goes to the front
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(info.Name(), ".tmp") {
+			os.Remove(filepath.Join(dir, info.Name()))
+			continue
+		}
+		s.add(info.Name(), info.Size())
+	}
+	s.mu.Lock()
+	s.evict()
+	s.mu.Unlock()
+	return s, nil
+}
+
+func (s *diskStorage) name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *diskStorage) Get(key string) (*Entry, bool) {
+	name := s.name(key)
+	record, ok := s.read(name)
+	if !ok || record.Key != key {
+		return nil, false
+	}
+	s.mu.Lock()
+	if elem, ok := s.files[name]; ok {
+		s.lru.MoveToFront(elem)
+	}
+	s.mu.Unlock()
+	return record.Entry, true
+}
+
+// read decodes the file with the given name.
+func (s *diskStorage) read(name string) (diskRecord, bool) {
+	var record diskRecord
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return record, false
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(&record); err != nil || record.Entry == nil {
+		return record, false
+	}
+	return record, true
+}
+
+func (s *diskStorage) Put(key string, entry *Entry) {
+	// write to a temporary file first so that
+	// readers never see a partial entry
+	f, err := ioutil.TempFile(s.dir, ".tmp")
+	if err != nil {
+		log.Printf("[ERROR] cache: %v", err)
+		return
+	}
+	err = gob.NewEncoder(f).Encode(diskRecord{Key: key, Entry: entry})
+	var size int64
+	if err == nil {
+		size, err = f.Seek(0, io.SeekCurrent)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && size > s.limit {
+		os.Remove(f.Name())
+		return
+	}
+	name := s.name(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(s.dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		log.Printf("[ERROR] cache: storing %s: %v", key, err)
+		return
+	}
+	s.remove(name, false)
+	s.add(name, size)
+	s.evict()
+}
+
+func (s *diskStorage) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(s.name(key), true)
+}
+
+// add records a file as the most recently used one. s.mu must be
+// held, except while the storage is being set up.
+func (s *diskStorage) add(name string, size int64) {
+	s.files[name] = s.lru.PushFront(&diskFile{name: name, size: size})
+	s.size += size
+}
+
+// remove forgets the file with the given name, deleting it from
+// disk if del is true. s.mu must be held.
+func (s *diskStorage) remove(name string, del bool) {
+	if del {
+		os.Remove(filepath.Join(s.dir, name))
+	}
+	elem, ok := s.files[name]
+	if !ok {
+		return
+	}
+	s.lru.Remove(elem)
+	delete(s.files, name)
+	s.size -= elem.Value.(*diskFile).size
+}
+
+// evict deletes the least recently used files until the
+// total size is within the limit. s.mu must be held.
+func (s *diskStorage) evict() {
+	for s.size > s.limit && s.lru.Len() > 0 {
+		s.remove(s.lru.Back().Value.(*diskFile).name, true)
+	}
+}
+
+// sweep deletes the entries which expired before now.
+func (s *diskStorage) sweep(now time.Time) {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+
+	for _, name := range names {
+		// hold the lock so that the file isn't
+		// replaced between reading and deleting it
+		s.mu.Lock()
+		if _, ok := s.files[name]; ok {
+			if record, ok := s.read(name); !ok || record.Entry.expired(now) {
+				s.remove(name, true)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Start starts sweeping expired entries in the background.
+func (s *diskStorage) Start() error {
+	s.stop = make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(diskSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.sweep(now)
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops the sweep started by Start.
+func (s *diskStorage) Stop() error {
+	if s.stop != nil {
+		close(s.stop)
+		s.wg.Wait()
+		s.stop = nil
+	}
+	return nil
+}
+
+// diskRecord is the file format of diskStorage. The key is kept
+// to tell entries apart whose keys hash the same.
+type diskRecord struct {
+	Key   string
+	Entry *Entry
+}
+
+// tieredStorage keeps entries both in memory and on disk,
+// so that they survive restarts.
+type tieredStorage struct {
+	memory *memoryStorage
+	disk   *diskStorage
+}
+
+func (s tieredStorage) Get(key string) (*Entry, bool) {
+	if entry, ok := s.memory.Get(key); ok {
+		return entry, true
+	}
+	entry, ok := s.disk.Get(key)
+	if ok {
+		s.memory.Put(key, entry)
+	}
+	return entry, ok
+}
+
+func (s tieredStorage) Put(key string, entry *Entry) {
+	s.memory.Put(key, entry)
+	s.disk.Put(key, entry)
+}
+
+func (s tieredStorage) Delete(key string) {
+	s.memory.Delete(key)
+	s.disk.Delete(key)
+}
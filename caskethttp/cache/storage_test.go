@@ -0,0 +1,175 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryStorageEviction(t *testing.T) {
+	s := newMemoryStorage(25)
+	entry := func(body string) *Entry {
+		return &Entry{Status: 200, Body: []byte(body)}
+	}
+
+	s.Put("a", entry("0123456789"))
+	s.Put("b", entry("0123456789"))
+	if _, ok := s.Get("a"); !ok {
+		t.Fatal("Expected entry a")
+	}
+
+	// b is the least recently used entry
+	s.Put("c", entry("0123456789"))
+	if _, ok := s.Get("b"); ok {
+		t.Error("Expected entry b to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := s.Get(key); !ok {
+			t.Errorf("Expected entry %s", key)
+		}
+	}
+
+	// replacing an entry doesn't count it twice
+	s.Put("c", entry("01234"))
+	if s.size != 17 {
+		t.Errorf("Expected size 17, got %d", s.size)
+	}
+
+	// entries larger than the limit aren't stored
+	s.Put("d", entry("0123456789012345678901234"))
+	if _, ok := s.Get("d"); ok {
+		t.Error("Expected entry d to not be stored")
+	}
+
+	s.Delete("a")
+	if _, ok := s.Get("a"); ok || s.size != 6 {
+		t.Errorf("Expected entry a to be deleted and size 6, got size %d", s.size)
+	}
+}
+
+func TestDiskStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "casket_cache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	entry := &Entry{
+		Status: http.StatusOK,
+		Header: http.Header{"Content-Type": {"text/plain"}},
+		Body:   []byte("hello"),
+		Vary:   []string{"Accept-Encoding"},
+		Stored: time.Now().UTC().Round(time.Second),
+		MaxAge: time.Minute,
+	}
+
+	disk, err := newDiskStorage(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk.Put("example.com/a", entry)
+	got, ok := disk.Get("example.com/a")
+	if !ok {
+		t.Fatal("Expected entry to be stored on disk")
+	}
+	if !reflect.DeepEqual(got, entry) {
+		t.Errorf("Expected %+v, got %+v", entry, got)
+	}
+	if _, ok := disk.Get("example.com/b"); ok {
+		t.Error("Expected no entry for another key")
+	}
+
+	// entries on disk are loaded into memory
+	tiered := tieredStorage{memory: newMemoryStorage(1 << 20), disk: disk}
+	if _, ok := tiered.Get("example.com/a"); !ok {
+		t.Fatal("Expected entry from disk")
+	}
+	if _, ok := tiered.memory.Get("example.com/a"); !ok {
+		t.Error("Expected entry to be loaded into memory")
+	}
+
+	tiered.Delete("example.com/a")
+	if _, ok := disk.Get("example.com/a"); ok {
+		t.Error("Expected entry to be deleted from disk")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("Expected no files left in cache directory, got %d", len(files))
+	}
+}
+
+func TestDiskStorageEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "casket_cache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	entry := func(maxAge time.Duration) *Entry {
+		return &Entry{Status: http.StatusOK, Body: make([]byte, 1000), Stored: now, MaxAge: maxAge}
+	}
+
+	disk, err := newDiskStorage(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk.Put("a", entry(time.Minute))
+	fileSize := disk.size
+	disk.limit = 2*fileSize + fileSize/2
+
+	disk.Put("b", entry(time.Minute))
+	if _, ok := disk.Get("a"); !ok {
+		t.Fatal("Expected entry a")
+	}
+
+	// b is the least recently used entry
+	disk.Put("c", entry(time.Minute))
+	if _, ok := disk.Get("b"); ok {
+		t.Error("Expected entry b to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := disk.Get(key); !ok {
+			t.Errorf("Expected entry %s", key)
+		}
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("Expected 2 files in cache directory, got %d", len(files))
+	}
+
+	// the files are picked up again after a restart
+	disk, err = newDiskStorage(dir, 2*fileSize+fileSize/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disk.size != 2*fileSize {
+		t.Errorf("Expected size %d, got %d", 2*fileSize, disk.size)
+	}
+
+	// expired entries are swept
+	disk.Put("d", entry(time.Second))
+	disk.sweep(now.Add(time.Hour))
+	if len(disk.files) != 0 || disk.size != 0 {
+		t.Errorf("Expected all entries to be swept, got %d of size %d", len(disk.files), disk.size)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected no files left in cache directory, got %d", len(files))
+	}
+}
@@ -22,6 +22,8 @@ import (
 	_ "github.com/tmpim/casket/caskethttp/basicauth"
 	_ "github.com/tmpim/casket/caskethttp/bind"
 	_ "github.com/tmpim/casket/caskethttp/browse"
+	_ "github.com/tmpim/casket/caskethttp/cache"
+	_ "github.com/tmpim/casket/caskethttp/cors"
 	_ "github.com/tmpim/casket/caskethttp/errors"
 	_ "github.com/tmpim/casket/caskethttp/expvar"
 	_ "github.com/tmpim/casket/caskethttp/extensions"
@@ -30,20 +32,28 @@ import (
 	_ "github.com/tmpim/casket/caskethttp/header"
 	_ "github.com/tmpim/casket/caskethttp/index"
 	_ "github.com/tmpim/casket/caskethttp/internalsrv"
+	_ "github.com/tmpim/casket/caskethttp/ipfilter"
+	_ "github.com/tmpim/casket/caskethttp/jwt"
 	_ "github.com/tmpim/casket/caskethttp/limits"
 	_ "github.com/tmpim/casket/caskethttp/log"
 	_ "github.com/tmpim/casket/caskethttp/markdown"
+	_ "github.com/tmpim/casket/caskethttp/metrics"
 	_ "github.com/tmpim/casket/caskethttp/mime"
 	_ "github.com/tmpim/casket/caskethttp/pprof"
 	_ "github.com/tmpim/casket/caskethttp/proxy"
+	_ "github.com/tmpim/casket/caskethttp/proxyprotocol"
 	_ "github.com/tmpim/casket/caskethttp/push"
+	_ "github.com/tmpim/casket/caskethttp/ratelimit"
+	_ "github.com/tmpim/casket/caskethttp/realip"
 	_ "github.com/tmpim/casket/caskethttp/redirect"
+	_ "github.com/tmpim/casket/caskethttp/replacebody"
 	_ "github.com/tmpim/casket/caskethttp/requestid"
 	_ "github.com/tmpim/casket/caskethttp/rewrite"
 	_ "github.com/tmpim/casket/caskethttp/root"
 	_ "github.com/tmpim/casket/caskethttp/status"
 	_ "github.com/tmpim/casket/caskethttp/templates"
 	_ "github.com/tmpim/casket/caskethttp/timeouts"
+	_ "github.com/tmpim/casket/caskethttp/tracing"
 	_ "github.com/tmpim/casket/caskethttp/tryfiles"
 	_ "github.com/tmpim/casket/caskethttp/websocket"
 	_ "github.com/tmpim/casket/onevent"
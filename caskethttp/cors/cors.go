@@ -0,0 +1,194 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cors implements Cross-Origin Resource Sharing.
+package cors
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+// CORS is middleware that allows cross-origin requests
+// from the configured origins, answering preflight
+// requests itself.
+type CORS struct {
+	Next  httpserver.Handler
+	Rules []*Rule
+}
+
+// Rule configures cross-origin requests to a path.
+type Rule struct {
+	Path string
+
+	// Origins are the allowed origins, like https://example.com.
+	// They may contain one * to match any subdomain, like
+	// https://*.example.com, or be * to allow any origin.
+	// OriginRegexps must match the whole origin.
+	Origins       []string
+	OriginRegexps []*regexp.Regexp
+
+	// Methods are the allowed methods of preflighted requests.
+	Methods []string
+
+	// AllowedHeaders are the allowed headers of preflighted
+	// requests. If empty, the requested headers are allowed.
+	AllowedHeaders []string
+
+	// ExposedHeaders are the response headers scripts may read.
+	ExposedHeaders []string
+
+	// AllowCredentials allows requests with cookies or
+	// HTTP authentication. It can't be used with origin *.
+	AllowCredentials bool
+
+	// MaxAge is how long, in seconds, the preflight response
+	// may be cached. It is not sent if 0.
+	MaxAge int
+}
+
+// anyOrigin returns true if r allows any origin.
+func (r *Rule) anyOrigin() bool {
+	for _, origin := range r.Origins {
+		if origin == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsOrigin returns true if origin is allowed by r.
+func (r *Rule) allowsOrigin(origin string) bool {
+	for _, allowed := range r.Origins {
+		if matchOrigin(allowed, origin) {
+			return true
+		}
+	}
+	for _, re := range r.OriginRegexps {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin returns true if origin matches pattern.
+func matchOrigin(pattern, origin string) bool {
+	if pattern == "*" {
+		return true
+	}
+	star := strings.Index(pattern, "*")
+	if star < 0 {
+		return strings.EqualFold(pattern, origin)
+	}
+	prefix, suffix := strings.ToLower(pattern[:star]), strings.ToLower(pattern[star+1:])
+	origin = strings.ToLower(origin)
+	if len(origin) <= len(prefix)+len(suffix) ||
+		!strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+	// the wildcard only stands for subdomains
+	return !strings.ContainsAny(origin[len(prefix):len(origin)-len(suffix)], "/:@")
+}
+
+// allowsMethod returns true if method is allowed by r.
+func (r *Rule) allowsMethod(method string) bool {
+	for _, allowed := range r.Methods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the rule with the longest path matching r,
+// or nil if none does.
+func (c CORS) match(r *http.Request) *Rule {
+	i := httpserver.Path(r.URL.Path).LongestMatch(len(c.Rules), func(i int) []string {
+		return []string{c.Rules[i].Path}
+	})
+	if i < 0 {
+		return nil
+	}
+	return c.Rules[i]
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (c CORS) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	rule := c.match(r)
+	if rule == nil {
+		return c.Next.ServeHTTP(w, r)
+	}
+
+	header := w.Header()
+	// unless every origin gets the same response,
+	// caches must keep a response per origin
+	if !rule.anyOrigin() {
+		header.Add("Vary", "Origin")
+	}
+
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	if preflight {
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+	}
+	if origin == "" {
+		return c.Next.ServeHTTP(w, r)
+	}
+	allowed := rule.allowsOrigin(origin)
+
+	if allowed {
+		if rule.anyOrigin() {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if rule.AllowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+
+	if !preflight {
+		if allowed && len(rule.ExposedHeaders) > 0 {
+			header.Set("Access-Control-Expose-Headers", strings.Join(rule.ExposedHeaders, ", "))
+		}
+		return c.Next.ServeHTTP(w, r)
+	}
+
+	// answer the preflight request here, since the
+	// handlers behind it don't expect OPTIONS requests
+	if allowed && rule.allowsMethod(r.Header.Get("Access-Control-Request-Method")) {
+		header.Set("Access-Control-Allow-Methods", strings.Join(rule.Methods, ", "))
+		if len(rule.AllowedHeaders) > 0 {
+			header.Set("Access-Control-Allow-Headers", strings.Join(rule.AllowedHeaders, ", "))
+		} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			header.Set("Access-Control-Allow-Headers", requested)
+		}
+		if rule.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(rule.MaxAge))
+		}
+	} else {
+		// without the CORS headers, the browser
+		// won't send the actual request
+		header.Del("Access-Control-Allow-Origin")
+		header.Del("Access-Control-Allow-Credentials")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return 0, nil
+}
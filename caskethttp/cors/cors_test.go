@@ -0,0 +1,183 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestMatchOrigin(t *testing.T) {
+	for i, test := range []struct {
+		pattern, origin string
+		expected        bool
+	}{
+		{"*", "https://anything.test", true},
+		{"https://example.com", "https://example.com", true},
+		{"https://example.com", "HTTPS://Example.com", true},
+		{"https://example.com", "http://example.com", false},
+		{"https://example.com", "https://example.com.evil.test", false},
+		{"https://*.example.com", "https://api.example.com", true},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "https://.example.com", false},
+		{"https://*.example.com", "https://evil.test/.example.com", false},
+		{"https://*.example.com", "https://evil.test:1@x.example.com", false},
+		{"https://*.example.com", "https://api.example.com.evil.test", false},
+		{"https://*.example.com", "http://api.example.com", false},
+		{"https://example.com:*", "https://example.com:8443", true},
+	} {
+		if actual := matchOrigin(test.pattern, test.origin); actual != test.expected {
+			t.Errorf("Test %d: Expected %s matching %s to be %v, got %v", i, test.origin, test.pattern, test.expected, actual)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	rules, err := corsParse(casket.NewTestController("http", `
+	cors
+	cors /api {
+		origin https://example.com https://*.example.org
+		origin_regexp https://[a-z]+\.example\.net
+		methods GET POST
+		exposed_headers X-Total-Count
+		allow_credentials
+		max_age 600
+	}
+	cors /upload {
+		origin https://example.com
+		allowed_headers Content-Type
+	}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var nextCalled bool
+	c := CORS{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			nextCalled = true
+			return http.StatusOK, nil
+		}),
+		Rules: rules,
+	}
+
+	for i, test := range []struct {
+		method, path string
+		header       map[string]string
+		expectedNext bool
+		expected     http.Header
+	}{
+		// simple requests
+		{"GET", "/", nil, true, http.Header{}},
+		{"GET", "/", map[string]string{"Origin": "https://a.test"}, true, http.Header{
+			"Access-Control-Allow-Origin": {"*"},
+		}},
+		{"GET", "/api/items", map[string]string{"Origin": "https://example.com"}, true, http.Header{
+			"Vary":                             {"Origin"},
+			"Access-Control-Allow-Origin":      {"https://example.com"},
+			"Access-Control-Allow-Credentials": {"true"},
+			"Access-Control-Expose-Headers":    {"X-Total-Count"},
+		}},
+		{"GET", "/api/items", map[string]string{"Origin": "https://www.example.org"}, true, http.Header{
+			"Vary":                             {"Origin"},
+			"Access-Control-Allow-Origin":      {"https://www.example.org"},
+			"Access-Control-Allow-Credentials": {"true"},
+			"Access-Control-Expose-Headers":    {"X-Total-Count"},
+		}},
+		{"GET", "/api/items", map[string]string{"Origin": "https://app.example.net"}, true, http.Header{
+			"Vary":                             {"Origin"},
+			"Access-Control-Allow-Origin":      {"https://app.example.net"},
+			"Access-Control-Allow-Credentials": {"true"},
+			"Access-Control-Expose-Headers":    {"X-Total-Count"},
+		}},
+		{"GET", "/api/items", map[string]string{"Origin": "https://evil.test"}, true, http.Header{
+			"Vary": {"Origin"},
+		}},
+		{"GET", "/api/items", map[string]string{"Origin": "https://app.example.net.evil.test"}, true, http.Header{
+			"Vary": {"Origin"},
+		}},
+		{"GET", "/api/items", nil, true, http.Header{
+			"Vary": {"Origin"},
+		}},
+
+		// preflight requests
+		{"OPTIONS", "/api/items", map[string]string{
+			"Origin":                         "https://example.com",
+			"Access-Control-Request-Method":  "POST",
+			"Access-Control-Request-Headers": "X-Token",
+		}, false, http.Header{
+			"Vary":                             {"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+			"Access-Control-Allow-Origin":      {"https://example.com"},
+			"Access-Control-Allow-Credentials": {"true"},
+			"Access-Control-Allow-Methods":     {"GET, POST"},
+			"Access-Control-Allow-Headers":     {"X-Token"},
+			"Access-Control-Max-Age":           {"600"},
+		}},
+		{"OPTIONS", "/api/items", map[string]string{
+			"Origin":                        "https://example.com",
+			"Access-Control-Request-Method": "DELETE",
+		}, false, http.Header{
+			"Vary": {"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+		}},
+		{"OPTIONS", "/api/items", map[string]string{
+			"Origin":                        "https://evil.test",
+			"Access-Control-Request-Method": "GET",
+		}, false, http.Header{
+			"Vary": {"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+		}},
+		{"OPTIONS", "/upload", map[string]string{
+			"Origin":                         "https://example.com",
+			"Access-Control-Request-Method":  "PUT",
+			"Access-Control-Request-Headers": "X-Token",
+		}, false, http.Header{
+			"Vary":                         {"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+			"Access-Control-Allow-Origin":  {"https://example.com"},
+			"Access-Control-Allow-Methods": {"GET, HEAD, POST, PUT, PATCH, DELETE"},
+			"Access-Control-Allow-Headers": {"Content-Type"},
+		}},
+		// OPTIONS requests that aren't preflights go through
+		{"OPTIONS", "/api/items", map[string]string{"Origin": "https://example.com"}, true, http.Header{
+			"Vary":                             {"Origin"},
+			"Access-Control-Allow-Origin":      {"https://example.com"},
+			"Access-Control-Allow-Credentials": {"true"},
+			"Access-Control-Expose-Headers":    {"X-Total-Count"},
+		}},
+	} {
+		nextCalled = false
+		r := httptest.NewRequest(test.method, test.path, nil)
+		for name, value := range test.header {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		status, err := c.ServeHTTP(w, r)
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		if nextCalled != test.expectedNext {
+			t.Errorf("Test %d: Expected next handler called to be %v", i, test.expectedNext)
+		}
+		if !test.expectedNext && (status != 0 || w.Code != http.StatusNoContent) {
+			t.Errorf("Test %d: Expected preflight to be answered with 204, got %d and %d", i, status, w.Code)
+		}
+		if !reflect.DeepEqual(w.Header(), test.expected) {
+			t.Errorf("Test %d: Expected headers %v, got %v", i, test.expected, w.Header())
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cors
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func init() {
+	casket.RegisterPlugin("cors", casket.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// defaultMethods are the methods allowed if none are configured.
+var defaultMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+
+// setup configures a new CORS middleware instance.
+func setup(c *casket.Controller) error {
+	rules, err := corsParse(c)
+	if err != nil {
+		return err
+	}
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return CORS{Next: next, Rules: rules}
+	})
+	return nil
+}
+
+func corsParse(c *casket.Controller) ([]*Rule, error) {
+	var rules []*Rule
+
+	for c.Next() {
+		rule := &Rule{Path: "/"}
+
+		args := c.RemainingArgs()
+		if len(args) > 0 && strings.HasPrefix(args[0], "/") {
+			rule.Path = args[0]
+			args = args[1:]
+		}
+		rule.Origins = splitList(args)
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "origin":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				rule.Origins = append(rule.Origins, splitList(args)...)
+			case "origin_regexp":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				// the pattern must match the whole origin, or
+				// https://example.com.evil.com would pass as well
+				re, err := regexp.Compile("^(?:" + c.Val() + ")$")
+				if err != nil {
+					return nil, c.Errf("invalid origin_regexp: %v", err)
+				}
+				rule.OriginRegexps = append(rule.OriginRegexps, re)
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+			case "methods":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				for _, method := range splitList(args) {
+					rule.Methods = append(rule.Methods, strings.ToUpper(method))
+				}
+			case "allowed_headers":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				rule.AllowedHeaders = append(rule.AllowedHeaders, splitList(args)...)
+			case "exposed_headers":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				rule.ExposedHeaders = append(rule.ExposedHeaders, splitList(args)...)
+			case "allow_credentials":
+				rule.AllowCredentials = true
+				if c.NextArg() {
+					allow, err := strconv.ParseBool(c.Val())
+					if err != nil {
+						return nil, c.Errf("invalid allow_credentials: %s", c.Val())
+					}
+					rule.AllowCredentials = allow
+				}
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+			case "max_age":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				maxAge, err := strconv.Atoi(c.Val())
+				if err != nil || maxAge < 0 {
+					return nil, c.Errf("invalid max_age: %s", c.Val())
+				}
+				rule.MaxAge = maxAge
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+			default:
+				return nil, c.Errf("unknown subdirective: %s", c.Val())
+			}
+		}
+
+		if len(rule.Origins) == 0 && len(rule.OriginRegexps) == 0 {
+			rule.Origins = []string{"*"}
+		}
+		for _, origin := range rule.Origins {
+			if strings.Count(origin, "*") > 1 {
+				return nil, c.Errf("origin may only contain one wildcard: %s", origin)
+			}
+		}
+		// browsers refuse credentials with the * origin, and
+		// echoing every origin instead would let any site
+		// make requests with the user's credentials
+		if rule.AllowCredentials && rule.anyOrigin() {
+			return nil, c.Err("allow_credentials can't be used with origin *")
+		}
+		if len(rule.Methods) == 0 {
+			rule.Methods = defaultMethods
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// splitList splits args that may also be comma-separated lists.
+func splitList(args []string) []string {
+	var list []string
+	for _, arg := range args {
+		for _, item := range strings.Split(arg, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
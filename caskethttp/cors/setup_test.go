@@ -0,0 +1,133 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cors
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := casket.NewTestController("http", `cors`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(CORS)
+	if !ok {
+		t.Fatalf("Expected handler to be type CORS, got: %#v", handler)
+	}
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+}
+
+func TestCORSParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  []Rule
+	}{
+		{`cors`, false, []Rule{
+			{Path: "/", Origins: []string{"*"}, Methods: defaultMethods},
+		}},
+		{`cors /api https://example.com,https://*.example.org`, false, []Rule{
+			{Path: "/api", Origins: []string{"https://example.com", "https://*.example.org"}, Methods: defaultMethods},
+		}},
+		{`cors /api {
+			origin https://example.com
+			origin https://other.com
+			methods get,post PUT
+			allowed_headers Content-Type, X-Token
+			exposed_headers X-Total-Count
+			allow_credentials
+			max_age 3600
+		}
+		cors /public`, false, []Rule{
+			{Path: "/api", Origins: []string{"https://example.com", "https://other.com"},
+				Methods: []string{"GET", "POST", "PUT"}, AllowedHeaders: []string{"Content-Type", "X-Token"},
+				ExposedHeaders: []string{"X-Total-Count"}, AllowCredentials: true, MaxAge: 3600},
+			{Path: "/public", Origins: []string{"*"}, Methods: defaultMethods},
+		}},
+		{`cors {
+			allow_credentials false
+		}`, false, []Rule{
+			{Path: "/", Origins: []string{"*"}, Methods: defaultMethods},
+		}},
+		{`cors {
+			origin_regexp ^https://[a-z]+\.example\.com$
+		}`, false, []Rule{
+			{Path: "/", Methods: defaultMethods},
+		}},
+		{`cors {
+			origin_regexp (
+		}`, true, nil},
+		{`cors https://*.*.example.com`, true, nil},
+		{`cors {
+			origin
+		}`, true, nil},
+		{`cors {
+			max_age -1
+		}`, true, nil},
+		{`cors {
+			max_age 10 20
+		}`, true, nil},
+		{`cors {
+			allow_credentials maybe
+		}`, true, nil},
+		{`cors {
+			allow_origin *
+		}`, true, nil},
+		{`cors {
+			allow_credentials
+		}`, true, nil},
+		{`cors * {
+			allow_credentials
+		}`, true, nil},
+		{`cors {
+			origin https://example.com *
+			allow_credentials
+		}`, true, nil},
+	}
+
+	for i, test := range tests {
+		actual, err := corsParse(casket.NewTestController("http", test.input))
+
+		if err == nil && test.shouldErr {
+			t.Errorf("Test %d didn't error, but it should have", i)
+		} else if err != nil && !test.shouldErr {
+			t.Errorf("Test %d errored, but it shouldn't have; got '%v'", i, err)
+		}
+		if len(actual) != len(test.expected) {
+			t.Fatalf("Test %d expected %d rules, but got %d", i, len(test.expected), len(actual))
+		}
+
+		for j, rule := range actual {
+			got := *rule
+			got.OriginRegexps = nil
+			if !reflect.DeepEqual(got, test.expected[j]) {
+				t.Errorf("Test %d, rule %d: Expected %+v, got %+v", i, j, test.expected[j], got)
+			}
+		}
+	}
+}
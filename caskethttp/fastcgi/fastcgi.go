@@ -120,6 +120,20 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error)
 			}
 			network, address := parseAddress(address)
 
+			// trace the request to the gateway as a client span, passing
+			// the trace context on to the application like a header
+			span := httpserver.StartSpan(r.Context(), "fastcgi "+address, httpserver.SpanKindClient)
+			defer span.Finish()
+			if span != nil {
+				span.SetAttribute("server.address", address)
+				env["HTTP_TRACEPARENT"] = span.TraceParent()
+				if span.TraceState != "" {
+					env["HTTP_TRACESTATE"] = span.TraceState
+				} else {
+					delete(env, "HTTP_TRACESTATE")
+				}
+			}
+
 			ctx := context.Background()
 			if rule.ConnectTimeout > 0 {
 				var cancel context.CancelFunc
@@ -129,6 +143,7 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error)
 
 			fcgiBackend, err := DialContext(ctx, network, address)
 			if err != nil {
+				span.SetError(err.Error())
 				return http.StatusBadGateway, err
 			}
 			defer fcgiBackend.Close()
@@ -165,6 +180,9 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error)
 				defer resp.Body.Close()
 			}
 
+			if err != nil && err != io.EOF {
+				span.SetError(err.Error())
+			}
 			if err != nil {
 				if err, ok := err.(net.Error); ok && err.Timeout() {
 					return http.StatusGatewayTimeout, err
@@ -173,6 +191,8 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error)
 				}
 			}
 
+			span.SetStatus(resp.StatusCode)
+
 			// Write response header
 			writeHeader(w, resp)
 
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/tmpim/casket"
@@ -66,6 +67,10 @@ const (
 	startsWithOp = "starts_with"
 	endsWithOp   = "ends_with"
 	matchOp      = "match"
+	gtOp         = "gt"
+	geOp         = "ge"
+	ltOp         = "lt"
+	leOp         = "le"
 )
 
 // ifCondition is a 'if' condition.
@@ -112,6 +117,9 @@ func newIfCond(a, op, b string) (ifCond, error) {
 			return ifCond{}, fmt.Errorf("Invalid regular expression: '%s', %v", i.b, err)
 		}
 		i.f = i.matchFunc
+	case gtOp, geOp, ltOp, leOp:
+		// It compares a and b as numbers.
+		i.f = i.compareFunc
 	default:
 		return ifCond{}, fmt.Errorf("Invalid operator %v", i.op)
 	}
@@ -134,13 +142,44 @@ func (i ifCond) matchFunc(a, b string) bool {
 	return i.rex.MatchString(a)
 }
 
+// compareFunc is condition for the numeric operators. It
+// is false if a or b is not a number.
+func (i ifCond) compareFunc(a, b string) bool {
+	x, err := strconv.ParseFloat(a, 64)
+	if err != nil {
+		return false
+	}
+	y, err := strconv.ParseFloat(b, 64)
+	if err != nil {
+		return false
+	}
+	switch i.op {
+	case gtOp:
+		return x > y
+	case geOp:
+		return x >= y
+	case ltOp:
+		return x < y
+	default:
+		return x <= y
+	}
+}
+
 // True returns true if the condition is true and false otherwise.
 // If r is not nil, it replaces placeholders before comparison.
 func (i ifCond) True(r *http.Request) bool {
+	if r != nil {
+		return i.trueWith(NewReplacer(r, nil, ""))
+	}
+	return i.trueWith(nil)
+}
+
+// trueWith is like True, but replaces placeholders
+// using replacer, unless it is nil.
+func (i ifCond) trueWith(replacer Replacer) bool {
 	if i.f != nil {
 		a, b := i.a, i.b
-		if r != nil {
-			replacer := NewReplacer(r, nil, "")
+		if replacer != nil {
 			a = replacer.Replace(i.a)
 			if i.op != matchOp {
 				b = replacer.Replace(i.b)
@@ -180,6 +219,18 @@ func (m IfMatcher) And(r *http.Request) bool {
 	return true
 }
 
+// MatchReplacer is like Match, but replaces the placeholders of the
+// conditions using replacer, which may know more than the request
+// alone, e.g. the status and latency of its response.
+func (m IfMatcher) MatchReplacer(replacer Replacer) bool {
+	for _, i := range m.ifs {
+		if i.trueWith(replacer) == m.isOr {
+			return m.isOr
+		}
+	}
+	return !m.isOr
+}
+
 // Or returns true if any of the conditions in m is true.
 func (m IfMatcher) Or(r *http.Request) bool {
 	for _, i := range m.ifs {
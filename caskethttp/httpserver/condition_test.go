@@ -17,6 +17,7 @@ package httpserver
 import (
 	"context"
 	"net/http"
+	"net/http/httptest"
 	"regexp"
 	"strings"
 	"testing"
@@ -80,6 +81,18 @@ func TestConditions(t *testing.T) {
 		{"b0a not_match b[a-z]+", true, false},
 		{"b0a not_match b[a-z0-9]+", false, false},
 		{"bac not_match b[a-z]{2}", false, false},
+		{"500 gt 499", true, false},
+		{"500 gt 500", false, false},
+		{"500 ge 500", true, false},
+		{"1.5 ge 2", false, false},
+		{"1.5 lt 2", true, false},
+		{"2 lt 2", false, false},
+		{"2 le 2", true, false},
+		{"3 le 2", false, false},
+		{"3 not_gt 2", false, false},
+		{"a gt 2", false, false},
+		{"a not_gt 2", true, false},
+		{"3 gt b", false, false},
 	}
 
 	for i, test := range tests {
@@ -208,6 +221,40 @@ func TestIfMatcher(t *testing.T) {
 		if isTrue != test.isTrue {
 			t.Errorf("Test %d: expected %v found %v", i, test.isTrue, isTrue)
 		}
+		if isTrue := matcher.MatchReplacer(nil); isTrue != test.isTrue {
+			t.Errorf("Test %d: expected MatchReplacer to be %v, found %v", i, test.isTrue, isTrue)
+		}
+	}
+}
+
+func TestIfMatcherReplacer(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	rr := NewResponseRecorder(httptest.NewRecorder())
+	rr.WriteHeader(http.StatusBadGateway)
+	replacer := NewReplacer(r, rr, "-")
+	replacer.Set("custom", "value")
+
+	for i, test := range []struct {
+		condition string
+		isTrue    bool
+	}{
+		{"{status} ge 500", true},
+		{"{status} lt 400", false},
+		{"{custom} is value", true},
+	} {
+		str := strings.Fields(test.condition)
+		cond, err := newIfCond(str[0], str[1], str[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		matcher := IfMatcher{Enabled: true, ifs: []ifCond{cond}}
+		if isTrue := matcher.MatchReplacer(replacer); isTrue != test.isTrue {
+			t.Errorf("Test %d: expected %v found %v", i, test.isTrue, isTrue)
+		}
+		// without the replacer, the response is unknown
+		if matcher.Match(r) && i < 2 {
+			t.Errorf("Test %d: expected condition to be false for the request alone", i)
+		}
 	}
 }
 
@@ -0,0 +1,116 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseNetworks parses a list of CIDR ranges like 10.0.0.0/8 or
+// 2001:db8::/32. Plain IP addresses are parsed as single-host networks.
+func ParseNetworks(values []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// NetworksContain returns true if ip is in any of networks.
+func NetworksContain(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP address of the client that made r, or
+// nil if it can't be parsed. If the connection comes from one of
+// trusted, the address is taken from header instead, which lists
+// the client followed by the proxies it went through, like
+// X-Forwarded-For does, or the for parameters of an RFC 7239
+// Forwarded header. The rightmost address that is not a trusted
+// proxy is used, since the ones left of it could have been made
+// up by the client.
+func ClientIP(r *http.Request, trusted []*net.IPNet, header string) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !NetworksContain(trusted, ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, value := range r.Header.Values(header) {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	if http.CanonicalHeaderKey(header) == "Forwarded" {
+		for i, hop := range hops {
+			hops[i] = forwardedFor(hop)
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !NetworksContain(trusted, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardedFor returns the address in the for parameter of
+// element, an element of an RFC 7239 Forwarded header like
+// for="[2001:db8::1]:4711";proto=https, without its port.
+func forwardedFor(element string) string {
+	for _, pair := range strings.Split(element, ";") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) < 4 || !strings.EqualFold(pair[:4], "for=") {
+			continue
+		}
+		node := strings.Trim(pair[4:], `"`)
+		if host, _, err := net.SplitHostPort(node); err == nil {
+			return host
+		}
+		return strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	}
+	return ""
+}
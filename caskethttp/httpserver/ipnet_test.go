@@ -0,0 +1,103 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpserver
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := ParseNetworks([]string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32", "::1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for i, test := range []struct {
+		ip       string
+		expected bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"::1", true},
+		{"::2", false},
+	} {
+		if actual := NetworksContain(networks, net.ParseIP(test.ip)); actual != test.expected {
+			t.Errorf("Test %d: Expected %s contained to be %v, got %v", i, test.ip, test.expected, actual)
+		}
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "not-an-ip", "1.2.3"} {
+		if _, err := ParseNetworks([]string{invalid}); err == nil {
+			t.Errorf("Expected error for %s", invalid)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, _ := ParseNetworks([]string{"10.0.0.0/8"})
+	for i, test := range []struct {
+		remote    string
+		forwarded []string
+		expected  string
+	}{
+		{"1.2.3.4:1234", nil, "1.2.3.4"},
+		{"1.2.3.4:1234", []string{"5.6.7.8"}, "1.2.3.4"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", []string{"5.6.7.8"}, "5.6.7.8"},
+		{"10.0.0.1:1234", []string{"9.9.9.9, 5.6.7.8, 10.0.0.2"}, "5.6.7.8"},
+		{"10.0.0.1:1234", []string{"9.9.9.9", "5.6.7.8"}, "5.6.7.8"},
+		{"10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"10.0.0.1:1234", []string{"5.6.7.8, garbage"}, "10.0.0.1"},
+		{"garbage", nil, "<nil>"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		for _, value := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if actual := ClientIP(r, trusted, "X-Forwarded-For").String(); actual != test.expected {
+			t.Errorf("Test %d: Expected client IP %s, got %s", i, test.expected, actual)
+		}
+	}
+}
+
+func TestClientIPForwarded(t *testing.T) {
+	trusted, _ := ParseNetworks([]string{"10.0.0.0/8"})
+	for i, test := range []struct {
+		forwarded string
+		expected  string
+	}{
+		{`for=5.6.7.8`, "5.6.7.8"},
+		{`For="5.6.7.8:4711";proto=https`, "5.6.7.8"},
+		{`for="[2001:db8::1]:4711"`, "2001:db8::1"},
+		{`for="[2001:db8::1]"`, "2001:db8::1"},
+		{`for=9.9.9.9, for=5.6.7.8;by=10.0.0.2, for=10.0.0.3`, "5.6.7.8"},
+		{`proto=https;for=5.6.7.8`, "5.6.7.8"},
+		{`for=unknown`, "10.0.0.1"},
+		{`for=_hidden, for=10.0.0.3`, "10.0.0.3"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("Forwarded", test.forwarded)
+		if actual := ClientIP(r, trusted, "forwarded").String(); actual != test.expected {
+			t.Errorf("Test %d: Expected client IP %s, got %s", i, test.expected, actual)
+		}
+	}
+}
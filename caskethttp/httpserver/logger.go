@@ -16,12 +16,14 @@ package httpserver
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/tmpim/casket"
 	gsyslog "github.com/hashicorp/go-syslog"
@@ -34,17 +36,20 @@ var remoteSyslogPrefixes = map[string]string{
 }
 
 // Logger is shared between errors and log plugins and supports both logging to
-// a file (with an optional file roller), local and remote syslog servers.
+// a file (with an optional file roller), local and remote syslog servers, and
+// the remote log outputs described at newRemoteLogWriter.
 type Logger struct {
 	Output string
 	*log.Logger
 	Roller       *LogRoller
 	writer       io.Writer
+	rolled       bool // writer is shared through Roller.GetLogWriter
 	fileMu       *sync.RWMutex
 	V4ipMask     net.IPMask
 	V6ipMask     net.IPMask
 	IPMaskExists bool
 	Exceptions   []string
+	BufferSize   int // lines buffered by remote log outputs; 0 for the default
 }
 
 // NewTestLogger creates logger suitable for testing purposes
@@ -83,6 +88,15 @@ func (l Logger) MaskIP(ip string) string {
 	return reqIP.Mask(l.V6ipMask).String()
 }
 
+// Dropped returns the number of lines a remote log output
+// dropped. It is always 0 for other outputs.
+func (l Logger) Dropped() int64 {
+	if w, ok := l.writer.(*remoteLogWriter); ok {
+		return w.Dropped()
+	}
+	return 0
+}
+
 // ShouldLog returns true if the path is not exempted from
 // being logged (i.e. it is not found in l.Exceptions).
 func (l Logger) ShouldLog(path string) bool {
@@ -143,6 +157,16 @@ selectwriter:
 			return err
 		}
 	default:
+		var remote *remoteLogWriter
+		remote, err = newRemoteLogWriter(l.Output, l.BufferSize)
+		if err != nil {
+			return err
+		}
+		if remote != nil {
+			l.writer = remote
+			break selectwriter
+		}
+
 		if address := parseSyslogAddress(l.Output); address != nil {
 			l.writer, err = gsyslog.DialLogger(address.network, address.address, gsyslog.LOG_ERR, "LOCAL0", "casket")
 
@@ -153,17 +177,25 @@ selectwriter:
 			break selectwriter
 		}
 
+		// only the rolling writer moves on to the file of the next
+		// period, a plain file would be written to indefinitely
+		rolled := l.Roller != nil && !l.Roller.Disabled
+		if !rolled && hasLogFilenamePattern(l.Output) {
+			return fmt.Errorf("log file %s has date placeholders, which need log rolling to be enabled", l.Output)
+		}
+
 		var file *os.File
 
-		file, err = os.OpenFile(l.Output, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		file, err = os.OpenFile(expandLogFilename(l.Output, time.Now()), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 		if err != nil {
 			return err
 		}
 
-		if l.Roller != nil && !l.Roller.Disabled {
+		if rolled {
 			file.Close()
 			l.Roller.Filename = l.Output
 			l.writer = l.Roller.GetLogWriter()
+			l.rolled = true
 		} else {
 			l.writer = file
 		}
@@ -187,6 +219,10 @@ func (l *Logger) Close() error {
 		l.fileMu.Lock()
 		err := closer.Close()
 		l.fileMu.Unlock()
+		if l.rolled {
+			l.rolled = false
+			l.Roller.ReleaseLogWriter()
+		}
 		return err
 	}
 
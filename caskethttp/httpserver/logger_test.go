@@ -26,6 +26,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	syslog "gopkg.in/mcuadros/go-syslog.v2"
 	"gopkg.in/mcuadros/go-syslog.v2/format"
@@ -116,6 +117,32 @@ func TestLoggingToFile(t *testing.T) {
 	os.Remove(file)
 }
 
+func TestLoggingToDatedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "casket_logger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "access-{date}.log")
+
+	logger := Logger{Output: file, Roller: &LogRoller{Disabled: true}}
+	if err := logger.Start(); err == nil {
+		t.Error("Expected an error for date placeholders without log rolling")
+	}
+
+	logger = Logger{Output: file, Roller: DefaultLogRoller()}
+	if err := logger.Start(); err != nil {
+		t.Fatalf("Got unexpected error during logger start: %v", err)
+	}
+	defer logger.Close()
+	logger.Print("dated")
+
+	content, err := ioutil.ReadFile(expandLogFilename(file, time.Now()))
+	if err != nil || !bytes.Contains(content, []byte("dated")) {
+		t.Errorf("Expected the file of today to be written, got %q (%v)", content, err)
+	}
+}
+
 func TestLoggingToSyslog(t *testing.T) {
 
 	testCases := []struct {
@@ -229,4 +229,7 @@ const (
 
 	// RequestIDCtxKey is the key for the U4 UUID value
 	RequestIDCtxKey casket.CtxKey = "request_id"
+
+	// TraceSpanCtxKey is the key for the server span of the request, if traced.
+	TraceSpanCtxKey casket.CtxKey = "trace_span"
 )
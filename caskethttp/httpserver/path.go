@@ -58,6 +58,22 @@ func (p Path) Matches(base string) bool {
 	return strings.HasPrefix(strings.ToLower(string(p)), strings.ToLower(base))
 }
 
+// LongestMatch returns the index of the rule with the longest
+// base path that p matches, or -1 if p matches none of them. There
+// are n rules, and paths returns the base paths of the rule at i.
+// Rules with equally long base paths are chosen by order.
+func (p Path) LongestMatch(n int, paths func(i int) []string) int {
+	matched, longest := -1, -1
+	for i := 0; i < n; i++ {
+		for _, base := range paths(i) {
+			if len(base) > longest && p.Matches(base) {
+				matched, longest = i, len(base)
+			}
+		}
+	}
+	return matched
+}
+
 // PathMatcher is a Path RequestMatcher.
 type PathMatcher string
 
@@ -144,3 +144,36 @@ func TestPathMatches(t *testing.T) {
 		}
 	}
 }
+
+func TestPathLongestMatch(t *testing.T) {
+	rules := [][]string{
+		{"/"},
+		{"/api", "/static"},
+		{"/api/v1"},
+		{"/static"},
+	}
+	paths := func(i int) []string { return rules[i] }
+
+	for i, test := range []struct {
+		reqPath  Path
+		expected int
+	}{
+		{"/", 0},
+		{"/other", 0},
+		{"/api", 1},
+		{"/api/v1/users", 2},
+		{"/api/v2", 1},
+		{"/static/app.js", 1}, // equally long paths go by order
+	} {
+		if got := test.reqPath.LongestMatch(len(rules), paths); got != test.expected {
+			t.Errorf("Test %d: For request path '%s': expected rule %d, got %d", i, test.reqPath, test.expected, got)
+		}
+	}
+
+	if got := Path("/api").LongestMatch(len(rules)-1, func(i int) []string { return rules[i+1] }); got != 0 {
+		t.Errorf("Expected rule 0, got %d", got)
+	}
+	if got := Path("/other").LongestMatch(len(rules)-1, func(i int) []string { return rules[i+1] }); got != -1 {
+		t.Errorf("Expected no rule, got %d", got)
+	}
+}
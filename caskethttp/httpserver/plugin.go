@@ -608,16 +608,18 @@ var directives = []string{
 	"on",
 	"supervisor", // github.com/lucaslorentz/casket-supervisor
 	"request_id",
-	"realip", // github.com/captncraig/casket-realip
-	"git",    // github.com/abiosoft/casket-git
+	"tracing",
+	"realip",
+	"git", // github.com/abiosoft/casket-git
 
 	// directives that add listener middleware to the stack
-	"proxyprotocol", // github.com/mastercactapus/casket-proxyprotocol
+	"proxyprotocol",
 
 	// directives that add middleware to the stack
-	"locale", // github.com/simia-tech/casket-locale
+	"metrics",
+	"prometheus", // deprecated alias of metrics
+	"locale",     // github.com/simia-tech/casket-locale
 	"log",
-	"cache", // github.com/nicolasazrak/casket-cache
 	"tryfiles",
 	"rewrite",
 	"ext",
@@ -626,36 +628,39 @@ var directives = []string{
 	"header",
 	"geoip", // github.com/kodnaplakal/casket-geoip
 	"errors",
-	"authz",        // github.com/casbin/casket-authz
-	"filter",       // github.com/echocat/casket-filter
-	"ipfilter",     // github.com/pyed/ipfilter
-	"ratelimit",    // github.com/xuqingfeng/casket-rate-limit
+	"authz",  // github.com/casbin/casket-authz
+	"filter", // github.com/echocat/casket-filter
+	"replace_body",
+	"ipfilter",
+	"ratelimit",
 	"recaptcha",    // github.com/defund/casket-recaptcha
 	"expires",      // github.com/epicagency/casket-expires
 	"forwardproxy", // github.com/casketserver/forwardproxy
 	"basicauth",
 	"redir",
 	"status",
-	"cors",      // github.com/captncraig/cors/casket
+	"cors",
 	"s3browser", // github.com/techknowlogick/casket-s3browser
 	"nobots",    // github.com/Xumeiquer/nobots
 	"mime",
 	"tmpauth",
 	"chuieauth",
-	"login",      // github.com/tarent/loginsrv/casket
-	"reauth",     // github.com/freman/casket-reauth
-	"extauth",    // github.com/BTBurke/casket-extauth
-	"jwt",        // github.com/BTBurke/casket-jwt
+	"login",   // github.com/tarent/loginsrv/casket
+	"reauth",  // github.com/freman/casket-reauth
+	"extauth", // github.com/BTBurke/casket-extauth
+	"jwt",
 	"permission", // github.com/dhaavi/casket-permission
-	"jsonp",      // github.com/pschlump/casket-jsonp
-	"upload",     // blitznote.com/src/casket.upload
-	"multipass",  // github.com/namsral/multipass/casket
+	// after access control, so that cached responses are
+	// only served to clients that are allowed to see them
+	"cache",
+	"jsonp",     // github.com/pschlump/casket-jsonp
+	"upload",    // blitznote.com/src/casket.upload
+	"multipass", // github.com/namsral/multipass/casket
 	"internal",
 	"pprof",
 	"expvar",
 	"push",
-	"datadog",    // github.com/payintech/casket-datadog
-	"prometheus", // github.com/miekg/casket-prometheus
+	"datadog", // github.com/payintech/casket-datadog
 	"templates",
 	"proxy",
 	"pubsub", // github.com/jung-kurt/casket-pubsub
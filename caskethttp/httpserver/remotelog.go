@@ -0,0 +1,377 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultRemoteLogBuffer is the number of lines a remote log
+// output holds in memory while they wait to be sent.
+const DefaultRemoteLogBuffer = 1024
+
+const (
+	remoteLogBatchSize     = 100
+	remoteLogFlushInterval = time.Second
+	remoteLogTimeout       = 10 * time.Second
+)
+
+// droppedLogLines counts the lines dropped by all remote log outputs.
+var droppedLogLines int64
+
+// DroppedLogLines returns the number of lines that remote log
+// outputs dropped, either because their buffer was full or
+// because sending them failed.
+func DroppedLogLines() int64 {
+	return atomic.LoadInt64(&droppedLogLines)
+}
+
+// logSender sends lines to a remote log output.
+type logSender interface {
+	// send sends lines and returns how many were sent.
+	send(lines [][]byte) (int, error)
+	close() error
+}
+
+// remoteLogWriter buffers the lines written to it and sends them
+// in the background. Writes never block; when the buffer is full,
+// lines are dropped and counted.
+type remoteLogWriter struct {
+	output  string
+	sender  logSender
+	lines   chan []byte
+	dropped int64
+
+	batchSize     int
+	flushInterval time.Duration
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// newRemoteLogWriter returns a writer for output if it is the URL of
+// a remote log output, i.e. one of
+//
+//	syslog+tls://host:port  RFC 5424 syslog over TLS
+//	http(s)://host/path     batched POST of newline-delimited JSON
+//	gelf+udp://host:port    GELF over UDP
+//
+// It returns nil if output is not a remote log output.
+func newRemoteLogWriter(output string, bufferSize int) (*remoteLogWriter, error) {
+	u, err := url.Parse(output)
+	if err != nil || u.Host == "" {
+		return nil, nil
+	}
+
+	var sender logSender
+	switch u.Scheme {
+	case "syslog+tls":
+		sender = &syslogTLSSender{address: u.Host, hostname: logHostname()}
+	case "http", "https":
+		sender = &httpLogSender{url: output, client: &http.Client{Timeout: remoteLogTimeout}}
+	case "gelf+udp":
+		conn, err := net.Dial("udp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		sender = &gelfSender{conn: conn, hostname: logHostname()}
+	default:
+		return nil, nil
+	}
+
+	if bufferSize <= 0 {
+		bufferSize = DefaultRemoteLogBuffer
+	}
+	w := &remoteLogWriter{
+		output:        output,
+		sender:        sender,
+		lines:         make(chan []byte, bufferSize),
+		batchSize:     remoteLogBatchSize,
+		flushInterval: remoteLogFlushInterval,
+		done:          make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+// Write queues the line p. It always succeeds.
+func (w *remoteLogWriter) Write(p []byte) (int, error) {
+	line := make([]byte, len(p))
+	copy(line, p)
+	select {
+	case w.lines <- bytes.TrimSuffix(line, []byte("\n")):
+	default:
+		w.drop(1)
+	}
+	return len(p), nil
+}
+
+// Close sends the buffered lines and closes the output.
+func (w *remoteLogWriter) Close() error {
+	w.closeOnce.Do(func() { close(w.done) })
+	w.wg.Wait()
+	return w.sender.close()
+}
+
+// Dropped returns the number of lines dropped by w.
+func (w *remoteLogWriter) Dropped() int64 {
+	return atomic.LoadInt64(&w.dropped)
+}
+
+func (w *remoteLogWriter) drop(n int) {
+	atomic.AddInt64(&w.dropped, int64(n))
+	atomic.AddInt64(&droppedLogLines, int64(n))
+}
+
+func (w *remoteLogWriter) run() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([][]byte, 0, w.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		sent, err := w.sender.send(batch)
+		if err != nil {
+			w.drop(len(batch) - sent)
+			log.Printf("[ERROR] Sending log lines to %s: %v", w.output, err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case line := <-w.lines:
+			batch = append(batch, line)
+			if len(batch) >= w.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-w.done:
+			for {
+				select {
+				case line := <-w.lines:
+					batch = append(batch, line)
+					if len(batch) >= w.batchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func logHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "-"
+	}
+	return hostname
+}
+
+// syslogTLSSender sends RFC 5424 messages over TLS, framed
+// by octet counting as described in RFC 5425. It reconnects
+// on the next batch if the connection fails.
+type syslogTLSSender struct {
+	address   string
+	hostname  string
+	tlsConfig *tls.Config
+	conn      net.Conn
+}
+
+// syslogPriority is the priority of the messages, i.e. facility
+// LOCAL0 and severity ERR, like the other syslog outputs.
+const syslogPriority = 16*8 + 3
+
+func (s *syslogTLSSender) send(lines [][]byte) (int, error) {
+	if s.conn == nil {
+		dialer := &net.Dialer{Timeout: remoteLogTimeout}
+		conn, err := tls.DialWithDialer(dialer, "tcp", s.address, s.tlsConfig)
+		if err != nil {
+			return 0, err
+		}
+		s.conn = conn
+	}
+
+	var buf bytes.Buffer
+	for i, line := range lines {
+		buf.Reset()
+		msg := fmt.Sprintf("<%d>1 %s %s casket %d - - %s",
+			syslogPriority, time.Now().Format(time.RFC3339Nano), s.hostname, os.Getpid(), line)
+		buf.WriteString(strconv.Itoa(len(msg)))
+		buf.WriteByte(' ')
+		buf.WriteString(msg)
+
+		s.conn.SetWriteDeadline(time.Now().Add(remoteLogTimeout))
+		if _, err := s.conn.Write(buf.Bytes()); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return i, err
+		}
+	}
+	return len(lines), nil
+}
+
+func (s *syslogTLSSender) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// httpLogSender POSTs batches of lines as newline-delimited JSON.
+// Lines that are not JSON objects are sent as the message field
+// of one.
+type httpLogSender struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpLogSender) send(lines [][]byte) (int, error) {
+	var body bytes.Buffer
+	for _, line := range lines {
+		if isJSONObject(line) {
+			body.Write(line)
+		} else {
+			msg, _ := json.Marshal(map[string]string{"message": string(line)})
+			body.Write(msg)
+		}
+		body.WriteByte('\n')
+	}
+
+	resp, err := s.client.Post(s.url, "application/x-ndjson", &body)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, fmt.Errorf("received %s", resp.Status)
+	}
+	return len(lines), nil
+}
+
+func (s *httpLogSender) close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// gelfSender sends GELF 1.1 messages over UDP, split into
+// chunks if they don't fit into one datagram.
+type gelfSender struct {
+	conn     net.Conn
+	hostname string
+}
+
+const (
+	gelfChunkSize = 1420
+	gelfMaxChunks = 128
+)
+
+func (s *gelfSender) send(lines [][]byte) (int, error) {
+	for i, line := range lines {
+		msg := map[string]interface{}{
+			"version":       "1.1",
+			"host":          s.hostname,
+			"short_message": string(line),
+			"timestamp":     float64(time.Now().UnixNano()) / 1e9,
+			"level":         3,
+		}
+		// the fields of structured lines become additional fields
+		if isJSONObject(line) {
+			var fields map[string]interface{}
+			if json.Unmarshal(line, &fields) == nil {
+				for key, value := range fields {
+					if key != "id" {
+						msg["_"+key] = value
+					}
+				}
+			}
+		}
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return i, err
+		}
+		if err := s.write(data); err != nil {
+			return i, err
+		}
+	}
+	return len(lines), nil
+}
+
+func (s *gelfSender) write(data []byte) error {
+	if len(data) <= gelfChunkSize {
+		_, err := s.conn.Write(data)
+		return err
+	}
+
+	const headerSize = 12
+	payload := gelfChunkSize - headerSize
+	count := (len(data) + payload - 1) / payload
+	if count > gelfMaxChunks {
+		return fmt.Errorf("GELF message of %d bytes is too large", len(data))
+	}
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	chunk := make([]byte, 0, gelfChunkSize)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * payload
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk = append(chunk[:0], 0x1e, 0x0f)
+		chunk = append(chunk, id[:]...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, data[i*payload:end]...)
+		if _, err := s.conn.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *gelfSender) close() error {
+	return s.conn.Close()
+}
+
+func isJSONObject(line []byte) bool {
+	return len(line) > 0 && line[0] == '{' && json.Valid(line)
+}
@@ -0,0 +1,189 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRemoteLogHTTP(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		if strings.Contains(string(body), "fail") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	logger := &Logger{Output: srv.URL + "/ingest"}
+	if err := logger.Start(); err != nil {
+		t.Fatal(err)
+	}
+	logger.Println(`{"status":200}`)
+	logger.Println("plain text")
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	expected := "{\"status\":200}\n{\"message\":\"plain text\"}\n"
+	if len(bodies) != 1 || bodies[0] != expected {
+		t.Errorf("Expected one batch %q, got %q", expected, bodies)
+	}
+	mu.Unlock()
+	if logger.Dropped() != 0 {
+		t.Errorf("Expected no dropped lines, got %d", logger.Dropped())
+	}
+
+	// lines of failed batches are dropped
+	before := DroppedLogLines()
+	logger = &Logger{Output: srv.URL}
+	if err := logger.Start(); err != nil {
+		t.Fatal(err)
+	}
+	logger.Println("fail")
+	logger.Println("fail again")
+	logger.Close()
+	if got := logger.Dropped(); got != 2 {
+		t.Errorf("Expected 2 dropped lines, got %d", got)
+	}
+	if got := DroppedLogLines() - before; got != 2 {
+		t.Errorf("Expected 2 more dropped lines in total, got %d", got)
+	}
+}
+
+func TestRemoteLogGELF(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	logger := &Logger{Output: "gelf+udp://" + conn.LocalAddr().String()}
+	if err := logger.Start(); err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("x", 3000)
+	logger.Println(`{"status":502,"id":"ignored"}`)
+	logger.Println(long)
+	logger.Close()
+
+	buf := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg map[string]interface{}
+	if err := json.Unmarshal(buf[:n], &msg); err != nil {
+		t.Fatalf("Expected a JSON message, got %q: %v", buf[:n], err)
+	}
+	if msg["version"] != "1.1" || msg["short_message"] != `{"status":502,"id":"ignored"}` ||
+		msg["_status"] != float64(502) || msg["_id"] != nil {
+		t.Errorf("Unexpected GELF message: %v", msg)
+	}
+
+	// the long message is split into chunks
+	var data []byte
+	for i := 0; i < 3; i++ {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > gelfChunkSize || buf[0] != 0x1e || buf[1] != 0x0f || buf[10] != byte(i) || buf[11] != 3 {
+			t.Fatalf("Chunk %d has an invalid header: % x", i, buf[:12])
+		}
+		data = append(data, buf[12:n]...)
+	}
+	if err := json.Unmarshal(data, &msg); err != nil || msg["short_message"] != long {
+		t.Errorf("Expected chunks to make up the long message, got error %v", err)
+	}
+}
+
+func TestRemoteLogSyslogTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	srv.Close()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", srv.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	received := make(chan string, 2)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			length, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(length))
+			msg := make([]byte, n)
+			if _, err := r.Read(msg); err != nil {
+				return
+			}
+			received <- string(msg)
+		}
+	}()
+
+	w, err := newRemoteLogWriter("syslog+tls://"+ln.Addr().String(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.sender.(*syslogTLSSender).tlsConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig
+	w.sender.(*syslogTLSSender).tlsConfig.ServerName = "example.com"
+	w.Write([]byte("first line\n"))
+	w.Write([]byte("second line\n"))
+	w.Close()
+
+	for _, line := range []string{"first line", "second line"} {
+		msg := <-received
+		if !strings.HasPrefix(msg, "<131>1 ") || !strings.HasSuffix(msg, " casket "+strconv.Itoa(os.Getpid())+" - - "+line) {
+			t.Errorf("Expected RFC 5424 message with '%s', got '%s'", line, msg)
+		}
+	}
+}
+
+func TestRemoteLogDrops(t *testing.T) {
+	w := &remoteLogWriter{lines: make(chan []byte, 2)}
+	for i := 0; i < 5; i++ {
+		if n, err := w.Write([]byte("line\n")); n != 5 || err != nil {
+			t.Errorf("Expected write to succeed, got %d, %v", n, err)
+		}
+	}
+	if got := w.Dropped(); got != 3 {
+		t.Errorf("Expected 3 dropped lines, got %d", got)
+	}
+}
@@ -133,6 +133,19 @@ func NewReplacer(r *http.Request, rr *ResponseRecorder, emptyValue string) Repla
 	return repl
 }
 
+// ReplacerWithEmptyValue returns a Replacer like rep which uses
+// emptyValue in place of empty values. rep must have been made by
+// NewReplacer; other Replacers are returned as they are.
+func ReplacerWithEmptyValue(rep Replacer, emptyValue string) Replacer {
+	r, ok := rep.(*replacer)
+	if !ok {
+		return rep
+	}
+	copied := *r
+	copied.emptyValue = emptyValue
+	return &copied
+}
+
 func canLogRequest(r *http.Request) bool {
 	if r.Method == "POST" || r.Method == "PUT" {
 		for _, cType := range r.Header[headerContentType] {
@@ -342,6 +355,10 @@ func (r *replacer) getSubstitution(key string) string {
 	case "{request_id}":
 		reqid, _ := r.request.Context().Value(RequestIDCtxKey).(string)
 		return reqid
+	case "{trace_id}":
+		return SpanFromContext(r.request.Context()).TraceIDString()
+	case "{span_id}":
+		return SpanFromContext(r.request.Context()).SpanIDString()
 	case "{rewrite_path}":
 		return r.request.URL.Path
 	case "{rewrite_path_escaped}":
@@ -16,9 +16,11 @@ package httpserver
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"path/filepath"
 	"strconv"
+	"sync"
 
 	lumberjack "gopkg.in/natefinch/lumberjack.v2"
 )
@@ -32,8 +34,28 @@ type LogRoller struct {
 	MaxBackups int
 	Compress   bool
 	LocalTime  bool
+
+	// RotateEvery is RotateDaily or RotateHourly to rotate the
+	// log at midnight or on the hour, besides rotating by size.
+	RotateEvery string
+
+	// MaxTotalSize is the most megabytes the log and its
+	// rotated files may take up; the oldest files are
+	// removed to stay below it. 0 means no limit.
+	MaxTotalSize int
+
+	// PostRotate is a command that is run after each time-based
+	// rotation, with the path of the rotated file appended to
+	// its arguments.
+	PostRotate []string
 }
 
+// Intervals of time-based rotation.
+const (
+	RotateDaily  = "daily"
+	RotateHourly = "hourly"
+)
+
 // GetLogWriter returns an io.Writer that writes to a rolling logger.
 // This should be called only from the main goroutine (like during
 // server setup) because this method is not thread-safe; it is careful
@@ -43,32 +65,69 @@ type LogRoller struct {
 // should not create more than one roller on the same file at the
 // same time. See issue #1363.
 func (l LogRoller) GetLogWriter() io.Writer {
-	absPath, err := filepath.Abs(l.Filename)
-	if err != nil {
-		absPath = l.Filename // oh well, hopefully they're consistent in how they specify the filename
-	}
+	absPath := l.absPath()
+	lumberjacksMu.Lock()
+	defer lumberjacksMu.Unlock()
+	lumberjackRefs[absPath]++
 	lj, has := lumberjacks[absPath]
 	if !has {
-		lj = &lumberjack.Logger{
-			Filename:   l.Filename,
-			MaxSize:    l.MaxSize,
-			MaxAge:     l.MaxAge,
-			MaxBackups: l.MaxBackups,
-			Compress:   l.Compress,
-			LocalTime:  l.LocalTime,
+		if l.RotateEvery != "" || l.MaxTotalSize > 0 || len(l.PostRotate) > 0 || hasLogFilenamePattern(l.Filename) {
+			lj = newRollingWriter(l)
+		} else {
+			lj = l.lumberjack(l.Filename)
 		}
 		lumberjacks[absPath] = lj
 	}
 	return lj
 }
 
+// ReleaseLogWriter releases a writer returned by GetLogWriter.
+// When the last user of a log file releases it, the writer is
+// dropped and its time-based rotation and retention stop.
+func (l LogRoller) ReleaseLogWriter() {
+	absPath := l.absPath()
+	lumberjacksMu.Lock()
+	defer lumberjacksMu.Unlock()
+	if lumberjackRefs[absPath]--; lumberjackRefs[absPath] > 0 {
+		return
+	}
+	if w, ok := lumberjacks[absPath].(*rollingWriter); ok {
+		w.stop()
+	}
+	delete(lumberjacks, absPath)
+	delete(lumberjackRefs, absPath)
+}
+
+func (l LogRoller) absPath() string {
+	absPath, err := filepath.Abs(l.Filename)
+	if err != nil {
+		absPath = l.Filename // oh well, hopefully they're consistent in how they specify the filename
+	}
+	return absPath
+}
+
+// lumberjack returns a logger rolling filename by size.
+func (l LogRoller) lumberjack(filename string) *lumberjack.Logger {
+	return &lumberjack.Logger{
+		Filename:   filename,
+		MaxSize:    l.MaxSize,
+		MaxAge:     l.MaxAge,
+		MaxBackups: l.MaxBackups,
+		Compress:   l.Compress,
+		LocalTime:  l.LocalTime,
+	}
+}
+
 // IsLogRollerSubdirective is true if the subdirective is for the log roller.
 func IsLogRollerSubdirective(subdir string) bool {
 	return subdir == directiveRotateSize ||
 		subdir == directiveRotateAge ||
 		subdir == directiveRotateKeep ||
 		subdir == directiveRotateCompress ||
-		subdir == directiveRotateDisable
+		subdir == directiveRotateDisable ||
+		subdir == directiveRotateEvery ||
+		subdir == directiveRotateTotalSize ||
+		subdir == directiveRotatePost
 }
 
 var errInvalidRollParameter = errors.New("invalid roller parameter")
@@ -79,18 +138,30 @@ func ParseRoller(l *LogRoller, what string, where ...string) error {
 		l = DefaultLogRoller()
 	}
 
-	// rotate_compress doesn't accept any parameters.
+	// rotate_compress doesn't accept any parameters,
+	// rotate_post accepts a command and its arguments,
 	// others only accept one parameter
-	if ((what == directiveRotateCompress || what == directiveRotateDisable) && len(where) != 0) ||
-		((what != directiveRotateCompress && what != directiveRotateDisable) && len(where) != 1) {
-		return errInvalidRollParameter
+	switch what {
+	case directiveRotateCompress, directiveRotateDisable:
+		if len(where) != 0 {
+			return errInvalidRollParameter
+		}
+	case directiveRotatePost:
+		if len(where) == 0 {
+			return errInvalidRollParameter
+		}
+	default:
+		if len(where) != 1 {
+			return errInvalidRollParameter
+		}
 	}
 
 	var (
 		value int
 		err   error
 	)
-	if what != directiveRotateCompress && what != directiveRotateDisable {
+	switch what {
+	case directiveRotateSize, directiveRotateAge, directiveRotateKeep, directiveRotateTotalSize:
 		value, err = strconv.Atoi(where[0])
 		if err != nil {
 			return err
@@ -98,6 +169,15 @@ func ParseRoller(l *LogRoller, what string, where ...string) error {
 	}
 
 	switch what {
+	case directiveRotateEvery:
+		if where[0] != RotateDaily && where[0] != RotateHourly {
+			return fmt.Errorf("invalid rotation interval '%s', must be %s or %s", where[0], RotateDaily, RotateHourly)
+		}
+		l.RotateEvery = where[0]
+	case directiveRotateTotalSize:
+		l.MaxTotalSize = value
+	case directiveRotatePost:
+		l.PostRotate = where
 	case directiveRotateDisable:
 		l.Disabled = true
 	case directiveRotateSize:
@@ -136,8 +216,17 @@ const (
 	directiveRotateAge      = "rotate_age"
 	directiveRotateKeep     = "rotate_keep"
 	directiveRotateCompress = "rotate_compress"
+
+	directiveRotateEvery     = "rotate_every"
+	directiveRotateTotalSize = "rotate_total_size"
+	directiveRotatePost      = "rotate_post"
 )
 
 // lumberjacks maps log filenames to the logger
 // that is being used to keep them rolled/maintained.
 var lumberjacks = make(map[string]io.Writer)
+
+// lumberjackRefs counts the users of each writer in lumberjacks.
+var lumberjackRefs = make(map[string]int)
+
+var lumberjacksMu sync.Mutex
@@ -0,0 +1,281 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpserver
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRoller(t *testing.T) {
+	for i, test := range []struct {
+		what      string
+		where     []string
+		shouldErr bool
+		expect    LogRoller
+	}{
+		{"rotate_size", []string{"5"}, false, LogRoller{MaxSize: 5}},
+		{"rotate_size", []string{}, true, LogRoller{}},
+		{"rotate_compress", []string{}, false, LogRoller{Compress: true}},
+		{"rotate_compress", []string{"yes"}, true, LogRoller{}},
+		{"rotate_every", []string{"daily"}, false, LogRoller{RotateEvery: RotateDaily}},
+		{"rotate_every", []string{"hourly"}, false, LogRoller{RotateEvery: RotateHourly}},
+		{"rotate_every", []string{"weekly"}, true, LogRoller{}},
+		{"rotate_total_size", []string{"500"}, false, LogRoller{MaxTotalSize: 500}},
+		{"rotate_total_size", []string{"big"}, true, LogRoller{}},
+		{"rotate_post", []string{"gzip", "-9"}, false, LogRoller{PostRotate: []string{"gzip", "-9"}}},
+		{"rotate_post", []string{}, true, LogRoller{}},
+	} {
+		if !IsLogRollerSubdirective(test.what) {
+			t.Errorf("Test %d: expected %s to be a roller subdirective", i, test.what)
+		}
+		var roller LogRoller
+		err := ParseRoller(&roller, test.what, test.where...)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error, got %v", i, err)
+		}
+		if !reflect.DeepEqual(roller, test.expect) {
+			t.Errorf("Test %d: expected %+v, got %+v", i, test.expect, roller)
+		}
+	}
+}
+
+func TestLogFilenamePatterns(t *testing.T) {
+	now := time.Date(2024, 3, 9, 17, 45, 0, 0, time.UTC)
+	if got := expandLogFilename("logs/{year}/{month}/access-{date}T{hour}.log", now); got != "logs/2024/03/access-2024-03-09T17.log" {
+		t.Errorf("Unexpected expanded filename %s", got)
+	}
+	if got := expandLogFilename("access.log", now); got != "access.log" {
+		t.Errorf("Expected filename without patterns to be unchanged, got %s", got)
+	}
+
+	if got, want := nextRotation(now, RotateHourly), time.Date(2024, 3, 9, 18, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Expected next hourly rotation at %v, got %v", want, got)
+	}
+	if got, want := nextRotation(now, RotateDaily), time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Expected next daily rotation at %v, got %v", want, got)
+	}
+}
+
+func TestRollingWriterRotate(t *testing.T) {
+	touch, err := exec.LookPath("touch")
+	if err != nil {
+		t.Skip("touch is not available")
+	}
+	dir, err := ioutil.TempDir("", "casket_roller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hooked := filepath.Join(dir, "hooked")
+	w := &rollingWriter{roller: LogRoller{
+		Filename:   filepath.Join(dir, "access-{date}.log"),
+		MaxSize:    100,
+		PostRotate: []string{touch, hooked},
+	}}
+	day := time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC)
+	w.open(day)
+	w.Write([]byte("first\n"))
+	w.rotate(day.Add(24 * time.Hour))
+	w.Write([]byte("second\n"))
+	w.Close()
+
+	for name, content := range map[string]string{
+		"access-2024-03-09.log": "first\n",
+		"access-2024-03-10.log": "second\n",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != content {
+			t.Errorf("Expected %s to contain %q, got %q (%v)", name, content, data, err)
+		}
+	}
+	if _, err := os.Stat(hooked); err != nil {
+		t.Errorf("Expected post-rotate command to have run: %v", err)
+	}
+
+	// without patterns, a backup is made the way lumberjack names them
+	w = &rollingWriter{roller: LogRoller{Filename: filepath.Join(dir, "plain.log"), MaxSize: 100}}
+	w.open(day)
+	w.Write([]byte("plain\n"))
+	w.rotate(day.Add(time.Hour))
+	w.Close()
+	backups, _ := filepath.Glob(filepath.Join(dir, "plain-*.log"))
+	if len(backups) != 1 {
+		t.Fatalf("Expected a backup of plain.log, got %v", backups)
+	}
+	if data, _ := ioutil.ReadFile(backups[0]); string(data) != "plain\n" {
+		t.Errorf("Expected backup to contain the rotated lines, got %q", data)
+	}
+}
+
+func TestRollingWriterRotateCompressed(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh is not available")
+	}
+	dir, err := ioutil.TempDir("", "casket_roller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the hook records the file it's given
+	hooked := filepath.Join(dir, "hooked")
+	w := &rollingWriter{roller: LogRoller{
+		Filename:   filepath.Join(dir, "access.log"),
+		MaxSize:    100,
+		Compress:   true,
+		PostRotate: []string{sh, "-c", `printf %s "$1" > ` + hooked, "sh"},
+	}}
+	w.open(time.Now())
+	w.Write([]byte("rotated\n"))
+	w.rotate(time.Now())
+	w.Write([]byte("current\n"))
+	w.Close()
+
+	data, err := ioutil.ReadFile(hooked)
+	if err != nil {
+		t.Fatalf("Expected post-rotate command to have run: %v", err)
+	}
+	backup := string(data)
+	if !strings.HasPrefix(filepath.Base(backup), "access-") || !strings.HasSuffix(backup, ".log.gz") {
+		t.Fatalf("Expected the hook to get the compressed backup, got '%s'", backup)
+	}
+	file, err := os.Open(backup)
+	if err != nil {
+		t.Fatalf("Expected the compressed backup to exist: %v", err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadAll(gz); string(content) != "rotated\n" {
+		t.Errorf("Expected backup to contain the rotated lines, got %q", content)
+	}
+	if leftover, _ := filepath.Glob(filepath.Join(dir, "access-*.log*")); len(leftover) != 1 {
+		t.Errorf("Expected only the compressed backup, got %v", leftover)
+	}
+	if current, _ := ioutil.ReadFile(filepath.Join(dir, "access.log")); string(current) != "current\n" {
+		t.Errorf("Expected a new log file, got %q", current)
+	}
+}
+
+func TestRollingWriterRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "casket_roller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	files := []struct {
+		name string
+		age  time.Duration
+		size int
+	}{
+		{"access-2024-03-01.log", 9 * 24 * time.Hour, megabyte / 2},
+		{"access-2024-03-02.log.gz", 8 * 24 * time.Hour, megabyte / 2},
+		{"access-2024-03-03-2024-03-03T10-00-00.000.log", 7 * 24 * time.Hour, megabyte / 2},
+		{"access-2024-03-04.log", 6 * 24 * time.Hour, megabyte / 2},
+		{"other.log", 10 * 24 * time.Hour, megabyte},
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		if err := ioutil.WriteFile(path, make([]byte, file.size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, now.Add(-file.age), now.Add(-file.age))
+	}
+
+	w := &rollingWriter{roller: LogRoller{
+		Filename:     filepath.Join(dir, "access-{date}.log"),
+		MaxAge:       9,
+		MaxTotalSize: 1,
+	}}
+	w.filename = filepath.Join(dir, "access-2024-03-10.log")
+	ioutil.WriteFile(w.filename, make([]byte, megabyte/4), 0644)
+	w.enforceRetention()
+
+	for _, name := range []string{"access-2024-03-01.log", "access-2024-03-02.log.gz", "access-2024-03-03-2024-03-03T10-00-00.000.log"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed", name)
+		}
+	}
+	for _, name := range []string{"access-2024-03-04.log", "access-2024-03-10.log", "other.log"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected %s to be kept: %v", name, err)
+		}
+	}
+}
+
+func TestReleaseLogWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "casket_roller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	retentionInterval = 10 * time.Millisecond
+	defer func() { retentionInterval = time.Minute }()
+
+	roller := LogRoller{Filename: filepath.Join(dir, "access.log"), MaxTotalSize: 1}
+	first, second := roller.GetLogWriter(), roller.GetLogWriter()
+	if first != second {
+		t.Fatal("Expected the log file to share one writer")
+	}
+	w, ok := first.(*rollingWriter)
+	if !ok {
+		t.Fatalf("Expected a rolling writer, got %T", first)
+	}
+
+	roller.ReleaseLogWriter()
+	if _, has := lumberjacks[roller.absPath()]; !has {
+		t.Error("Expected the writer to be kept while it is still used")
+	}
+	roller.ReleaseLogWriter()
+	if _, has := lumberjacks[roller.absPath()]; has {
+		t.Error("Expected the writer to be dropped once it isn't used anymore")
+	}
+	select {
+	case <-w.done:
+	default:
+		t.Fatal("Expected the dropped writer to be stopped")
+	}
+
+	// retention isn't enforced anymore
+	backup := filepath.Join(dir, "access-2024-03-01.log")
+	if err := ioutil.WriteFile(backup, make([]byte, 2*megabyte), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(backup); err != nil {
+		t.Errorf("Expected the stopped writer to leave %s alone: %v", backup, err)
+	}
+}
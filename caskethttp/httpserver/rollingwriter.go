@@ -0,0 +1,342 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpserver
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// retentionInterval is how often the retention policies of a
+// rolling writer are enforced between time-based rotations.
+var retentionInterval = time.Minute
+
+// logFilenamePatterns are replaced by the date of the
+// period a log file is written in.
+var logFilenamePatterns = []string{"{date}", "{year}", "{month}", "{day}", "{hour}"}
+
+// hasLogFilenamePattern returns true if filename contains a date pattern.
+func hasLogFilenamePattern(filename string) bool {
+	for _, pattern := range logFilenamePatterns {
+		if strings.Contains(filename, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandLogFilename replaces the date patterns in filename with t.
+func expandLogFilename(filename string, t time.Time) string {
+	if !hasLogFilenamePattern(filename) {
+		return filename
+	}
+	return strings.NewReplacer(
+		"{date}", t.Format("2006-01-02"),
+		"{year}", t.Format("2006"),
+		"{month}", t.Format("01"),
+		"{day}", t.Format("02"),
+		"{hour}", t.Format("15"),
+	).Replace(filename)
+}
+
+// nextRotation returns the start of the period after the one t is in.
+func nextRotation(t time.Time, every string) time.Time {
+	y, m, d := t.Date()
+	if every == RotateHourly {
+		return time.Date(y, m, d, t.Hour()+1, 0, 0, 0, t.Location())
+	}
+	return time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+}
+
+// rollingWriter extends the size-based rolling of lumberjack
+// with rotation at wall clock boundaries, filenames with dates,
+// a limit on the total size of the log files and a post-rotate
+// hook. The current file is written by a lumberjack logger,
+// which is replaced whenever the expanded filename changes.
+type rollingWriter struct {
+	roller LogRoller
+
+	mu       sync.Mutex
+	filename string // the current, expanded filename
+	current  *lumberjack.Logger
+
+	interval time.Duration // of enforcing retention
+	done     chan struct{} // closed to stop run
+}
+
+func newRollingWriter(l LogRoller) *rollingWriter {
+	w := &rollingWriter{roller: l, interval: retentionInterval, done: make(chan struct{})}
+	w.open(w.now())
+	if l.RotateEvery != "" || l.MaxTotalSize > 0 || (l.MaxAge > 0 && hasLogFilenamePattern(l.Filename)) {
+		go w.run()
+	}
+	return w
+}
+
+func (w *rollingWriter) now() time.Time {
+	if w.roller.LocalTime {
+		return time.Now()
+	}
+	return time.Now().UTC()
+}
+
+// open makes the file of the period t is in the current one.
+func (w *rollingWriter) open(t time.Time) {
+	w.filename = expandLogFilename(w.roller.Filename, t)
+	w.current = w.roller.lumberjack(w.filename)
+}
+
+// Write writes p to the current file.
+func (w *rollingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current.Write(p)
+}
+
+// Close closes the current file. It is reopened by the next write.
+func (w *rollingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current.Close()
+}
+
+func (w *rollingWriter) run() {
+	for {
+		now := w.now()
+		wait := w.interval
+		var next time.Time
+		if w.roller.RotateEvery != "" {
+			next = nextRotation(now, w.roller.RotateEvery)
+			if until := next.Sub(now); until < wait {
+				wait = until
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-w.done:
+			timer.Stop()
+			return
+		}
+
+		if !next.IsZero() && !w.now().Before(next) {
+			w.rotate(next)
+		} else {
+			w.enforceRetention()
+		}
+	}
+}
+
+// stop stops run once the writer is no longer used.
+func (w *rollingWriter) stop() {
+	close(w.done)
+}
+
+// rotate starts the period beginning at t. If the filename has
+// date patterns, the file of the new period is opened; otherwise
+// the current file is moved aside as a backup.
+func (w *rollingWriter) rotate(t time.Time) {
+	w.mu.Lock()
+	rotated := w.filename
+	var pending string
+	if filename := expandLogFilename(w.roller.Filename, t); filename != w.filename {
+		w.current.Close()
+		w.open(t)
+	} else {
+		var err error
+		rotated, pending, err = w.moveAside()
+		if err != nil {
+			log.Printf("[ERROR] Rotating log %s: %v", w.filename, err)
+		}
+	}
+	w.mu.Unlock()
+
+	// compress outside the lock, so that writes don't wait for it
+	if pending != "" {
+		if err := compressLogFile(pending, rotated); err != nil {
+			log.Printf("[ERROR] Compressing log %s: %v", rotated, err)
+			rotated = ""
+		}
+	}
+
+	w.enforceRetention()
+
+	if len(w.roller.PostRotate) > 0 && rotated != "" {
+		args := append(append([]string{}, w.roller.PostRotate[1:]...), rotated)
+		cmd := exec.Command(w.roller.PostRotate[0], args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Printf("[ERROR] Running post-rotate command for log %s: %v", rotated, err)
+		}
+	}
+}
+
+// logFileInfo is a file belonging to a log.
+type logFileInfo struct {
+	path string
+	os.FileInfo
+}
+
+// files returns the log's files except the current
+// one, from the least to the most recently modified.
+func (w *rollingWriter) files() ([]logFileInfo, string) {
+	w.mu.Lock()
+	current := w.filename
+	w.mu.Unlock()
+
+	// the expanded filenames and lumberjack's backups of
+	// them look like name[-...].ext, possibly compressed
+	ext := filepath.Ext(w.roller.Filename)
+	base := strings.TrimSuffix(w.roller.Filename, ext)
+	for _, pattern := range logFilenamePatterns {
+		base = strings.Replace(base, pattern, "*", -1)
+	}
+	var globs []string
+	for _, glob := range []string{base + ext, base + "-*" + ext} {
+		globs = append(globs, glob, glob+".gz")
+	}
+
+	seen := make(map[string]bool)
+	var files []logFileInfo
+	for _, glob := range globs {
+		matches, _ := filepath.Glob(glob)
+		for _, path := range matches {
+			if seen[path] || path == current {
+				continue
+			}
+			seen[path] = true
+			if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+				files = append(files, logFileInfo{path, info})
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	return files, current
+}
+
+// enforceRetention removes the oldest files of the log while they
+// take up more than MaxTotalSize and, since lumberjack only cleans
+// up the backups of a single filename, files of past periods that
+// are older than MaxAge.
+func (w *rollingWriter) enforceRetention() {
+	files, current := w.files()
+
+	if w.roller.MaxAge > 0 && hasLogFilenamePattern(w.roller.Filename) {
+		cutoff := time.Now().Add(-time.Duration(w.roller.MaxAge) * 24 * time.Hour)
+		for len(files) > 0 && files[0].ModTime().Before(cutoff) {
+			w.remove(files[0].path)
+			files = files[1:]
+		}
+	}
+
+	if w.roller.MaxTotalSize > 0 {
+		limit := int64(w.roller.MaxTotalSize) * megabyte
+		var total int64
+		if info, err := os.Stat(current); err == nil {
+			total = info.Size()
+		}
+		for _, file := range files {
+			total += file.Size()
+		}
+		for len(files) > 0 && total > limit {
+			w.remove(files[0].path)
+			total -= files[0].Size()
+			files = files[1:]
+		}
+	}
+}
+
+func (w *rollingWriter) remove(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("[ERROR] Removing old log file: %v", err)
+	}
+}
+
+const megabyte = 1024 * 1024
+
+// backupTimeFormat is the timestamp lumberjack puts in the names of
+// its backups, which it only keeps, compresses and removes if they
+// are named like that.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// moveAside closes the current file and renames it the way lumberjack
+// names its backups; lumberjack creates a new file on the next write.
+// It returns the name of the backup, or "" if there was no file. With
+// compression on, the backup is compressed by the caller: the file is
+// renamed to pending, which lumberjack ignores, so that it isn't
+// compressed by lumberjack at the same time.
+func (w *rollingWriter) moveAside() (backup, pending string, err error) {
+	if err := w.current.Close(); err != nil {
+		return "", "", err
+	}
+	if _, err := os.Stat(w.filename); os.IsNotExist(err) {
+		return "", "", nil
+	}
+	ext := filepath.Ext(w.filename)
+	backup = strings.TrimSuffix(w.filename, ext) + "-" + w.now().Format(backupTimeFormat) + ext
+	target := backup
+	if w.roller.Compress {
+		backup += ".gz"
+		pending = target + ".pending"
+		target = pending
+	}
+	if err := os.Rename(w.filename, target); err != nil {
+		return "", "", err
+	}
+	return backup, pending, nil
+}
+
+// compressLogFile gzips src to dst and removes src.
+func compressLogFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err = io.Copy(gz, in); err == nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
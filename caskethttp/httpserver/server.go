@@ -457,9 +457,37 @@ func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) (int, error)
 		return http.StatusForbidden, nil
 	}
 
+	if vhost.Tracer != nil {
+		return serveTraced(vhost, w, r)
+	}
 	return vhost.middlewareChain.ServeHTTP(w, r)
 }
 
+// serveTraced serves r with the middleware of vhost within a server span.
+func serveTraced(vhost *SiteConfig, w http.ResponseWriter, r *http.Request) (int, error) {
+	r, span := vhost.Tracer.StartServerSpan(r)
+	defer span.Finish()
+
+	// the request's replacer was created before the span
+	if repl, ok := r.Context().Value(ReplacerCtxKey).(Replacer); ok {
+		repl.Set("trace_id", span.TraceIDString())
+		repl.Set("span_id", span.SpanIDString())
+	}
+
+	rec := NewResponseRecorder(w)
+	status, err := vhost.middlewareChain.ServeHTTP(rec, r)
+	if status >= 400 {
+		// an error status that hasn't been written yet
+		span.SetStatus(status)
+	} else {
+		span.SetStatus(rec.Status())
+	}
+	if err != nil {
+		span.SetError(err.Error())
+	}
+	return status, err
+}
+
 func trimPathPrefix(u *url.URL, prefix string) *url.URL {
 	// We need to use URL.EscapedPath() when trimming the pathPrefix as
 	// URL.Path is ambiguous about / or %2f - see docs. See #1927
@@ -488,6 +516,11 @@ func (s *Server) Address() string {
 	return s.Server.Addr
 }
 
+// Sites returns the configs of the sites s serves.
+func (s *Server) Sites() []*SiteConfig {
+	return s.sites
+}
+
 // Stop stops s gracefully (or forcefully after timeout) and
 // closes its listener.
 func (s *Server) Stop() error {
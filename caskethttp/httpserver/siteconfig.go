@@ -73,6 +73,10 @@ type SiteConfig struct {
 	// If true, any requests not matching other site definitions
 	// may be served by this site.
 	FallbackSite bool
+
+	// Tracer starts a span for each request to the site,
+	// if tracing is enabled.
+	Tracer *Tracer
 }
 
 // Timeouts specify various timeouts for a server to use.
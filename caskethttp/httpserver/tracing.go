@@ -0,0 +1,259 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Span kinds, as defined by OpenTelemetry.
+const (
+	SpanKindServer = 2
+	SpanKindClient = 3
+)
+
+// SpanExporter receives spans once they have ended.
+type SpanExporter interface {
+	ExportSpan(*Span)
+}
+
+// Tracer starts the spans of a site. If a request carries a W3C
+// traceparent header, its server span continues that trace.
+type Tracer struct {
+	// Exporter receives the sampled spans.
+	Exporter SpanExporter
+
+	// SampleRatio is the fraction of new traces that are
+	// sampled. Requests continuing a trace keep its
+	// sampling decision.
+	SampleRatio float64
+}
+
+// Span is a timed operation within a trace. All methods
+// may be called on a nil Span, doing nothing.
+type Span struct {
+	TraceID      [16]byte
+	SpanID       [8]byte
+	ParentSpanID [8]byte // zero for the root span of a trace
+	TraceState   string
+	Sampled      bool
+	Name         string
+	Kind         int
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]interface{}
+	Error        bool
+	Message      string
+
+	tracer *Tracer
+	ended  int32
+}
+
+// StartServerSpan starts the server span of r and returns
+// r with the span added to its context.
+func (t *Tracer) StartServerSpan(r *http.Request) (*http.Request, *Span) {
+	span := &Span{
+		Name:   r.Method,
+		Kind:   SpanKindServer,
+		Start:  time.Now(),
+		tracer: t,
+	}
+	if traceID, parentID, sampled, ok := parseTraceParent(r.Header.Get("Traceparent")); ok {
+		span.TraceID = traceID
+		span.ParentSpanID = parentID
+		span.Sampled = sampled
+		span.TraceState = r.Header.Get("Tracestate")
+	} else {
+		rand.Read(span.TraceID[:])
+		span.Sampled = t.sample(span.TraceID)
+	}
+	rand.Read(span.SpanID[:])
+
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("url.path", r.URL.Path)
+	span.SetAttribute("server.address", r.Host)
+	span.SetAttribute("client.address", r.RemoteAddr)
+	if ua := r.UserAgent(); ua != "" {
+		span.SetAttribute("user_agent.original", ua)
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), TraceSpanCtxKey, span)), span
+}
+
+// sample decides whether a new trace is sampled. The decision
+// is derived from the trace ID so it is consistent for a trace.
+func (t *Tracer) sample(traceID [16]byte) bool {
+	if t.SampleRatio >= 1 {
+		return true
+	}
+	if t.SampleRatio <= 0 {
+		return false
+	}
+	bound := uint64(t.SampleRatio * (1 << 63))
+	return binary.BigEndian.Uint64(traceID[8:])>>1 < bound
+}
+
+// SpanFromContext returns the span in ctx, or nil if there is none.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(TraceSpanCtxKey).(*Span)
+	return span
+}
+
+// StartSpan starts a child span of the span in ctx. It
+// returns nil if ctx has no span, i.e. tracing is disabled.
+func StartSpan(ctx context.Context, name string, kind int) *Span {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return nil
+	}
+	span := &Span{
+		TraceID:      parent.TraceID,
+		ParentSpanID: parent.SpanID,
+		TraceState:   parent.TraceState,
+		Sampled:      parent.Sampled,
+		Name:         name,
+		Kind:         kind,
+		Start:        time.Now(),
+		tracer:       parent.tracer,
+	}
+	rand.Read(span.SpanID[:])
+	return span
+}
+
+// SetAttribute sets an attribute of the span. Values
+// should be strings, integers, floats or booleans.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]interface{})
+	}
+	s.Attributes[key] = value
+}
+
+// SetStatus records the response status of the span's request,
+// marking the span as failed for server errors.
+func (s *Span) SetStatus(status int) {
+	if s == nil || status == 0 {
+		return
+	}
+	s.SetAttribute("http.response.status_code", status)
+	if status >= 500 {
+		s.SetError(http.StatusText(status))
+	}
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.Error = true
+	s.Message = message
+}
+
+// Finish ends the span and exports it if it is sampled.
+// Only the first call has an effect.
+func (s *Span) Finish() {
+	if s == nil || !atomic.CompareAndSwapInt32(&s.ended, 0, 1) {
+		return
+	}
+	s.End = time.Now()
+	if s.Sampled && s.tracer != nil && s.tracer.Exporter != nil {
+		s.tracer.Exporter.ExportSpan(s)
+	}
+}
+
+// TraceIDString returns the hex-encoded trace ID.
+func (s *Span) TraceIDString() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.TraceID[:])
+}
+
+// SpanIDString returns the hex-encoded span ID.
+func (s *Span) SpanIDString() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.SpanID[:])
+}
+
+// TraceParent returns the W3C traceparent header value
+// which makes the span the parent of a remote span.
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	flags := "00"
+	if s.Sampled {
+		flags = "01"
+	}
+	return "00-" + s.TraceIDString() + "-" + s.SpanIDString() + "-" + flags
+}
+
+// Inject sets the traceparent and tracestate headers in h,
+// so that the receiver of a request continues the trace.
+func (s *Span) Inject(h http.Header) {
+	if s == nil {
+		return
+	}
+	h.Set("Traceparent", s.TraceParent())
+	if s.TraceState != "" {
+		h.Set("Tracestate", s.TraceState)
+	} else {
+		h.Del("Tracestate")
+	}
+}
+
+// parseTraceParent parses a W3C traceparent header value.
+func parseTraceParent(value string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	// version 00 has exactly four fields; later versions may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return
+	}
+	var version, flags [1]byte
+	if _, err := hex.Decode(version[:], []byte(parts[0])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return
+	}
+	// only lowercase hex is valid
+	if strings.ToLower(value) != value {
+		return
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
@@ -0,0 +1,210 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tmpim/casket/caskettls"
+)
+
+type spanRecorder struct {
+	spans []*Span
+}
+
+func (sr *spanRecorder) ExportSpan(span *Span) {
+	sr.spans = append(sr.spans, span)
+}
+
+func TestParseTraceParent(t *testing.T) {
+	for i, test := range []struct {
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	} {
+		traceID, parentID, sampled, ok := parseTraceParent(test.value)
+		if ok != test.ok {
+			t.Errorf("Test %d: expected ok=%v, got %v", i, test.ok, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if sampled != test.sampled {
+			t.Errorf("Test %d: expected sampled=%v, got %v", i, test.sampled, sampled)
+		}
+		span := &Span{TraceID: traceID, SpanID: parentID, Sampled: sampled}
+		if got, want := span.TraceParent()[3:], test.value[3:55]; got != want {
+			t.Errorf("Test %d: expected IDs %s, got %s", i, want, got)
+		}
+	}
+}
+
+func TestTracerSample(t *testing.T) {
+	var low, high [16]byte
+	high[8] = 0xff
+	for i, test := range []struct {
+		ratio   float64
+		traceID [16]byte
+		expect  bool
+	}{
+		{1, high, true},
+		{0, low, false},
+		{0.5, low, true},
+		{0.5, high, false},
+	} {
+		tracer := &Tracer{SampleRatio: test.ratio}
+		if got := tracer.sample(test.traceID); got != test.expect {
+			t.Errorf("Test %d: expected %v, got %v", i, test.expect, got)
+		}
+	}
+}
+
+func TestSpans(t *testing.T) {
+	exporter := new(spanRecorder)
+	tracer := &Tracer{Exporter: exporter, SampleRatio: 0}
+
+	req := httptest.NewRequest("GET", "/foo", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("Tracestate", "vendor=value")
+	req, server := tracer.StartServerSpan(req)
+
+	if got, want := server.TraceIDString(), "4bf92f3577b34da6a3ce929d0e0e4736"; got != want {
+		t.Errorf("Expected server span to continue trace %s, got %s", want, got)
+	}
+	if !server.Sampled {
+		t.Error("Expected server span to keep the sampling decision of its parent")
+	}
+	if SpanFromContext(req.Context()) != server {
+		t.Error("Expected server span in request context")
+	}
+
+	client := StartSpan(req.Context(), "backend", SpanKindClient)
+	if client.TraceID != server.TraceID || client.ParentSpanID != server.SpanID {
+		t.Errorf("Expected client span to be a child of the server span")
+	}
+	h := make(http.Header)
+	client.Inject(h)
+	if got, want := h.Get("Traceparent"), "00-"+server.TraceIDString()+"-"+client.SpanIDString()+"-01"; got != want {
+		t.Errorf("Expected traceparent %s, got %s", want, got)
+	}
+	if got := h.Get("Tracestate"); got != "vendor=value" {
+		t.Errorf("Expected tracestate to be propagated, got '%s'", got)
+	}
+
+	client.SetStatus(http.StatusBadGateway)
+	client.Finish()
+	client.Finish()
+	server.Finish()
+	if len(exporter.spans) != 2 {
+		t.Fatalf("Expected 2 exported spans, got %d", len(exporter.spans))
+	}
+	if !exporter.spans[0].Error {
+		t.Error("Expected span with status 502 to be an error")
+	}
+
+	// without a span in the context, tracing is disabled
+	var span *Span = StartSpan(context.Background(), "backend", SpanKindClient)
+	if span != nil {
+		t.Fatal("Expected no span without a parent")
+	}
+	span.SetStatus(http.StatusOK)
+	span.Inject(h)
+	span.Finish()
+}
+
+func TestServeTraced(t *testing.T) {
+	exporter := new(spanRecorder)
+	site := &SiteConfig{
+		Addr:   Address{Original: "localhost:2015", Host: "localhost", Port: "2015"},
+		TLS:    new(caskettls.Config),
+		Tracer: &Tracer{Exporter: exporter, SampleRatio: 1},
+	}
+	var traceID, spanID string
+	site.AddMiddleware(func(next Handler) Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			repl := r.Context().Value(ReplacerCtxKey).(Replacer)
+			traceID = repl.Replace("{trace_id}")
+			spanID = NewReplacer(r, nil, "").Replace("{span_id}")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return 0, nil
+		})
+	})
+	s, err := NewServer("localhost:2015", []*SiteConfig{site})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost:2015/", nil)
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(exporter.spans) != 1 {
+		t.Fatalf("Expected 1 exported span, got %d", len(exporter.spans))
+	}
+	span := exporter.spans[0]
+	if traceID != span.TraceIDString() || spanID != span.SpanIDString() {
+		t.Errorf("Expected placeholders %s/%s, got %s/%s", span.TraceIDString(), span.SpanIDString(), traceID, spanID)
+	}
+	if got := span.Attributes["http.response.status_code"]; got != http.StatusServiceUnavailable {
+		t.Errorf("Expected status attribute 503, got %v", got)
+	}
+	if !span.Error {
+		t.Error("Expected span to be an error")
+	}
+}
+
+func TestServeTracedHandlerError(t *testing.T) {
+	exporter := new(spanRecorder)
+	site := &SiteConfig{
+		Addr:   Address{Original: "localhost:2015", Host: "localhost", Port: "2015"},
+		TLS:    new(caskettls.Config),
+		Tracer: &Tracer{Exporter: exporter, SampleRatio: 1},
+	}
+	site.AddMiddleware(func(next Handler) Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusForbidden, errors.New("not allowed")
+		})
+	})
+	s, err := NewServer("localhost:2015", []*SiteConfig{site})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost:2015/", nil)
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(exporter.spans) != 1 {
+		t.Fatalf("Expected 1 exported span, got %d", len(exporter.spans))
+	}
+	if span := exporter.spans[0]; !span.Error || span.Message != "not allowed" {
+		t.Errorf("Expected the handler error to be recorded, got %v %q", span.Error, span.Message)
+	}
+}
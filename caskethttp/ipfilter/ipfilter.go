@@ -0,0 +1,199 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ipfilter implements allowing or blocking
+// requests by the IP address of the client.
+package ipfilter
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+// reloadInterval is how often a list file is checked for changes.
+var reloadInterval = time.Second
+
+// IPFilter is middleware that allows or blocks requests
+// depending on the IP address of the client.
+type IPFilter struct {
+	Next  httpserver.Handler
+	Rules []*Rule
+}
+
+// Rule filters the requests to a set of paths.
+type Rule struct {
+	// Paths are the paths the rule applies to.
+	Paths []string
+
+	// Allow makes the rule allow only the listed networks,
+	// instead of blocking them.
+	Allow bool
+
+	// Networks lists the networks to allow or block.
+	Networks []*net.IPNet
+
+	// List is a file of more networks, which is reloaded
+	// when it changes.
+	List *ListFile
+
+	// Status is the status code of the response to
+	// blocked requests.
+	Status int
+
+	// Rewrite is the path blocked requests are rewritten
+	// to, if any, instead of being responded to with Status.
+	// It must not be a path protected by the internal
+	// directive, which runs after ipfilter and so answers
+	// the rewritten request with 404 Not Found.
+	Rewrite string
+
+	// TrustedProxies lists the proxies that are trusted to
+	// tell the address of the client in ClientIPHeader.
+	TrustedProxies []*net.IPNet
+	ClientIPHeader string
+}
+
+// listed returns true if ip is in the networks of r.
+func (r *Rule) listed(ip net.IP) bool {
+	if httpserver.NetworksContain(r.Networks, ip) {
+		return true
+	}
+	return r.List != nil && httpserver.NetworksContain(r.List.Networks(), ip)
+}
+
+// blocks returns true if r blocks the request.
+func (r *Rule) blocks(req *http.Request) bool {
+	ip := httpserver.ClientIP(req, r.TrustedProxies, r.ClientIPHeader)
+	if ip == nil {
+		// if we can't tell, only let it through block lists
+		return r.Allow
+	}
+	return r.listed(ip) != r.Allow
+}
+
+// match returns the rule with the longest path matching r,
+// or nil if none does.
+func (f IPFilter) match(r *http.Request) *Rule {
+	i := httpserver.Path(r.URL.Path).LongestMatch(len(f.Rules), func(i int) []string {
+		return f.Rules[i].Paths
+	})
+	if i < 0 {
+		return nil
+	}
+	return f.Rules[i]
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (f IPFilter) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	rule := f.match(r)
+	if rule == nil || !rule.blocks(r) {
+		return f.Next.ServeHTTP(w, r)
+	}
+
+	if rule.Rewrite != "" {
+		r.URL.Path = rule.Rewrite
+		return f.Next.ServeHTTP(w, r)
+	}
+	return rule.Status, nil
+}
+
+// ListFile is a file listing networks, one per line. Blank lines
+// and lines starting with # are ignored. The file is checked for
+// changes at most once every second, and reloaded if it changed.
+type ListFile struct {
+	Path string
+
+	mu       sync.Mutex
+	networks []*net.IPNet
+	info     os.FileInfo
+	checked  time.Time
+}
+
+// NewListFile loads the list of networks in the file at path.
+func NewListFile(path string) (*ListFile, error) {
+	l := &ListFile{Path: path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.load(info); err != nil {
+		return nil, err
+	}
+	l.checked = time.Now()
+	return l, nil
+}
+
+// Networks returns the networks in the file, reloading
+// it first if it changed.
+func (l *ListFile) Networks() []*net.IPNet {
+	l.mu.Lock()
+	if time.Since(l.checked) >= reloadInterval {
+		l.checked = time.Now()
+		if info, err := os.Stat(l.Path); err != nil {
+			log.Printf("[ERROR] ipfilter: %v", err)
+		} else if fileChanged(info, l.info) {
+			if err := l.load(info); err != nil {
+				// keep filtering with the last good list
+				log.Printf("[ERROR] ipfilter: Reloading %s: %v", l.Path, err)
+			}
+		}
+	}
+	networks := l.networks
+	l.mu.Unlock()
+	return networks
+}
+
+// load reads the file, which was stat'ed as info.
+func (l *ListFile) load(info os.FileInfo) error {
+	file, err := os.Open(l.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var values []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		values = append(values, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	networks, err := httpserver.ParseNetworks(values)
+	if err != nil {
+		return fmt.Errorf("%s: %v", l.Path, err)
+	}
+
+	l.networks, l.info = networks, info
+	return nil
+}
+
+func fileChanged(new, old os.FileInfo) bool {
+	return old == nil ||
+		new.Size() != old.Size() ||
+		new.ModTime() != old.ModTime()
+}
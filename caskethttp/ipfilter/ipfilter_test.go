@@ -0,0 +1,164 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipfilter
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+	"github.com/tmpim/casket/caskethttp/internalsrv"
+)
+
+func TestIPFilter(t *testing.T) {
+	rules, err := ipFilterParse(casket.NewTestController("http", `
+	ipfilter / {
+		rule block
+		ip 1.2.3.0/24
+		trusted_proxies 10.0.0.0/8
+	}
+	ipfilter /admin {
+		rule allow
+		ip 192.168.0.0/16 ::1
+		status 404
+	}
+	ipfilter /api {
+		rule block
+		ip 5.6.7.8
+		rewrite /blocked.html
+	}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var servedPath string
+	f := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			servedPath = r.URL.Path
+			return http.StatusOK, nil
+		}),
+		Rules: rules,
+	}
+
+	for i, test := range []struct {
+		path, remote, forwarded string
+		expectedStatus          int
+		expectedPath            string
+	}{
+		{"/", "9.9.9.9:1234", "", http.StatusOK, "/"},
+		{"/", "1.2.3.4:1234", "", http.StatusForbidden, ""},
+		{"/", "10.0.0.1:1234", "1.2.3.4", http.StatusForbidden, ""},
+		{"/", "10.0.0.1:1234", "9.9.9.9", http.StatusOK, "/"},
+		{"/", "9.9.9.9:1234", "1.2.3.4", http.StatusOK, "/"},       // untrusted proxy
+		{"/", "1.2.3.4:1234", "9.9.9.9", http.StatusForbidden, ""}, // untrusted proxy
+		{"/admin/users", "192.168.1.1:1234", "", http.StatusOK, "/admin/users"},
+		{"/admin/users", "[::1]:1234", "", http.StatusOK, "/admin/users"},
+		{"/admin/users", "9.9.9.9:1234", "", http.StatusNotFound, ""},
+		{"/admin/users", "garbage", "", http.StatusNotFound, ""},
+		{"/api/items", "5.6.7.8:1234", "", http.StatusOK, "/blocked.html"},
+		{"/api/items", "1.2.3.4:1234", "", http.StatusOK, "/api/items"}, // most specific rule only
+	} {
+		servedPath = ""
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		status, err := f.ServeHTTP(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		if status != test.expectedStatus {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expectedStatus, status)
+		}
+		if servedPath != test.expectedPath {
+			t.Errorf("Test %d: Expected %q to be served, got %q", i, test.expectedPath, servedPath)
+		}
+	}
+}
+
+func TestIPFilterRewriteInternal(t *testing.T) {
+	rules, err := ipFilterParse(casket.NewTestController("http", `
+	ipfilter / {
+		rule block
+		ip 1.2.3.4
+		rewrite /internal/blocked.html
+	}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// internal runs after ipfilter, so rewriting
+	// to an internal path can't serve the page
+	f := IPFilter{
+		Next: internalsrv.Internal{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Paths: []string{"/internal"},
+		},
+		Rules: rules,
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "1.2.3.4:1234"
+	if status, _ := f.ServeHTTP(httptest.NewRecorder(), r); status != http.StatusNotFound {
+		t.Errorf("Expected an internal rewrite to be answered with %d, got %d", http.StatusNotFound, status)
+	}
+}
+
+func TestListFileReload(t *testing.T) {
+	reloadInterval = 0
+	defer func() { reloadInterval = time.Second }()
+
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "list")
+	if err := ioutil.WriteFile(path, []byte("1.2.3.4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := NewListFile(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	rule := &Rule{List: list}
+	if !rule.listed(net.ParseIP("1.2.3.4")) || rule.listed(net.ParseIP("5.6.7.8")) {
+		t.Fatal("Expected only 1.2.3.4 to be listed")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("1.2.3.4\n5.6.7.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !rule.listed(net.ParseIP("5.6.7.8")) {
+		t.Error("Expected list to be reloaded after it changed")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("bogus entry\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !rule.listed(net.ParseIP("5.6.7.8")) {
+		t.Error("Expected last good list to be kept when the file is invalid")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipfilter
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func init() {
+	casket.RegisterPlugin("ipfilter", casket.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new IPFilter middleware instance.
+func setup(c *casket.Controller) error {
+	rules, err := ipFilterParse(c)
+	if err != nil {
+		return err
+	}
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return IPFilter{Next: next, Rules: rules}
+	})
+	return nil
+}
+
+func ipFilterParse(c *casket.Controller) ([]*Rule, error) {
+	var rules []*Rule
+
+	for c.Next() {
+		rule := &Rule{
+			Paths:          c.RemainingArgs(),
+			Status:         http.StatusForbidden,
+			ClientIPHeader: "X-Forwarded-For",
+		}
+		if len(rule.Paths) == 0 {
+			rule.Paths = []string{"/"}
+		}
+
+		var hasRule bool
+		for c.NextBlock() {
+			switch c.Val() {
+			case "rule":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case "allow":
+					rule.Allow = true
+				case "block":
+					rule.Allow = false
+				default:
+					return nil, c.Errf("rule must be allow or block, got: %s", c.Val())
+				}
+				hasRule = true
+			case "ip":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				networks, err := httpserver.ParseNetworks(args)
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				rule.Networks = append(rule.Networks, networks...)
+			case "ip_file":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				// relative to the Casketfile rather than the site
+				// root, so that the list isn't served with the site
+				path := c.Val()
+				if !filepath.IsAbs(path) {
+					path = filepath.Join(filepath.Dir(c.File()), path)
+				}
+				list, err := NewListFile(path)
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				rule.List = list
+			case "status":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				status, err := strconv.Atoi(c.Val())
+				if err != nil || status < 400 || status > 599 {
+					return nil, c.Errf("invalid status: %s", c.Val())
+				}
+				rule.Status = status
+			case "rewrite":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				rule.Rewrite = c.Val()
+			case "trusted_proxies":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				networks, err := httpserver.ParseNetworks(args)
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				rule.TrustedProxies = append(rule.TrustedProxies, networks...)
+			case "client_ip_header":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				rule.ClientIPHeader = c.Val()
+			default:
+				return nil, c.Errf("unknown subdirective: %s", c.Val())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+		}
+
+		if !hasRule {
+			return nil, c.Err("ipfilter needs a rule (allow or block)")
+		}
+		if len(rule.Networks) == 0 && rule.List == nil {
+			return nil, c.Err("ipfilter needs an ip or ip_file to filter by")
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
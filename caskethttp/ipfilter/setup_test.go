@@ -0,0 +1,183 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipfilter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/casketfile"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := casket.NewTestController("http", `ipfilter / {
+		rule block
+		ip 10.0.0.0/8
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(IPFilter)
+	if !ok {
+		t.Fatalf("Expected handler to be type IPFilter, got: %#v", handler)
+	}
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+}
+
+func TestIPFilterParse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listPath := filepath.Join(dir, "list")
+	if err := ioutil.WriteFile(listPath, []byte("# office\n192.168.0.0/16\n\n10.1.1.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	badListPath := filepath.Join(dir, "bad")
+	if err := ioutil.WriteFile(badListPath, []byte("not-an-ip\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  []Rule
+	}{
+		{`ipfilter {
+			rule block
+			ip 10.0.0.0/8 1.2.3.4
+		}`, false, []Rule{
+			{Paths: []string{"/"}, Status: 403, ClientIPHeader: "X-Forwarded-For"},
+		}},
+		{`ipfilter /admin /private {
+			rule allow
+			ip_file ` + listPath + `
+			status 404
+			trusted_proxies 172.16.0.0/12
+			client_ip_header X-Real-IP
+		}
+		ipfilter /api {
+			rule block
+			ip 1.2.3.4
+			rewrite /blocked.html
+		}`, false, []Rule{
+			{Paths: []string{"/admin", "/private"}, Allow: true, Status: 404, ClientIPHeader: "X-Real-IP"},
+			{Paths: []string{"/api"}, Status: 403, Rewrite: "/blocked.html", ClientIPHeader: "X-Forwarded-For"},
+		}},
+		{`ipfilter`, true, nil},
+		{`ipfilter {
+			ip 1.2.3.4
+		}`, true, nil},
+		{`ipfilter {
+			rule allow
+		}`, true, nil},
+		{`ipfilter {
+			rule maybe
+			ip 1.2.3.4
+		}`, true, nil},
+		{`ipfilter {
+			rule block
+			ip 1.2.3.400
+		}`, true, nil},
+		{`ipfilter {
+			rule block
+			ip_file ` + filepath.Join(dir, "missing") + `
+		}`, true, nil},
+		{`ipfilter {
+			rule block
+			ip_file ` + badListPath + `
+		}`, true, nil},
+		{`ipfilter {
+			rule block
+			ip 1.2.3.4
+			status 200
+		}`, true, nil},
+		{`ipfilter {
+			rule block
+			ip 1.2.3.4
+			rewrite /a /b
+		}`, true, nil},
+		{`ipfilter {
+			rule block
+			ip 1.2.3.4
+			unknown
+		}`, true, nil},
+	}
+
+	for i, test := range tests {
+		actual, err := ipFilterParse(casket.NewTestController("http", test.input))
+
+		if err == nil && test.shouldErr {
+			t.Errorf("Test %d didn't error, but it should have", i)
+		} else if err != nil && !test.shouldErr {
+			t.Errorf("Test %d errored, but it shouldn't have; got '%v'", i, err)
+		}
+		if len(actual) != len(test.expected) {
+			t.Fatalf("Test %d expected %d rules, but got %d", i, len(test.expected), len(actual))
+		}
+
+		for j, rule := range actual {
+			expected := test.expected[j]
+			if rule.Allow != expected.Allow || rule.Status != expected.Status ||
+				rule.Rewrite != expected.Rewrite || rule.ClientIPHeader != expected.ClientIPHeader {
+				t.Errorf("Test %d, rule %d: Expected %+v, got %+v", i, j, expected, rule)
+			}
+			if len(rule.Paths) != len(expected.Paths) {
+				t.Errorf("Test %d, rule %d: Expected paths %v, got %v", i, j, expected.Paths, rule.Paths)
+			}
+		}
+	}
+}
+
+func TestIPFilterParseRelativeListFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "list"), []byte("10.0.0.0/8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	input := `ipfilter {
+		rule block
+		ip_file list
+	}`
+	c := casket.NewTestController("http", input)
+	c.Dispenser = casketfile.NewDispenser(filepath.Join(dir, "Casketfile"), strings.NewReader(input))
+	httpserver.GetConfig(c).Root = filepath.Join(dir, "www")
+
+	rules, err := ipFilterParse(c)
+	if err != nil {
+		t.Fatalf("Expected the list next to the Casketfile to be loaded, got %v", err)
+	}
+	if expected := filepath.Join(dir, "list"); rules[0].List.Path != expected {
+		t.Errorf("Expected list path %s, got %s", expected, rules[0].List.Path)
+	}
+}
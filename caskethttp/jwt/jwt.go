@@ -0,0 +1,257 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jwt implements authenticating requests with JSON Web Tokens.
+package jwt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+// now is the clock tokens are validated with; tests replace it.
+var now = time.Now
+
+// JWT is middleware that requires requests to carry a valid token,
+// and makes its claims available as {jwt.<claim>} placeholders.
+type JWT struct {
+	Next  httpserver.Handler
+	Rules []*Rule
+}
+
+// Rule protects a set of paths.
+type Rule struct {
+	// Paths are the protected paths, and Except the
+	// paths in them that are not protected.
+	Paths  []string
+	Except []string
+
+	// Sources are where the token is looked for, in order.
+	Sources []TokenSource
+
+	// Validator validates the tokens.
+	Validator Validator
+
+	// Allow and Deny are claim rules. If there are Allow rules,
+	// one of them must match the claims; no Deny rule may match.
+	Allow []ClaimRule
+	Deny  []ClaimRule
+}
+
+// TokenSource tells where a token is in a request.
+type TokenSource struct {
+	// Header is the name of a header with a bearer token.
+	Header string
+
+	// Cookie is the name of a cookie with the token.
+	Cookie string
+}
+
+// token returns the token in r from s, if any.
+func (s TokenSource) token(r *http.Request) string {
+	if s.Cookie != "" {
+		if cookie, err := r.Cookie(s.Cookie); err == nil {
+			return cookie.Value
+		}
+		return ""
+	}
+	value := r.Header.Get(s.Header)
+	if len(value) > 7 && strings.EqualFold(value[:7], "Bearer ") {
+		return strings.TrimSpace(value[7:])
+	}
+	return ""
+}
+
+// ClaimRule matches claims whose Claim has one of Values. If the
+// claim is an array, it matches if any of its elements does.
+type ClaimRule struct {
+	Claim  string
+	Values []string
+}
+
+// matches returns true if r matches claims.
+func (r ClaimRule) matches(claims Claims) bool {
+	value, ok := claims.lookup(r.Claim)
+	if !ok {
+		return false
+	}
+	values := []interface{}{value}
+	if array, ok := value.([]interface{}); ok {
+		values = array
+	}
+	for _, v := range values {
+		if contains(r.Values, claimString(v)) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizes returns true if the claim rules of r let claims through.
+func (r *Rule) authorizes(claims Claims) bool {
+	for _, deny := range r.Deny {
+		if deny.matches(claims) {
+			return false
+		}
+	}
+	if len(r.Allow) == 0 {
+		return true
+	}
+	for _, allow := range r.Allow {
+		if allow.matches(claims) {
+			return true
+		}
+	}
+	return false
+}
+
+// protects returns true if r protects path.
+func (r *Rule) protects(path string) bool {
+	for _, except := range r.Except {
+		if httpserver.Path(path).Matches(except) {
+			return false
+		}
+	}
+	for _, p := range r.Paths {
+		if httpserver.Path(path).Matches(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the rule protecting the longest path
+// matching r, or nil if none does.
+func (j JWT) match(r *http.Request) *Rule {
+	i := httpserver.Path(r.URL.Path).LongestMatch(len(j.Rules), func(i int) []string {
+		if !j.Rules[i].protects(r.URL.Path) {
+			return nil
+		}
+		return j.Rules[i].Paths
+	})
+	if i < 0 {
+		return nil
+	}
+	return j.Rules[i]
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (j JWT) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	// CORS preflight requests, which browsers send without
+	// credentials, are answered by the cors directive before this
+	rule := j.match(r)
+	if rule == nil {
+		return j.Next.ServeHTTP(w, r)
+	}
+
+	var token string
+	for _, source := range rule.Sources {
+		if token = source.token(r); token != "" {
+			break
+		}
+	}
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+		return http.StatusUnauthorized, nil
+	}
+
+	claims, err := rule.Validator.Validate(token, now())
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return http.StatusUnauthorized, fmt.Errorf("jwt: %v", err)
+	}
+	if !rule.authorizes(claims) {
+		return http.StatusForbidden, nil
+	}
+
+	// make the claims available to later middleware,
+	// like proxy headers and logs
+	repl := httpserver.NewReplacer(r, nil, "")
+	claims.each(func(name string, value interface{}) {
+		repl.Set("jwt."+name, claimString(value))
+	})
+
+	return j.Next.ServeHTTP(w, r)
+}
+
+// lookup returns the claim at path, where the
+// names of nested claims are separated by dots.
+func (c Claims) lookup(path string) (interface{}, bool) {
+	var value interface{} = map[string]interface{}(c)
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// each calls f with each claim in c, including the
+// claims nested in objects, which are named by their
+// path like lookup expects.
+func (c Claims) each(f func(name string, value interface{})) {
+	var walk func(prefix string, object map[string]interface{})
+	walk = func(prefix string, object map[string]interface{}) {
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			f(prefix+name, object[name])
+			if nested, ok := object[name].(map[string]interface{}); ok {
+				walk(prefix+name+".", nested)
+			}
+		}
+	}
+	walk("", c)
+}
+
+// claimString formats a claim value as a placeholder value:
+// strings and numbers as they are, arrays as comma-separated
+// lists and objects as JSON.
+func claimString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = claimString(item)
+		}
+		return strings.Join(items, ",")
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwt
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestJWT(t *testing.T) {
+	keys := newTestKeys(t)
+	start := time.Unix(1600000000, 0)
+	now = func() time.Time { return start }
+	defer func() { now = time.Now }()
+
+	rules, err := jwtParse(casket.NewTestController("http", `
+	jwt /api {
+		secret s3cr3t
+		except /api/public
+		deny role banned
+	}
+	jwt /api/admin {
+		secret s3cr3t
+		allow role admin
+		allow groups ops
+	}
+	jwt /app {
+		secret s3cr3t
+		token_source cookie session
+		token_source header
+	}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var placeholders string
+	j := JWT{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			placeholders = httpserver.NewReplacer(r, nil, "-").Replace("{jwt.sub} {jwt.role} {jwt.groups} {jwt.org.name} {jwt.missing}")
+			return http.StatusOK, nil
+		}),
+		Rules: rules,
+	}
+
+	user := keys.sign(t, HS256, "", map[string]interface{}{"sub": "alice", "role": "user", "exp": start.Add(time.Hour).Unix()})
+	admin := keys.sign(t, HS256, "", map[string]interface{}{"sub": "bob", "role": "admin", "org": map[string]string{"name": "acme"}})
+	ops := keys.sign(t, HS256, "", map[string]interface{}{"sub": "carol", "groups": []string{"dev", "ops"}})
+	banned := keys.sign(t, HS256, "", map[string]interface{}{"sub": "mallory", "role": "banned"})
+	expired := keys.sign(t, HS256, "", map[string]interface{}{"sub": "alice", "exp": start.Add(-time.Hour).Unix()})
+	forged := (testKeys{secret: []byte("guess")}).sign(t, HS256, "", map[string]interface{}{"sub": "alice", "role": "admin"})
+
+	for i, test := range []struct {
+		method, path, authorization, cookie string
+		expectedStatus                      int
+		expectedPlaceholders                string
+	}{
+		{"GET", "/", "", "", http.StatusOK, "- - - - -"},
+		{"GET", "/api/items", "", "", http.StatusUnauthorized, ""},
+		{"GET", "/api/items", "Basic YWxpY2U6cHc=", "", http.StatusUnauthorized, ""},
+		{"GET", "/api/items", "Bearer " + user, "", http.StatusOK, "alice user - - -"},
+		{"GET", "/api/items", "bearer " + user, "", http.StatusOK, "alice user - - -"},
+		{"GET", "/api/items", "Bearer " + expired, "", http.StatusUnauthorized, ""},
+		{"GET", "/api/items", "Bearer " + forged, "", http.StatusUnauthorized, ""},
+		{"GET", "/api/items", "Bearer " + banned, "", http.StatusForbidden, ""},
+		{"GET", "/api/public/info", "", "", http.StatusOK, "- - - - -"},
+		{"OPTIONS", "/api/items", "", "", http.StatusUnauthorized, ""},
+		{"OPTIONS", "/api/items", "Bearer " + user, "", http.StatusOK, "alice user - - -"},
+		{"GET", "/api/admin/users", "Bearer " + user, "", http.StatusForbidden, ""},
+		{"GET", "/api/admin/users", "Bearer " + admin, "", http.StatusOK, "bob admin - acme -"},
+		{"GET", "/api/admin/users", "Bearer " + ops, "", http.StatusOK, "carol - dev,ops - -"},
+		{"GET", "/app/home", "", user, http.StatusOK, "alice user - - -"},
+		{"GET", "/app/home", "Bearer " + admin, "", http.StatusOK, "bob admin - acme -"},
+		{"GET", "/app/home", "Bearer " + user, "garbage", http.StatusUnauthorized, ""},
+	} {
+		placeholders = ""
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		if test.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "session", Value: test.cookie})
+		}
+		// the server sets up the replacer shared by the middleware of a request
+		r = r.WithContext(context.WithValue(r.Context(), httpserver.ReplacerCtxKey, httpserver.NewReplacer(r, nil, "")))
+
+		w := httptest.NewRecorder()
+		status, _ := j.ServeHTTP(w, r)
+		if status != test.expectedStatus {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expectedStatus, status)
+		}
+		if placeholders != test.expectedPlaceholders {
+			t.Errorf("Test %d: Expected placeholders %q, got %q", i, test.expectedPlaceholders, placeholders)
+		}
+		if status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Test %d: Expected WWW-Authenticate header", i)
+		}
+	}
+}
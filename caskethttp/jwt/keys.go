@@ -0,0 +1,259 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwt
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LoadKeyFile loads a key from a file. A PEM encoded public key or
+// certificate is loaded as key for RS256, ES256 or EdDSA; the contents
+// of any other file, without a trailing newline, as HS256 secret.
+func LoadKeyFile(path string) (Key, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Key{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		secret := bytes.TrimRight(data, "\r\n")
+		if len(secret) == 0 {
+			return Key{}, fmt.Errorf("%s: empty secret", path)
+		}
+		return Key{Key: secret}, nil
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return Key{}, fmt.Errorf("%s: unsupported PEM block type %s", path, block.Type)
+	}
+	if err != nil {
+		return Key{}, fmt.Errorf("%s: %v", path, err)
+	}
+	k := Key{Key: key}
+	if k.algorithm() == "" {
+		return Key{}, fmt.Errorf("%s: unsupported key type %T", path, key)
+	}
+	return k, nil
+}
+
+// Defaults for fetching JWKS.
+var (
+	// DefaultJWKSRefresh is how often a JWKS is fetched again.
+	DefaultJWKSRefresh = time.Hour
+
+	// jwksMinRefetch is how long to wait before fetching a
+	// JWKS again to look for a key that wasn't in it.
+	jwksMinRefetch = time.Minute
+)
+
+// JWKS is a JSON Web Key Set fetched from a URL. The keys are
+// cached and fetched again every Refresh, or earlier when a token
+// is signed by a key that is not in the cached set, as happens
+// after the keys are rotated.
+type JWKS struct {
+	URL     string
+	Refresh time.Duration
+	Client  *http.Client
+
+	mu       sync.Mutex
+	keys     []Key
+	err      error         // why the last fetch failed
+	fetched  time.Time     // when keys were fetched
+	tried    time.Time     // when fetching was last tried
+	fetching chan struct{} // closed when the fetch in progress is done
+}
+
+// Keys implements KeySource. Requests are not held up while
+// the keys are fetched, unless they need the fetched keys.
+func (j *JWKS) Keys(kid string) ([]Key, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	current := time.Now()
+	stale := j.fetched.IsZero() || current.Sub(j.fetched) >= j.refresh()
+	missing := kid != "" && len(matchKeys(j.keys, kid)) == 0
+	if (stale || missing) && j.fetching == nil && current.Sub(j.tried) >= jwksMinRefetch {
+		j.tried = current
+		done := make(chan struct{})
+		j.fetching = done
+
+		j.mu.Unlock()
+		keys, err := j.fetch()
+		j.mu.Lock()
+
+		j.fetching = nil
+		close(done)
+		if err != nil {
+			j.err = err
+			if !j.fetched.IsZero() {
+				// keep using the keys we have
+				log.Printf("[ERROR] jwt: %v", err)
+			}
+		} else {
+			j.keys, j.err, j.fetched = keys, nil, current
+		}
+	} else if j.fetching != nil && (j.fetched.IsZero() || missing) {
+		// wait for the keys another request is fetching
+		done := j.fetching
+		j.mu.Unlock()
+		<-done
+		j.mu.Lock()
+	}
+
+	if j.fetched.IsZero() {
+		return nil, j.err
+	}
+	return matchKeys(j.keys, kid), nil
+}
+
+func (j *JWKS) refresh() time.Duration {
+	if j.Refresh > 0 {
+		return j.Refresh
+	}
+	return DefaultJWKSRefresh
+}
+
+// fetch fetches the key set.
+func (j *JWKS) fetch() ([]Key, error) {
+	client := j.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Get(j.URL)
+	if err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching JWKS from %s: status %d", j.URL, resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decoding JWKS from %s: %v", j.URL, err)
+	}
+	var keys []Key
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.key()
+		if err != nil {
+			// skip keys we don't support
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS from %s has no supported signing keys", j.URL)
+	}
+	return keys, nil
+}
+
+// jwk is a JSON Web Key (RFC 7517).
+type jwk struct {
+	KeyType string `json:"kty"`
+	Use     string `json:"use"`
+	KeyID   string `json:"kid"`
+	Curve   string `json:"crv"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+	K       string `json:"k"`
+}
+
+// key returns the verification key of k.
+func (k jwk) key() (Key, error) {
+	key := Key{ID: k.KeyID}
+	switch {
+	case k.KeyType == "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return key, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return key, errors.New("invalid RSA exponent")
+		}
+		key.Key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case k.KeyType == "EC" && k.Curve == "P-256":
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return key, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return key, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return key, errors.New("EC point is not on the curve")
+		}
+		key.Key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	case k.KeyType == "OKP" && k.Curve == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return key, errors.New("invalid Ed25519 key")
+		}
+		key.Key = ed25519.PublicKey(x)
+	case k.KeyType == "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil || len(secret) == 0 {
+			return key, errors.New("invalid symmetric key")
+		}
+		key.Key = secret
+	default:
+		return key, fmt.Errorf("unsupported key type %s %s", k.KeyType, k.Curve)
+	}
+	return key, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwt
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadKeyFile(t *testing.T) {
+	keys := newTestKeys(t)
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	pkix := func(key interface{}) []byte {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	}
+
+	for i, test := range []struct {
+		path      string
+		shouldErr bool
+		expected  string
+	}{
+		{write("secret", []byte("s3cr3t\n")), false, HS256},
+		{write("rsa.pem", pkix(&keys.rsa.PublicKey)), false, RS256},
+		{write("rsa1.pem", pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&keys.rsa.PublicKey)})), false, RS256},
+		{write("ec.pem", pkix(&keys.ecdsa.PublicKey)), false, ES256},
+		{write("ed.pem", pkix(keys.ed25519Pub)), false, EdDSA},
+		{write("private.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("x")})), true, ""},
+		{write("bad.pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("x")})), true, ""},
+		{write("empty", []byte("\n")), true, ""},
+		{filepath.Join(dir, "missing"), true, ""},
+	} {
+		key, err := LoadKeyFile(test.path)
+		if err == nil && test.shouldErr {
+			t.Errorf("Test %d didn't error, but it should have", i)
+		} else if err != nil && !test.shouldErr {
+			t.Errorf("Test %d errored, but it shouldn't have; got '%v'", i, err)
+		}
+		if err == nil && key.algorithm() != test.expected {
+			t.Errorf("Test %d: Expected key for %s, got %s", i, test.expected, key.algorithm())
+		}
+	}
+
+	key, _ := LoadKeyFile(filepath.Join(dir, "secret"))
+	if string(key.Key.([]byte)) != "s3cr3t" {
+		t.Errorf("Expected secret without trailing newline, got %q", key.Key)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	first, second := newTestKeys(t), newTestKeys(t)
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	var mu sync.Mutex
+	var fetches int
+	set := []map[string]string{
+		{"kty": "RSA", "kid": "one", "n": b64(first.rsa.N.Bytes()), "e": b64(big.NewInt(int64(first.rsa.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(first.ecdsa.X.Bytes()), "y": b64(first.ecdsa.Y.Bytes())},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(first.ed25519Pub)},
+		{"kty": "oct", "kid": "hmac", "k": b64(first.secret)},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(second.rsa.N.Bytes()), "e": "AQAB"},
+		{"kty": "EC", "kid": "p384", "crv": "P-384", "x": "AA", "y": "AA"},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": set})
+	}))
+	defer srv.Close()
+
+	jwksMinRefetch = 0
+	defer func() { jwksMinRefetch = time.Minute }()
+
+	jwks := &JWKS{URL: srv.URL}
+	v := Validator{Sources: []KeySource{jwks}}
+	for _, test := range []struct{ alg, kid string }{{RS256, "one"}, {ES256, "ec"}, {EdDSA, "ed"}, {HS256, "hmac"}} {
+		if _, err := v.Validate(first.sign(t, test.alg, test.kid, map[string]interface{}{}), time.Now()); err != nil {
+			t.Errorf("%s: Expected token to verify with JWKS key %s, got %v", test.alg, test.kid, err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("Expected JWKS to be fetched once and cached, got %d fetches", fetches)
+	}
+	if _, err := v.Validate(second.sign(t, RS256, "enc", map[string]interface{}{}), time.Now()); err != ErrNoVerificationKey {
+		t.Errorf("Expected encryption key not to be used, got %v", err)
+	}
+
+	// rotate the keys
+	mu.Lock()
+	set = append(set, map[string]string{"kty": "RSA", "kid": "two", "n": b64(second.rsa.N.Bytes()), "e": b64(big.NewInt(int64(second.rsa.E)).Bytes())})
+	fetches = 0
+	mu.Unlock()
+	if _, err := v.Validate(second.sign(t, RS256, "two", map[string]interface{}{}), time.Now()); err != nil {
+		t.Errorf("Expected JWKS to be fetched again for a new key ID, got %v", err)
+	}
+	if fetches != 1 {
+		t.Errorf("Expected 1 more fetch, got %d", fetches)
+	}
+
+	// the cached keys are kept when fetching fails
+	srv.Close()
+	if _, err := v.Validate(first.sign(t, RS256, "one", map[string]interface{}{}), time.Now()); err != nil {
+		t.Errorf("Expected cached keys to be used, got %v", err)
+	}
+	if _, err := v.Validate(second.sign(t, RS256, "three", map[string]interface{}{}), time.Now()); err != ErrNoVerificationKey {
+		t.Errorf("Expected no key for unknown key ID, got %v", err)
+	}
+
+	if _, err := (&JWKS{URL: srv.URL}).Keys(""); err == nil {
+		t.Error("Expected an error when the key set was never fetched")
+	}
+}
+
+func TestJWKSFetchDoesNotBlock(t *testing.T) {
+	keys := newTestKeys(t)
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var fetches int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		n := fetches
+		mu.Unlock()
+		if n > 1 {
+			<-release
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "oct", "kid": "one", "k": b64(keys.secret)},
+		}})
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	jwksMinRefetch = 0
+	defer func() { jwksMinRefetch = time.Minute }()
+
+	jwks := &JWKS{URL: srv.URL}
+	if found, err := jwks.Keys("one"); err != nil || len(found) != 1 {
+		t.Fatalf("Expected 1 key, got %d and %v", len(found), err)
+	}
+
+	// look for an unknown key, which hangs on fetching
+	go jwks.Keys("two")
+	for {
+		mu.Lock()
+		n := fetches
+		mu.Unlock()
+		if n > 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if found, err := jwks.Keys("one"); err != nil || len(found) != 1 {
+			t.Errorf("Expected 1 key, got %d and %v", len(found), err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected cached keys while fetching, but Keys blocked")
+	}
+}
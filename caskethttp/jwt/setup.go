@@ -0,0 +1,189 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwt
+
+import (
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func init() {
+	casket.RegisterPlugin("jwt", casket.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new JWT middleware instance.
+func setup(c *casket.Controller) error {
+	rules, err := jwtParse(c)
+	if err != nil {
+		return err
+	}
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return JWT{Next: next, Rules: rules}
+	})
+	return nil
+}
+
+func jwtParse(c *casket.Controller) ([]*Rule, error) {
+	var rules []*Rule
+
+	for c.Next() {
+		rule := &Rule{Paths: c.RemainingArgs()}
+		var keys Keys
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "path":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				rule.Paths = append(rule.Paths, args...)
+			case "except":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				rule.Except = append(rule.Except, args...)
+			case "secret":
+				args := c.RemainingArgs()
+				if len(args) != 1 || args[0] == "" {
+					return nil, c.ArgErr()
+				}
+				keys = append(keys, Key{Key: []byte(args[0])})
+			case "key_file":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				// relative to the Casketfile rather than the site
+				// root, so that the key isn't served with the site
+				path := args[0]
+				if !filepath.IsAbs(path) {
+					path = filepath.Join(filepath.Dir(c.File()), path)
+				}
+				key, err := LoadKeyFile(path)
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				keys = append(keys, key)
+			case "jwks":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				// over plain HTTP, anyone on the path
+				// could swap in keys of their own
+				u, err := url.Parse(args[0])
+				if err != nil || u.Scheme != "https" || u.Host == "" {
+					return nil, c.Errf("invalid JWKS URL, must be https: %s", args[0])
+				}
+				jwks := &JWKS{URL: args[0]}
+				if len(args) == 2 {
+					refresh, err := time.ParseDuration(args[1])
+					if err != nil || refresh <= 0 {
+						return nil, c.Errf("invalid JWKS refresh interval: %s", args[1])
+					}
+					jwks.Refresh = refresh
+				}
+				rule.Validator.Sources = append(rule.Validator.Sources, jwks)
+			case "algorithms":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				for _, alg := range args {
+					switch alg {
+					case HS256, RS256, ES256, EdDSA:
+						rule.Validator.Algorithms = append(rule.Validator.Algorithms, alg)
+					default:
+						return nil, c.Errf("unsupported algorithm: %s", alg)
+					}
+				}
+			case "issuer":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				rule.Validator.Issuers = append(rule.Validator.Issuers, args...)
+			case "audience":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				rule.Validator.Audiences = append(rule.Validator.Audiences, args...)
+			case "leeway":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				leeway, err := time.ParseDuration(args[0])
+				if err != nil || leeway < 0 {
+					return nil, c.Errf("invalid leeway: %s", args[0])
+				}
+				rule.Validator.Leeway = leeway
+			case "token_source":
+				args := c.RemainingArgs()
+				switch {
+				case len(args) == 1 && args[0] == "header":
+					rule.Sources = append(rule.Sources, TokenSource{Header: "Authorization"})
+				case len(args) == 2 && args[0] == "header":
+					rule.Sources = append(rule.Sources, TokenSource{Header: args[1]})
+				case len(args) == 2 && args[0] == "cookie":
+					rule.Sources = append(rule.Sources, TokenSource{Cookie: args[1]})
+				default:
+					return nil, c.ArgErr()
+				}
+			case "allow", "deny":
+				kind := c.Val()
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return nil, c.ArgErr()
+				}
+				claimRule := ClaimRule{Claim: args[0], Values: args[1:]}
+				if kind == "allow" {
+					rule.Allow = append(rule.Allow, claimRule)
+				} else {
+					rule.Deny = append(rule.Deny, claimRule)
+				}
+			default:
+				return nil, c.Errf("unknown subdirective: %s", c.Val())
+			}
+		}
+
+		if len(keys) > 0 {
+			rule.Validator.Sources = append([]KeySource{keys}, rule.Validator.Sources...)
+		}
+		if len(rule.Validator.Sources) == 0 {
+			return nil, c.Err("jwt needs a secret, key_file or jwks to verify tokens with")
+		}
+		if len(rule.Paths) == 0 {
+			rule.Paths = []string{"/"}
+		}
+		if len(rule.Sources) == 0 {
+			rule.Sources = []TokenSource{{Header: "Authorization"}}
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
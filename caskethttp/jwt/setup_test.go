@@ -0,0 +1,194 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/casketfile"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := casket.NewTestController("http", `jwt {
+		secret s3cr3t
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(JWT)
+	if !ok {
+		t.Fatalf("Expected handler to be type JWT, got: %#v", handler)
+	}
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+}
+
+func TestJWTParse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretPath := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secretPath, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input           string
+		shouldErr       bool
+		expected        []Rule
+		expectedSources []int // key sources per rule
+	}{
+		{`jwt {
+			secret s3cr3t
+		}`, false, []Rule{
+			{Paths: []string{"/"}, Sources: []TokenSource{{Header: "Authorization"}}},
+		}, []int{1}},
+		{`jwt /api /admin {
+			path /internal
+			except /api/public
+			key_file ` + secretPath + `
+			jwks https://idp.test/.well-known/jwks.json 10m
+			algorithms RS256 ES256
+			issuer https://idp.test
+			audience api web
+			leeway 30s
+			token_source cookie token
+			token_source header X-Token
+			allow role admin editor
+			deny sub mallory
+		}
+		jwt /other {
+			secret s3cr3t
+			secret 0th3r
+		}`, false, []Rule{
+			{
+				Paths:   []string{"/api", "/admin", "/internal"},
+				Except:  []string{"/api/public"},
+				Sources: []TokenSource{{Cookie: "token"}, {Header: "X-Token"}},
+				Validator: Validator{
+					Algorithms: []string{RS256, ES256},
+					Issuers:    []string{"https://idp.test"},
+					Audiences:  []string{"api", "web"},
+					Leeway:     30 * time.Second,
+				},
+				Allow: []ClaimRule{{Claim: "role", Values: []string{"admin", "editor"}}},
+				Deny:  []ClaimRule{{Claim: "sub", Values: []string{"mallory"}}},
+			},
+			{Paths: []string{"/other"}, Sources: []TokenSource{{Header: "Authorization"}}},
+		}, []int{2, 1}},
+		{`jwt`, true, nil, nil},
+		{`jwt /api {
+			issuer https://idp.test
+		}`, true, nil, nil},
+		{`jwt {
+			key_file ` + filepath.Join(dir, "missing") + `
+		}`, true, nil, nil},
+		{`jwt {
+			jwks ftp://idp.test/keys
+		}`, true, nil, nil},
+		{`jwt {
+			jwks http://idp.test/keys
+		}`, true, nil, nil},
+		{`jwt {
+			jwks https://idp.test/keys never
+		}`, true, nil, nil},
+		{`jwt {
+			secret s3cr3t
+			algorithms none
+		}`, true, nil, nil},
+		{`jwt {
+			secret s3cr3t
+			leeway -1s
+		}`, true, nil, nil},
+		{`jwt {
+			secret s3cr3t
+			token_source query token
+		}`, true, nil, nil},
+		{`jwt {
+			secret s3cr3t
+			allow role
+		}`, true, nil, nil},
+		{`jwt {
+			secret
+		}`, true, nil, nil},
+		{`jwt {
+			secret s3cr3t
+			redirect /login
+		}`, true, nil, nil},
+	}
+
+	for i, test := range tests {
+		actual, err := jwtParse(casket.NewTestController("http", test.input))
+
+		if err == nil && test.shouldErr {
+			t.Errorf("Test %d didn't error, but it should have", i)
+		} else if err != nil && !test.shouldErr {
+			t.Errorf("Test %d errored, but it shouldn't have; got '%v'", i, err)
+		}
+		if len(actual) != len(test.expected) {
+			t.Fatalf("Test %d expected %d rules, but got %d", i, len(test.expected), len(actual))
+		}
+
+		for j, rule := range actual {
+			if len(rule.Validator.Sources) != test.expectedSources[j] {
+				t.Errorf("Test %d, rule %d: Expected %d key sources, got %d", i, j, test.expectedSources[j], len(rule.Validator.Sources))
+			}
+			got := *rule
+			got.Validator.Sources = nil
+			if !reflect.DeepEqual(got, test.expected[j]) {
+				t.Errorf("Test %d, rule %d: Expected %+v, got %+v", i, j, test.expected[j], got)
+			}
+		}
+	}
+}
+
+func TestJWTParseRelativeKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	input := `jwt {
+		key_file secret
+	}`
+	c := casket.NewTestController("http", input)
+	c.Dispenser = casketfile.NewDispenser(filepath.Join(dir, "Casketfile"), strings.NewReader(input))
+	httpserver.GetConfig(c).Root = filepath.Join(dir, "www")
+
+	if _, err := jwtParse(c); err != nil {
+		t.Errorf("Expected the key next to the Casketfile to be loaded, got %v", err)
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Algorithms that tokens can be signed with.
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+// Errors returned when a token is not valid.
+var (
+	ErrMalformed         = errors.New("malformed token")
+	ErrAlgorithm         = errors.New("algorithm not allowed")
+	ErrSignature         = errors.New("invalid signature")
+	ErrExpired           = errors.New("token is expired")
+	ErrNotValidYet       = errors.New("token is not valid yet")
+	ErrInvalidIssuer     = errors.New("invalid issuer")
+	ErrInvalidAudience   = errors.New("invalid audience")
+	ErrNoVerificationKey = errors.New("no key to verify the token with")
+)
+
+// Claims are the claims of a token.
+type Claims map[string]interface{}
+
+// header is the JOSE header of a token.
+type header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// Key is a key that verifies the signature of tokens.
+type Key struct {
+	// ID matches the kid header of the tokens
+	// it signed, if it is not empty.
+	ID string
+
+	// Key is a []byte for HS256, *rsa.PublicKey for RS256,
+	// *ecdsa.PublicKey on the P-256 curve for ES256 or
+	// ed25519.PublicKey for EdDSA.
+	Key interface{}
+}
+
+// algorithm returns the algorithm k verifies.
+func (k Key) algorithm() string {
+	switch key := k.Key.(type) {
+	case []byte:
+		return HS256
+	case *rsa.PublicKey:
+		return RS256
+	case *ecdsa.PublicKey:
+		if key.Curve == elliptic.P256() {
+			return ES256
+		}
+	case ed25519.PublicKey:
+		return EdDSA
+	}
+	return ""
+}
+
+// verify returns true if signature is the signature
+// of signed by k with algorithm alg.
+func (k Key) verify(alg string, signed, signature []byte) bool {
+	// checking the algorithm against the type of the key
+	// prevents verifying HS256 with a public key as secret
+	if k.algorithm() != alg {
+		return false
+	}
+	digest := sha256.Sum256(signed)
+	switch key := k.Key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		if len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, digest[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, signed, signature)
+	}
+	return false
+}
+
+// KeySource provides the keys that may have signed a token.
+type KeySource interface {
+	// Keys returns the keys that may have signed a token with
+	// the key ID kid, which is empty if the token has none.
+	Keys(kid string) ([]Key, error)
+}
+
+// Keys is a fixed set of keys.
+type Keys []Key
+
+// Keys implements KeySource.
+func (ks Keys) Keys(kid string) ([]Key, error) {
+	return matchKeys(ks, kid), nil
+}
+
+// matchKeys returns the keys of keys that match kid.
+func matchKeys(keys []Key, kid string) []Key {
+	if kid == "" {
+		return keys
+	}
+	var matched []Key
+	for _, key := range keys {
+		if key.ID == "" || key.ID == kid {
+			matched = append(matched, key)
+		}
+	}
+	return matched
+}
+
+// Validator validates tokens.
+type Validator struct {
+	// Sources provide the keys to verify tokens with.
+	Sources []KeySource
+
+	// Algorithms are the allowed algorithms. If empty,
+	// any of the supported algorithms is allowed.
+	Algorithms []string
+
+	// Issuers and Audiences are the allowed values of the iss
+	// and aud claims. They are not checked if empty.
+	Issuers   []string
+	Audiences []string
+
+	// Leeway is the clock skew allowed when
+	// checking the exp and nbf claims.
+	Leeway time.Duration
+}
+
+// Validate verifies the signature of token and validates its
+// claims at time now, returning the claims if it is valid.
+func (v Validator) Validate(token string, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var hdr header
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return nil, ErrMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if !v.allows(hdr.Algorithm) {
+		return nil, ErrAlgorithm
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	var verified, haveKeys bool
+	for _, source := range v.Sources {
+		keys, err := source.Keys(hdr.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			haveKeys = true
+			if key.verify(hdr.Algorithm, signed, signature) {
+				verified = true
+				break
+			}
+		}
+		if verified {
+			break
+		}
+	}
+	if !haveKeys {
+		return nil, ErrNoVerificationKey
+	}
+	if !verified {
+		return nil, ErrSignature
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil || claims == nil {
+		return nil, ErrMalformed
+	}
+	if err := v.validateClaims(claims, now); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// allows returns true if tokens may be signed with alg.
+func (v Validator) allows(alg string) bool {
+	switch alg {
+	case HS256, RS256, ES256, EdDSA:
+	default:
+		return false
+	}
+	if len(v.Algorithms) == 0 {
+		return true
+	}
+	for _, allowed := range v.Algorithms {
+		if allowed == alg {
+			return true
+		}
+	}
+	return false
+}
+
+func (v Validator) validateClaims(claims Claims, now time.Time) error {
+	if exp, ok, err := claims.time("exp"); err != nil {
+		return err
+	} else if ok && !now.Before(exp.Add(v.Leeway)) {
+		return ErrExpired
+	}
+	if nbf, ok, err := claims.time("nbf"); err != nil {
+		return err
+	} else if ok && now.Before(nbf.Add(-v.Leeway)) {
+		return ErrNotValidYet
+	}
+
+	if len(v.Issuers) > 0 {
+		iss, _ := claims["iss"].(string)
+		if !contains(v.Issuers, iss) {
+			return ErrInvalidIssuer
+		}
+	}
+	if len(v.Audiences) > 0 {
+		var valid bool
+		for _, aud := range claims.strings("aud") {
+			if contains(v.Audiences, aud) {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return ErrInvalidAudience
+		}
+	}
+	return nil
+}
+
+// time returns the time of the NumericDate claim name,
+// and whether the claim is present.
+func (c Claims) time(name string) (time.Time, bool, error) {
+	value, ok := c[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("%s claim is not a number", name)
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%s claim is not a number", name)
+	}
+	// beyond 2^53, float64 can't even hold whole seconds
+	if math.IsNaN(seconds) || math.Abs(seconds) >= 1<<53 {
+		return time.Time{}, false, fmt.Errorf("%s claim is out of range", name)
+	}
+	sec, frac := math.Modf(seconds)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second))), true, nil
+}
+
+// strings returns the values of claim name, which
+// is a string or an array of strings.
+func (c Claims) strings(name string) []string {
+	switch value := c[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var values []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment into v.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
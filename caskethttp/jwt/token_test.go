@@ -0,0 +1,202 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// testKeys are signing keys for each algorithm and their verification keys.
+type testKeys struct {
+	secret     []byte
+	rsa        *rsa.PrivateKey
+	ecdsa      *ecdsa.PrivateKey
+	ed25519    ed25519.PrivateKey
+	ed25519Pub ed25519.PublicKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	keys := testKeys{secret: []byte("s3cr3t")}
+	var err error
+	if keys.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if keys.ecdsa, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if keys.ed25519Pub, keys.ed25519, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// sign returns a token with claims signed with alg by the matching key in keys.
+func (keys testKeys) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch alg {
+	case HS256:
+		mac := hmac.New(sha256.New, keys.secret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case RS256:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, keys.rsa, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case ES256:
+		r, s, err := ecdsa.Sign(rand.Reader, keys.ecdsa, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case EdDSA:
+		signature = ed25519.Sign(keys.ed25519, []byte(signed))
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestValidate(t *testing.T) {
+	keys := newTestKeys(t)
+	start := time.Unix(1600000000, 0)
+	v := Validator{
+		Sources: []KeySource{Keys{
+			{Key: keys.secret},
+			{Key: &keys.rsa.PublicKey},
+			{Key: &keys.ecdsa.PublicKey},
+			{Key: keys.ed25519Pub},
+		}},
+		Issuers:   []string{"https://issuer.test"},
+		Audiences: []string{"api"},
+		Leeway:    time.Minute,
+	}
+	valid := map[string]interface{}{
+		"sub": "alice",
+		"iss": "https://issuer.test",
+		"aud": []string{"web", "api"},
+		"exp": start.Add(time.Hour).Unix(),
+		"nbf": start.Add(-time.Hour).Unix(),
+	}
+	with := func(name string, value interface{}) map[string]interface{} {
+		claims := make(map[string]interface{})
+		for k, v := range valid {
+			claims[k] = v
+		}
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	for _, alg := range []string{HS256, RS256, ES256, EdDSA} {
+		claims, err := v.Validate(keys.sign(t, alg, "", valid), start)
+		if err != nil {
+			t.Errorf("%s: Expected valid token, got %v", alg, err)
+			continue
+		}
+		if claims["sub"] != "alice" {
+			t.Errorf("%s: Expected sub claim alice, got %v", alg, claims["sub"])
+		}
+	}
+
+	other := newTestKeys(t)
+	for i, test := range []struct {
+		token    string
+		expected error
+	}{
+		{"not.a.token.at.all", ErrMalformed},
+		{"abc", ErrMalformed},
+		{keys.sign(t, "none", "", valid), ErrAlgorithm},
+		{keys.sign(t, "HS512", "", valid), ErrAlgorithm},
+		{other.sign(t, RS256, "", valid), ErrSignature},
+		{other.sign(t, ES256, "", valid), ErrSignature},
+		{keys.sign(t, HS256, "", with("exp", start.Add(-time.Minute).Unix())), ErrExpired},
+		{keys.sign(t, HS256, "", with("nbf", start.Add(2*time.Minute).Unix())), ErrNotValidYet},
+		{keys.sign(t, HS256, "", with("iss", "https://evil.test")), ErrInvalidIssuer},
+		{keys.sign(t, HS256, "", with("iss", nil)), ErrInvalidIssuer},
+		{keys.sign(t, HS256, "", with("aud", "web")), ErrInvalidAudience},
+		{keys.sign(t, HS256, "", with("aud", nil)), ErrInvalidAudience},
+		{keys.sign(t, HS256, "", with("exp", start.Add(-30*time.Second).Unix())), nil}, // leeway
+		{keys.sign(t, HS256, "", with("nbf", start.Add(30*time.Second).Unix())), nil},
+		{keys.sign(t, HS256, "", with("exp", nil)), nil},
+		{keys.sign(t, HS256, "", with("aud", "api")), nil},
+		{keys.sign(t, HS256, "", with("exp", int64(1e11))), nil}, // after 2262
+		{keys.sign(t, HS256, "", with("exp", float64(start.Unix())+90.5)), nil},
+	} {
+		if _, err := v.Validate(test.token, start); err != test.expected {
+			t.Errorf("Test %d: Expected error %v, got %v", i, test.expected, err)
+		}
+	}
+
+	for _, exp := range []interface{}{1e300, -1e300, "soon"} {
+		if _, err := v.Validate(keys.sign(t, HS256, "", with("exp", exp)), start); err == nil {
+			t.Errorf("Expected error for exp %v", exp)
+		}
+	}
+}
+
+func TestValidateAlgorithmConfusion(t *testing.T) {
+	keys := newTestKeys(t)
+	// an HS256 token whose secret is the Ed25519 public key
+	// must not verify with the public key
+	confused := testKeys{secret: keys.ed25519Pub}
+	v := Validator{Sources: []KeySource{Keys{{Key: keys.ed25519Pub}}}}
+	if _, err := v.Validate(confused.sign(t, HS256, "", map[string]interface{}{}), time.Now()); err != ErrSignature {
+		t.Errorf("Expected signature error, got %v", err)
+	}
+
+	v = Validator{Sources: []KeySource{Keys{{Key: keys.secret}}}, Algorithms: []string{RS256}}
+	if _, err := v.Validate(keys.sign(t, HS256, "", map[string]interface{}{}), time.Now()); err != ErrAlgorithm {
+		t.Errorf("Expected algorithm error, got %v", err)
+	}
+}
+
+func TestValidateKeyID(t *testing.T) {
+	keys := newTestKeys(t)
+	other := newTestKeys(t)
+	v := Validator{Sources: []KeySource{Keys{
+		{ID: "old", Key: &other.rsa.PublicKey},
+		{ID: "new", Key: &keys.rsa.PublicKey},
+	}}}
+
+	if _, err := v.Validate(keys.sign(t, RS256, "new", map[string]interface{}{}), time.Now()); err != nil {
+		t.Errorf("Expected token to verify with key new, got %v", err)
+	}
+	if _, err := v.Validate(keys.sign(t, RS256, "old", map[string]interface{}{}), time.Now()); err != ErrSignature {
+		t.Errorf("Expected token to only be verified with key old, got %v", err)
+	}
+	if _, err := v.Validate(keys.sign(t, RS256, "unknown", map[string]interface{}{}), time.Now()); err != ErrNoVerificationKey {
+		t.Errorf("Expected no key for unknown key ID, got %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+// Structured log encodings. Entries without an encoding
+// are written using their Format string.
+const (
+	EncodingJSON   = "json"
+	EncodingLogfmt = "logfmt"
+)
+
+// Field is a value of a structured log entry.
+type Field struct {
+	// Key is the name of the field in the entry.
+	Key string
+
+	// Placeholder is the name of the placeholder that
+	// is the value of the field, without braces. The
+	// names request_headers and response_headers stand
+	// for all headers of the request or response.
+	Placeholder string
+}
+
+// DefaultFields are the fields of structured log entries if
+// none are configured. They hold the common log format values.
+var DefaultFields = []Field{
+	{"remote", "remote"},
+	{"user", "user"},
+	{"when", "when_iso"},
+	{"method", "method"},
+	{"uri", "uri"},
+	{"proto", "proto"},
+	{"status", "status"},
+	{"size", "size"},
+	{"latency_ms", "latency_ms"},
+}
+
+// DefaultRedactedHeaders are the headers whose values are left
+// out of the request_headers and response_headers fields if none
+// are configured, as they hold credentials.
+var DefaultRedactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// redactedValue replaces the values of redacted headers.
+const redactedValue = "REDACTED"
+
+// integerPlaceholders are written as numbers in structured entries.
+var integerPlaceholders = map[string]bool{
+	"status":       true,
+	"size":         true,
+	"latency_ms":   true,
+	"port":         true,
+	"server_port":  true,
+	"when_unix":    true,
+	"when_unix_ms": true,
+}
+
+// structured returns e as a structured log line. Fields whose
+// placeholder has no value are null.
+func (e *Entry) structured(rep httpserver.Replacer, r *http.Request, rr *httpserver.ResponseRecorder) string {
+	// an empty value tells placeholders without a value
+	// apart from those whose value is the common log "-"
+	rep = httpserver.ReplacerWithEmptyValue(rep, "")
+	values := make([]interface{}, len(e.Fields))
+	for i, field := range e.Fields {
+		values[i] = e.fieldValue(field.Placeholder, rep, r, rr)
+	}
+
+	var buf bytes.Buffer
+	if e.Encoding == EncodingJSON {
+		buf.WriteByte('{')
+		for i, field := range e.Fields {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSON(&buf, field.Key)
+			buf.WriteByte(':')
+			writeJSON(&buf, values[i])
+		}
+		buf.WriteByte('}')
+		return buf.String()
+	}
+
+	for i, field := range e.Fields {
+		if headers, ok := values[i].(map[string]string); ok {
+			names := make([]string, 0, len(headers))
+			for name := range headers {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				writeLogfmt(&buf, field.Key+"."+name, headers[name])
+			}
+			continue
+		}
+		writeLogfmt(&buf, field.Key, values[i])
+	}
+	return buf.String()
+}
+
+// fieldValue returns the value of placeholder as a string,
+// an integer, a map of headers or nil if it has no value.
+func (e *Entry) fieldValue(placeholder string, rep httpserver.Replacer, r *http.Request, rr *httpserver.ResponseRecorder) interface{} {
+	switch {
+	case placeholder == "request_headers":
+		return headerMap(r.Header, e.Redact)
+	case placeholder == "response_headers":
+		return headerMap(rr.Header(), e.Redact)
+	case strings.HasPrefix(placeholder, ">"):
+		return headerValue(r.Header, placeholder[1:])
+	case strings.HasPrefix(placeholder, "<"):
+		return headerValue(rr.Header(), placeholder[1:])
+	}
+
+	value := rep.Replace("{" + placeholder + "}")
+	if value == "" {
+		return nil
+	}
+	if integerPlaceholders[placeholder] {
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return n
+		}
+	}
+	return value
+}
+
+func headerValue(h http.Header, name string) interface{} {
+	values, ok := h[textproto.CanonicalMIMEHeaderKey(name)]
+	if !ok {
+		return nil
+	}
+	return strings.Join(values, ",")
+}
+
+// headerMap returns the values of h by header name,
+// replacing the values of the headers in redact.
+func headerMap(h http.Header, redact []string) map[string]string {
+	headers := make(map[string]string, len(h))
+	for name, values := range h {
+		headers[name] = strings.Join(values, ",")
+	}
+	for _, name := range redact {
+		if _, ok := headers[textproto.CanonicalMIMEHeaderKey(name)]; ok {
+			headers[textproto.CanonicalMIMEHeaderKey(name)] = redactedValue
+		}
+	}
+	return headers
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	// unlike json.Marshal, the encoder can be told not to
+	// escape HTML characters, which keeps URIs readable
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+	// drop the newline written by Encode
+	buf.Truncate(buf.Len() - 1)
+}
+
+func writeLogfmt(buf *bytes.Buffer, key string, v interface{}) {
+	if buf.Len() > 0 {
+		buf.WriteByte(' ')
+	}
+	buf.WriteString(logfmtKey(key))
+	buf.WriteByte('=')
+	switch v := v.(type) {
+	case nil:
+	case int64:
+		buf.WriteString(strconv.FormatInt(v, 10))
+	case string:
+		if needsQuoting(v) {
+			buf.WriteString(strconv.Quote(v))
+		} else {
+			buf.WriteString(v)
+		}
+	}
+}
+
+// logfmtKey replaces the characters that may not be used in logfmt keys.
+func logfmtKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' || r == unicode.ReplacementChar {
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+func needsQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == '\\' || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func serveStructured(t *testing.T, entry *Entry) string {
+	var f bytes.Buffer
+	entry.Log = httpserver.NewTestLogger(&f)
+	logger := Logger{
+		Rules: []*Rule{{PathScope: "/", Entries: []*Entry{entry}}},
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.(*httpserver.ResponseRecorder).Replacer.Set("testval", `say "hi"`)
+			w.(*httpserver.ResponseRecorder).Replacer.Set("dash", "-")
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("hello"))
+			return 0, nil
+		}),
+	}
+
+	r := httptest.NewRequest("GET", "/path?a=<b>&c=d", nil)
+	r = r.WithContext(context.WithValue(r.Context(), httpserver.OriginalURLCtxKey, *r.URL))
+	r.Header.Set("User-Agent", "test agent")
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	r.Header.Set("Authorization", "Bearer secret")
+	if _, err := logger.ServeHTTP(httptest.NewRecorder(), r); err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(f.String(), "\n")
+}
+
+func TestStructuredJSON(t *testing.T) {
+	logged := serveStructured(t, &Entry{
+		Encoding: EncodingJSON,
+		Fields: []Field{
+			{"method", "method"},
+			{"uri", "uri"},
+			{"status", "status"},
+			{"size", "size"},
+			{"user", "user"},
+			{"test", "testval"},
+			{"dash", "dash"},
+			{"agent", ">User-Agent"},
+			{"referer", ">Referer"},
+			{"request_headers", "request_headers"},
+			{"response_headers", "response_headers"},
+		},
+		Redact: DefaultRedactedHeaders,
+	})
+
+	if !strings.HasPrefix(logged, `{"method":"GET","uri":"/path?a=<b>&c=d","status":200,"size":5,"user":null,`) {
+		t.Errorf("Expected fields in order with typed values, got: %s", logged)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(logged), &entry); err != nil {
+		t.Fatalf("Expected valid JSON, got error %v: %s", err, logged)
+	}
+	expected := map[string]interface{}{
+		"method":  "GET",
+		"uri":     "/path?a=<b>&c=d",
+		"status":  float64(200),
+		"size":    float64(5),
+		"user":    nil,
+		"test":    `say "hi"`,
+		"dash":    "-",
+		"agent":   "test agent",
+		"referer": nil,
+		"request_headers": map[string]interface{}{
+			"Authorization":   "REDACTED",
+			"User-Agent":      "test agent",
+			"X-Forwarded-For": "10.0.0.1",
+		},
+		"response_headers": map[string]interface{}{
+			"Content-Type": "text/plain",
+		},
+	}
+	if !reflect.DeepEqual(entry, expected) {
+		t.Errorf("Expected entry %v, got %v", expected, entry)
+	}
+}
+
+func TestStructuredLogfmt(t *testing.T) {
+	logged := serveStructured(t, &Entry{
+		Encoding: EncodingLogfmt,
+		Fields: []Field{
+			{"method", "method"},
+			{"status", "status"},
+			{"test", "testval"},
+			{"user", "user"},
+			{"user agent", ">User-Agent"},
+			{"res", "response_headers"},
+		},
+	})
+
+	expected := `method=GET status=200 test="say \"hi\"" user= user_agent="test agent" res.Content-Type=text/plain`
+	if logged != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, logged)
+	}
+}
@@ -17,6 +17,7 @@ package log
 
 import (
 	"fmt"
+	"math/rand"
 	"net"
 	"net/http"
 
@@ -74,6 +75,11 @@ func (l Logger) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 					continue
 				}
 
+				// Check the conditions and sampling of the entry
+				if !e.shouldLog(rep, responseRecorder.Status()) {
+					continue
+				}
+
 				// Mask IP Address
 				if e.Log.IPMaskExists {
 					hostip, _, err := net.SplitHostPort(r.RemoteAddr)
@@ -83,7 +89,11 @@ func (l Logger) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 						rep.Set("remote", maskedIP)
 					}
 				}
-				e.Log.Println(rep.Replace(e.Format))
+				if e.Encoding != "" {
+					e.Log.Println(e.structured(rep, r, responseRecorder))
+				} else {
+					e.Log.Println(rep.Replace(e.Format))
+				}
 
 			}
 
@@ -97,6 +107,41 @@ func (l Logger) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 type Entry struct {
 	Format string
 	Log    *httpserver.Logger
+
+	// Encoding is EncodingJSON or EncodingLogfmt for structured
+	// entries made of Fields; the Format is used otherwise.
+	Encoding string
+	Fields   []Field
+
+	// Redact are the headers whose values are
+	// replaced in the header map fields.
+	Redact []string
+
+	// Condition, if enabled, must match for a request to be logged.
+	// It is evaluated once the response has been written, so it
+	// may refer to placeholders such as {status} and {latency_ms}.
+	Condition httpserver.IfMatcher
+
+	// If Sampling is true, only a SampleRatio fraction of the
+	// successful requests is logged. Errors are always logged.
+	Sampling    bool
+	SampleRatio float64
+}
+
+// sample returns a random number in [0, 1); it
+// is a variable so that tests can replace it.
+var sample = rand.Float64
+
+// shouldLog returns whether a request with the
+// response status should be logged by e.
+func (e *Entry) shouldLog(rep httpserver.Replacer, status int) bool {
+	if e.Condition.Enabled && !e.Condition.MatchReplacer(rep) {
+		return false
+	}
+	if e.Sampling && status < 400 {
+		return sample() < e.SampleRatio
+	}
+	return true
 }
 
 // Rule configures the logging middleware.
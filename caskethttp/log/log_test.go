@@ -23,6 +23,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/tmpim/casket"
 	"github.com/tmpim/casket/caskethttp/httpserver"
 )
 
@@ -264,3 +265,71 @@ func TestLogExcept(t *testing.T) {
 
 	}
 }
+
+func TestLogConditions(t *testing.T) {
+	c := casket.NewTestController("http", `log /sampled stdout {uri} {
+		sample 0.5
+	}
+	log / stdout {status} {
+		if {status} ge 500
+		if {>X-Debug} is 1
+		if_op or
+	}`)
+	rules, err := logParse(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f bytes.Buffer
+	for _, rule := range rules {
+		for _, e := range rule.Entries {
+			e.Log = httpserver.NewTestLogger(&f)
+		}
+	}
+
+	var status int
+	logger := Logger{
+		Rules: rules,
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.WriteHeader(status)
+			return 0, nil
+		}),
+	}
+
+	defer func(f func() float64) { sample = f }(sample)
+	sample = func() float64 { return 0.6 }
+
+	tests := []struct {
+		path   string
+		debug  bool
+		status int
+		logged bool
+	}{
+		{"/", false, http.StatusOK, false},
+		{"/", false, http.StatusNotFound, false},
+		{"/", false, http.StatusBadGateway, true},
+		{"/", true, http.StatusOK, true},
+		{"/sampled", false, http.StatusOK, false},
+		{"/sampled", false, http.StatusNotFound, true},
+	}
+	for i, test := range tests {
+		f.Reset()
+		status = test.status
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.debug {
+			r.Header.Set("X-Debug", "1")
+		}
+		logger.ServeHTTP(httptest.NewRecorder(), r)
+		if logged := f.Len() > 0; logged != test.logged {
+			t.Errorf("Test %d: expected logged=%v, got %v", i, test.logged, logged)
+		}
+	}
+
+	// with a higher sample ratio, the successful request is logged
+	sample = func() float64 { return 0.4 }
+	f.Reset()
+	status = http.StatusOK
+	logger.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/sampled", nil))
+	if f.Len() == 0 {
+		t.Error("Expected sampled request to be logged")
+	}
+}
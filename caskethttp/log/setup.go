@@ -16,6 +16,7 @@ package log
 
 import (
 	"net"
+	"strconv"
 	"strings"
 
 	"github.com/tmpim/casket"
@@ -55,7 +56,23 @@ func logParse(c *casket.Controller) ([]*Rule, error) {
 		var logRoller *httpserver.LogRoller
 		logRoller = httpserver.DefaultLogRoller()
 
+		var encoding string
+		var fields []Field
+		var redact []string
+		var sampling bool
+		var sampleRatio float64
+		var bufferSize int
+
+		// Integrate request matcher for 'if' conditions.
+		matcher, err := httpserver.SetupIfMatcher(c)
+		if err != nil {
+			return nil, err
+		}
+
 		for c.NextBlock() {
+			if httpserver.IfMatcherKeyword(c) {
+				continue
+			}
 			what := c.Val()
 			where := c.RemainingArgs()
 
@@ -97,6 +114,72 @@ func logParse(c *casket.Controller) ([]*Rule, error) {
 					logExceptions = append(logExceptions, where[i])
 				}
 
+			} else if what == "format" {
+
+				if len(where) != 1 {
+					return nil, c.ArgErr()
+				}
+				switch where[0] {
+				case "text":
+					encoding = ""
+				case EncodingJSON, EncodingLogfmt:
+					encoding = where[0]
+				default:
+					return nil, c.Errf("unknown log format '%s'", where[0])
+				}
+
+			} else if what == "buffer_size" {
+
+				if len(where) != 1 {
+					return nil, c.ArgErr()
+				}
+				size, err := strconv.Atoi(where[0])
+				if err != nil || size < 1 {
+					return nil, c.Errf("invalid buffer size '%s'", where[0])
+				}
+				bufferSize = size
+
+			} else if what == "sample" {
+
+				if len(where) != 1 {
+					return nil, c.ArgErr()
+				}
+				ratio, err := strconv.ParseFloat(where[0], 64)
+				if err != nil || ratio < 0 || ratio > 1 {
+					return nil, c.Errf("invalid sample ratio '%s', must be between 0 and 1", where[0])
+				}
+				sampling = true
+				sampleRatio = ratio
+
+			} else if what == "fields" {
+
+				if len(where) == 0 {
+					return nil, c.ArgErr()
+				}
+				for _, name := range where {
+					name = strings.TrimSuffix(strings.TrimPrefix(name, "{"), "}")
+					fields = append(fields, Field{Key: name, Placeholder: name})
+				}
+
+			} else if what == "field" {
+
+				if len(where) != 2 {
+					return nil, c.ArgErr()
+				}
+				placeholder := strings.TrimSuffix(strings.TrimPrefix(where[1], "{"), "}")
+				fields = append(fields, Field{Key: where[0], Placeholder: placeholder})
+
+			} else if what == "redact" {
+
+				if len(where) == 0 {
+					return nil, c.ArgErr()
+				}
+				redact = []string{}
+				if len(where) == 1 && where[0] == "off" {
+					continue
+				}
+				redact = append(redact, where...)
+
 			} else if httpserver.IsLogRollerSubdirective(what) {
 
 				if err := httpserver.ParseRoller(logRoller, what, where...); err != nil {
@@ -132,6 +215,24 @@ func logParse(c *casket.Controller) ([]*Rule, error) {
 			return nil, c.ArgErr()
 		}
 
+		if encoding == "" && len(fields) > 0 {
+			return nil, c.Err("log fields require the json or logfmt format")
+		}
+		if encoding == "" && redact != nil {
+			return nil, c.Err("log redact requires the json or logfmt format")
+		}
+		if encoding != "" {
+			if len(args) > 2 {
+				return nil, c.Errf("log format string can't be used with the %s format", encoding)
+			}
+			if len(fields) == 0 {
+				fields = DefaultFields
+			}
+			if redact == nil {
+				redact = DefaultRedactedHeaders
+			}
+		}
+
 		rules = appendEntry(rules, path, &Entry{
 			Log: &httpserver.Logger{
 				Output:       output,
@@ -140,8 +241,15 @@ func logParse(c *casket.Controller) ([]*Rule, error) {
 				V6ipMask:     ip6Mask,
 				IPMaskExists: ipMaskExists,
 				Exceptions:   logExceptions,
+				BufferSize:   bufferSize,
 			},
-			Format: format,
+			Format:      format,
+			Encoding:    encoding,
+			Fields:      fields,
+			Redact:      redact,
+			Condition:   matcher.(httpserver.IfMatcher),
+			Sampling:    sampling,
+			SampleRatio: sampleRatio,
 		})
 	}
 
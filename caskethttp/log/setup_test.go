@@ -262,6 +262,33 @@ func TestLogParse(t *testing.T) {
 				Format: DefaultLogFormat,
 			}},
 		}}},
+		{`log access-{date}.log {
+			rotate_every hourly
+			rotate_total_size 500
+			rotate_post /usr/local/bin/ship-log --remove
+		}`, false, []Rule{{
+			PathScope: "/",
+			Entries: []*Entry{{
+				Log: &httpserver.Logger{
+					Output: "access-{date}.log",
+					Roller: &httpserver.LogRoller{
+						MaxSize:      100,
+						MaxAge:       14,
+						MaxBackups:   10,
+						LocalTime:    true,
+						RotateEvery:  httpserver.RotateHourly,
+						MaxTotalSize: 500,
+						PostRotate:   []string{"/usr/local/bin/ship-log", "--remove"},
+					},
+					V4ipMask: net.IPMask(net.ParseIP(DefaultIP4Mask).To4()),
+					V6ipMask: net.IPMask(net.ParseIP(DefaultIP6Mask)),
+				},
+				Format: DefaultLogFormat,
+			}},
+		}}},
+		{`log access.log {
+			rotate_every weekly
+		}`, true, nil},
 		{`log access0.log {
 			ipmask 255.255.255.0
 		}`, false, []Rule{{
@@ -331,6 +358,112 @@ func TestLogParse(t *testing.T) {
 				Format: "{when}",
 			}},
 		}}},
+		{`log / access.log {
+			format json
+		}`, false, []Rule{{
+			PathScope: "/",
+			Entries: []*Entry{{
+				Log: &httpserver.Logger{
+					Output:   "access.log",
+					Roller:   httpserver.DefaultLogRoller(),
+					V4ipMask: net.IPMask(net.ParseIP(DefaultIP4Mask).To4()),
+					V6ipMask: net.IPMask(net.ParseIP(DefaultIP6Mask)),
+				},
+				Format:   DefaultLogFormat,
+				Encoding: EncodingJSON,
+				Fields:   DefaultFields,
+				Redact:   DefaultRedactedHeaders,
+			}},
+		}}},
+		{`log access.log {
+			format logfmt
+			fields status {size} >User-Agent
+			field headers request_headers
+			redact X-Api-Key Cookie
+		}`, false, []Rule{{
+			PathScope: "/",
+			Entries: []*Entry{{
+				Log: &httpserver.Logger{
+					Output:   "access.log",
+					Roller:   httpserver.DefaultLogRoller(),
+					V4ipMask: net.IPMask(net.ParseIP(DefaultIP4Mask).To4()),
+					V6ipMask: net.IPMask(net.ParseIP(DefaultIP6Mask)),
+				},
+				Format:   DefaultLogFormat,
+				Encoding: EncodingLogfmt,
+				Fields: []Field{
+					{"status", "status"},
+					{"size", "size"},
+					{">User-Agent", ">User-Agent"},
+					{"headers", "request_headers"},
+				},
+				Redact: []string{"X-Api-Key", "Cookie"},
+			}},
+		}}},
+		{`log access.log {
+			format json
+			redact off
+		}`, false, []Rule{{
+			PathScope: "/",
+			Entries: []*Entry{{
+				Log: &httpserver.Logger{
+					Output:   "access.log",
+					Roller:   httpserver.DefaultLogRoller(),
+					V4ipMask: net.IPMask(net.ParseIP(DefaultIP4Mask).To4()),
+					V6ipMask: net.IPMask(net.ParseIP(DefaultIP6Mask)),
+				},
+				Format:   DefaultLogFormat,
+				Encoding: EncodingJSON,
+				Fields:   DefaultFields,
+				Redact:   []string{},
+			}},
+		}}},
+		{`log access.log {
+			redact Cookie
+		}`, true, nil},
+		{`log access.log {
+			format json
+			redact
+		}`, true, nil},
+		{`log access.log {
+			format xml
+		}`, true, nil},
+		{`log https://logs.example.com/ingest {
+			buffer_size 100
+		}`, false, []Rule{{
+			PathScope: "/",
+			Entries: []*Entry{{
+				Log: &httpserver.Logger{
+					Output:     "https://logs.example.com/ingest",
+					Roller:     httpserver.DefaultLogRoller(),
+					V4ipMask:   net.IPMask(net.ParseIP(DefaultIP4Mask).To4()),
+					V6ipMask:   net.IPMask(net.ParseIP(DefaultIP6Mask)),
+					BufferSize: 100,
+				},
+				Format: DefaultLogFormat,
+			}},
+		}}},
+		{`log access.log {
+			buffer_size none
+		}`, true, nil},
+		{`log access.log {
+			sample 2
+		}`, true, nil},
+		{`log access.log {
+			sample
+		}`, true, nil},
+		{`log access.log {
+			if {status} between 500
+		}`, true, nil},
+		{`log access.log {
+			fields status
+		}`, true, nil},
+		{`log access.log {
+			field status
+		}`, true, nil},
+		{`log / access.log {common} {
+			format json
+		}`, true, nil},
 		{`log access.log { rotate_size 2 rotate_age 10 rotate_keep 3 }`, true, nil},
 		{`log access.log { rotate_compress invalid }`, true, nil},
 		{`log access.log { rotate_size }`, true, nil},
@@ -369,6 +502,16 @@ func TestLogParse(t *testing.T) {
 						i, j, test.expectedLogRules[j].Entries[k].Log, actualEntry.Log)
 				}
 
+				if actualEntry.Encoding != test.expectedLogRules[j].Entries[k].Encoding {
+					t.Errorf("Test %d expected %dth LogRule Encoding to be  %s  , but got %s",
+						i, j, test.expectedLogRules[j].Entries[k].Encoding, actualEntry.Encoding)
+				}
+
+				if !reflect.DeepEqual(actualEntry.Fields, test.expectedLogRules[j].Entries[k].Fields) {
+					t.Errorf("Test %d expected %dth LogRule Fields to be  %v  , but got %v",
+						i, j, test.expectedLogRules[j].Entries[k].Fields, actualEntry.Fields)
+				}
+
 				if actualEntry.Format != test.expectedLogRules[j].Entries[k].Format {
 					t.Errorf("Test %d expected %dth LogRule Format to be  %s  , but got %s",
 						i, j, test.expectedLogRules[j].Entries[k].Format, actualEntry.Format)
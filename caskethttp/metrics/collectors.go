@@ -0,0 +1,159 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+	"github.com/tmpim/casket/caskethttp/proxy"
+	"github.com/tmpim/casket/caskettls"
+)
+
+// proxyCollector collects the health and statistics of proxy
+// upstream hosts. Hosts that appear in several proxy directives
+// with the same base path are added up.
+type proxyCollector struct {
+	healthy, fails, active, requests, errors *prometheus.Desc
+}
+
+func newProxyCollector() *proxyCollector {
+	labels := []string{"upstream", "host"}
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "proxy", name), help, labels, nil)
+	}
+	return &proxyCollector{
+		healthy:  desc("upstream_healthy", "Whether the upstream host is available (1) or down (0)."),
+		fails:    desc("upstream_fails", "Number of recent failed requests counted against the upstream host."),
+		active:   desc("upstream_active_requests", "Number of requests currently sent to the upstream host."),
+		requests: desc("upstream_requests_total", "Number of requests sent to the upstream host."),
+		errors:   desc("upstream_errors_total", "Number of failed requests to the upstream host."),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *proxyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.healthy
+	ch <- c.fails
+	ch <- c.active
+	ch <- c.requests
+	ch <- c.errors
+}
+
+// Collect implements prometheus.Collector.
+func (c *proxyCollector) Collect(ch chan<- prometheus.Metric) {
+	type key struct{ upstream, host string }
+	var keys []key
+	hosts := make(map[key]*proxy.HostStats)
+	for _, upstream := range proxy.Stats() {
+		for _, host := range upstream.Hosts {
+			k := key{upstream.From, host.Name}
+			total, ok := hosts[k]
+			if !ok {
+				host := host
+				hosts[k] = &host
+				keys = append(keys, k)
+				continue
+			}
+			total.Healthy = total.Healthy && host.Healthy
+			total.Fails += host.Fails
+			total.Active += host.Active
+			total.Requests += host.Requests
+			total.Errors += host.Errors
+		}
+	}
+
+	for _, k := range keys {
+		host := hosts[k]
+		healthy := 0.0
+		if host.Healthy {
+			healthy = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.healthy, prometheus.GaugeValue, healthy, k.upstream, k.host)
+		ch <- prometheus.MustNewConstMetric(c.fails, prometheus.GaugeValue, float64(host.Fails), k.upstream, k.host)
+		ch <- prometheus.MustNewConstMetric(c.active, prometheus.GaugeValue, float64(host.Active), k.upstream, k.host)
+		ch <- prometheus.MustNewConstMetric(c.requests, prometheus.CounterValue, float64(host.Requests), k.upstream, k.host)
+		ch <- prometheus.MustNewConstMetric(c.errors, prometheus.CounterValue, float64(host.Errors), k.upstream, k.host)
+	}
+}
+
+// tlsCollector collects the expiration times of
+// the certificates of all running instances.
+type tlsCollector struct {
+	expiry *prometheus.Desc
+}
+
+func newTLSCollector() *tlsCollector {
+	return &tlsCollector{
+		expiry: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "tls", "certificate_expiry_timestamp_seconds"),
+			"Time at which the certificate for a name expires, in seconds since the Unix epoch.",
+			[]string{"name"}, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *tlsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.expiry
+}
+
+// Collect implements prometheus.Collector.
+func (c *tlsCollector) Collect(ch chan<- prometheus.Metric) {
+	expirations := make(map[string]float64)
+	for _, inst := range casket.Instances() {
+		for name, expires := range caskettls.CertificateExpirations(inst) {
+			if ts := float64(expires.Unix()); ts > expirations[name] {
+				expirations[name] = ts
+			}
+		}
+	}
+	for name, ts := range expirations {
+		ch <- prometheus.MustNewConstMetric(c.expiry, prometheus.GaugeValue, ts, name)
+	}
+}
+
+// instanceCollector collects the number of instance reloads
+// and of log lines dropped by remote log outputs.
+type instanceCollector struct {
+	reloads         *prometheus.Desc
+	droppedLogLines *prometheus.Desc
+}
+
+func newInstanceCollector() *instanceCollector {
+	return &instanceCollector{
+		reloads: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "instance", "reloads_total"),
+			"Number of instance reloads, by result.",
+			[]string{"result"}, nil),
+		droppedLogLines: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "log", "dropped_lines_total"),
+			"Number of log lines dropped by remote log outputs.",
+			nil, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *instanceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.reloads
+	ch <- c.droppedLogLines
+}
+
+// Collect implements prometheus.Collector.
+func (c *instanceCollector) Collect(ch chan<- prometheus.Metric) {
+	succeeded, failed := casket.Reloads()
+	ch <- prometheus.MustNewConstMetric(c.reloads, prometheus.CounterValue, float64(succeeded), "success")
+	ch <- prometheus.MustNewConstMetric(c.reloads, prometheus.CounterValue, float64(failed), "failure")
+	ch <- prometheus.MustNewConstMetric(c.droppedLogLines, prometheus.CounterValue, float64(httpserver.DroppedLogLines()))
+}
@@ -0,0 +1,49 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/proxy"
+)
+
+func TestProxyCollector(t *testing.T) {
+	// the same host proxied to from two sites is added up
+	setupProxy, err := casket.DirectiveAction("http", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := setupProxy(casket.NewTestController("http", "proxy /api localhost:8081")); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	expected := `
+# HELP casket_proxy_upstream_healthy Whether the upstream host is available (1) or down (0).
+# TYPE casket_proxy_upstream_healthy gauge
+casket_proxy_upstream_healthy{host="http://localhost:8081",upstream="/api"} 1
+`
+	if err := testutil.CollectAndCompare(newProxyCollector(), strings.NewReader(expected), "casket_proxy_upstream_healthy"); err != nil {
+		t.Error(err)
+	}
+	if n := len(proxy.Stats()); n != 2 {
+		t.Errorf("Expected 2 running upstreams, got %d", n)
+	}
+}
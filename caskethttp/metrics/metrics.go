@@ -0,0 +1,134 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics provides a middleware layer that records
+// request metrics and exposes them in the Prometheus format.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+const namespace = "casket"
+
+// The metrics are shared by all sites and kept across
+// restarts, so they are registered once per process.
+var (
+	registry     = prometheus.NewRegistry()
+	registerOnce sync.Once
+
+	requestLabels = []string{"site", "code", "method"}
+
+	requestCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests handled.",
+	}, requestLabels)
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to handle HTTP requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, requestLabels)
+
+	responseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "response_size_bytes",
+		Help:      "Size of HTTP response bodies.",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 8),
+	}, requestLabels)
+
+	requestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_in_flight",
+		Help:      "Number of HTTP requests currently being handled.",
+	}, []string{"site"})
+)
+
+func register() {
+	registry.MustRegister(
+		requestCount,
+		requestDuration,
+		responseSize,
+		requestsInFlight,
+		newProxyCollector(),
+		newTLSCollector(),
+		newInstanceCollector(),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Metrics is middleware that records metrics of the
+// requests to a site and serves them at Path.
+type Metrics struct {
+	Next    httpserver.Handler
+	Site    string
+	Path    string
+	handler http.Handler
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (m Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if m.Path != "" && r.URL.Path == m.Path {
+		m.handler.ServeHTTP(w, r)
+		return 0, nil
+	}
+
+	inFlight := requestsInFlight.WithLabelValues(m.Site)
+	inFlight.Inc()
+	defer inFlight.Dec()
+
+	start := time.Now()
+	rec := httpserver.NewResponseRecorder(w)
+	status, err := m.Next.ServeHTTP(rec, r)
+
+	// an error status that hasn't been written yet
+	// will be written further down the chain
+	code := rec.Status()
+	if status >= 400 {
+		code = status
+	}
+	labels := []string{m.Site, statusClass(code), r.Method}
+	requestCount.WithLabelValues(labels...).Inc()
+	requestDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+	responseSize.WithLabelValues(labels...).Observe(float64(rec.Size()))
+
+	return status, err
+}
+
+// statusClass returns the class of an HTTP status code, such as "2xx".
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+func newHandler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestMetrics(t *testing.T) {
+	registerOnce.Do(register)
+	m := Metrics{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			switch r.URL.Path {
+			case "/missing":
+				return http.StatusNotFound, nil
+			case "/teapot":
+				w.WriteHeader(http.StatusTeapot)
+			}
+			w.Write([]byte("hello"))
+			return 0, nil
+		}),
+		Site:    "http://metrics.test",
+		Path:    "/metrics",
+		handler: newHandler(),
+	}
+
+	for _, path := range []string{"/", "/a", "/missing", "/teapot"} {
+		if _, err := m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)); err != nil {
+			t.Fatalf("Expected no error for %s, got %v", path, err)
+		}
+	}
+
+	tests := []struct {
+		code  string
+		count float64
+	}{
+		{"2xx", 2},
+		{"4xx", 2},
+		{"5xx", 0},
+	}
+	for _, test := range tests {
+		count := testutil.ToFloat64(requestCount.WithLabelValues(m.Site, test.code, "GET"))
+		if count != test.count {
+			t.Errorf("Expected %v %s requests, got %v", test.count, test.code, count)
+		}
+	}
+	if inFlight := testutil.ToFloat64(requestsInFlight.WithLabelValues(m.Site)); inFlight != 0 {
+		t.Errorf("Expected no requests in flight, got %v", inFlight)
+	}
+
+	w := httptest.NewRecorder()
+	status, err := m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if status != 0 || err != nil {
+		t.Fatalf("Expected metrics to be served, got status %d and %v", status, err)
+	}
+	body := w.Body.String()
+	for _, metric := range []string{
+		`casket_http_requests_total{code="2xx",method="GET",site="http://metrics.test"} 2`,
+		`casket_http_request_duration_seconds_count{code="4xx",method="GET",site="http://metrics.test"} 2`,
+		`casket_http_response_size_bytes_sum{code="2xx",method="GET",site="http://metrics.test"} 10`,
+		`casket_instance_reloads_total{result="success"}`,
+		`casket_log_dropped_lines_total `,
+	} {
+		if !strings.Contains(body, metric) {
+			t.Errorf("Expected metrics to contain %s, got:\n%s", metric, body)
+		}
+	}
+}
+
+func TestStatusClass(t *testing.T) {
+	for code, expected := range map[int]string{
+		0:   "unknown",
+		200: "2xx",
+		304: "3xx",
+		499: "4xx",
+		503: "5xx",
+		600: "unknown",
+	} {
+		if got := statusClass(code); got != expected {
+			t.Errorf("Expected class %s for %d, got %s", expected, code, got)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"log"
+	"strings"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func init() {
+	casket.RegisterPlugin("metrics", casket.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+	// prometheus is the name of the plugin this directive
+	// replaced, which is still accepted to not break configs
+	casket.RegisterPlugin("prometheus", casket.Plugin{
+		ServerType: "http",
+		Action:     setupPrometheus,
+	})
+}
+
+// defaultPath is the path metrics are served at by default.
+const defaultPath = "/metrics"
+
+// setup configures a new Metrics middleware instance.
+func setup(c *casket.Controller) error {
+	m, err := metricsParse(c)
+	if err != nil {
+		return err
+	}
+	registerOnce.Do(register)
+	m.handler = newHandler()
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		m.Next = next
+		return m
+	})
+
+	return nil
+}
+
+// setupPrometheus configures a Metrics middleware instance
+// from the config of the former prometheus plugin.
+func setupPrometheus(c *casket.Controller) error {
+	log.Printf("[WARNING] %s:%d - the prometheus directive is deprecated, use metrics instead", c.File(), c.Line())
+	return setup(c)
+}
+
+func metricsParse(c *casket.Controller) (Metrics, error) {
+	m := Metrics{
+		Site: httpserver.GetConfig(c).Addr.String(),
+		Path: defaultPath,
+	}
+
+	var parsed bool
+	for c.Next() {
+		if parsed {
+			return m, c.Err("metrics can only be specified once per site")
+		}
+		parsed = true
+
+		legacy := c.Val() == "prometheus"
+
+		args := c.RemainingArgs()
+		switch len(args) {
+		case 0:
+		case 1:
+			if legacy && !strings.HasPrefix(args[0], "/") {
+				// metrics are served by the site
+				// instead of on an address of their own
+				log.Printf("[WARNING] %s:%d - prometheus: ignoring address %s, serving metrics at %s", c.File(), c.Line(), args[0], m.Path)
+				break
+			}
+			m.Path = args[0]
+		default:
+			return m, c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "site":
+				if !c.NextArg() {
+					return m, c.ArgErr()
+				}
+				m.Site = c.Val()
+			case "path":
+				if !legacy {
+					return m, c.Errf("unknown property '%s'", c.Val())
+				}
+				if !c.NextArg() {
+					return m, c.ArgErr()
+				}
+				m.Path = c.Val()
+			case "address", "hostname", "use_casket_addr", "label":
+				if !legacy {
+					return m, c.Errf("unknown property '%s'", c.Val())
+				}
+				log.Printf("[WARNING] %s:%d - prometheus: %s is not supported anymore, ignoring it", c.File(), c.Line(), c.Val())
+				c.RemainingArgs()
+			default:
+				return m, c.Errf("unknown property '%s'", c.Val())
+			}
+		}
+	}
+
+	// "off" records metrics without serving them on this site
+	if m.Path == "off" {
+		m.Path = ""
+	}
+	return m, nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := casket.NewTestController("http", `metrics`)
+	err := setup(c)
+	if err != nil {
+		t.Errorf("Expected no errors, got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(Metrics)
+	if !ok {
+		t.Fatalf("Expected handler to be type Metrics, got: %#v", handler)
+	}
+
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+	if myHandler.handler == nil {
+		t.Error("Expected metrics handler to be set")
+	}
+}
+
+func TestMetricsParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		path      string
+		site      string
+	}{
+		{`metrics`, false, "/metrics", ""},
+		{`metrics /stats`, false, "/stats", ""},
+		{`metrics off`, false, "", ""},
+		{`metrics {
+			site example
+		  }`, false, "/metrics", "example"},
+		{`metrics /a /b`, true, "", ""},
+		{`metrics {
+			site
+		  }`, true, "", ""},
+		{`metrics {
+			unknown x
+		  }`, true, "", ""},
+		{`metrics
+		  metrics /b`, true, "", ""},
+		{`metrics {
+			path /stats
+		  }`, true, "", ""},
+
+		// the config of the former prometheus plugin
+		{`prometheus`, false, "/metrics", ""},
+		{`prometheus localhost:9180`, false, "/metrics", ""},
+		{`prometheus {
+			address localhost:9180
+			path /stats
+			label host {host}
+			use_casket_addr
+		  }`, false, "/stats", ""},
+		{`prometheus {
+			path
+		  }`, true, "", ""},
+	}
+	for i, test := range tests {
+		m, err := metricsParse(casket.NewTestController("http", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+			continue
+		}
+		if m.Path != test.path {
+			t.Errorf("Test %d: Expected path %q, got %q", i, test.path, m.Path)
+		}
+		if m.Site != test.site {
+			t.Errorf("Test %d: Expected site %q, got %q", i, test.site, m.Site)
+		}
+	}
+}
@@ -52,3 +52,27 @@ func newBufferedBody(src io.ReadCloser) (*bufferedBody, error) {
 		Reader: bytes.NewReader(b),
 	}, nil
 }
+
+// newLimitedBufferedBody is like newBufferedBody, but only buffers src if it
+// is no longer than max bytes. Otherwise the returned body streams the
+// remainder of src after the bytes read so far, and buffered is false.
+func newLimitedBufferedBody(src io.ReadCloser, max int64) (body io.ReadCloser, buffered bool, err error) {
+	if src == nil {
+		return nil, true, nil
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(src, max+1))
+	if err != nil {
+		src.Close()
+		return nil, false, err
+	}
+	if int64(len(b)) > max {
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), src), src}, false, nil
+	}
+	src.Close()
+	return &bufferedBody{
+		Reader: bytes.NewReader(b),
+	}, true, nil
+}
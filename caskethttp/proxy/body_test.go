@@ -21,6 +21,7 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -90,3 +91,35 @@ func TestBodyRetry(t *testing.T) {
 		t.Fatalf("result = %s, want %s", result, testCase)
 	}
 }
+
+func TestLimitedBufferedBody(t *testing.T) {
+	tests := []struct {
+		body     string
+		max      int64
+		buffered bool
+	}{
+		{"", 4, true},
+		{"test", 4, true},
+		{"test content", 4, false},
+	}
+
+	for i, test := range tests {
+		body, buffered, err := newLimitedBufferedBody(ioutil.NopCloser(strings.NewReader(test.body)), test.max)
+		if err != nil {
+			t.Fatalf("Test %d: unexpected error: %v", i, err)
+		}
+		if buffered != test.buffered {
+			t.Errorf("Test %d: expected buffered=%v, got %v", i, test.buffered, buffered)
+		}
+		if _, ok := body.(*bufferedBody); ok != test.buffered {
+			t.Errorf("Test %d: expected a *bufferedBody=%v, got %T", i, test.buffered, body)
+		}
+		result, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatalf("Test %d: unexpected error: %v", i, err)
+		}
+		if string(result) != test.body {
+			t.Errorf("Test %d: expected body %q, got %q", i, test.body, result)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// breakerBuckets is the number of buckets the sliding
+// window of a circuit breaker is divided into.
+const breakerBuckets = 10
+
+// breakerLatencyQuantile is the fraction of requests that must be
+// faster than the latency threshold for the circuit to stay closed,
+// i.e. the circuit opens once the p95 latency exceeds the threshold.
+const breakerLatencyQuantile = 0.95
+
+var errBreakerOpen = errors.New("circuit breaker is open")
+
+// BreakerConfig holds the circuit breaker settings
+// shared by all hosts of an upstream.
+type BreakerConfig struct {
+	// Window is the length of the sliding window over
+	// which the error ratio and latency are measured.
+	Window time.Duration
+
+	// ErrorRatio is the fraction of failed requests in
+	// the window at which the circuit opens. Zero disables
+	// the error ratio check.
+	ErrorRatio float64
+
+	// Latency is the p95 latency in the window at which
+	// the circuit opens. Zero disables the latency check.
+	Latency time.Duration
+
+	// MinRequests is the minimum number of requests in
+	// the window before the circuit may open.
+	MinRequests int
+
+	// OpenDuration is how long the circuit stays open
+	// before letting probe requests through.
+	OpenDuration time.Duration
+
+	// HalfOpenRequests is the number of probe requests
+	// allowed while half-open, all of which must succeed
+	// for the circuit to close again.
+	HalfOpenRequests int
+}
+
+// Enabled returns true if any trip condition is configured.
+func (c BreakerConfig) Enabled() bool {
+	return c.ErrorRatio > 0 || c.Latency > 0
+}
+
+type breakerBucket struct {
+	start    time.Time
+	requests int
+	failures int
+	slow     int
+}
+
+// CircuitBreaker passively tracks the outcome of requests to a single
+// upstream host and stops traffic to it once it appears to be failing.
+type CircuitBreaker struct {
+	config BreakerConfig
+	now    func() time.Time
+
+	mu         sync.Mutex
+	state      string
+	generation uint64 // incremented on every change of state
+	openedAt   time.Time
+	buckets    [breakerBuckets]breakerBucket
+	probes     int // probes in flight while half-open
+	successes  int // successful probes while half-open
+}
+
+// NewCircuitBreaker returns a closed circuit breaker using config.
+func NewCircuitBreaker(config BreakerConfig) *CircuitBreaker {
+	if config.HalfOpenRequests < 1 {
+		config.HalfOpenRequests = 1
+	}
+	return &CircuitBreaker{
+		config: config,
+		now:    time.Now,
+		state:  BreakerClosed,
+	}
+}
+
+// State returns the current state of the circuit breaker.
+func (cb *CircuitBreaker) State() string {
+	if cb == nil {
+		return BreakerClosed
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.advance()
+	return cb.state
+}
+
+// Ready reports whether a request could currently be let through,
+// without reserving a half-open probe slot.
+func (cb *CircuitBreaker) Ready() bool {
+	if cb == nil {
+		return true
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.advance()
+	switch cb.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		return cb.probes < cb.config.HalfOpenRequests-cb.successes
+	}
+	return true
+}
+
+// Begin must be called before a request is sent to the host. It returns
+// false if the request must not be sent, in which case Done must not be
+// called. Otherwise, the returned generation must be passed to Done or
+// Abort.
+func (cb *CircuitBreaker) Begin() (uint64, bool) {
+	if cb == nil {
+		return 0, true
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.advance()
+	switch cb.state {
+	case BreakerOpen:
+		return 0, false
+	case BreakerHalfOpen:
+		if cb.probes >= cb.config.HalfOpenRequests-cb.successes {
+			return 0, false
+		}
+		cb.probes++
+	}
+	return cb.generation, true
+}
+
+// Done records the outcome of a request started with Begin in the
+// given generation. failed is true for transport errors and 5xx
+// responses, and latency is the time taken to receive the response
+// headers. Requests begun before the last change of state are
+// ignored, so that e.g. a slow request sent while the circuit was
+// closed can't close it again when it is half-open.
+func (cb *CircuitBreaker) Done(generation uint64, failed bool, latency time.Duration) {
+	if cb == nil {
+		return
+	}
+	slow := cb.config.Latency > 0 && latency > cb.config.Latency
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if generation != cb.generation {
+		return
+	}
+	if cb.state == BreakerHalfOpen {
+		if cb.probes > 0 {
+			cb.probes--
+		}
+		if failed || slow {
+			cb.trip()
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.config.HalfOpenRequests {
+			cb.reset()
+		}
+		return
+	}
+	if cb.state != BreakerClosed {
+		return
+	}
+
+	b := cb.bucket()
+	b.requests++
+	if failed {
+		b.failures++
+	}
+	if slow {
+		b.slow++
+	}
+
+	var requests, failures, slowRequests int
+	cutoff := cb.now().Add(-cb.config.Window)
+	for _, b := range cb.buckets {
+		if b.start.After(cutoff) {
+			requests += b.requests
+			failures += b.failures
+			slowRequests += b.slow
+		}
+	}
+	if requests == 0 || requests < cb.config.MinRequests {
+		return
+	}
+	if cb.config.ErrorRatio > 0 && float64(failures)/float64(requests) >= cb.config.ErrorRatio {
+		cb.trip()
+		return
+	}
+	if cb.config.Latency > 0 && float64(slowRequests)/float64(requests) > 1-breakerLatencyQuantile {
+		cb.trip()
+	}
+}
+
+// Abort releases a request started with Begin without
+// recording an outcome, e.g. when the client went away.
+func (cb *CircuitBreaker) Abort(generation uint64) {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if generation == cb.generation && cb.state == BreakerHalfOpen && cb.probes > 0 {
+		cb.probes--
+	}
+}
+
+// advance moves an open circuit to half-open once
+// the open duration has elapsed. cb.mu must be held.
+func (cb *CircuitBreaker) advance() {
+	if cb.state == BreakerOpen && cb.now().Sub(cb.openedAt) >= cb.config.OpenDuration {
+		cb.state = BreakerHalfOpen
+		cb.generation++
+		cb.probes = 0
+		cb.successes = 0
+	}
+}
+
+// trip opens the circuit. cb.mu must be held.
+func (cb *CircuitBreaker) trip() {
+	cb.state = BreakerOpen
+	cb.generation++
+	cb.openedAt = cb.now()
+	cb.probes = 0
+	cb.successes = 0
+}
+
+// reset closes the circuit and clears the sliding window.
+// cb.mu must be held.
+func (cb *CircuitBreaker) reset() {
+	cb.state = BreakerClosed
+	cb.generation++
+	cb.buckets = [breakerBuckets]breakerBucket{}
+	cb.probes = 0
+	cb.successes = 0
+}
+
+// bucket returns the bucket for the current time,
+// clearing it if it is stale. cb.mu must be held.
+func (cb *CircuitBreaker) bucket() *breakerBucket {
+	width := cb.config.Window / breakerBuckets
+	if width <= 0 {
+		width = 1
+	}
+	now := cb.now()
+	start := now.Truncate(width)
+	b := &cb.buckets[(now.UnixNano()/int64(width))%breakerBuckets]
+	if !b.start.Equal(start) {
+		*b = breakerBucket{start: start}
+	}
+	return b
+}
@@ -0,0 +1,251 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmpim/casket/casketfile"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func newTestBreaker(config BreakerConfig) (*CircuitBreaker, *time.Time) {
+	now := time.Unix(1000, 0)
+	cb := NewCircuitBreaker(config)
+	cb.now = func() time.Time { return now }
+	return cb, &now
+}
+
+// breakerRequest records the outcome of a request, if cb lets it through.
+func breakerRequest(cb *CircuitBreaker, failed bool, latency time.Duration) {
+	if gen, ok := cb.Begin(); ok {
+		cb.Done(gen, failed, latency)
+	}
+}
+
+func TestCircuitBreakerErrorRatio(t *testing.T) {
+	cb, now := newTestBreaker(BreakerConfig{
+		Window:           10 * time.Second,
+		ErrorRatio:       0.5,
+		MinRequests:      4,
+		OpenDuration:     5 * time.Second,
+		HalfOpenRequests: 2,
+	})
+
+	// not enough requests to trip yet
+	for i := 0; i < 3; i++ {
+		breakerRequest(cb, true, time.Millisecond)
+	}
+	if state := cb.State(); state != BreakerClosed {
+		t.Fatalf("Expected breaker to be %s, got %s", BreakerClosed, state)
+	}
+
+	// failures outside of the window are forgotten
+	*now = now.Add(11 * time.Second)
+	for i := 0; i < 3; i++ {
+		breakerRequest(cb, false, time.Millisecond)
+	}
+	breakerRequest(cb, true, time.Millisecond)
+	if state := cb.State(); state != BreakerClosed {
+		t.Fatalf("Expected breaker to be %s, got %s", BreakerClosed, state)
+	}
+
+	// 4 out of 8 requests failed
+	for i := 0; i < 3; i++ {
+		breakerRequest(cb, true, time.Millisecond)
+	}
+	if state := cb.State(); state != BreakerOpen {
+		t.Fatalf("Expected breaker to be %s, got %s", BreakerOpen, state)
+	}
+	if _, ok := cb.Begin(); cb.Ready() || ok {
+		t.Fatal("Expected open breaker to reject requests")
+	}
+
+	// half-open lets a limited number of probes through
+	*now = now.Add(5 * time.Second)
+	if state := cb.State(); state != BreakerHalfOpen {
+		t.Fatalf("Expected breaker to be %s, got %s", BreakerHalfOpen, state)
+	}
+	gen1, ok1 := cb.Begin()
+	gen2, ok2 := cb.Begin()
+	if !ok1 || !ok2 {
+		t.Fatal("Expected half-open breaker to allow 2 probes")
+	}
+	if _, ok := cb.Begin(); cb.Ready() || ok {
+		t.Fatal("Expected half-open breaker to reject a third probe")
+	}
+
+	// a failed probe opens the circuit again
+	cb.Done(gen1, false, time.Millisecond)
+	cb.Done(gen2, true, time.Millisecond)
+	if state := cb.State(); state != BreakerOpen {
+		t.Fatalf("Expected breaker to be %s, got %s", BreakerOpen, state)
+	}
+
+	// successful probes close it
+	*now = now.Add(5 * time.Second)
+	for i := 0; i < 2; i++ {
+		gen, ok := cb.Begin()
+		if !ok {
+			t.Fatalf("Expected probe %d to be allowed", i)
+		}
+		cb.Done(gen, false, time.Millisecond)
+	}
+	if state := cb.State(); state != BreakerClosed {
+		t.Fatalf("Expected breaker to be %s, got %s", BreakerClosed, state)
+	}
+}
+
+func TestCircuitBreakerStaleRequests(t *testing.T) {
+	cb, now := newTestBreaker(BreakerConfig{
+		Window:       10 * time.Second,
+		ErrorRatio:   0.5,
+		MinRequests:  2,
+		OpenDuration: 5 * time.Second,
+	})
+
+	// a slow request is sent while the circuit is closed
+	stale, _ := cb.Begin()
+	breakerRequest(cb, true, time.Millisecond)
+	breakerRequest(cb, true, time.Millisecond)
+	if state := cb.State(); state != BreakerOpen {
+		t.Fatalf("Expected breaker to be %s, got %s", BreakerOpen, state)
+	}
+
+	*now = now.Add(5 * time.Second)
+	probe, ok := cb.Begin()
+	if !ok {
+		t.Fatal("Expected half-open breaker to allow a probe")
+	}
+
+	// its success must not close the circuit, nor
+	// take the place of the probe in flight
+	cb.Done(stale, false, time.Millisecond)
+	if state := cb.State(); state != BreakerHalfOpen {
+		t.Fatalf("Expected breaker to be %s, got %s", BreakerHalfOpen, state)
+	}
+	cb.Abort(stale)
+	if _, ok := cb.Begin(); ok {
+		t.Fatal("Expected the probe slot to still be taken")
+	}
+
+	cb.Done(probe, false, time.Millisecond)
+	if state := cb.State(); state != BreakerClosed {
+		t.Fatalf("Expected breaker to be %s, got %s", BreakerClosed, state)
+	}
+}
+
+func TestCircuitBreakerLatency(t *testing.T) {
+	cb, _ := newTestBreaker(BreakerConfig{
+		Window:       10 * time.Second,
+		Latency:      100 * time.Millisecond,
+		MinRequests:  20,
+		OpenDuration: 5 * time.Second,
+	})
+
+	// 1 in 20 slow requests keeps the p95 under the threshold
+	for i := 0; i < 19; i++ {
+		breakerRequest(cb, false, 10*time.Millisecond)
+	}
+	breakerRequest(cb, false, time.Second)
+	if state := cb.State(); state != BreakerClosed {
+		t.Fatalf("Expected breaker to be %s, got %s", BreakerClosed, state)
+	}
+
+	breakerRequest(cb, false, time.Second)
+	if state := cb.State(); state != BreakerOpen {
+		t.Fatalf("Expected breaker to be %s, got %s", BreakerOpen, state)
+	}
+}
+
+func TestParseBlockCircuitBreaker(t *testing.T) {
+	tests := []struct {
+		config    string
+		shouldErr bool
+		expected  BreakerConfig
+	}{
+		{"circuit_breaker_error_ratio 0.25\ncircuit_breaker_latency 250ms\ncircuit_breaker_window 1m\ncircuit_breaker_min_requests 50\ncircuit_breaker_open_duration 15s\ncircuit_breaker_half_open_requests 3", false,
+			BreakerConfig{Window: time.Minute, ErrorRatio: 0.25, Latency: 250 * time.Millisecond, MinRequests: 50, OpenDuration: 15 * time.Second, HalfOpenRequests: 3}},
+		{"circuit_breaker_error_ratio 1.5", true, BreakerConfig{}},
+		{"circuit_breaker_latency -1s", true, BreakerConfig{}},
+		{"circuit_breaker_min_requests 0", true, BreakerConfig{}},
+		{"circuit_breaker_window", true, BreakerConfig{}},
+		{"circuit_breaker_window soon", true, BreakerConfig{}},
+		{"circuit_breaker_error_ratio half", true, BreakerConfig{}},
+		{"circuit_breaker_half_open_requests many", true, BreakerConfig{}},
+	}
+
+	for i, test := range tests {
+		u := staticUpstream{}
+		c := casketfile.NewDispenser("Testfile", strings.NewReader(test.config))
+		var err error
+		for c.Next() && err == nil {
+			err = parseBlock(&c, &u, false)
+		}
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test %d: expected error=%v, got %v", i, test.shouldErr, err)
+		}
+		if err != nil && !strings.HasPrefix(err.Error(), "Testfile:1 - ") {
+			t.Errorf("Test %d: expected error with the config location, got %v", i, err)
+		}
+		if !test.shouldErr && u.Breaker != test.expected {
+			t.Errorf("Test %d: expected %+v, got %+v", i, test.expected, u.Breaker)
+		}
+	}
+}
+
+func TestProxyCircuitBreaker(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	config := "proxy / " + backend.URL + " {\n circuit_breaker_error_ratio 0.5\n circuit_breaker_min_requests 2\n}"
+	upstreams, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+	if err != nil {
+		t.Fatalf("Expected no error. Got: %s", err.Error())
+	}
+	p := &Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams}
+
+	expected := []struct {
+		status  int
+		breaker string
+	}{
+		{http.StatusServiceUnavailable, BreakerClosed},
+		{http.StatusServiceUnavailable, BreakerOpen},
+		{http.StatusBadGateway, "-"},
+	}
+	for i, exp := range expected {
+		r := httptest.NewRequest("GET", "/", nil)
+		rr := httpserver.NewResponseRecorder(testResponseRecorder{
+			ResponseWriterWrapper: &httpserver.ResponseWriterWrapper{ResponseWriter: httptest.NewRecorder()},
+		})
+		rr.Replacer = httpserver.NewReplacer(r, rr, "-")
+		status, _ := p.ServeHTTP(rr, r)
+		if status == 0 {
+			status = rr.Status()
+		}
+		if status != exp.status {
+			t.Errorf("Request %d: expected status %d, got %d", i, exp.status, status)
+		}
+		if state := rr.Replacer.Replace("{upstream_breaker}"); state != exp.breaker {
+			t.Errorf("Request %d: expected breaker state %s, got %s", i, exp.breaker, state)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+const (
+	defaultHashKey        = "{uri}"
+	defaultHashLoadFactor = 1.25
+	defaultHashVirtual    = 100
+)
+
+// ConsistentHash is a policy that selects hosts using a hash ring with
+// virtual nodes, so that adding or removing a host only remaps the keys
+// of that host. With bounded loads, no host is given more than
+// LoadFactor times the average number of connections; excess requests
+// spill over to the next host on the ring.
+type ConsistentHash struct {
+	// Key is a placeholder string, such as "{path}" or
+	// "{~session}", which is hashed to select a host.
+	Key string
+
+	// LoadFactor bounds the connections of each host to this
+	// multiple of the average. Zero disables bounded loads.
+	LoadFactor float64
+
+	// Virtual is the number of points each host has on the ring.
+	Virtual int
+
+	err   error
+	mutex sync.Mutex
+	pool  HostPool // the pool the ring was built from
+	ring  []ringNode
+}
+
+type ringNode struct {
+	hash uint32
+	host *UpstreamHost
+}
+
+// newConsistentHash creates a ConsistentHash policy from the
+// arguments [key [load_factor [virtual_nodes]]].
+func newConsistentHash(args []string) *ConsistentHash {
+	r := &ConsistentHash{
+		Key:        defaultHashKey,
+		LoadFactor: defaultHashLoadFactor,
+		Virtual:    defaultHashVirtual,
+	}
+	if len(args) > 3 {
+		r.err = fmt.Errorf("consistent_hash takes at most 3 arguments, got %d", len(args))
+		return r
+	}
+	if len(args) > 0 {
+		r.Key = args[0]
+	}
+	if len(args) > 1 {
+		factor, err := strconv.ParseFloat(args[1], 64)
+		if err != nil || (factor != 0 && factor < 1) {
+			r.err = fmt.Errorf("invalid consistent_hash load factor '%s': must be 0 or at least 1", args[1])
+			return r
+		}
+		r.LoadFactor = factor
+	}
+	if len(args) > 2 {
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 1 {
+			r.err = fmt.Errorf("invalid consistent_hash virtual nodes '%s': must be a positive integer", args[2])
+			return r
+		}
+		r.Virtual = n
+	}
+	return r
+}
+
+func (r *ConsistentHash) validate() error {
+	return r.err
+}
+
+// Select selects the first available host at or after the hash of
+// the request's key on the ring, skipping hosts that are over their
+// load bound.
+func (r *ConsistentHash) Select(pool HostPool, request *http.Request) *UpstreamHost {
+	if len(pool) == 0 {
+		return nil
+	}
+	key := httpserver.NewReplacer(request, nil, "").Replace(r.Key)
+	ring := r.getRing(pool)
+
+	// the bound on each host's connections, counting this request
+	bound := int64(math.MaxInt64)
+	if r.LoadFactor > 0 {
+		var total int64
+		available := 0
+		for _, host := range pool {
+			if host.Available() {
+				total += atomic.LoadInt64(&host.Conns)
+				available++
+			}
+		}
+		if available == 0 {
+			return nil
+		}
+		bound = int64(math.Ceil(r.LoadFactor * float64(total+1) / float64(available)))
+	}
+
+	h := hash(key)
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	var fallback *UpstreamHost
+	for i := 0; i < len(ring); i++ {
+		host := ring[(start+i)%len(ring)].host
+		if !host.Available() {
+			continue
+		}
+		if atomic.LoadInt64(&host.Conns)+1 <= bound {
+			return host
+		}
+		if fallback == nil {
+			fallback = host
+		}
+	}
+	return fallback
+}
+
+// getRing returns the hash ring for pool, rebuilding
+// it if the hosts in the pool have changed.
+func (r *ConsistentHash) getRing(pool HostPool) []ringNode {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if samePool(r.pool, pool) {
+		return r.ring
+	}
+
+	virtual := r.Virtual
+	if virtual < 1 {
+		virtual = defaultHashVirtual
+	}
+	ring := make([]ringNode, 0, len(pool)*virtual)
+	for _, host := range pool {
+		for i := 0; i < virtual; i++ {
+			ring = append(ring, ringNode{hash(host.Name + "-" + strconv.Itoa(i)), host})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	r.pool = append(HostPool(nil), pool...)
+	r.ring = ring
+	return ring
+}
+
+// samePool returns true if a and b contain the same hosts in the same order.
+func samePool(a, b HostPool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,157 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/tmpim/casket/casketfile"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func consistentHashPool(n int) HostPool {
+	var pool HostPool
+	for i := 0; i < n; i++ {
+		pool = append(pool, &UpstreamHost{Name: fmt.Sprintf("http://10.0.0.%d:80", i+1)})
+	}
+	return pool
+}
+
+func TestConsistentHashPolicy(t *testing.T) {
+	pool := consistentHashPool(5)
+	policy := newConsistentHash([]string{"{path}", "0"})
+
+	selectFor := func(pool HostPool, path string) *UpstreamHost {
+		r, _ := http.NewRequest("GET", path, nil)
+		r = r.WithContext(context.WithValue(r.Context(), httpserver.OriginalURLCtxKey, *r.URL))
+		return policy.Select(pool, r)
+	}
+
+	// the same key always maps to the same host
+	before := make(map[string]*UpstreamHost)
+	for i := 0; i < 1000; i++ {
+		path := fmt.Sprintf("/item/%d", i)
+		before[path] = selectFor(pool, path)
+		if again := selectFor(pool, path); again != before[path] {
+			t.Fatalf("Expected %s to map to %s again, got %s", path, before[path].Name, again.Name)
+		}
+	}
+
+	// keys are spread over all hosts
+	perHost := make(map[*UpstreamHost]int)
+	for _, host := range before {
+		perHost[host]++
+	}
+	for _, host := range pool {
+		if perHost[host] < 100 {
+			t.Errorf("Expected at least 100 of 1000 keys on %s, got %d", host.Name, perHost[host])
+		}
+	}
+
+	// removing a host only remaps the keys it was responsible for
+	removed := pool[2]
+	smaller := append(append(HostPool{}, pool[:2]...), pool[3:]...)
+	for path, host := range before {
+		after := selectFor(smaller, path)
+		if host != removed && after != host {
+			t.Errorf("Expected %s to stay on %s after removing %s, got %s", path, host.Name, removed.Name, after.Name)
+		}
+	}
+
+	// marking a host down behaves the same as removing it
+	removed.Unhealthy = 1
+	for path, host := range before {
+		after := selectFor(pool, path)
+		if after == removed {
+			t.Errorf("Expected %s not to be selected while down", removed.Name)
+		}
+		if host != removed && after != host {
+			t.Errorf("Expected %s to stay on %s while %s is down, got %s", path, host.Name, removed.Name, after.Name)
+		}
+	}
+
+	// no host available
+	for _, host := range pool {
+		host.Unhealthy = 1
+	}
+	if h := selectFor(pool, "/"); h != nil {
+		t.Errorf("Expected no host to be selected when all are down, got %s", h.Name)
+	}
+}
+
+func TestConsistentHashBoundedLoads(t *testing.T) {
+	pool := consistentHashPool(4)
+	policy := newConsistentHash([]string{"{>X-Key}", "1.5"})
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Key", "hot")
+
+	// all requests for a hot key pile up on one host until it reaches
+	// its bound, after which they spill over to other hosts
+	counts := make(map[*UpstreamHost]int)
+	for i := 0; i < 40; i++ {
+		host := policy.Select(pool, r)
+		host.Conns++
+		counts[host]++
+	}
+	for host, n := range counts {
+		// ceil(1.5 * 40 / 4)
+		if n > 15 {
+			t.Errorf("Expected at most 15 connections on %s, got %d", host.Name, n)
+		}
+	}
+	if len(counts) < 3 {
+		t.Errorf("Expected load to spill over to at least 3 hosts, got %d", len(counts))
+	}
+}
+
+func TestConsistentHashArgs(t *testing.T) {
+	tests := []struct {
+		config     string
+		shouldErr  bool
+		key        string
+		loadFactor float64
+		virtual    int
+	}{
+		{"policy consistent_hash", false, "{uri}", 1.25, 100},
+		{"policy consistent_hash {~session}", false, "{~session}", 1.25, 100},
+		{"policy consistent_hash {path} 2 50", false, "{path}", 2, 50},
+		{"policy consistent_hash {path} 0", false, "{path}", 0, 100},
+		{"policy consistent_hash {path} 0.5", true, "", 0, 0},
+		{"policy consistent_hash {path} 2 none", true, "", 0, 0},
+		{"policy consistent_hash {path} 2 50 extra", true, "", 0, 0},
+	}
+
+	for i, test := range tests {
+		u := staticUpstream{}
+		c := casketfile.NewDispenser("Testfile", strings.NewReader(test.config))
+		c.Next()
+		err := parseBlock(&c, &u, false)
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test %d: expected error=%v, got %v", i, test.shouldErr, err)
+		}
+		if test.shouldErr {
+			continue
+		}
+		policy := u.Policy.(*ConsistentHash)
+		if policy.Key != test.key || policy.LoadFactor != test.loadFactor || policy.Virtual != test.virtual {
+			t.Errorf("Test %d: expected key=%s load_factor=%v virtual=%d, got key=%s load_factor=%v virtual=%d",
+				i, test.key, test.loadFactor, test.virtual, policy.Key, policy.LoadFactor, policy.Virtual)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const defaultStickyCookie = "casket_upstream"
+
+// defaultCookieSecret signs the cookies of policies without a secret
+// of their own. It is generated once per process, so that cookies stay
+// valid when the config is reloaded, but not when casket is restarted.
+var (
+	defaultCookieSecret     []byte
+	defaultCookieSecretErr  error
+	defaultCookieSecretOnce sync.Once
+)
+
+// Cookie is a policy that pins clients to the host they were first sent
+// to with a signed cookie. Requests without a valid cookie, or whose host
+// is no longer available, are routed using the fallback policy.
+type Cookie struct {
+	// Name is the name of the cookie.
+	Name string
+
+	// Fallback selects hosts for clients without a usable cookie.
+	Fallback Policy
+
+	secret []byte
+	err    error
+}
+
+// newCookie creates a Cookie policy from the arguments
+// [name [secret [fallback_policy [fallback_args...]]]]. If no secret is
+// given, a random one is used, which invalidates cookies on restart.
+func newCookie(args []string) *Cookie {
+	r := &Cookie{
+		Name:     defaultStickyCookie,
+		Fallback: &Random{},
+	}
+	if len(args) > 0 {
+		r.Name = args[0]
+	}
+	if len(args) > 1 {
+		r.secret = []byte(args[1])
+	} else {
+		defaultCookieSecretOnce.Do(func() {
+			defaultCookieSecret = make([]byte, 32)
+			if _, err := rand.Read(defaultCookieSecret); err != nil {
+				defaultCookieSecretErr = fmt.Errorf("generating cookie secret: %v", err)
+			}
+		})
+		if defaultCookieSecretErr != nil {
+			r.err = defaultCookieSecretErr
+			return r
+		}
+		r.secret = defaultCookieSecret
+	}
+	if len(args) > 2 {
+		name := args[2]
+		policyCreateFunc, ok := supportedPolicies[name]
+		if !ok || name == "cookie" {
+			r.err = fmt.Errorf("invalid fallback policy '%s' for cookie policy", name)
+			return r
+		}
+		r.Fallback = policyCreateFunc(args[3:])
+		if v, ok := r.Fallback.(validator); ok {
+			r.err = v.validate()
+		}
+	}
+	return r
+}
+
+func (r *Cookie) validate() error {
+	return r.err
+}
+
+// Select selects the host identified by the request's cookie if it is
+// available, and otherwise defers to the fallback policy.
+func (r *Cookie) Select(pool HostPool, request *http.Request) *UpstreamHost {
+	if host := r.cookieHost(pool, request); host != nil && host.Available() {
+		return host
+	}
+	return r.Fallback.Select(pool, request)
+}
+
+// updateResponse sets the cookie on resp if the request wasn't
+// already pinned to host.
+func (r *Cookie) updateResponse(host *UpstreamHost, request *http.Request, resp *http.Response) {
+	if r.cookieHost(HostPool{host}, request) == host {
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     r.Name,
+		Value:    r.sign(host),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   request.TLS != nil,
+	}
+	resp.Header.Add("Set-Cookie", cookie.String())
+}
+
+// cookieHost returns the host from pool which the request's
+// cookie identifies, or nil if there's no valid cookie.
+func (r *Cookie) cookieHost(pool HostPool, request *http.Request) *UpstreamHost {
+	cookie, err := request.Cookie(r.Name)
+	if err != nil {
+		return nil
+	}
+	for _, host := range pool {
+		if hmac.Equal([]byte(cookie.Value), []byte(r.sign(host))) {
+			return host
+		}
+	}
+	return nil
+}
+
+// sign returns the cookie value identifying host, which is an opaque
+// identifier of the host followed by its signature.
+func (r *Cookie) sign(host *UpstreamHost) string {
+	sum := sha256.Sum256([]byte(host.Name))
+	id := hex.EncodeToString(sum[:8])
+	mac := hmac.New(sha256.New, r.secret)
+	mac.Write([]byte(id))
+	return id + "." + hex.EncodeToString(mac.Sum(nil))
+}
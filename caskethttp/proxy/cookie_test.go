@@ -0,0 +1,119 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCookiePolicy(t *testing.T) {
+	pool := testPool()
+	policy := newCookie([]string{"sticky", "secret", "round_robin"})
+	if err := policy.validate(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, ok := policy.Fallback.(*RoundRobin); !ok {
+		t.Fatalf("Expected round_robin fallback, got %T", policy.Fallback)
+	}
+
+	// first request has no cookie, so the fallback picks a host and
+	// the response pins the client to it
+	r, _ := http.NewRequest("GET", "/", nil)
+	h := policy.Select(pool, r)
+	resp := &http.Response{Header: make(http.Header)}
+	policy.updateResponse(h, r, resp)
+	setCookie := resp.Header.Get("Set-Cookie")
+	if !strings.HasPrefix(setCookie, "sticky=") {
+		t.Fatalf("Expected sticky cookie to be set, got %q", setCookie)
+	}
+	if strings.Contains(setCookie, h.Name) {
+		t.Errorf("Expected cookie not to reveal the host address, got %q", setCookie)
+	}
+	cookie := (&http.Response{Header: resp.Header}).Cookies()[0]
+
+	// later requests stick to the same host without setting the cookie again
+	for i := 0; i < 5; i++ {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		if got := policy.Select(pool, r); got != h {
+			t.Fatalf("Expected sticky host %s, got %s", h.Name, got.Name)
+		}
+		resp := &http.Response{Header: make(http.Header)}
+		policy.updateResponse(h, r, resp)
+		if got := resp.Header.Get("Set-Cookie"); got != "" {
+			t.Errorf("Expected no cookie to be set again, got %q", got)
+		}
+	}
+
+	// a tampered cookie is ignored
+	r, _ = http.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "sticky", Value: cookie.Value[:len(cookie.Value)-1] + "0"})
+	if policy.cookieHost(pool, r) != nil {
+		t.Error("Expected tampered cookie to be rejected")
+	}
+
+	// a cookie signed with another secret is ignored
+	other := newCookie([]string{"sticky", "other"})
+	r, _ = http.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	if other.cookieHost(pool, r) != nil {
+		t.Error("Expected cookie signed with another secret to be rejected")
+	}
+
+	// the fallback takes over when the sticky host goes down,
+	// and the client is pinned to the new host
+	h.Unhealthy = 1
+	r, _ = http.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	h2 := policy.Select(pool, r)
+	if h2 == h {
+		t.Fatalf("Expected a different host when %s is down", h.Name)
+	}
+	resp = &http.Response{Header: make(http.Header)}
+	policy.updateResponse(h2, r, resp)
+	if resp.Header.Get("Set-Cookie") == "" {
+		t.Error("Expected cookie to be updated for the new host")
+	}
+}
+
+func TestCookiePolicyArgs(t *testing.T) {
+	policy := newCookie(nil)
+	if policy.Name != defaultStickyCookie {
+		t.Errorf("Expected default cookie name %s, got %s", defaultStickyCookie, policy.Name)
+	}
+	if _, ok := policy.Fallback.(*Random); !ok {
+		t.Errorf("Expected random fallback, got %T", policy.Fallback)
+	}
+	if len(policy.secret) == 0 {
+		t.Error("Expected a random secret to be generated")
+	}
+
+	// the random secret is kept when the config is reloaded
+	host := &UpstreamHost{Name: "http://localhost:8080"}
+	if reloaded := newCookie(nil); reloaded.sign(host) != policy.sign(host) {
+		t.Error("Expected cookies to stay valid across reloads")
+	}
+
+	for _, name := range []string{"cookie", "nonexistent"} {
+		if err := newCookie([]string{"sticky", "secret", name}).validate(); err == nil {
+			t.Errorf("Expected error for fallback policy %s", name)
+		}
+	}
+	if err := newCookie([]string{"sticky", "secret", "consistent_hash", "{uri}", "0.5"}).validate(); err == nil {
+		t.Error("Expected error from invalid fallback policy arguments")
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultDNSInterval is how often upstream_dns names
+// are re-resolved if no interval is configured.
+const defaultDNSInterval = 30 * time.Second
+
+// defaultFileInterval is how often the upstream_file
+// is checked for changes if no interval is configured.
+const defaultFileInterval = 5 * time.Second
+
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// hostSpec describes an upstream host before it is turned
+// into an UpstreamHost.
+type hostSpec struct {
+	name       string
+	weight     int
+	serverName string // TLS server name, if it differs from the host in name
+}
+
+// dnsUpstream is a name which is periodically re-resolved
+// into upstream hosts.
+type dnsUpstream struct {
+	name   string
+	weight int
+}
+
+// hosts returns the current host pool.
+func (u *staticUpstream) hosts() HostPool {
+	u.hostsMu.RLock()
+	defer u.hostsMu.RUnlock()
+	return u.Hosts
+}
+
+// setDiscovered replaces the hosts found by the given
+// discovery source and swaps in the resulting host pool.
+func (u *staticUpstream) setDiscovered(source string, specs []hostSpec) error {
+	u.hostsMu.Lock()
+	defer u.hostsMu.Unlock()
+	if u.discovered == nil {
+		u.discovered = make(map[string][]hostSpec)
+	}
+	u.discovered[source] = specs
+	return u.rebuildHosts()
+}
+
+// rebuildHosts builds the host pool from the statically configured
+// hosts followed by all discovered ones, in a stable order. Hosts
+// which are already in the pool are kept as they are, so that their
+// connection counts, failures and health carry over. u.hostsMu
+// must be held.
+func (u *staticUpstream) rebuildHosts() error {
+	specs := append([]hostSpec{}, u.staticHosts...)
+	sources := make([]string, 0, len(u.discovered))
+	for source := range u.discovered {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		specs = append(specs, u.discovered[source]...)
+	}
+
+	existing := make(map[string][]*UpstreamHost, len(u.Hosts))
+	for _, host := range u.Hosts {
+		existing[host.Name] = append(existing[host.Name], host)
+	}
+
+	pool := make(HostPool, 0, len(specs))
+	for _, spec := range specs {
+		// a host whose weight changed is replaced, as policies
+		// read the weight without synchronization
+		name := hostName(spec.name)
+		if hosts := existing[name]; len(hosts) > 0 && hosts[0].Weight == spec.weight {
+			pool = append(pool, hosts[0])
+			existing[name] = hosts[1:]
+			continue
+		}
+		host, err := u.NewHost(spec.name)
+		if err != nil {
+			return err
+		}
+		host.Weight = spec.weight
+		if spec.serverName != "" {
+			host.ReverseProxy.UseServerName(spec.serverName)
+		}
+		pool = append(pool, host)
+	}
+
+	// let go of idle connections to hosts which were removed;
+	// requests still in flight to them are unaffected
+	kept := make(map[*UpstreamHost]struct{}, len(pool))
+	for _, host := range pool {
+		kept[host] = struct{}{}
+	}
+	for _, host := range u.Hosts {
+		if _, ok := kept[host]; ok || host.ReverseProxy == nil {
+			continue
+		}
+		if t, ok := host.ReverseProxy.Transport.(interface{ CloseIdleConnections() }); ok {
+			t.CloseIdleConnections()
+		}
+	}
+	u.Hosts = pool
+	if hu, ok := u.Policy.(hostsUpdater); ok {
+		hu.updateHosts(pool)
+	}
+	return nil
+}
+
+// parseDNSUpstream validates an upstream_dns name, which is either
+// a service locator or a host name with an optional scheme and port.
+func parseDNSUpstream(name string) error {
+	if strings.HasPrefix(name, "srv://") || strings.HasPrefix(name, "srv+https://") {
+		return nil
+	}
+	if !strings.Contains(name, "://") {
+		name = "http://" + name
+	}
+	target, err := url.Parse(name)
+	if err != nil {
+		return err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme '%s' for upstream_dns", target.Scheme)
+	}
+	if target.Hostname() == "" || (target.Path != "" && target.Path != "/") {
+		return fmt.Errorf("invalid upstream_dns name '%s'", name)
+	}
+	return nil
+}
+
+// resolveDNS resolves an upstream_dns name into its current hosts,
+// using A/AAAA records for host names and SRV records for service
+// locators.
+func (u *staticUpstream) resolveDNS(d dnsUpstream) ([]hostSpec, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var specs []hostSpec
+	if strings.HasPrefix(d.name, "srv://") || strings.HasPrefix(d.name, "srv+https://") {
+		scheme := "http"
+		service := strings.TrimPrefix(d.name, "srv://")
+		if strings.HasPrefix(d.name, "srv+https://") {
+			scheme = "https"
+			service = strings.TrimPrefix(d.name, "srv+https://")
+		}
+		_, addrs, err := u.resolver.LookupSRV(ctx, "", "", service)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			target := strings.TrimSuffix(addr.Target, ".")
+			specs = append(specs, hostSpec{
+				name:   scheme + "://" + net.JoinHostPort(target, strconv.Itoa(int(addr.Port))),
+				weight: d.weight,
+			})
+		}
+		return specs, nil
+	}
+
+	name := d.name
+	if !strings.Contains(name, "://") {
+		name = "http://" + name
+	}
+	target, err := url.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addrs, err := u.hostResolver.LookupHost(ctx, target.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		spec := hostSpec{
+			name:   target.Scheme + "://" + net.JoinHostPort(addr, port),
+			weight: d.weight,
+		}
+		if target.Scheme == "https" {
+			spec.serverName = target.Hostname()
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// refreshDNS re-resolves all upstream_dns names. If a name fails to
+// resolve, the hosts previously found for it are kept.
+func (u *staticUpstream) refreshDNS() {
+	for _, d := range u.DNSUpstreams {
+		specs, err := u.resolveDNS(d)
+		if err != nil {
+			log.Printf("[ERROR] proxy: resolving upstream %s: %v", d.name, err)
+			continue
+		}
+		if err := u.setDiscovered("dns:"+d.name, specs); err != nil {
+			log.Printf("[ERROR] proxy: updating hosts of upstream %s: %v", d.name, err)
+		}
+	}
+}
+
+// DNSWorker re-resolves the upstream_dns names
+// every DNSInterval until stop is closed.
+func (u *staticUpstream) DNSWorker(stop chan struct{}) {
+	ticker := time.NewTicker(u.DNSInterval)
+	for {
+		select {
+		case <-ticker.C:
+			u.refreshDNS()
+		case <-stop:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// parseUpstreamList parses a list of upstream hosts with one
+// "host:port [weight]" entry per line. Blank lines and lines
+// starting with # are ignored.
+func parseUpstreamList(r io.Reader) ([]hostSpec, error) {
+	var specs []hostSpec
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: expected host and optional weight", line)
+		}
+		if strings.HasPrefix(fields[0], "srv://") || strings.HasPrefix(fields[0], "srv+https://") {
+			return nil, fmt.Errorf("line %d: service locators are not supported", line)
+		}
+		weight := 1
+		if len(fields) == 2 {
+			w, err := strconv.Atoi(strings.TrimPrefix(fields[1], "weight="))
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("line %d: invalid weight '%s': must be a positive integer", line, fields[1])
+			}
+			weight = w
+		}
+		hosts, err := parseUpstream(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		for _, host := range hosts {
+			specs = append(specs, hostSpec{name: host, weight: weight})
+		}
+	}
+	return specs, scanner.Err()
+}
+
+// loadUpstreamFile reads the upstream_file if it changed since it was
+// last loaded and swaps in its hosts.
+func (u *staticUpstream) loadUpstreamFile() error {
+	info, err := os.Stat(u.UpstreamFile)
+	if err != nil {
+		return err
+	}
+	if u.upstreamFileInfo != nil &&
+		info.Size() == u.upstreamFileInfo.Size() &&
+		info.ModTime().Equal(u.upstreamFileInfo.ModTime()) {
+		return nil
+	}
+
+	file, err := os.Open(u.UpstreamFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	specs, err := parseUpstreamList(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", u.UpstreamFile, err)
+	}
+	if err := u.setDiscovered("file:"+u.UpstreamFile, specs); err != nil {
+		return err
+	}
+	u.upstreamFileInfo = info
+	return nil
+}
+
+// FileWorker reloads the upstream_file whenever it changes, checking
+// every FileInterval until stop is closed. If the file can't be
+// loaded, the hosts previously read from it are kept.
+func (u *staticUpstream) FileWorker(stop chan struct{}) {
+	ticker := time.NewTicker(u.FileInterval)
+	for {
+		select {
+		case <-ticker.C:
+			if err := u.loadUpstreamFile(); err != nil {
+				log.Printf("[ERROR] proxy: loading upstream file: %v", err)
+			}
+		case <-stop:
+			ticker.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tmpim/casket/casketfile"
+)
+
+type testHostResolver struct {
+	sync.Mutex
+	addrs map[string][]string
+}
+
+func (r *testHostResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.Lock()
+	defer r.Unlock()
+	addrs, ok := r.addrs[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return addrs, nil
+}
+
+func (r *testHostResolver) set(host string, addrs ...string) {
+	r.Lock()
+	defer r.Unlock()
+	r.addrs[host] = addrs
+}
+
+func hostNames(pool HostPool) []string {
+	var names []string
+	for _, host := range pool {
+		names = append(names, host.Name)
+	}
+	return names
+}
+
+func TestUpstreamDNSRefresh(t *testing.T) {
+	resolver := &testHostResolver{addrs: make(map[string][]string)}
+	resolver.set("backend.internal", "10.0.0.1", "10.0.0.2")
+	resolver.set("secure.internal", "fd00::1")
+
+	u := &staticUpstream{
+		Policy:       &Random{},
+		MaxFails:     1,
+		hostResolver: resolver,
+		resolver: testResolver{
+			result: []*net.SRV{
+				{Target: "a.service.", Port: 8080},
+			},
+		},
+		staticHosts: []hostSpec{{name: "http://static:80", weight: 1}},
+		DNSUpstreams: []dnsUpstream{
+			{name: "backend.internal:8080", weight: 3},
+			{name: "https://secure.internal", weight: 1},
+			{name: "srv://_http._tcp.service", weight: 1},
+		},
+	}
+	if err := u.rebuildHosts(); err != nil {
+		t.Fatal(err)
+	}
+	u.refreshDNS()
+
+	expected := []string{
+		"http://static:80",
+		"http://10.0.0.1:8080",
+		"http://10.0.0.2:8080",
+		"https://[fd00::1]:443",
+		"http://a.service:8080",
+	}
+	if got := hostNames(u.hosts()); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected hosts %v, got %v", expected, got)
+	}
+	for _, host := range u.hosts()[1:3] {
+		if host.Weight != 3 {
+			t.Errorf("Expected weight 3 for %s, got %d", host.Name, host.Weight)
+		}
+	}
+	transport := u.hosts()[3].ReverseProxy.Transport.(*http.Transport)
+	if transport.TLSClientConfig == nil || transport.TLSClientConfig.ServerName != "secure.internal" {
+		t.Errorf("Expected TLS server name secure.internal, got %+v", transport.TLSClientConfig)
+	}
+
+	// state of hosts which remain is kept
+	kept := u.hosts()[2]
+	kept.Conns = 5
+	kept.Fails = 1
+	resolver.set("backend.internal", "10.0.0.2", "10.0.0.3")
+	u.refreshDNS()
+	expected = []string{
+		"http://static:80",
+		"http://10.0.0.2:8080",
+		"http://10.0.0.3:8080",
+		"https://[fd00::1]:443",
+		"http://a.service:8080",
+	}
+	if got := hostNames(u.hosts()); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected hosts %v, got %v", expected, got)
+	}
+	if u.hosts()[1] != kept || kept.Conns != 5 || kept.Fails != 1 {
+		t.Errorf("Expected host %s and its state to be kept", kept.Name)
+	}
+
+	// hosts are kept if resolution fails
+	resolver.Lock()
+	delete(resolver.addrs, "backend.internal")
+	resolver.Unlock()
+	u.refreshDNS()
+	if got := hostNames(u.hosts()); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected hosts %v after failed lookup, got %v", expected, got)
+	}
+	if u.GetHostCount() != len(expected) {
+		t.Errorf("Expected host count %d, got %d", len(expected), u.GetHostCount())
+	}
+}
+
+func TestUpstreamDNSParse(t *testing.T) {
+	upstreams, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(`
+	proxy / {
+		upstream_dns localhost:8080 weight=2
+		upstream_dns_interval 1m
+	}`)), "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	u := upstreams[0].(*staticUpstream)
+	defer u.Stop()
+	if u.DNSInterval != time.Minute {
+		t.Errorf("Expected interval 1m, got %v", u.DNSInterval)
+	}
+	if len(u.DNSUpstreams) != 1 || u.DNSUpstreams[0] != (dnsUpstream{"localhost:8080", 2}) {
+		t.Errorf("Expected localhost:8080 with weight 2, got %+v", u.DNSUpstreams)
+	}
+
+	for _, input := range []string{
+		"proxy / {\n upstream_dns \n}",
+		"proxy / {\n upstream_dns ftp://backend \n}",
+		"proxy / {\n upstream_dns backend/path \n}",
+		"proxy / {\n upstream_dns backend weight=0 \n}",
+		"proxy / {\n upstream_dns backend \n upstream_dns_interval 0s \n}",
+		"proxy / srv://_http._tcp.service {\n upstream_dns backend \n}",
+	} {
+		upstreams, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(input)), "")
+		if err == nil {
+			for _, u := range upstreams {
+				u.Stop()
+			}
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+
+	input := "proxy / {\n upstream_dns backend \n upstream_dns_interval soon \n}"
+	if _, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(input)), ""); err == nil || !strings.HasPrefix(err.Error(), "Testfile:3 - ") {
+		t.Errorf("Expected error with the config location for %q, got %v", input, err)
+	}
+}
+
+func TestParseUpstreamList(t *testing.T) {
+	specs, err := parseUpstreamList(strings.NewReader(`
+# backends
+10.0.0.1:8080
+10.0.0.2:8080 3
+   10.0.0.3:8080   weight=2
+https://secure:8443
+10.0.1.1:9000-9001 2
+`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []hostSpec{
+		{name: "10.0.0.1:8080", weight: 1},
+		{name: "10.0.0.2:8080", weight: 3},
+		{name: "10.0.0.3:8080", weight: 2},
+		{name: "https://secure:8443", weight: 1},
+		{name: "10.0.1.1:9000", weight: 2},
+		{name: "10.0.1.1:9001", weight: 2},
+	}
+	if !reflect.DeepEqual(specs, expected) {
+		t.Errorf("Expected %v, got %v", expected, specs)
+	}
+
+	for _, input := range []string{
+		"10.0.0.1:8080 0",
+		"10.0.0.1:8080 heavy",
+		"10.0.0.1:8080 1 2",
+		"srv://_http._tcp.service",
+	} {
+		if _, err := parseUpstreamList(strings.NewReader(input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestUpstreamFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "casket_proxy_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "upstreams")
+	write := func(content string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("10.0.0.1:8080\n10.0.0.2:8080 2\n", time.Now().Add(-time.Hour))
+
+	upstreams, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(`
+	proxy / localhost:9000 {
+		upstream_file `+path+`
+		upstream_file_interval 1h
+	}`)), "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	u := upstreams[0].(*staticUpstream)
+	defer u.Stop()
+
+	expected := []string{"http://localhost:9000", "http://10.0.0.1:8080", "http://10.0.0.2:8080"}
+	if got := hostNames(u.hosts()); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected hosts %v, got %v", expected, got)
+	}
+	if w := u.hosts()[2].Weight; w != 2 {
+		t.Errorf("Expected weight 2, got %d", w)
+	}
+
+	// drain one backend and add another
+	kept := u.hosts()[2]
+	kept.Conns = 3
+	write("10.0.0.2:8080 2\n10.0.0.3:8080\n", time.Now())
+	if err := u.loadUpstreamFile(); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"http://localhost:9000", "http://10.0.0.2:8080", "http://10.0.0.3:8080"}
+	if got := hostNames(u.hosts()); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected hosts %v, got %v", expected, got)
+	}
+	if u.hosts()[1] != kept || kept.Conns != 3 {
+		t.Errorf("Expected host %s and its state to be kept", kept.Name)
+	}
+
+	// a broken file leaves the hosts as they are
+	write("10.0.0.4:8080 nope\n", time.Now().Add(time.Hour))
+	if err := u.loadUpstreamFile(); err == nil {
+		t.Error("Expected error for invalid upstream file")
+	}
+	if got := hostNames(u.hosts()); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected hosts %v after invalid file, got %v", expected, got)
+	}
+
+	// the file must be readable at startup
+	_, err = NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(`
+	proxy / {
+		upstream_file `+filepath.Join(dir, "missing")+`
+	}`)), "")
+	if err == nil {
+		t.Error("Expected error for missing upstream file")
+	}
+
+	_, err = NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(`
+	proxy / {
+		upstream_file `+path+`
+		upstream_file_interval hourly
+	}`)), "")
+	if err == nil || !strings.HasPrefix(err.Error(), "Testfile:4 - ") {
+		t.Errorf("Expected error with the config location for invalid upstream_file_interval, got %v", err)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// grpcHealthCheckPath is the method of the standard gRPC health
+// checking protocol, grpc.health.v1.Health/Check.
+const grpcHealthCheckPath = "/grpc.health.v1.Health/Check"
+
+// grpcServing is the SERVING value of HealthCheckResponse.ServingStatus.
+const grpcServing = 1
+
+// isGRPC returns true if contentType is that of a gRPC message.
+func isGRPC(contentType string) bool {
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+")
+}
+
+// grpcStatus returns the gRPC status code of a response which has
+// been read completely, if it is a gRPC response. The status is
+// usually a trailer, but is a header in trailers-only responses.
+func grpcStatus(resp *http.Response) (int, bool) {
+	if resp == nil || !isGRPC(resp.Header.Get("Content-Type")) {
+		return 0, false
+	}
+	value := resp.Header.Get("Grpc-Status")
+	if value == "" {
+		value = resp.Trailer.Get("Grpc-Status")
+	}
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	return code, true
+}
+
+// grpcFailed returns true if resp is a gRPC response with a status
+// that indicates a failure of the upstream rather than of the call,
+// i.e. the equivalent of a 5xx status.
+func grpcFailed(resp *http.Response) bool {
+	code, ok := grpcStatus(resp)
+	if !ok {
+		return false
+	}
+	switch code {
+	case 2, // UNKNOWN
+		4,  // DEADLINE_EXCEEDED
+		13, // INTERNAL
+		14, // UNAVAILABLE
+		15: // DATA_LOSS
+		return true
+	}
+	return false
+}
+
+// newH2CTransport returns a transport which speaks HTTP/2 over
+// plaintext connections dialed with dialer.
+func newH2CTransport(dialer *net.Dialer) *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// grpcHealthTransport sends gRPC health checks over HTTP/2, using
+// h2c for http URLs and TLS for https URLs.
+type grpcHealthTransport struct {
+	h2c *http2.Transport
+	tls *http2.Transport
+}
+
+func newGRPCHealthTransport(insecureSkipVerify bool) *grpcHealthTransport {
+	return &grpcHealthTransport{
+		h2c: newH2CTransport(defaultDialer),
+		tls: &http2.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSkipVerify},
+		},
+	}
+}
+
+func (t *grpcHealthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" {
+		return t.tls.RoundTrip(req)
+	}
+	return t.h2c.RoundTrip(req)
+}
+
+// grpcHealthRequest returns a framed HealthCheckRequest message
+// asking for the status of service.
+func grpcHealthRequest(service string) []byte {
+	var msg []byte
+	if service != "" {
+		msg = append(msg, 0x0a) // field 1, length-delimited
+		msg = binary.AppendUvarint(msg, uint64(len(service)))
+		msg = append(msg, service...)
+	}
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// parseGRPCHealthResponse returns the serving status
+// of a framed HealthCheckResponse message.
+func parseGRPCHealthResponse(body []byte) (uint64, error) {
+	if len(body) < 5 {
+		return 0, errors.New("short gRPC message")
+	}
+	if body[0] != 0 {
+		return 0, errors.New("compressed gRPC message")
+	}
+	n := binary.BigEndian.Uint32(body[1:5])
+	if uint32(len(body)-5) < n {
+		return 0, errors.New("short gRPC message")
+	}
+	msg := body[5 : 5+n]
+
+	// the status is field 1; unknown fields are skipped
+	var status uint64
+	for len(msg) > 0 {
+		tag, l := binary.Uvarint(msg)
+		if l <= 0 {
+			return 0, errors.New("invalid gRPC message")
+		}
+		msg = msg[l:]
+		switch tag & 7 {
+		case 0: // varint
+			v, l := binary.Uvarint(msg)
+			if l <= 0 {
+				return 0, errors.New("invalid gRPC message")
+			}
+			msg = msg[l:]
+			if tag>>3 == 1 {
+				status = v
+			}
+		case 2: // length-delimited
+			v, l := binary.Uvarint(msg)
+			if l <= 0 || uint64(len(msg)-l) < v {
+				return 0, errors.New("invalid gRPC message")
+			}
+			msg = msg[l+int(v):]
+		default:
+			return 0, errors.New("unexpected field in gRPC message")
+		}
+	}
+	return status, nil
+}
+
+// checkGRPCHealth performs a gRPC health check against hostURL and
+// reports whether the service is serving.
+func (u *staticUpstream) checkGRPCHealth(hostURL string) bool {
+	req, err := http.NewRequest(http.MethodPost, hostURL, bytes.NewReader(grpcHealthRequest(u.HealthCheck.GRPCService)))
+	if err != nil {
+		return false
+	}
+	for name, values := range u.HealthCheck.Headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	if u.HealthCheck.Host != "" {
+		req.Host = u.HealthCheck.Host
+	}
+	if host := u.HealthCheck.Headers.Get("Host"); host != "" {
+		req.Host = host
+	}
+
+	resp, err := u.HealthCheck.Client.Do(req)
+	if err != nil {
+		return false
+	}
+	// the body has to be read completely for the trailers
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return false
+	}
+	if code, ok := grpcStatus(resp); !ok || code != 0 {
+		return false
+	}
+	status, err := parseGRPCHealthResponse(body)
+	return err == nil && status == grpcServing
+}
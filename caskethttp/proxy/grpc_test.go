@@ -0,0 +1,211 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tmpim/casket/casketfile"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func newH2CServer(handler http.HandlerFunc) *httptest.Server {
+	return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+}
+
+// grpcHealthResponse returns a framed HealthCheckResponse,
+// preceded by an unknown field.
+func grpcHealthResponse(status uint64) []byte {
+	msg := []byte{0x12, 0x01, 'x', 0x08}
+	msg = binary.AppendUvarint(msg, status)
+	frame := make([]byte, 5)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+func TestGRPCHealthMessages(t *testing.T) {
+	req := grpcHealthRequest("my.Service")
+	expected := append([]byte{0, 0, 0, 0, 12, 0x0a, 10}, "my.Service"...)
+	if string(req) != string(expected) {
+		t.Errorf("Expected request %v, got %v", expected, req)
+	}
+	if req := grpcHealthRequest(""); string(req) != "\x00\x00\x00\x00\x00" {
+		t.Errorf("Expected empty request, got %v", req)
+	}
+
+	status, err := parseGRPCHealthResponse(grpcHealthResponse(grpcServing))
+	if err != nil || status != grpcServing {
+		t.Errorf("Expected status SERVING, got %d and %v", status, err)
+	}
+	for _, body := range [][]byte{
+		{0, 0, 0},
+		{1, 0, 0, 0, 0},
+		{0, 0, 0, 0, 5, 0x08},
+		{0, 0, 0, 0, 2, 0x12, 0x05},
+	} {
+		if _, err := parseGRPCHealthResponse(body); err == nil {
+			t.Errorf("Expected error for %v", body)
+		}
+	}
+}
+
+func TestGRPCFailed(t *testing.T) {
+	tests := []struct {
+		contentType string
+		header      string
+		trailer     string
+		failed      bool
+	}{
+		{"application/grpc", "", "0", false},
+		{"application/grpc", "", "5", false},
+		{"application/grpc+proto", "", "14", true},
+		{"application/grpc", "13", "", true},
+		{"application/json", "", "14", false},
+		{"application/grpc", "", "", false},
+	}
+	for i, test := range tests {
+		resp := &http.Response{Header: http.Header{}, Trailer: http.Header{}}
+		resp.Header.Set("Content-Type", test.contentType)
+		if test.header != "" {
+			resp.Header.Set("Grpc-Status", test.header)
+		}
+		if test.trailer != "" {
+			resp.Trailer.Set("Grpc-Status", test.trailer)
+		}
+		if got := grpcFailed(resp); got != test.failed {
+			t.Errorf("Test %d: Expected failed to be %v, got %v", i, test.failed, got)
+		}
+	}
+	if grpcFailed(nil) {
+		t.Error("Expected no failure without a response")
+	}
+}
+
+func TestReverseProxyH2CTrailers(t *testing.T) {
+	var status atomic.Value
+	status.Store("0")
+	backend := newH2CServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("Expected HTTP/2 request, got %s", r.Proto)
+		}
+		if te := r.Header.Get("Te"); te != "trailers" {
+			t.Errorf("Expected TE: trailers to be passed on, got %q", te)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+		w.Header().Set("Grpc-Status", status.Load().(string))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "unannounced")
+	})
+	defer backend.Close()
+
+	config := "proxy / " + backend.URL + " {\n transport h2c\n fail_timeout 1m\n max_fails 2\n}"
+	upstreams, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+	if err != nil {
+		t.Fatalf("Expected no error. Got: %s", err.Error())
+	}
+	p := &Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams}
+	host := upstreams[0].(*staticUpstream).Hosts[0]
+
+	for i, code := range []string{"0", "14", "5"} {
+		status.Store(code)
+		r := httptest.NewRequest("POST", "/pkg.Service/Method", strings.NewReader("message"))
+		r.Header.Set("Content-Type", "application/grpc")
+		r.Header.Set("Te", "trailers")
+		w := httptest.NewRecorder()
+		if _, err := p.ServeHTTP(testResponseRecorder{
+			ResponseWriterWrapper: &httpserver.ResponseWriterWrapper{ResponseWriter: w},
+		}, r); err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		res := w.Result()
+		if body, _ := ioutil.ReadAll(res.Body); string(body) != "message" {
+			t.Errorf("Test %d: Expected body to be proxied, got %q", i, body)
+		}
+		if got := res.Trailer.Get("Grpc-Status"); got != code {
+			t.Errorf("Test %d: Expected Grpc-Status trailer %s, got %q", i, code, got)
+		}
+		if got := res.Trailer.Get("Grpc-Message"); got != "unannounced" {
+			t.Errorf("Test %d: Expected unannounced Grpc-Message trailer, got %q", i, got)
+		}
+	}
+
+	// only UNAVAILABLE counts as a failure of the host
+	if fails := atomic.LoadInt32(&host.Fails); fails != 1 {
+		t.Errorf("Expected 1 failure to be counted, got %d", fails)
+	}
+
+	// h2c requires plaintext upstreams
+	config = "proxy / https://localhost {\n transport h2c\n}"
+	if _, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(config)), ""); err == nil {
+		t.Error("Expected error for h2c transport to an https upstream")
+	}
+}
+
+func TestGRPCHealthCheck(t *testing.T) {
+	var serving atomic.Value
+	serving.Store(true)
+	backend := newH2CServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != grpcHealthCheckPath || r.Method != http.MethodPost {
+			t.Errorf("Unexpected health check %s %s", r.Method, r.URL.Path)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != string(grpcHealthRequest("my.Service")) {
+			t.Errorf("Unexpected health check request %v", body)
+		}
+		status := uint64(2) // NOT_SERVING
+		if serving.Load().(bool) {
+			status = grpcServing
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write(grpcHealthResponse(status))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	})
+	defer backend.Close()
+
+	config := "proxy / " + backend.URL + " {\n transport h2c\n health_check_protocol grpc\n health_check_grpc_service my.Service\n health_check_interval 1h\n}"
+	upstreams, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+	if err != nil {
+		t.Fatalf("Expected no error. Got: %s", err.Error())
+	}
+	u := upstreams[0].(*staticUpstream)
+	defer u.Stop()
+
+	if u.HealthCheck.Path != grpcHealthCheckPath {
+		t.Errorf("Expected health check path %s, got %s", grpcHealthCheckPath, u.HealthCheck.Path)
+	}
+	if !u.checkHealth(backend.URL + grpcHealthCheckPath) {
+		t.Error("Expected SERVING backend to be healthy")
+	}
+	serving.Store(false)
+	if u.checkHealth(backend.URL + grpcHealthCheckPath) {
+		t.Error("Expected NOT_SERVING backend to be unhealthy")
+	}
+
+	config = "proxy / localhost {\n health_check_protocol websocket\n}"
+	if _, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(config)), ""); err == nil {
+		t.Error("Expected error for unsupported health check protocol")
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+const (
+	// defaultMirrorMaxBodySize is the largest request
+	// body that is mirrored if no limit is configured.
+	defaultMirrorMaxBodySize = 64 * 1024
+
+	// maxMirrorsInFlight is the number of mirrored requests
+	// an upstream has in flight at most. Requests beyond
+	// that are not mirrored.
+	maxMirrorsInFlight = 100
+)
+
+// Mirror sends copies of requests to a secondary upstream host,
+// discarding its responses.
+type Mirror struct {
+	// Host is the upstream host requests are mirrored to. It is
+	// set up like the upstream's other hosts, so it shares their
+	// transport settings.
+	Host *UpstreamHost
+
+	// Percent is the percentage of requests which are mirrored.
+	Percent float64
+
+	// MaxBodySize is the largest request body that is mirrored.
+	MaxBodySize int64
+
+	// Timeout is how long a mirrored request may take.
+	Timeout time.Duration
+
+	target   string
+	inFlight chan struct{}
+}
+
+// newMirror returns a Mirror for all requests, with target
+// yet to be set up as its host.
+func newMirror() *Mirror {
+	return &Mirror{
+		Percent:     100,
+		MaxBodySize: defaultMirrorMaxBodySize,
+		inFlight:    make(chan struct{}, maxMirrorsInFlight),
+	}
+}
+
+// parsePercent parses a percentage such as "10%" or "2.5".
+func parsePercent(s string) (float64, error) {
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || percent <= 0 || percent > 100 {
+		return 0, fmt.Errorf("invalid percentage '%s': must be above 0 and at most 100", s)
+	}
+	return percent, nil
+}
+
+// sample reports whether a request should be mirrored.
+func (m *Mirror) sample() bool {
+	return m.Percent >= 100 || rand.Float64()*100 < m.Percent
+}
+
+// errMirrorBodyTooLarge is returned by bufferBody
+// for requests which are too large to be mirrored.
+var errMirrorBodyTooLarge = errors.New("request body too large to mirror")
+
+// bufferBody returns a copy of the body of outreq, buffering the
+// body if it isn't buffered already.
+func (m *Mirror) bufferBody(outreq *http.Request) ([]byte, error) {
+	if outreq.Body == nil || outreq.Body == http.NoBody {
+		return nil, nil
+	}
+	bb, ok := outreq.Body.(*bufferedBody)
+	if !ok {
+		body, buffered, err := newLimitedBufferedBody(outreq.Body, m.MaxBodySize)
+		if err != nil {
+			return nil, err
+		}
+		outreq.Body = body
+		if !buffered {
+			return nil, errMirrorBodyTooLarge
+		}
+		bb = body.(*bufferedBody)
+	}
+	if int64(bb.Size()) > m.MaxBodySize {
+		return nil, errMirrorBodyTooLarge
+	}
+	b, err := ioutil.ReadAll(bb)
+	if err != nil {
+		return nil, err
+	}
+	return b, bb.rewind()
+}
+
+// send sends a copy of outreq with the given body to the mirror host
+// in the background. replacer is used to fill in upstream headers.
+func (m *Mirror) send(outreq *http.Request, body []byte, replacer httpserver.Replacer) {
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		return
+	}
+
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	mreq := outreq.Clone(ctx)
+	mreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	mreq.ContentLength = int64(len(body))
+	if nameURL, err := url.Parse(m.Host.Name); err == nil {
+		mreq.Host = nameURL.Host
+	}
+	if m.Host.UpstreamHeaders != nil {
+		mutateHeadersByRules(mreq.Header, m.Host.UpstreamHeaders, replacer, m.Host.UpstreamHeaderReplacements)
+		if hostHeaders, ok := mreq.Header["Host"]; ok && len(hostHeaders) > 0 {
+			mreq.Host = hostHeaders[len(hostHeaders)-1]
+		}
+	}
+
+	go func() {
+		defer func() {
+			cancel()
+			<-m.inFlight
+		}()
+
+		rp := m.Host.ReverseProxy
+		rp.Director(mreq)
+		if mreq.URL.Scheme == "quic" {
+			mreq.URL.Scheme = "https"
+		}
+		resp, err := rp.Transport.RoundTrip(mreq)
+		if err != nil {
+			log.Printf("[ERROR] proxy: mirroring %s %s to %s: %v", mreq.Method, mreq.URL.RequestURI(), m.Host.Name, err)
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			log.Printf("[ERROR] proxy: mirroring %s %s to %s: %s", mreq.Method, mreq.URL.RequestURI(), m.Host.Name, resp.Status)
+		}
+	}()
+}
@@ -0,0 +1,157 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmpim/casket/casketfile"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestParseBlockMirror(t *testing.T) {
+	tests := []struct {
+		config      string
+		shouldErr   bool
+		percent     float64
+		maxBodySize int64
+	}{
+		{"mirror localhost:8081", false, 100, defaultMirrorMaxBodySize},
+		{"mirror localhost:8081 12.5%\n mirror_max_body_size 1MB", false, 12.5, 1 << 20},
+		{"mirror_max_body_size 1MB\n mirror localhost:8081 5", false, 5, 1 << 20},
+		{"mirror", true, 0, 0},
+		{"mirror localhost:8081 0%", true, 0, 0},
+		{"mirror localhost:8081 101%", true, 0, 0},
+		{"mirror localhost:8081 10% extra", true, 0, 0},
+		{"mirror localhost:8081\n mirror localhost:8082", true, 0, 0},
+		{"mirror_max_body_size big", true, 0, 0},
+		{"mirror_max_body_size 1MB", true, 0, 0},
+	}
+
+	for i, test := range tests {
+		config := "proxy / localhost:8080 {\n " + test.config + "\n}"
+		upstreams, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+			continue
+		}
+		mirror := upstreams[0].(*staticUpstream).GetMirror()
+		if mirror == nil || mirror.Host == nil || mirror.Host.Name != "http://localhost:8081" {
+			t.Errorf("Test %d: Expected mirror to localhost:8081, got %+v", i, mirror)
+			continue
+		}
+		if mirror.Percent != test.percent || mirror.MaxBodySize != test.maxBodySize {
+			t.Errorf("Test %d: Expected %v%% and max body size %d, got %v%% and %d",
+				i, test.percent, test.maxBodySize, mirror.Percent, mirror.MaxBodySize)
+		}
+	}
+}
+
+type mirroredRequest struct {
+	method, uri, body, header string
+}
+
+func TestReverseProxyMirror(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	mirrored := make(chan mirroredRequest, 10)
+	release := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- mirroredRequest{r.Method, r.RequestURI, string(body), r.Header.Get("X-Shadow")}
+		<-release
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+	defer close(release)
+
+	config := "proxy / " + backend.URL + " {\n mirror " + shadow.URL + "\n mirror_max_body_size 8B\n header_upstream X-Shadow {method}\n}"
+	upstreams, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+	if err != nil {
+		t.Fatalf("Expected no error. Got: %s", err.Error())
+	}
+	p := &Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams}
+
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			p.ServeHTTP(testResponseRecorder{
+				ResponseWriterWrapper: &httpserver.ResponseWriterWrapper{ResponseWriter: w},
+			}, r)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the response not to wait for the mirror")
+		}
+		if w.Body.String() != body {
+			t.Errorf("Expected body %q, got %q", body, w.Body.String())
+		}
+		return w
+	}
+
+	// the shadow upstream blocks until released, which
+	// must not hold up the response to the client
+	serve("POST", "/submit?x=1", "payload")
+	select {
+	case m := <-mirrored:
+		expected := mirroredRequest{"POST", "/submit?x=1", "payload", "POST"}
+		if m != expected {
+			t.Errorf("Expected mirrored request %+v, got %+v", expected, m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected request to be mirrored")
+	}
+
+	// requests with bodies above the limit are proxied, but not mirrored
+	serve("POST", "/large", "too large to mirror")
+	select {
+	case m := <-mirrored:
+		t.Errorf("Expected large request not to be mirrored, got %+v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMirrorSample(t *testing.T) {
+	m := newMirror()
+	m.Percent = 25
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		if m.sample() {
+			sampled++
+		}
+	}
+	if sampled < 2000 || sampled > 3000 {
+		t.Errorf("Expected about 2500 of 10000 requests to be sampled, got %d", sampled)
+	}
+}
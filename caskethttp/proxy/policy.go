@@ -22,6 +22,7 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 )
 
 // HostPool is a collection of UpstreamHosts.
@@ -32,6 +33,25 @@ type Policy interface {
 	Select(pool HostPool, r *http.Request) *UpstreamHost
 }
 
+// responseUpdater is implemented by policies which need to modify the
+// upstream response after a host was selected, e.g. to set a cookie.
+type responseUpdater interface {
+	updateResponse(host *UpstreamHost, r *http.Request, resp *http.Response)
+}
+
+// hostsUpdater is implemented by policies which keep state
+// per host, to be told about the hosts of the upstream when
+// they change, as they may be called with only some of them.
+type hostsUpdater interface {
+	updateHosts(pool HostPool)
+}
+
+// validator is implemented by policies which can reject
+// the arguments they were configured with.
+type validator interface {
+	validate() error
+}
+
 func init() {
 	RegisterPolicy("random", func(args []string) Policy { return &Random{} })
 	RegisterPolicy("least_conn", func(args []string) Policy { return &LeastConn{} })
@@ -40,6 +60,10 @@ func init() {
 	RegisterPolicy("first", func(args []string) Policy { return &First{} })
 	RegisterPolicy("uri_hash", func(args []string) Policy { return &URIHash{} })
 	RegisterPolicy("header", func(args []string) Policy { return &Header{args} })
+	RegisterPolicy("weighted_round_robin", func(args []string) Policy { return &WeightedRoundRobin{} })
+	RegisterPolicy("weighted_least_conn", func(args []string) Policy { return &WeightedLeastConn{} })
+	RegisterPolicy("consistent_hash", func(args []string) Policy { return newConsistentHash(args) })
+	RegisterPolicy("cookie", func(args []string) Policy { return newCookie(args) })
 }
 
 // Random is a policy that selects up hosts from a pool at random.
@@ -205,3 +229,96 @@ func (r *Header) Select(pool HostPool, request *http.Request) *UpstreamHost {
 	}
 	return hostByHashing(pool, val)
 }
+
+// hostWeight returns the weight of host, treating unset weights as 1.
+func hostWeight(host *UpstreamHost) int64 {
+	if host.Weight < 1 {
+		return 1
+	}
+	return int64(host.Weight)
+}
+
+// WeightedRoundRobin is a policy that selects hosts based on smooth
+// weighted round-robin ordering, as implemented by nginx.
+type WeightedRoundRobin struct {
+	current map[*UpstreamHost]int64
+	mutex   sync.Mutex
+}
+
+// Select selects an up host from the pool such that each host is selected
+// in proportion to its weight, interleaving selections as evenly as possible.
+func (r *WeightedRoundRobin) Select(pool HostPool, request *http.Request) *UpstreamHost {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.current == nil {
+		r.current = make(map[*UpstreamHost]int64, len(pool))
+	}
+
+	var bestHost *UpstreamHost
+	var total int64
+	for _, host := range pool {
+		if !host.Available() {
+			continue
+		}
+		weight := hostWeight(host)
+		r.current[host] += weight
+		total += weight
+		if bestHost == nil || r.current[host] > r.current[bestHost] {
+			bestHost = host
+		}
+	}
+	if bestHost != nil {
+		r.current[bestHost] -= total
+	}
+	return bestHost
+}
+
+// updateHosts forgets the hosts which were removed from the upstream.
+func (r *WeightedRoundRobin) updateHosts(pool HostPool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	current := make(map[*UpstreamHost]int64, len(pool))
+	for _, host := range pool {
+		if weight, ok := r.current[host]; ok {
+			current[host] = weight
+		}
+	}
+	r.current = current
+}
+
+// WeightedLeastConn is a policy that selects the host with the
+// least connections relative to its weight.
+type WeightedLeastConn struct{}
+
+// Select selects the up host with the lowest ratio of connections to
+// weight in the pool. If more than one host has the same lowest ratio,
+// one of the hosts is chosen at random.
+func (r *WeightedLeastConn) Select(pool HostPool, request *http.Request) *UpstreamHost {
+	var bestHost *UpstreamHost
+	var bestConns, bestWeight int64
+	count := 0
+	for _, host := range pool {
+		if !host.Available() {
+			continue
+		}
+
+		conns, weight := atomic.LoadInt64(&host.Conns), hostWeight(host)
+		// compare conns/weight < bestConns/bestWeight without division
+		if bestHost == nil || conns*bestWeight < bestConns*weight {
+			bestHost, bestConns, bestWeight = host, conns, weight
+			count = 1
+			continue
+		}
+
+		// Among hosts with the same ratio, perform a reservoir
+		// sample: https://en.wikipedia.org/wiki/Reservoir_sampling
+		if conns*bestWeight == bestConns*weight {
+			count++
+			if (rand.Int() % count) == 0 {
+				bestHost, bestConns, bestWeight = host, conns, weight
+			}
+		}
+	}
+	return bestHost
+}
@@ -359,3 +359,76 @@ func TestHeaderPolicy(t *testing.T) {
 		}
 	}
 }
+
+func TestWeightedRoundRobinPolicy(t *testing.T) {
+	pool := testPool()
+	pool[0].Weight = 5
+	pool[1].Weight = 1
+	pool[2].Weight = 1
+	wrrPolicy := &WeightedRoundRobin{}
+	request, _ := http.NewRequest("GET", "/", nil)
+
+	// the smooth weighted round-robin sequence for weights 5, 1, 1
+	expected := []int{0, 0, 1, 0, 2, 0, 0}
+	for round := 0; round < 2; round++ {
+		for i, exp := range expected {
+			if h := wrrPolicy.Select(pool, request); h != pool[exp] {
+				t.Errorf("Round %d, selection %d: expected host %d, got %s", round, i, exp, h.Name)
+			}
+		}
+	}
+
+	// mark host as down
+	pool[0].Unhealthy = 1
+	for i := 0; i < 4; i++ {
+		if h := wrrPolicy.Select(pool, request); h != pool[1+i%2] {
+			t.Errorf("Selection %d: expected host %d when the first host is down, got %s", i, 1+i%2, h.Name)
+		}
+	}
+
+	// mark all hosts as down
+	pool[1].Unhealthy = 1
+	pool[2].Unhealthy = 1
+	if h := wrrPolicy.Select(pool, request); h != nil {
+		t.Error("Expected no host to be selected when all hosts are down.")
+	}
+
+	// hosts left out of a selection, e.g. when retrying,
+	// are only forgotten once they leave the upstream
+	pool[0].Unhealthy = 0
+	pool[1].Unhealthy = 0
+	wrrPolicy.Select(pool[1:], request)
+	if _, ok := wrrPolicy.current[pool[0]]; !ok {
+		t.Error("Expected host 0 to be kept when it wasn't in the pool")
+	}
+	wrrPolicy.updateHosts(pool[1:])
+	if _, ok := wrrPolicy.current[pool[0]]; ok || len(wrrPolicy.current) != 2 {
+		t.Errorf("Expected only host 0 to be forgotten, got %v", wrrPolicy.current)
+	}
+}
+
+func TestWeightedLeastConnPolicy(t *testing.T) {
+	pool := testPool()
+	wlcPolicy := &WeightedLeastConn{}
+	request, _ := http.NewRequest("GET", "/", nil)
+
+	pool[0].Weight = 4
+	pool[0].Conns = 12
+	pool[1].Weight = 1
+	pool[1].Conns = 4
+	pool[2].Weight = 2
+	pool[2].Conns = 7
+	if h := wlcPolicy.Select(pool, request); h != pool[0] {
+		t.Errorf("Expected first host to have the least connections per weight, got %s", h.Name)
+	}
+
+	pool[0].Conns = 16
+	if h := wlcPolicy.Select(pool, request); h != pool[2] {
+		t.Errorf("Expected third host to have the least connections per weight, got %s", h.Name)
+	}
+
+	pool[2].Conns = 8
+	if h := wlcPolicy.Select(pool, request); h != pool[0] && h != pool[1] && h != pool[2] {
+		t.Errorf("Expected any host to be selected when all are equally loaded, got %v", h)
+	}
+}
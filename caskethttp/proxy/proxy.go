@@ -16,8 +16,11 @@
 package proxy
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
 	"errors"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
@@ -26,6 +29,8 @@ import (
 	"time"
 
 	"github.com/tmpim/casket/caskethttp/httpserver"
+	"github.com/tmpim/casket/caskethttp/replacebody"
+	"golang.org/x/net/http/httpguts"
 )
 
 // Proxy represents a middleware instance that can proxy requests.
@@ -72,6 +77,28 @@ type Upstream interface {
 	Stop() error
 }
 
+// excludingSelector is implemented by upstreams which can
+// avoid selecting hosts that a request was already sent to.
+type excludingSelector interface {
+	selectExcluding(r *http.Request, exclude map[*UpstreamHost]struct{}) *UpstreamHost
+}
+
+// retryingUpstream is implemented by upstreams which retry
+// requests the upstream hosts responded to with certain statuses.
+type retryingUpstream interface {
+	// Gets the policy deciding which failed requests
+	// are retried, or nil if there is none.
+	GetRetryPolicy() *RetryPolicy
+}
+
+// mirroringUpstream is implemented by upstreams which
+// copy requests to a mirror.
+type mirroringUpstream interface {
+	// Gets the mirror requests are copied to,
+	// or nil if there is none.
+	GetMirror() *Mirror
+}
+
 // UpstreamHostDownFunc can be used to customize how Down behaves.
 type UpstreamHostDownFunc func(*UpstreamHost) bool
 
@@ -81,7 +108,9 @@ type UpstreamHost struct {
 	// atomic operations.
 	Conns             int64 // must be first field to be 64-bit aligned on 32-bit systems
 	MaxConns          int64
-	Name              string // hostname of this upstream host
+	stats             hostStats // accessed atomically, so must stay 64-bit aligned
+	Name              string    // hostname of this upstream host
+	Weight            int       // relative weight used by weighted policies
 	UpstreamHeaders   http.Header
 	DownstreamHeaders http.Header
 	FailTimeout       time.Duration
@@ -94,8 +123,12 @@ type UpstreamHost struct {
 	// is healthy and any non-zero value indicates unhealthy.
 	Unhealthy                    int32
 	HealthCheckResult            atomic.Value
+	healthCheckPasses            int32           // consecutive passed health checks
+	healthCheckFails             int32           // consecutive failed health checks
+	Breaker                      *CircuitBreaker // nil if no circuit breaker is configured
 	UpstreamHeaderReplacements   headerReplacements
 	DownstreamHeaderReplacements headerReplacements
+	BodyRule                     *replacebody.Rule // nil if response bodies aren't rewritten
 }
 
 // Down checks whether the upstream host is down or not.
@@ -114,9 +147,22 @@ func (uh *UpstreamHost) Full() bool {
 	return uh.MaxConns > 0 && atomic.LoadInt64(&uh.Conns) >= uh.MaxConns
 }
 
+// countFailure remembers a failed request for FailTimeout,
+// if request failure counting is enabled.
+func (uh *UpstreamHost) countFailure() {
+	timeout := uh.FailTimeout
+	if timeout > 0 {
+		atomic.AddInt32(&uh.Fails, 1)
+		go func(host *UpstreamHost, timeout time.Duration) {
+			time.Sleep(timeout)
+			atomic.AddInt32(&host.Fails, -1)
+		}(uh, timeout)
+	}
+}
+
 // Available checks whether the upstream host is available for proxying to
 func (uh *UpstreamHost) Available() bool {
-	return !uh.Down() && !uh.Full()
+	return !uh.Down() && !uh.Full() && uh.Breaker.Ready()
 }
 
 // ServeHTTP satisfies the httpserver.Handler interface.
@@ -156,17 +202,71 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 		}
 	}
 
+	// A retry policy additionally allows requests with eligible methods to
+	// be retried after the upstream responded with a retryable status. Their
+	// bodies are only buffered up to a limit, and larger ones aren't retried.
+	var retryPolicy *RetryPolicy
+	if ru, ok := upstream.(retryingUpstream); ok {
+		retryPolicy = ru.GetRetryPolicy()
+	}
+	retryable := retryPolicy.AllowsMethod(r.Method)
+	if retryable && !requiresBuffering {
+		body, buffered, err := newLimitedBufferedBody(outreq.Body, retryPolicy.MaxBodySize)
+		if err != nil {
+			return http.StatusBadRequest, errors.New("failed to read downstream request body")
+		}
+		if body != nil {
+			outreq.Body = body
+		}
+		retryable = buffered
+	}
+
+	// Copies of requests are mirrored in the background, which
+	// requires their bodies to be buffered too. Requests with bodies
+	// that are too large aren't mirrored.
+	if mu, ok := upstream.(mirroringUpstream); ok {
+		if mirror := mu.GetMirror(); mirror != nil && mirror.sample() && !requestIsWebsocket(r) {
+			body, err := mirror.bufferBody(outreq)
+			switch err {
+			case nil:
+				mirror.send(outreq, body, replacer)
+			case errMirrorBodyTooLarge:
+			default:
+				return http.StatusBadRequest, errors.New("failed to read downstream request body")
+			}
+		}
+	}
+
+	// The director modifies the request URL in place,
+	// so it has to be restored before each retry.
+	originalURL := *outreq.URL
+
+	// The mayRetry function reports whether another attempt
+	// may be made after the current one failed.
+	start := time.Now()
+	attempts := 0
+	mayRetry := func() bool {
+		if retryable {
+			if attempts >= retryPolicy.MaxAttempts {
+				return false
+			}
+			if upstream.GetTryDuration() == 0 {
+				return true
+			}
+		}
+		// if we've tried long enough, break
+		return time.Since(start) < upstream.GetTryDuration()
+	}
+
 	// The keepRetrying function will return true if we should
 	// loop and try to select another host, or false if we
 	// should break and stop retrying.
-	start := time.Now()
 	keepRetrying := func(backendErr error) bool {
 		// if downstream has canceled the request, break
 		if backendErr == context.Canceled {
 			return false
 		}
-		// if we've tried long enough, break
-		if time.Since(start) >= upstream.GetTryDuration() {
+		if !mayRetry() {
 			return false
 		}
 		// otherwise, wait and try the next available host
@@ -175,10 +275,21 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 	}
 
 	var backendErr error
+	var held *retryableStatusError // the last response held back for a retry
+	tried := make(map[*UpstreamHost]struct{})
 	for {
+		attempts++
+
 		// since Select() should give us "up" hosts, keep retrying
 		// hosts until timeout (or until we get a nil host).
-		host := upstream.Select(r)
+		var host *UpstreamHost
+		if es, ok := upstream.(excludingSelector); ok && retryable && len(tried) > 0 {
+			// prefer replaying retried requests to a different host
+			host = es.selectExcluding(r, tried)
+		} else {
+			host = upstream.Select(r)
+		}
+
 		if host == nil {
 			if backendErr == nil {
 				backendErr = errors.New("no hosts available upstream")
@@ -228,6 +339,17 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 			}
 		}
 
+		// only gzip can be decoded for rewriting bodies; without
+		// Accept-Encoding, the transport asks for gzip and decodes
+		// it transparently
+		if host.BodyRule != nil {
+			if strings.Contains(outreq.Header.Get("Accept-Encoding"), "gzip") {
+				outreq.Header.Set("Accept-Encoding", "gzip")
+			} else {
+				outreq.Header.Del("Accept-Encoding")
+			}
+		}
+
 		// prepare a function that will update response
 		// headers coming back downstream
 		var downHeaderUpdateFn respUpdateFn
@@ -242,6 +364,58 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 				return http.StatusInternalServerError, errors.New("unable to rewind downstream request body")
 			}
 		}
+		if len(tried) > 0 {
+			*outreq.URL = originalURL
+		}
+		tried[host] = struct{}{}
+
+		// the circuit breaker may have opened, or run out of
+		// half-open probes, since the host was selected
+		breakerGen, ok := host.Breaker.Begin()
+		if !ok {
+			backendErr = errBreakerOpen
+			if !keepRetrying(backendErr) {
+				break
+			}
+			continue
+		}
+
+		// trace each attempt as a client span of the request
+		span := httpserver.StartSpan(r.Context(), "proxy "+host.Name, httpserver.SpanKindClient)
+		span.SetAttribute("http.request.method", outreq.Method)
+		span.SetAttribute("server.address", outreq.Host)
+		span.Inject(outreq.Header)
+
+		// record the upstream status and time to first byte
+		// so that the circuit breaker can be updated
+		var upstreamResp *http.Response
+		var upstreamStatus int
+		var upstreamLatency time.Duration
+		roundTripStart := time.Now()
+		respUpdateFn := func(resp *http.Response) error {
+			upstreamResp = resp
+			upstreamStatus = resp.StatusCode
+			upstreamLatency = time.Since(roundTripStart)
+			if ru, ok := upstream.(responseUpdater); ok {
+				ru.updateResponse(host, r, resp)
+			}
+			if downHeaderUpdateFn != nil {
+				if err := downHeaderUpdateFn(resp); err != nil {
+					return err
+				}
+			}
+			if host.BodyRule != nil && r.Method != http.MethodHead {
+				if err := rewriteBody(resp, host.BodyRule, replacer); err != nil {
+					return err
+				}
+			}
+			// hold the response back if we're going to retry, so
+			// that it can still be passed on if no attempt is left
+			if retryable && retryPolicy.AllowsStatus(resp.StatusCode) && mayRetry() {
+				return holdResponse(resp)
+			}
+			return nil
+		}
 
 		// tell the proxy to serve the request
 		//
@@ -252,11 +426,40 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 		func() {
 			atomic.AddInt64(&host.Conns, 1)
 			defer atomic.AddInt64(&host.Conns, -1)
-			backendErr = proxy.ServeHTTP(w, outreq, downHeaderUpdateFn)
+			atomic.AddInt64(&host.stats.requests, 1)
+			defer func() {
+				if backendErr == context.Canceled || backendErr == httpserver.ErrMaxBytesExceeded {
+					// not the upstream's fault
+					host.Breaker.Abort(breakerGen)
+					return
+				}
+				if upstreamStatus == 0 {
+					upstreamLatency = time.Since(roundTripStart)
+				}
+				failed := upstreamStatus == 0 || upstreamStatus >= 500 || grpcFailed(upstreamResp)
+				host.stats.done(failed, upstreamLatency)
+				host.Breaker.Done(breakerGen, failed, upstreamLatency)
+			}()
+			backendErr = proxy.ServeHTTP(w, outreq, respUpdateFn)
 		}()
 
+		span.SetStatus(upstreamStatus)
+		if backendErr != nil {
+			span.SetError(backendErr.Error())
+		}
+		span.Finish()
+
+		if rr, ok := w.(*httpserver.ResponseRecorder); ok && rr.Replacer != nil && host.Breaker != nil {
+			rr.Replacer.Set("upstream_breaker", host.Breaker.State())
+		}
+
 		// if no errors, we're done here
 		if backendErr == nil {
+			// a gRPC error is only known once the response has been
+			// written, so it counts as a failure but isn't retried
+			if grpcFailed(upstreamResp) {
+				host.countFailure()
+			}
 			return 0, nil
 		}
 
@@ -269,14 +472,13 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 		}
 
 		// failover; remember this failure for some time if
-		// request failure counting is enabled
-		timeout := host.FailTimeout
-		if timeout > 0 {
-			atomic.AddInt32(&host.Fails, 1)
-			go func(host *UpstreamHost, timeout time.Duration) {
-				time.Sleep(timeout)
-				atomic.AddInt32(&host.Fails, -1)
-			}(host, timeout)
+		// request failure counting is enabled. A retried status
+		// means the host is reachable, which the circuit breaker
+		// already takes into account.
+		if statusErr, ok := backendErr.(retryableStatusError); ok {
+			held = &statusErr
+		} else {
+			host.countFailure()
 		}
 
 		// if we've tried long enough, break
@@ -285,6 +487,12 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 		}
 	}
 
+	if held != nil {
+		// pass on the last response, even if later
+		// attempts didn't get one at all
+		held.writeTo(w)
+		return 0, nil
+	}
 	return http.StatusBadGateway, backendErr
 }
 
@@ -354,6 +562,8 @@ func createUpstreamRequest(rw http.ResponseWriter, r *http.Request) (*http.Reque
 	// Remove hop-by-hop headers to the backend. Especially
 	// important is "Connection" because we want a persistent
 	// connection, regardless of what the client sent to us.
+	// "TE: trailers" is kept though, since gRPC servers need it.
+	teTrailers := httpguts.HeaderValuesContainsToken(r.Header["Te"], "trailers")
 	for _, h := range hopHeaders {
 		if outreq.Header.Get(h) != "" {
 			if !copiedHeaders {
@@ -364,6 +574,9 @@ func createUpstreamRequest(rw http.ResponseWriter, r *http.Request) (*http.Reque
 			outreq.Header.Del(h)
 		}
 	}
+	if teTrailers {
+		outreq.Header.Set("Te", "trailers")
+	}
 
 	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
 		// If we aren't the first proxy, retain prior
@@ -379,9 +592,45 @@ func createUpstreamRequest(rw http.ResponseWriter, r *http.Request) (*http.Reque
 }
 
 func createRespHeaderUpdateFn(rules http.Header, replacer httpserver.Replacer, replacements headerReplacements) respUpdateFn {
-	return func(resp *http.Response) {
+	return func(resp *http.Response) error {
 		mutateHeadersByRules(resp.Header, rules, replacer, replacements)
+		return nil
+	}
+}
+
+// rewriteBody makes resp's body stream through the replacements of
+// rule, if its media type matches. Gzip-encoded bodies are decoded,
+// leaving compression for the client up to the gzip directive.
+func rewriteBody(resp *http.Response, rule *replacebody.Rule, replacer httpserver.Replacer) error {
+	if !replacebody.Rewritable(resp.StatusCode) || !rule.MatchesType(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+	var body io.Reader = resp.Body
+	switch resp.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		buffered := bufio.NewReader(resp.Body)
+		if _, err := buffered.Peek(1); err == io.EOF {
+			// an empty body has nothing to decode
+			body = buffered
+		} else {
+			gz, err := gzip.NewReader(buffered)
+			if err != nil {
+				return err
+			}
+			body = gz
+		}
+		resp.Header.Del("Content-Encoding")
+	default:
+		return nil
 	}
+	replacebody.PrepareHeader(resp.Header)
+	resp.ContentLength = -1
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{replacebody.NewReader(body, rule.Replacements, replacer), resp.Body}
+	return nil
 }
 
 func mutateHeadersByRules(headers, rules http.Header, repl httpserver.Replacer, replacements headerReplacements) {
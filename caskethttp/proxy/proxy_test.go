@@ -17,6 +17,7 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/tls"
 	"fmt"
@@ -33,6 +34,7 @@ import (
 	"reflect"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -1780,3 +1782,141 @@ func TestQuic(t *testing.T) {
 		t.Errorf("Expected response body, got: %s", responseContent)
 	}
 }
+
+func TestProxyReplaceBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := "<a href=\"http://backend.internal/page\">\n"
+		switch r.URL.Path {
+		case "/gzip":
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte(body))
+			gz.Close()
+			return
+		case "/empty":
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", "gzip")
+			return
+		case "/negotiated":
+			w.Header().Set("Content-Type", "text/html")
+			if strings.Contains(r.Header.Get("Accept-Encoding"), "br") {
+				w.Header().Set("Content-Encoding", "br")
+				io.WriteString(w, "not brotli")
+				return
+			}
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		io.WriteString(w, body)
+	}))
+	defer backend.Close()
+
+	config := "proxy / " + backend.URL + " {\n" +
+		" replace_body http://backend.internal https://{host}\n" +
+		` replace_body_regexp "/(page)" "/app/$1"` + "\n}"
+	upstreams, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+	if err != nil {
+		t.Fatalf("Expected no error. Got: %s", err.Error())
+	}
+	p := &Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams}
+
+	tests := []struct {
+		path string
+		body string
+	}{
+		{"/html", "<a href=\"https://example.com/app/page\">\n"},
+		{"/gzip", "<a href=\"https://example.com/app/page\">\n"},
+		{"/empty", ""},
+		{"/negotiated", "<a href=\"https://example.com/app/page\">\n"},
+		{"/json", "<a href=\"http://backend.internal/page\">\n"},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", "http://example.com"+test.path, nil)
+		// keep the transport from transparently decoding gzip
+		r.Header.Set("Accept-Encoding", "br, gzip")
+		rec := httptest.NewRecorder()
+		w := testResponseRecorder{
+			ResponseWriterWrapper: &httpserver.ResponseWriterWrapper{ResponseWriter: rec},
+		}
+		if _, err := p.ServeHTTP(w, r); err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		if rec.Body.String() != test.body {
+			t.Errorf("Test %d: Expected body %q, got %q", i, test.body, rec.Body.String())
+		}
+		if test.path != "/json" {
+			if cl := rec.Header().Get("Content-Length"); cl != "" {
+				t.Errorf("Test %d: Expected Content-Length to be removed, got %s", i, cl)
+			}
+			if ce := rec.Header().Get("Content-Encoding"); ce != "" {
+				t.Errorf("Test %d: Expected Content-Encoding to be removed, got %s", i, ce)
+			}
+		}
+	}
+
+	for _, config := range []string{
+		"proxy / localhost {\n replace_body a\n}",
+		"proxy / localhost {\n replace_body \"\" b\n}",
+		"proxy / localhost {\n replace_body_regexp ( b\n}",
+		"proxy / localhost {\n replace_body_types text/html\n}",
+	} {
+		if _, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(config)), ""); err == nil {
+			t.Errorf("Expected error for config %q", config)
+		}
+	}
+}
+
+type spanRecorder struct {
+	sync.Mutex
+	spans []*httpserver.Span
+}
+
+func (sr *spanRecorder) ExportSpan(span *httpserver.Span) {
+	sr.Lock()
+	sr.spans = append(sr.spans, span)
+	sr.Unlock()
+}
+
+func TestProxyTracing(t *testing.T) {
+	var traceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	p := &Proxy{Next: httpserver.EmptyNext, Upstreams: []Upstream{newFakeUpstream(backend.URL, false, 30*time.Second, 300*time.Millisecond)}}
+
+	exporter := new(spanRecorder)
+	tracer := &httpserver.Tracer{Exporter: exporter, SampleRatio: 1}
+	r, server := tracer.StartServerSpan(httptest.NewRequest("GET", "/", nil))
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+
+	if len(exporter.spans) != 1 {
+		t.Fatalf("Expected 1 exported span, got %d", len(exporter.spans))
+	}
+	span := exporter.spans[0]
+	if span.ParentSpanID != server.SpanID || span.Kind != httpserver.SpanKindClient {
+		t.Errorf("Expected a client span child of the server span, got %+v", span)
+	}
+	if traceparent != span.TraceParent() {
+		t.Errorf("Expected backend to receive traceparent %s, got %s", span.TraceParent(), traceparent)
+	}
+	if !span.Error {
+		t.Error("Expected span of a 503 response to be an error")
+	}
+
+	// without tracing, the client's traceparent is passed on as is
+	traceparent = ""
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	p.ServeHTTP(httptest.NewRecorder(), r)
+	if traceparent != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("Expected client traceparent to reach the backend, got '%s'", traceparent)
+	}
+}
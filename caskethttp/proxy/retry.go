@@ -0,0 +1,131 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// defaultRetryMethods are the idempotent methods which
+// are retried if a retry policy doesn't list any methods.
+var defaultRetryMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodOptions,
+	http.MethodPut,
+	http.MethodDelete,
+	http.MethodTrace,
+}
+
+// RetryPolicy describes which requests may be sent to another
+// upstream host after a failed attempt.
+type RetryPolicy struct {
+	// Statuses are the upstream response statuses
+	// which cause the request to be retried.
+	Statuses []statusRange
+
+	// Methods are the request methods eligible for retries.
+	Methods map[string]struct{}
+
+	// MaxAttempts is the maximum number of times a request
+	// is sent upstream, including the first attempt.
+	MaxAttempts int
+
+	// MaxBodySize is the largest request body which will be
+	// buffered for replaying. Requests with larger bodies are
+	// not retried.
+	MaxBodySize int64
+}
+
+// NewRetryPolicy returns a RetryPolicy with default settings.
+func NewRetryPolicy() *RetryPolicy {
+	p := &RetryPolicy{
+		Methods:     make(map[string]struct{}),
+		MaxAttempts: 3,
+		MaxBodySize: 64 * 1024,
+	}
+	for _, method := range defaultRetryMethods {
+		p.Methods[method] = struct{}{}
+	}
+	return p
+}
+
+// AllowsMethod returns true if requests with method may be retried.
+func (p *RetryPolicy) AllowsMethod(method string) bool {
+	if p == nil {
+		return false
+	}
+	_, ok := p.Methods[method]
+	return ok
+}
+
+// AllowsStatus returns true if an upstream response
+// with the given status should be retried.
+func (p *RetryPolicy) AllowsStatus(status int) bool {
+	if p == nil {
+		return false
+	}
+	for _, s := range p.Statuses {
+		if s.contains(status) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxHeldResponseSize is the largest upstream response body held
+// back for retrying. Responses with larger bodies are passed on.
+const maxHeldResponseSize = 64 * 1024
+
+// retryableStatusError is returned by ReverseProxy.ServeHTTP when
+// the upstream response was held back so that it can be retried.
+type retryableStatusError struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (e retryableStatusError) Error() string {
+	return fmt.Sprintf("upstream responded with retryable status %d", e.status)
+}
+
+// writeTo writes the held back response to w.
+func (e retryableStatusError) writeTo(w http.ResponseWriter) {
+	copyHeader(w.Header(), e.header)
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// holdResponse reads the body of resp so that it can be retried,
+// returning a retryableStatusError holding the response. If the body
+// is too large, it is left to be passed on and nil is returned.
+func holdResponse(resp *http.Response) error {
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHeldResponseSize+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxHeldResponseSize {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	return retryableStatusError{status: resp.StatusCode, header: resp.Header, body: body}
+}
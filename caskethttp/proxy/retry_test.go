@@ -0,0 +1,235 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tmpim/casket/casketfile"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestParseBlockRetry(t *testing.T) {
+	tests := []struct {
+		config      string
+		shouldErr   bool
+		statuses    []statusRange
+		methods     []string
+		maxAttempts int
+		maxBodySize int64
+	}{
+		{"retry 502 503", false, []statusRange{{502, 502}, {503, 503}}, defaultRetryMethods, 3, 64 * 1024},
+		{"retry 5xx\nretry_methods get post\nretry_max_attempts 5\nretry_max_body_size 1MB", false,
+			[]statusRange{{500, 599}}, []string{"GET", "POST"}, 5, 1024 * 1024},
+		{"retry", true, nil, nil, 0, 0},
+		{"retry 700", true, nil, nil, 0, 0},
+		{"retry_max_attempts 0", true, nil, nil, 0, 0},
+		{"retry_max_attempts many", true, nil, nil, 0, 0},
+		{"retry_max_body_size lots", true, nil, nil, 0, 0},
+	}
+
+	for i, test := range tests {
+		u := staticUpstream{}
+		c := casketfile.NewDispenser("Testfile", strings.NewReader(test.config))
+		var err error
+		for c.Next() && err == nil {
+			err = parseBlock(&c, &u, false)
+		}
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test %d: expected error=%v, got %v", i, test.shouldErr, err)
+		}
+		if test.shouldErr {
+			if err != nil && !strings.HasPrefix(err.Error(), "Testfile:1 - ") {
+				t.Errorf("Test %d: expected error with the config location, got %v", i, err)
+			}
+			continue
+		}
+		p := u.RetryPolicy
+		if len(p.Statuses) != len(test.statuses) {
+			t.Errorf("Test %d: expected statuses %v, got %v", i, test.statuses, p.Statuses)
+		}
+		for j := range test.statuses {
+			if j < len(p.Statuses) && p.Statuses[j] != test.statuses[j] {
+				t.Errorf("Test %d: expected statuses %v, got %v", i, test.statuses, p.Statuses)
+			}
+		}
+		if len(p.Methods) != len(test.methods) {
+			t.Errorf("Test %d: expected methods %v, got %v", i, test.methods, p.Methods)
+		}
+		for _, method := range test.methods {
+			if !p.AllowsMethod(method) {
+				t.Errorf("Test %d: expected method %s to be allowed", i, method)
+			}
+		}
+		if p.MaxAttempts != test.maxAttempts {
+			t.Errorf("Test %d: expected max attempts %d, got %d", i, test.maxAttempts, p.MaxAttempts)
+		}
+		if p.MaxBodySize != test.maxBodySize {
+			t.Errorf("Test %d: expected max body size %d, got %d", i, test.maxBodySize, p.MaxBodySize)
+		}
+	}
+}
+
+func TestReverseProxyRetryStatus(t *testing.T) {
+	var badHits, goodHits int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&badHits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&goodHits, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer good.Close()
+
+	tests := []struct {
+		name           string
+		block          string
+		method         string
+		body           string
+		expectStatus   int
+		expectBody     string
+		expectBadHits  int32
+		expectGoodHits int32
+	}{
+		{"GET is retried", "retry 503", "GET", "", http.StatusOK, "", 1, 1},
+		{"POST is not retried by default", "retry 503", "POST", "payload", http.StatusServiceUnavailable, "", 1, 0},
+		{"POST is replayed when allowed", "retry 503\n retry_methods POST", "POST", "payload", http.StatusOK, "payload", 1, 1},
+		{"large bodies are not replayed", "retry 503\n retry_methods POST\n retry_max_body_size 4B", "POST", "payload", http.StatusServiceUnavailable, "", 1, 0},
+		{"unlisted statuses are not retried", "retry 502", "GET", "", http.StatusServiceUnavailable, "", 1, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			atomic.StoreInt32(&badHits, 0)
+			atomic.StoreInt32(&goodHits, 0)
+
+			config := "proxy / " + bad.URL + " " + good.URL + " {\n policy first\n try_interval 0\n " + test.block + "\n}"
+			upstreams, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+			if err != nil {
+				t.Fatalf("Expected no error. Got: %s", err.Error())
+			}
+			p := &Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams}
+
+			r := httptest.NewRequest(test.method, "/", strings.NewReader(test.body))
+			w := httptest.NewRecorder()
+			status, _ := p.ServeHTTP(testResponseRecorder{
+				ResponseWriterWrapper: &httpserver.ResponseWriterWrapper{ResponseWriter: w},
+			}, r)
+			if status == 0 {
+				status = w.Code
+			}
+
+			if status != test.expectStatus {
+				t.Errorf("Expected status %d, got %d", test.expectStatus, status)
+			}
+			if w.Body.String() != test.expectBody {
+				t.Errorf("Expected body %q, got %q", test.expectBody, w.Body.String())
+			}
+			if got := atomic.LoadInt32(&badHits); got != test.expectBadHits {
+				t.Errorf("Expected %d requests to the failing backend, got %d", test.expectBadHits, got)
+			}
+			if got := atomic.LoadInt32(&goodHits); got != test.expectGoodHits {
+				t.Errorf("Expected %d requests to the working backend, got %d", test.expectGoodHits, got)
+			}
+		})
+	}
+}
+
+func TestReverseProxyRetryLastResponse(t *testing.T) {
+	var hits int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("X-Upstream", "bad")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("try again later"))
+	}))
+	defer bad.Close()
+
+	// the breaker opens after the first response, so
+	// that there is no host left for the next attempt
+	config := "proxy / " + bad.URL + " {\n try_interval 0\n fail_timeout 10s\n retry 503\n" +
+		" circuit_breaker_error_ratio 0.5\n circuit_breaker_min_requests 1\n}"
+	upstreams, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+	if err != nil {
+		t.Fatalf("Expected no error. Got: %s", err.Error())
+	}
+	p := &Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	status, err := p.ServeHTTP(testResponseRecorder{
+		ResponseWriterWrapper: &httpserver.ResponseWriterWrapper{ResponseWriter: w},
+	}, r)
+	if status != 0 || err != nil {
+		t.Errorf("Expected the response to be written, got status %d and %v", status, err)
+	}
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "try again later" || w.Header().Get("X-Upstream") != "bad" {
+		t.Errorf("Expected the upstream response, got %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Errorf("Expected 1 request upstream, got %d", got)
+	}
+
+	// a retried status doesn't count as a failed request
+	host := upstreams[0].(*staticUpstream).Hosts[0]
+	if fails := atomic.LoadInt32(&host.Fails); fails != 0 {
+		t.Errorf("Expected no failures to be counted, got %d", fails)
+	}
+}
+
+func TestReverseProxyRetryRefused(t *testing.T) {
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("try again later"))
+	}))
+	defer bad.Close()
+
+	// an address nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := "http://" + ln.Addr().String()
+	ln.Close()
+
+	// the 503 is retried, and the last attempt is refused
+	config := "proxy / " + bad.URL + " " + refused + " {\n policy first\n try_interval 0\n retry 503\n retry_max_attempts 2\n}"
+	upstreams, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+	if err != nil {
+		t.Fatalf("Expected no error. Got: %s", err.Error())
+	}
+	p := &Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	status, err := p.ServeHTTP(testResponseRecorder{
+		ResponseWriterWrapper: &httpserver.ResponseWriterWrapper{ResponseWriter: w},
+	}, r)
+	if status != 0 || err != nil {
+		t.Errorf("Expected the held response to be written, got status %d and %v", status, err)
+	}
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "try again later" {
+		t.Errorf("Expected the 503 response, got %d %q", w.Code, w.Body.String())
+	}
+}
@@ -350,6 +350,99 @@ func (rp *ReverseProxy) UseClientCertificates(keyPair *tls.Certificate) {
 	}
 }
 
+// UseServerName sets the name used to verify the upstream's
+// certificate, for upstreams which are addressed by IP.
+func (rp *ReverseProxy) UseServerName(serverName string) {
+	if transport, ok := rp.Transport.(*http.Transport); ok {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.ServerName = serverName
+	} else if transport, ok := rp.Transport.(*http3.RoundTripper); ok {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.ServerName = serverName
+	}
+}
+
+// UseH2C makes the proxy speak HTTP/2 over plaintext connections
+// to the upstream, as expected by many gRPC servers.
+func (rp *ReverseProxy) UseH2C() {
+	rp.Transport = newH2CTransport(rp.dialer)
+}
+
+// TransportConfig holds the connection pool settings
+// shared by all hosts of an upstream.
+type TransportConfig struct {
+	// IdleConnTimeout is how long an idle connection is kept
+	// in the pool before being closed. Zero means no limit.
+	IdleConnTimeout time.Duration
+
+	// MaxConnsPerHost limits the number of connections to the
+	// host, including those in use. Zero means no limit.
+	MaxConnsPerHost int
+
+	// DialTimeout overrides the timeout for connecting
+	// to the host, if non-zero.
+	DialTimeout time.Duration
+
+	// ResponseHeaderTimeout is how long to wait for the response
+	// headers after sending the request. Zero means no limit.
+	ResponseHeaderTimeout time.Duration
+
+	// HTTP2 enables HTTP/2 to TLS upstreams.
+	HTTP2 bool
+
+	// TLSSessionCacheSize is the number of TLS sessions cached for
+	// resumption. Zero disables session resumption.
+	TLSSessionCacheSize int
+}
+
+// UseTransportConfig applies the connection pool settings in config.
+func (rp *ReverseProxy) UseTransportConfig(config TransportConfig) {
+	if config.DialTimeout > 0 {
+		rp.dialer.Timeout = config.DialTimeout
+	}
+	switch transport := rp.Transport.(type) {
+	case *http.Transport:
+		transport.IdleConnTimeout = config.IdleConnTimeout
+		transport.MaxConnsPerHost = config.MaxConnsPerHost
+		transport.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+		if config.TLSSessionCacheSize > 0 {
+			if transport.TLSClientConfig == nil {
+				transport.TLSClientConfig = &tls.Config{}
+			}
+			transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(config.TLSSessionCacheSize)
+		}
+		useHTTP2(transport, config.HTTP2)
+	case *http2.Transport:
+		transport.IdleConnTimeout = config.IdleConnTimeout
+	}
+}
+
+// useHTTP2 enables or disables HTTP/2 on transport.
+func useHTTP2(transport *http.Transport, enabled bool) {
+	_, configured := transport.TLSNextProto["h2"]
+	if enabled && !configured {
+		if err := http2.ConfigureTransport(transport); err != nil {
+			log.Println("[ERROR] failed to configure transport to use HTTP/2: ", err)
+		}
+	} else if !enabled && configured {
+		// a non-nil, empty map disables HTTP/2
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		if transport.TLSClientConfig != nil {
+			var protos []string
+			for _, proto := range transport.TLSClientConfig.NextProtos {
+				if proto != "h2" {
+					protos = append(protos, proto)
+				}
+			}
+			transport.TLSClientConfig.NextProtos = protos
+		}
+	}
+}
+
 // ServeHTTP serves the proxied request to the upstream by performing a roundtrip.
 // It is designed to handle websocket connection upgrades as well.
 func (rp *ReverseProxy) ServeHTTP(rw http.ResponseWriter, outreq *http.Request, respUpdateFn respUpdateFn) error {
@@ -386,7 +479,10 @@ func (rp *ReverseProxy) ServeHTTP(rw http.ResponseWriter, outreq *http.Request,
 	}
 
 	if respUpdateFn != nil {
-		respUpdateFn(res)
+		if err := respUpdateFn(res); err != nil {
+			_ = res.Body.Close()
+			return err
+		}
 	}
 
 	if isWebsocket {
@@ -484,9 +580,13 @@ func (rp *ReverseProxy) ServeHTTP(rw http.ResponseWriter, outreq *http.Request,
 			rw.Header()["Trailer"] = vv
 		}
 
+		// gRPC responses always end in trailers, which are usually
+		// unannounced, and stream messages which mustn't be delayed.
+		grpc := isGRPC(res.Header.Get("Content-Type"))
+
 		// Now copy over the status code as well as the response body.
 		rw.WriteHeader(res.StatusCode)
-		if announcedTrailerKeyCount > 0 {
+		if announcedTrailerKeyCount > 0 || grpc {
 			// Force chunking if we saw a response trailer.
 			// This prevents net/http from calculating the length
 			// for short bodies and adding a Content-Length.
@@ -494,7 +594,11 @@ func (rp *ReverseProxy) ServeHTTP(rw http.ResponseWriter, outreq *http.Request,
 				fl.Flush()
 			}
 		}
-		rp.copyResponse(rw, res.Body)
+		if grpc {
+			rp.copyResponseImmediately(rw, res.Body)
+		} else {
+			rp.copyResponse(rw, res.Body)
+		}
 
 		// Now close the body to fully populate res.Trailer.
 		closeBody()
@@ -511,6 +615,25 @@ func (rp *ReverseProxy) ServeHTTP(rw http.ResponseWriter, outreq *http.Request,
 	return nil
 }
 
+// copyResponseImmediately copies src to dst,
+// flushing dst after every write.
+func (rp *ReverseProxy) copyResponseImmediately(dst io.Writer, src io.Reader) {
+	if wf, ok := dst.(writeFlusher); ok {
+		dst = immediateFlushWriter{wf}
+	}
+	pooledIoCopy(dst, src)
+}
+
+type immediateFlushWriter struct {
+	dst writeFlusher
+}
+
+func (w immediateFlushWriter) Write(p []byte) (int, error) {
+	n, err := w.dst.Write(p)
+	w.dst.Flush()
+	return n, err
+}
+
 func (rp *ReverseProxy) copyResponse(dst io.Writer, src io.Reader) {
 	if rp.FlushInterval != 0 {
 		if wf, ok := dst.(writeFlusher); ok {
@@ -567,8 +690,16 @@ func copyHeader(dst, src http.Header) {
 //
 // WARNING: Only a shallow copy will be created!
 func shallowCopyTrailers(dstHeader, srcTrailer http.Header, forceSetTrailers bool) {
+	announced := make(map[string]struct{}, len(dstHeader["Trailer"]))
+	for _, v := range dstHeader["Trailer"] {
+		for _, k := range strings.Split(v, ",") {
+			announced[http.CanonicalHeaderKey(strings.TrimSpace(k))] = struct{}{}
+		}
+	}
 	for k, vv := range srcTrailer {
-		if forceSetTrailers {
+		// trailers which weren't announced in the "Trailer"
+		// header, like gRPC's, need to be marked as such
+		if _, ok := announced[k]; forceSetTrailers && !ok {
 			k = http.TrailerPrefix + k
 		}
 		dstHeader[k] = vv
@@ -591,7 +722,10 @@ var hopHeaders = []string{
 	"Upgrade",
 }
 
-type respUpdateFn func(resp *http.Response)
+// respUpdateFn is called with the upstream response before it is
+// written downstream. If it returns an error, the response is
+// discarded and the error is returned from ReverseProxy.ServeHTTP.
+type respUpdateFn func(resp *http.Response) error
 
 type hijackedConn struct {
 	net.Conn
@@ -30,6 +30,10 @@ func init() {
 func setup(c *casket.Controller) error {
 	upstreams, err := NewStaticUpstreams(c.Dispenser, httpserver.GetConfig(c).Host())
 	if err != nil {
+		// stop the workers of the upstreams parsed before the error
+		for _, upstream := range upstreams {
+			upstream.Stop()
+		}
 		return err
 	}
 	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
@@ -39,6 +43,13 @@ func setup(c *casket.Controller) error {
 	// Register shutdown handlers.
 	for _, upstream := range upstreams {
 		c.OnShutdown(upstream.Stop)
+		if u, ok := upstream.(*staticUpstream); ok {
+			registerUpstream(u)
+			c.OnShutdown(func() error {
+				unregisterUpstream(u)
+				return nil
+			})
+		}
 	}
 
 	return nil
@@ -0,0 +1,125 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"expvar"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	expvar.Publish("proxy", expvar.Func(func() interface{} {
+		return Stats()
+	}))
+}
+
+// hostStats holds the request counters of an UpstreamHost.
+// All fields are accessed atomically.
+type hostStats struct {
+	requests    int64
+	errors      int64
+	lastLatency int64 // nanoseconds
+}
+
+// done records the outcome of a request to the host.
+func (s *hostStats) done(failed bool, latency time.Duration) {
+	if failed {
+		atomic.AddInt64(&s.errors, 1)
+	}
+	atomic.StoreInt64(&s.lastLatency, int64(latency))
+}
+
+// HostStats is a snapshot of the state and
+// request statistics of an upstream host.
+type HostStats struct {
+	Name        string        `json:"name"`
+	Healthy     bool          `json:"healthy"`
+	Fails       int32         `json:"fails"`
+	Breaker     string        `json:"breaker"`
+	Active      int64         `json:"active_requests"`
+	Requests    int64         `json:"total_requests"`
+	Errors      int64         `json:"errors"`
+	LastLatency time.Duration `json:"last_latency_ns"`
+}
+
+// Stats returns a snapshot of the host's statistics.
+func (uh *UpstreamHost) Stats() HostStats {
+	return HostStats{
+		Name:        uh.Name,
+		Healthy:     !uh.Down(),
+		Fails:       atomic.LoadInt32(&uh.Fails),
+		Breaker:     uh.Breaker.State(),
+		Active:      atomic.LoadInt64(&uh.Conns),
+		Requests:    atomic.LoadInt64(&uh.stats.requests),
+		Errors:      atomic.LoadInt64(&uh.stats.errors),
+		LastLatency: time.Duration(atomic.LoadInt64(&uh.stats.lastLatency)),
+	}
+}
+
+// UpstreamStats holds the statistics of all hosts of an upstream.
+type UpstreamStats struct {
+	From  string      `json:"from"`
+	Hosts []HostStats `json:"hosts"`
+}
+
+// runningUpstreams holds the upstreams of all proxy
+// directives that are currently being served.
+var runningUpstreams = struct {
+	sync.Mutex
+	m map[*staticUpstream]struct{}
+}{m: make(map[*staticUpstream]struct{})}
+
+// registerUpstream makes the statistics of u available
+// through Stats until it is unregistered.
+func registerUpstream(u *staticUpstream) {
+	runningUpstreams.Lock()
+	runningUpstreams.m[u] = struct{}{}
+	runningUpstreams.Unlock()
+}
+
+// unregisterUpstream removes u from the statistics.
+func unregisterUpstream(u *staticUpstream) {
+	runningUpstreams.Lock()
+	delete(runningUpstreams.m, u)
+	runningUpstreams.Unlock()
+}
+
+// Stats returns the statistics of the upstreams of all running
+// proxy directives, sorted by the path they proxy from. It is
+// also published through expvar as "proxy".
+func Stats() []UpstreamStats {
+	runningUpstreams.Lock()
+	upstreams := make([]*staticUpstream, 0, len(runningUpstreams.m))
+	for u := range runningUpstreams.m {
+		upstreams = append(upstreams, u)
+	}
+	runningUpstreams.Unlock()
+
+	stats := make([]UpstreamStats, 0, len(upstreams))
+	for _, u := range upstreams {
+		us := UpstreamStats{From: u.From(), Hosts: []HostStats{}}
+		for _, host := range u.hosts() {
+			us.Hosts = append(us.Hosts, host.Stats())
+		}
+		stats = append(stats, us)
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].From < stats[j].From
+	})
+	return stats
+}
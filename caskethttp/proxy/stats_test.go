@@ -0,0 +1,90 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tmpim/casket/casketfile"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestHostStats(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/fail") {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+
+	upstreams, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader("proxy /api "+backend.URL)), "")
+	if err != nil {
+		t.Fatalf("Expected no error. Got: %s", err.Error())
+	}
+	u := upstreams[0].(*staticUpstream)
+	registerUpstream(u)
+	defer unregisterUpstream(u)
+
+	p := &Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams}
+	for _, path := range []string{"/api/ok", "/api/fail", "/api/ok"} {
+		r := httptest.NewRequest("GET", path, nil)
+		w := testResponseRecorder{
+			ResponseWriterWrapper: &httpserver.ResponseWriterWrapper{ResponseWriter: httptest.NewRecorder()},
+		}
+		if _, err := p.ServeHTTP(w, r); err != nil {
+			t.Fatalf("Expected no error for %s, got %v", path, err)
+		}
+	}
+
+	stats := u.Hosts[0].Stats()
+	if stats.Name != backend.URL {
+		t.Errorf("Expected name %s, got %s", backend.URL, stats.Name)
+	}
+	if !stats.Healthy || stats.Breaker != BreakerClosed {
+		t.Errorf("Expected healthy host with closed breaker, got %+v", stats)
+	}
+	if stats.Requests != 3 || stats.Errors != 1 || stats.Active != 0 {
+		t.Errorf("Expected 3 requests with 1 error and none active, got %+v", stats)
+	}
+	if stats.LastLatency <= 0 {
+		t.Errorf("Expected last latency to be recorded, got %v", stats.LastLatency)
+	}
+
+	var published []UpstreamStats
+	if err := json.Unmarshal([]byte(expvar.Get("proxy").String()), &published); err != nil {
+		t.Fatalf("Expected published stats to be JSON, got %v", err)
+	}
+	found := false
+	for _, us := range published {
+		if us.From == "/api" && len(us.Hosts) == 1 && us.Hosts[0].Requests == 3 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected upstream /api in published stats, got %+v", published)
+	}
+
+	unregisterUpstream(u)
+	for _, us := range Stats() {
+		if us.From == "/api" {
+			t.Error("Expected unregistered upstream to be removed from stats")
+		}
+	}
+}
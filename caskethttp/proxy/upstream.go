@@ -26,6 +26,7 @@ import (
 	"net/http"
 	"net/textproto"
 	"net/url"
+	"os"
 	"path"
 	"regexp"
 	"strconv"
@@ -36,20 +37,27 @@ import (
 
 	"crypto/tls"
 
+	"github.com/inhies/go-bytesize"
 	"github.com/tmpim/casket/casketfile"
 	"github.com/tmpim/casket/caskethttp/httpserver"
+	"github.com/tmpim/casket/caskethttp/replacebody"
 )
 
 var (
 	supportedPolicies = make(map[string]func([]string) Policy)
 )
 
+// defaultTLSSessionCacheSize is the number of TLS sessions
+// cached per host when session resumption is enabled.
+const defaultTLSSessionCacheSize = 64
+
 type staticUpstream struct {
 	from              string
 	upstreamHeaders   http.Header
 	downstreamHeaders http.Header
 	stop              chan struct{}  // Signals running goroutines to stop.
 	wg                sync.WaitGroup // Used to wait for running goroutines to stop.
+	hostsMu           sync.RWMutex   // Guards Hosts once discovery is running.
 	Hosts             HostPool
 	Policy            Policy
 	KeepAlive         int
@@ -59,20 +67,42 @@ type staticUpstream struct {
 	TryDuration       time.Duration
 	TryInterval       time.Duration
 	MaxConns          int64
+	Transport         TransportConfig
 	HealthCheck       struct {
 		Client        http.Client
 		Path          string
+		Method        string
 		Interval      time.Duration
 		Timeout       time.Duration
 		Host          string
 		Port          string
+		Headers       http.Header
 		ContentString string
+		BodyRegexp    *regexp.Regexp
+		Statuses      []statusRange
+		Rise          int32
+		Fall          int32
+		Protocol      string // "http" or "grpc"
+		GRPCService   string
 	}
+	Breaker                      BreakerConfig
+	RetryPolicy                  *RetryPolicy
+	Mirror                       *Mirror
+	BodyRule                     *replacebody.Rule
 	WithoutPathPrefix            string
 	IgnoredSubPaths              []string
 	insecureSkipVerify           bool
+	h2c                          bool
 	MaxFails                     int32
+	DNSUpstreams                 []dnsUpstream
+	DNSInterval                  time.Duration
+	UpstreamFile                 string
+	FileInterval                 time.Duration
+	upstreamFileInfo             os.FileInfo
+	staticHosts                  []hostSpec
+	discovered                   map[string][]hostSpec
 	resolver                     srvResolver
+	hostResolver                 hostResolver
 	CaCertPool                   *x509.CertPool
 	upstreamHeaderReplacements   headerReplacements
 	downstreamHeaderReplacements headerReplacements
@@ -83,6 +113,34 @@ type srvResolver interface {
 	LookupSRV(context.Context, string, string, string) (string, []*net.SRV, error)
 }
 
+// statusRange is an inclusive range of HTTP status codes
+// that a health check response is expected to fall into.
+type statusRange struct {
+	min, max int
+}
+
+// contains returns true if status lies within the range.
+func (s statusRange) contains(status int) bool {
+	return status >= s.min && status <= s.max
+}
+
+// parseStatusRange parses a status code such as "200", or a class
+// of status codes such as "2xx", into a statusRange.
+func parseStatusRange(s string) (statusRange, error) {
+	if len(s) == 3 && strings.HasSuffix(strings.ToLower(s), "xx") {
+		class, err := strconv.Atoi(s[:1])
+		if err != nil || class < 1 || class > 5 {
+			return statusRange{}, fmt.Errorf("invalid status class '%s'", s)
+		}
+		return statusRange{class * 100, class*100 + 99}, nil
+	}
+	code, err := strconv.Atoi(s)
+	if err != nil || code < 100 || code > 599 {
+		return statusRange{}, fmt.Errorf("invalid status code '%s'", s)
+	}
+	return statusRange{code, code}, nil
+}
+
 // headerReplacement stores a compiled regex matcher and a string replacer, for replacement rules
 type headerReplacement struct {
 	regexp *regexp.Regexp
@@ -111,18 +169,30 @@ func NewStaticUpstreams(c casketfile.Dispenser, host string) ([]Upstream, error)
 	for c.Next() {
 
 		upstream := &staticUpstream{
-			from:                         "",
-			stop:                         make(chan struct{}),
-			upstreamHeaders:              make(http.Header),
-			downstreamHeaders:            make(http.Header),
-			Hosts:                        nil,
-			Policy:                       &Random{},
-			MaxFails:                     1,
-			TryInterval:                  250 * time.Millisecond,
-			MaxConns:                     0,
-			KeepAlive:                    http.DefaultMaxIdleConnsPerHost,
-			Timeout:                      30 * time.Second,
+			from:              "",
+			stop:              make(chan struct{}),
+			upstreamHeaders:   make(http.Header),
+			downstreamHeaders: make(http.Header),
+			Hosts:             nil,
+			Policy:            &Random{},
+			MaxFails:          1,
+			TryInterval:       250 * time.Millisecond,
+			MaxConns:          0,
+			KeepAlive:         http.DefaultMaxIdleConnsPerHost,
+			Timeout:           30 * time.Second,
+			Transport: TransportConfig{
+				HTTP2: httpserver.HTTP2,
+			},
+			Breaker: BreakerConfig{
+				Window:           10 * time.Second,
+				MinRequests:      10,
+				OpenDuration:     30 * time.Second,
+				HalfOpenRequests: 1,
+			},
+			DNSInterval:                  defaultDNSInterval,
+			FileInterval:                 defaultFileInterval,
 			resolver:                     net.DefaultResolver,
+			hostResolver:                 net.DefaultResolver,
 			upstreamHeaderReplacements:   make(headerReplacements),
 			downstreamHeaderReplacements: make(headerReplacements),
 		}
@@ -132,9 +202,28 @@ func NewStaticUpstreams(c casketfile.Dispenser, host string) ([]Upstream, error)
 		}
 
 		var to []string
+		var weights []int
 		hasSrv := false
 
+		// the number of hosts parsed from the preceding
+		// upstream which a weight would apply to
+		unweighted := 0
+
 		for _, t := range c.RemainingArgs() {
+			if weight, ok, err := parseWeight(t); ok {
+				if err != nil {
+					return upstreams, c.Err(err.Error())
+				}
+				if unweighted == 0 {
+					return upstreams, c.Errf("weight '%s' must follow an upstream", t)
+				}
+				for i := len(weights) - unweighted; i < len(weights); i++ {
+					weights[i] = weight
+				}
+				unweighted = 0
+				continue
+			}
+
 			if len(to) > 0 && hasSrv {
 				return upstreams, c.Err("only one upstream is supported when using SRV locator")
 			}
@@ -152,6 +241,10 @@ func NewStaticUpstreams(c casketfile.Dispenser, host string) ([]Upstream, error)
 				return upstreams, err
 			}
 			to = append(to, parsed...)
+			for range parsed {
+				weights = append(weights, 1)
+			}
+			unweighted = len(parsed)
 		}
 
 		for c.NextBlock() {
@@ -169,7 +262,57 @@ func NewStaticUpstreams(c casketfile.Dispenser, host string) ([]Upstream, error)
 				if err != nil {
 					return upstreams, err
 				}
+				weight := 1
+				if c.NextArg() {
+					var ok bool
+					weight, ok, err = parseWeight(c.Val())
+					if !ok {
+						return upstreams, c.ArgErr()
+					}
+					if err != nil {
+						return upstreams, c.Err(err.Error())
+					}
+				}
+				for range parsed {
+					weights = append(weights, weight)
+				}
 				to = append(to, parsed...)
+			case "upstream_dns":
+				if !c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
+				if hasSrv {
+					return upstreams, c.Err("upstream_dns directive is not supported when backend is service locator")
+				}
+				if err := parseDNSUpstream(c.Val()); err != nil {
+					return upstreams, c.Err(err.Error())
+				}
+				d := dnsUpstream{name: c.Val(), weight: 1}
+				if c.NextArg() {
+					weight, ok, err := parseWeight(c.Val())
+					if !ok {
+						return upstreams, c.ArgErr()
+					}
+					if err != nil {
+						return upstreams, c.Err(err.Error())
+					}
+					d.weight = weight
+				}
+				upstream.DNSUpstreams = append(upstream.DNSUpstreams, d)
+			case "upstream_file":
+				if !c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
+				if hasSrv {
+					return upstreams, c.Err("upstream_file directive is not supported when backend is service locator")
+				}
+				if upstream.UpstreamFile != "" {
+					return upstreams, c.Err("only one upstream_file is supported")
+				}
+				upstream.UpstreamFile = c.Val()
+				if c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
 			default:
 				if err := parseBlock(&c, upstream, hasSrv); err != nil {
 					return upstreams, err
@@ -177,17 +320,60 @@ func NewStaticUpstreams(c casketfile.Dispenser, host string) ([]Upstream, error)
 			}
 		}
 
-		if len(to) == 0 {
+		if len(to) == 0 && len(upstream.DNSUpstreams) == 0 && upstream.UpstreamFile == "" {
 			return upstreams, c.ArgErr()
 		}
 
-		upstream.Hosts = make([]*UpstreamHost, len(to))
-		for i, host := range to {
-			uh, err := upstream.NewHost(host)
+		if upstream.BodyRule != nil && len(upstream.BodyRule.Replacements) == 0 {
+			return upstreams, c.Err("replace_body_types requires replace_body or replace_body_regexp")
+		}
+
+		if upstream.Mirror != nil {
+			if upstream.Mirror.target == "" {
+				return upstreams, c.Err("mirror_max_body_size requires a mirror")
+			}
+			mirrorHost, err := upstream.NewHost(upstream.Mirror.target)
 			if err != nil {
 				return upstreams, err
 			}
-			upstream.Hosts[i] = uh
+			upstream.Mirror.Host = mirrorHost
+			upstream.Mirror.Timeout = upstream.Timeout
+		}
+
+		for i, host := range to {
+			upstream.staticHosts = append(upstream.staticHosts, hostSpec{name: host, weight: weights[i]})
+		}
+		if err := upstream.rebuildHosts(); err != nil {
+			return upstreams, err
+		}
+
+		if upstream.UpstreamFile != "" {
+			if err := upstream.loadUpstreamFile(); err != nil {
+				return upstreams, c.Err(err.Error())
+			}
+		}
+
+		// the workers are only started once nothing can fail
+		// anymore, so that they don't outlive a config error
+		if upstream.UpstreamFile != "" {
+			upstream.wg.Add(1)
+			go func() {
+				defer upstream.wg.Done()
+				upstream.FileWorker(upstream.stop)
+			}()
+		}
+
+		if len(upstream.DNSUpstreams) > 0 {
+			upstream.refreshDNS()
+			upstream.wg.Add(1)
+			go func() {
+				defer upstream.wg.Done()
+				upstream.DNSWorker(upstream.stop)
+			}()
+		}
+
+		if upstream.HealthCheck.Protocol == "grpc" {
+			upstream.HealthCheck.Path = grpcHealthCheckPath
 		}
 
 		if upstream.HealthCheck.Path != "" {
@@ -197,6 +383,9 @@ func NewStaticUpstreams(c casketfile.Dispenser, host string) ([]Upstream, error)
 					TLSClientConfig: &tls.Config{InsecureSkipVerify: upstream.insecureSkipVerify},
 				},
 			}
+			if upstream.HealthCheck.Protocol == "grpc" {
+				upstream.HealthCheck.Client.Transport = newGRPCHealthTransport(upstream.insecureSkipVerify)
+			}
 
 			// set up health check upstream host if we have one
 			if host != "" {
@@ -220,7 +409,9 @@ func (u *staticUpstream) From() string {
 	return u.from
 }
 
-func (u *staticUpstream) NewHost(host string) (*UpstreamHost, error) {
+// hostName returns the name of the UpstreamHost created for host,
+// defaulting to http if host has no scheme.
+func hostName(host string) string {
 	if !strings.HasPrefix(host, "http") &&
 		!strings.HasPrefix(host, "unix:") &&
 		!strings.HasPrefix(host, "quic:") &&
@@ -228,8 +419,13 @@ func (u *staticUpstream) NewHost(host string) (*UpstreamHost, error) {
 		!strings.HasPrefix(host, "srv+https://") {
 		host = "http://" + host
 	}
+	return host
+}
+
+func (u *staticUpstream) NewHost(host string) (*UpstreamHost, error) {
 	uh := &UpstreamHost{
-		Name:              host,
+		Name:              hostName(host),
+		Weight:            1,
 		Conns:             0,
 		Fails:             0,
 		FailTimeout:       u.FailTimeout,
@@ -252,6 +448,11 @@ func (u *staticUpstream) NewHost(host string) (*UpstreamHost, error) {
 		HealthCheckResult:            atomic.Value{},
 		UpstreamHeaderReplacements:   u.upstreamHeaderReplacements,
 		DownstreamHeaderReplacements: u.downstreamHeaderReplacements,
+		BodyRule:                     u.BodyRule,
+	}
+
+	if u.Breaker.Enabled() {
+		uh.Breaker = NewCircuitBreaker(u.Breaker)
 	}
 
 	baseURL, err := url.Parse(uh.Name)
@@ -260,6 +461,13 @@ func (u *staticUpstream) NewHost(host string) (*UpstreamHost, error) {
 	}
 
 	uh.ReverseProxy = NewSingleHostReverseProxy(baseURL, uh.WithoutPathPrefix, u.KeepAlive, u.Timeout, u.FallbackDelay)
+	if u.h2c {
+		if baseURL.Scheme != "http" {
+			return nil, fmt.Errorf("h2c transport requires an http upstream, got %s", uh.Name)
+		}
+		uh.ReverseProxy.UseH2C()
+	}
+	uh.ReverseProxy.UseTransportConfig(u.Transport)
 	if u.insecureSkipVerify {
 		uh.ReverseProxy.UseInsecureTransport()
 	}
@@ -275,6 +483,19 @@ func (u *staticUpstream) NewHost(host string) (*UpstreamHost, error) {
 	return uh, nil
 }
 
+// parseWeight parses a "weight=N" token. ok is false if
+// the token isn't a weight at all.
+func parseWeight(t string) (weight int, ok bool, err error) {
+	if !strings.HasPrefix(t, "weight=") {
+		return 0, false, nil
+	}
+	weight, err = strconv.Atoi(t[len("weight="):])
+	if err != nil || weight < 1 {
+		return 0, true, fmt.Errorf("invalid weight '%s': must be a positive integer", t)
+	}
+	return weight, true, nil
+}
+
 func parseUpstream(u string) ([]string, error) {
 	if strings.HasPrefix(u, "unix:") {
 		return []string{u}, nil
@@ -351,6 +572,11 @@ func parseBlock(c *casketfile.Dispenser, u *staticUpstream, hasSrv bool) error {
 			args = append(args, c.Val())
 		}
 		u.Policy = policyCreateFunc(args)
+		if v, ok := u.Policy.(validator); ok {
+			if err := v.validate(); err != nil {
+				return c.Err(err.Error())
+			}
+		}
 	case "fallback_delay":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -369,6 +595,63 @@ func parseBlock(c *casketfile.Dispenser, u *staticUpstream, hasSrv bool) error {
 			return err
 		}
 		u.FailTimeout = dur
+	case "upstream_dns_interval":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return c.Errf("invalid upstream_dns_interval '%s': %v", c.Val(), err)
+		}
+		if dur <= 0 {
+			return c.Err("upstream_dns_interval must be positive")
+		}
+		u.DNSInterval = dur
+	case "upstream_file_interval":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return c.Errf("invalid upstream_file_interval '%s': %v", c.Val(), err)
+		}
+		if dur <= 0 {
+			return c.Err("upstream_file_interval must be positive")
+		}
+		u.FileInterval = dur
+	case "mirror":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if u.Mirror == nil {
+			u.Mirror = newMirror()
+		}
+		if u.Mirror.target != "" {
+			return c.Err("only one mirror is supported")
+		}
+		u.Mirror.target = c.Val()
+		if c.NextArg() {
+			percent, err := parsePercent(c.Val())
+			if err != nil {
+				return c.Err(err.Error())
+			}
+			u.Mirror.Percent = percent
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "mirror_max_body_size":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		size, err := bytesize.Parse(c.Val())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		if u.Mirror == nil {
+			u.Mirror = newMirror()
+		}
+		u.Mirror.MaxBodySize = int64(size)
 	case "max_fails":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -408,18 +691,96 @@ func parseBlock(c *casketfile.Dispenser, u *staticUpstream, hasSrv bool) error {
 			return err
 		}
 		u.MaxConns = n
+	case "idle_conn_timeout", "dial_timeout", "response_header_timeout":
+		which := c.Val()
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return c.Errf("invalid %s '%s': %v", which, c.Val(), err)
+		}
+		if dur < 0 {
+			return c.Errf("%s must not be negative", which)
+		}
+		switch which {
+		case "idle_conn_timeout":
+			u.Transport.IdleConnTimeout = dur
+		case "dial_timeout":
+			u.Transport.DialTimeout = dur
+		case "response_header_timeout":
+			u.Transport.ResponseHeaderTimeout = dur
+		}
+	case "max_conns_per_host":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return c.Errf("invalid max_conns_per_host '%s': %v", c.Val(), err)
+		}
+		if n < 0 {
+			return c.Err("max_conns_per_host must not be negative")
+		}
+		u.Transport.MaxConnsPerHost = n
+	case "http2":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "on":
+			u.Transport.HTTP2 = true
+		case "off":
+			u.Transport.HTTP2 = false
+		default:
+			return c.Errf("http2 must be 'on' or 'off', got '%s'", c.Val())
+		}
+	case "tls_session_resumption":
+		u.Transport.TLSSessionCacheSize = defaultTLSSessionCacheSize
+		if c.NextArg() {
+			n, err := strconv.Atoi(c.Val())
+			if err != nil {
+				return c.Errf("invalid tls_session_resumption '%s': %v", c.Val(), err)
+			}
+			if n < 1 {
+				return c.Err("tls_session_resumption cache size must be at least 1")
+			}
+			u.Transport.TLSSessionCacheSize = n
+		}
 	case "health_check":
 		if !c.NextArg() {
 			return c.ArgErr()
 		}
 		u.HealthCheck.Path = c.Val()
-
-		// Set defaults
-		if u.HealthCheck.Interval == 0 {
-			u.HealthCheck.Interval = 30 * time.Second
+		u.setHealthCheckDefaults()
+	case "health_check_protocol":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "http":
+		case "grpc":
+			u.setHealthCheckDefaults()
+		default:
+			return c.Errf("unsupported health check protocol '%s'", c.Val())
+		}
+		u.HealthCheck.Protocol = c.Val()
+	case "health_check_grpc_service":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		u.HealthCheck.GRPCService = c.Val()
+	case "transport":
+		if !c.NextArg() {
+			return c.ArgErr()
 		}
-		if u.HealthCheck.Timeout == 0 {
-			u.HealthCheck.Timeout = 60 * time.Second
+		switch c.Val() {
+		case "http":
+			u.h2c = false
+		case "h2c":
+			u.h2c = true
+		default:
+			return c.Errf("unsupported transport '%s'", c.Val())
 		}
 	case "health_check_interval":
 		var interval string
@@ -465,6 +826,162 @@ func parseBlock(c *casketfile.Dispenser, u *staticUpstream, hasSrv bool) error {
 			return c.ArgErr()
 		}
 		u.HealthCheck.ContentString = c.Val()
+	case "health_check_method":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		u.HealthCheck.Method = strings.ToUpper(c.Val())
+	case "health_check_status":
+		statuses := c.RemainingArgs()
+		if len(statuses) == 0 {
+			return c.ArgErr()
+		}
+		for _, status := range statuses {
+			r, err := parseStatusRange(status)
+			if err != nil {
+				return c.Err(err.Error())
+			}
+			u.HealthCheck.Statuses = append(u.HealthCheck.Statuses, r)
+		}
+	case "health_check_body":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		r, err := regexp.Compile(c.Val())
+		if err != nil {
+			return c.Errf("invalid health_check_body regexp '%s': %v", c.Val(), err)
+		}
+		u.HealthCheck.BodyRegexp = r
+	case "health_check_header":
+		var header, value string
+		if !c.Args(&header, &value) {
+			return c.ArgErr()
+		}
+		if u.HealthCheck.Headers == nil {
+			u.HealthCheck.Headers = make(http.Header)
+		}
+		u.HealthCheck.Headers.Add(header, value)
+	case "health_check_rise", "health_check_fall":
+		which := c.Val()
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return c.Errf("invalid %s '%s': %v", which, c.Val(), err)
+		}
+		if n < 1 {
+			return c.Errf("%s must be at least 1", which)
+		}
+		if which == "health_check_rise" {
+			u.HealthCheck.Rise = int32(n)
+		} else {
+			u.HealthCheck.Fall = int32(n)
+		}
+	case "circuit_breaker_window", "circuit_breaker_latency", "circuit_breaker_open_duration":
+		which := c.Val()
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return c.Errf("invalid %s '%s': %v", which, c.Val(), err)
+		}
+		if dur <= 0 {
+			return c.Errf("%s must be positive", which)
+		}
+		switch which {
+		case "circuit_breaker_window":
+			u.Breaker.Window = dur
+		case "circuit_breaker_latency":
+			u.Breaker.Latency = dur
+		case "circuit_breaker_open_duration":
+			u.Breaker.OpenDuration = dur
+		}
+	case "circuit_breaker_error_ratio":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		ratio, err := strconv.ParseFloat(c.Val(), 64)
+		if err != nil {
+			return c.Errf("invalid circuit_breaker_error_ratio '%s': %v", c.Val(), err)
+		}
+		if ratio <= 0 || ratio > 1 {
+			return c.Err("circuit_breaker_error_ratio must be greater than 0 and at most 1")
+		}
+		u.Breaker.ErrorRatio = ratio
+	case "circuit_breaker_min_requests", "circuit_breaker_half_open_requests":
+		which := c.Val()
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return c.Errf("invalid %s '%s': %v", which, c.Val(), err)
+		}
+		if n < 1 {
+			return c.Errf("%s must be at least 1", which)
+		}
+		if which == "circuit_breaker_min_requests" {
+			u.Breaker.MinRequests = n
+		} else {
+			u.Breaker.HalfOpenRequests = n
+		}
+	case "retry":
+		statuses := c.RemainingArgs()
+		if len(statuses) == 0 {
+			return c.ArgErr()
+		}
+		if u.RetryPolicy == nil {
+			u.RetryPolicy = NewRetryPolicy()
+		}
+		for _, status := range statuses {
+			r, err := parseStatusRange(status)
+			if err != nil {
+				return c.Err(err.Error())
+			}
+			u.RetryPolicy.Statuses = append(u.RetryPolicy.Statuses, r)
+		}
+	case "retry_methods":
+		methods := c.RemainingArgs()
+		if len(methods) == 0 {
+			return c.ArgErr()
+		}
+		if u.RetryPolicy == nil {
+			u.RetryPolicy = NewRetryPolicy()
+		}
+		u.RetryPolicy.Methods = make(map[string]struct{})
+		for _, method := range methods {
+			u.RetryPolicy.Methods[strings.ToUpper(method)] = struct{}{}
+		}
+	case "retry_max_attempts":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return c.Errf("invalid retry_max_attempts '%s': %v", c.Val(), err)
+		}
+		if n < 1 {
+			return c.Err("retry_max_attempts must be at least 1")
+		}
+		if u.RetryPolicy == nil {
+			u.RetryPolicy = NewRetryPolicy()
+		}
+		u.RetryPolicy.MaxAttempts = n
+	case "retry_max_body_size":
+		sizeStr := strings.Join(c.RemainingArgs(), " ")
+		if sizeStr == "" {
+			return c.ArgErr()
+		}
+		size, err := bytesize.Parse(sizeStr)
+		if err != nil {
+			return c.Errf("error parsing retry_max_body_size: %v", err)
+		}
+		if u.RetryPolicy == nil {
+			u.RetryPolicy = NewRetryPolicy()
+		}
+		u.RetryPolicy.MaxBodySize = int64(size)
 	case "header_upstream":
 		isUpstream = true
 		fallthrough
@@ -497,6 +1014,40 @@ func parseBlock(c *casketfile.Dispenser, u *staticUpstream, hasSrv bool) error {
 				u.downstreamHeaders.Add(header, value)
 			}
 		}
+	case "replace_body":
+		var search, replace string
+		if !c.Args(&search, &replace) || c.NextArg() {
+			return c.ArgErr()
+		}
+		if search == "" {
+			return c.Err("replace_body search text must not be empty")
+		}
+		if u.BodyRule == nil {
+			u.BodyRule = &replacebody.Rule{}
+		}
+		u.BodyRule.Replacements = append(u.BodyRule.Replacements, replacebody.Replacement{Search: search, Replace: replace})
+	case "replace_body_regexp":
+		var pattern, replace string
+		if !c.Args(&pattern, &replace) || c.NextArg() {
+			return c.ArgErr()
+		}
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			return c.Errf("invalid replace_body_regexp '%s': %v", pattern, err)
+		}
+		if u.BodyRule == nil {
+			u.BodyRule = &replacebody.Rule{}
+		}
+		u.BodyRule.Replacements = append(u.BodyRule.Replacements, replacebody.Replacement{Regexp: r, Replace: replace})
+	case "replace_body_types":
+		types := c.RemainingArgs()
+		if len(types) == 0 {
+			return c.ArgErr()
+		}
+		if u.BodyRule == nil {
+			u.BodyRule = &replacebody.Rule{}
+		}
+		u.BodyRule.Types = append(u.BodyRule.Types, types...)
 	case "transparent", "trans":
 		// Note: X-Forwarded-For header is always being appended for proxy connections
 		// See implementation of createUpstreamRequest in proxy.go
@@ -619,12 +1170,126 @@ func (u *staticUpstream) resolveHost(h string) ([]string, bool, error) {
 	return names, true, nil
 }
 
+// setHealthCheckDefaults sets the defaults for
+// health check settings which haven't been configured.
+func (u *staticUpstream) setHealthCheckDefaults() {
+	if u.HealthCheck.Method == "" {
+		u.HealthCheck.Method = http.MethodGet
+	}
+	if u.HealthCheck.Interval == 0 {
+		u.HealthCheck.Interval = 30 * time.Second
+	}
+	if u.HealthCheck.Timeout == 0 {
+		u.HealthCheck.Timeout = 60 * time.Second
+	}
+}
+
+// checkHealth performs a single health check request against hostURL
+// and reports whether the response satisfied all configured criteria.
+func (u *staticUpstream) checkHealth(hostURL string) bool {
+	if u.HealthCheck.Protocol == "grpc" {
+		return u.checkGRPCHealth(hostURL)
+	}
+
+	method := u.HealthCheck.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	// set up request, needed to be able to modify headers
+	// possible errors are bad HTTP methods or un-parsable urls
+	req, err := http.NewRequest(method, hostURL, nil)
+	if err != nil {
+		return false
+	}
+	for name, values := range u.HealthCheck.Headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	// set host for request going upstream
+	if u.HealthCheck.Host != "" {
+		req.Host = u.HealthCheck.Host
+	}
+	if host := u.HealthCheck.Headers.Get("Host"); host != "" {
+		req.Host = host
+	}
+	r, err := u.HealthCheck.Client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer func() {
+		if _, err := io.Copy(ioutil.Discard, r.Body); err != nil {
+			log.Println("[ERROR] failed to copy: ", err)
+		}
+		_ = r.Body.Close()
+	}()
+	if len(u.HealthCheck.Statuses) > 0 {
+		matched := false
+		for _, status := range u.HealthCheck.Statuses {
+			if status.contains(r.StatusCode) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	} else if r.StatusCode < 200 || r.StatusCode >= 400 {
+		return false
+	}
+	if u.HealthCheck.ContentString == "" && u.HealthCheck.BodyRegexp == nil { // don't check the body
+		return true
+	}
+	// TODO ReadAll will be replaced if deemed necessary
+	//      See https://github.com/tmpim/casket/pull/1691
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return false
+	}
+	if u.HealthCheck.ContentString != "" && !bytes.Contains(buf, []byte(u.HealthCheck.ContentString)) {
+		return false
+	}
+	if u.HealthCheck.BodyRegexp != nil && !u.HealthCheck.BodyRegexp.Match(buf) {
+		return false
+	}
+	return true
+}
+
+// updateHealth records the outcome of a health check for host. The host
+// is only marked unhealthy after u.HealthCheck.Fall consecutive failures,
+// and only marked healthy again after u.HealthCheck.Rise consecutive
+// passes, so that flapping backends don't bounce in and out of the pool.
+func (u *staticUpstream) updateHealth(host *UpstreamHost, healthy bool) {
+	rise, fall := u.HealthCheck.Rise, u.HealthCheck.Fall
+	if rise < 1 {
+		rise = 1
+	}
+	if fall < 1 {
+		fall = 1
+	}
+
+	if healthy {
+		atomic.StoreInt32(&host.healthCheckFails, 0)
+		passes := atomic.AddInt32(&host.healthCheckPasses, 1)
+		if atomic.LoadInt32(&host.Unhealthy) != 0 && passes >= rise {
+			atomic.StoreInt32(&host.Unhealthy, 0)
+		}
+	} else {
+		atomic.StoreInt32(&host.healthCheckPasses, 0)
+		fails := atomic.AddInt32(&host.healthCheckFails, 1)
+		if atomic.LoadInt32(&host.Unhealthy) == 0 && fails >= fall {
+			atomic.StoreInt32(&host.Unhealthy, 1)
+		}
+	}
+}
+
 func (u *staticUpstream) healthCheck() {
-	for _, host := range u.Hosts {
+	for _, host := range u.hosts() {
 		candidates, isSrv, err := u.resolveHost(host.Name)
 		if err != nil {
+			u.updateHealth(host, false)
 			host.HealthCheckResult.Store(err.Error())
-			atomic.StoreInt32(&host.Unhealthy, 1)
 			continue
 		}
 
@@ -636,55 +1301,15 @@ func (u *staticUpstream) healthCheck() {
 			}
 			hostURL += u.HealthCheck.Path
 
-			unhealthy := func() bool {
-				// set up request, needed to be able to modify headers
-				// possible errors are bad HTTP methods or un-parsable urls
-				req, err := http.NewRequest("GET", hostURL, nil)
-				if err != nil {
-					return true
-				}
-				// set host for request going upstream
-				if u.HealthCheck.Host != "" {
-					req.Host = u.HealthCheck.Host
-				}
-				r, err := u.HealthCheck.Client.Do(req)
-				if err != nil {
-					return true
-				}
-				defer func() {
-					if _, err := io.Copy(ioutil.Discard, r.Body); err != nil {
-						log.Println("[ERROR] failed to copy: ", err)
-					}
-					_ = r.Body.Close()
-				}()
-				if r.StatusCode < 200 || r.StatusCode >= 400 {
-					return true
-				}
-				if u.HealthCheck.ContentString == "" { // don't check for content string
-					return false
-				}
-				// TODO ReadAll will be replaced if deemed necessary
-				//      See https://github.com/tmpim/casket/pull/1691
-				buf, err := ioutil.ReadAll(r.Body)
-				if err != nil {
-					return true
-				}
-				if bytes.Contains(buf, []byte(u.HealthCheck.ContentString)) {
-					return false
-				}
-				return true
-			}()
-
-			if unhealthy {
+			if !u.checkHealth(hostURL) {
 				unhealthyCount++
 			}
 		}
 
-		if unhealthyCount == len(candidates) {
-			atomic.StoreInt32(&host.Unhealthy, 1)
+		u.updateHealth(host, unhealthyCount != len(candidates))
+		if atomic.LoadInt32(&host.Unhealthy) != 0 {
 			host.HealthCheckResult.Store("Failed")
 		} else {
-			atomic.StoreInt32(&host.Unhealthy, 0)
 			host.HealthCheckResult.Store("OK")
 		}
 	}
@@ -705,7 +1330,25 @@ func (u *staticUpstream) HealthCheckWorker(stop chan struct{}) {
 }
 
 func (u *staticUpstream) Select(r *http.Request) *UpstreamHost {
-	pool := u.Hosts
+	return u.selectFrom(u.hosts(), r)
+}
+
+// selectExcluding selects a host which is not in exclude, falling
+// back to any host if all available hosts are excluded.
+func (u *staticUpstream) selectExcluding(r *http.Request, exclude map[*UpstreamHost]struct{}) *UpstreamHost {
+	var pool HostPool
+	for _, host := range u.hosts() {
+		if _, ok := exclude[host]; !ok && host.Available() {
+			pool = append(pool, host)
+		}
+	}
+	if len(pool) == 0 {
+		return u.Select(r)
+	}
+	return u.selectFrom(pool, r)
+}
+
+func (u *staticUpstream) selectFrom(pool HostPool, r *http.Request) *UpstreamHost {
 	if len(pool) == 1 {
 		if !pool[0].Available() {
 			return nil
@@ -728,6 +1371,14 @@ func (u *staticUpstream) Select(r *http.Request) *UpstreamHost {
 	return u.Policy.Select(pool, r)
 }
 
+// updateResponse lets the upstream's policy modify the response
+// coming back from host, if the policy needs to.
+func (u *staticUpstream) updateResponse(host *UpstreamHost, r *http.Request, resp *http.Response) {
+	if ru, ok := u.Policy.(responseUpdater); ok {
+		ru.updateResponse(host, r, resp)
+	}
+}
+
 func (u *staticUpstream) AllowedPath(requestPath string) bool {
 	for _, ignoredSubPath := range u.IgnoredSubPaths {
 		p := path.Clean(requestPath)
@@ -767,8 +1418,18 @@ func (u *staticUpstream) GetTimeout() time.Duration {
 	return u.Timeout
 }
 
+// GetMirror returns u.Mirror.
+func (u *staticUpstream) GetMirror() *Mirror {
+	return u.Mirror
+}
+
+// GetRetryPolicy returns u.RetryPolicy.
+func (u *staticUpstream) GetRetryPolicy() *RetryPolicy {
+	return u.RetryPolicy
+}
+
 func (u *staticUpstream) GetHostCount() int {
-	return len(u.Hosts)
+	return len(u.hosts())
 }
 
 // Stop sends a signal to all goroutines started by this staticUpstream to exit
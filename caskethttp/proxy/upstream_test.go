@@ -648,6 +648,172 @@ func TestHealthCheckContentString(t *testing.T) {
 	}
 }
 
+func TestUpstreamWeights(t *testing.T) {
+	tests := []struct {
+		config    string
+		shouldErr bool
+		weights   []int
+	}{
+		{"proxy / localhost:8080 localhost:8081", false, []int{1, 1}},
+		{"proxy / localhost:8080 weight=3 localhost:8081", false, []int{3, 1}},
+		{"proxy / localhost:8080 localhost:8081-8082 weight=2", false, []int{1, 2, 2}},
+		{"proxy / localhost:8080 {\n upstream localhost:8081 weight=5\n upstream localhost:8082\n}", false, []int{1, 5, 1}},
+		{"proxy / weight=2 localhost:8080", true, nil},
+		{"proxy / localhost:8080 weight=2 weight=3", true, nil},
+		{"proxy / localhost:8080 weight=0", true, nil},
+		{"proxy / localhost:8080 {\n upstream localhost:8081 heavy\n}", true, nil},
+	}
+
+	for i, test := range tests {
+		upstreams, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(test.config)), "")
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test %d: expected error=%v, got %v", i, test.shouldErr, err)
+		}
+		if test.shouldErr {
+			continue
+		}
+		hosts := upstreams[0].(*staticUpstream).Hosts
+		if len(hosts) != len(test.weights) {
+			t.Fatalf("Test %d: expected %d hosts, got %d", i, len(test.weights), len(hosts))
+		}
+		for j, host := range hosts {
+			if host.Weight != test.weights[j] {
+				t.Errorf("Test %d: expected host %d to have weight %d, got %d", i, j, test.weights[j], host.Weight)
+			}
+		}
+	}
+}
+
+func TestParseStatusRange(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  statusRange
+		shouldErr bool
+	}{
+		{"200", statusRange{200, 200}, false},
+		{"2xx", statusRange{200, 299}, false},
+		{"5XX", statusRange{500, 599}, false},
+		{"6xx", statusRange{}, true},
+		{"99", statusRange{}, true},
+		{"abc", statusRange{}, true},
+	}
+
+	for i, test := range tests {
+		actual, err := parseStatusRange(test.input)
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test %d: expected error=%v, got %v", i, test.shouldErr, err)
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: expected %v, got %v", i, test.expected, actual)
+		}
+	}
+}
+
+func TestHealthCheckMethodStatusBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead && r.Header.Get("X-Check") == "yes" {
+			w.WriteHeader(http.StatusAccepted)
+			_, _ = fmt.Fprintf(w, `{"status": "up", "version": 3}`)
+			return
+		}
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		block   string
+		healthy bool
+	}{
+		{"health_check_header X-Check yes", true},
+		{"health_check_header X-Check yes\n health_check_status 2xx", true},
+		{"health_check_header X-Check yes\n health_check_status 200", false},
+		{"health_check_header X-Check yes\n health_check_body version.:\\s*[0-9]+", true},
+		{"health_check_header X-Check yes\n health_check_body status.:\\s*.down", false},
+		{"health_check_header X-Check yes\n health_check_method HEAD", false},
+		{"health_check_status 4xx", true},
+		{"", false},
+	}
+
+	for i, test := range tests {
+		config := "proxy / " + server.URL + " {\n health_check /health\n health_check_interval 1h\n " + test.block + "\n}"
+		upstreams, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+		if err != nil {
+			t.Fatalf("Test %d: expected no error. Got: %s", i, err.Error())
+		}
+		for _, upstream := range upstreams {
+			staticUpstream := upstream.(*staticUpstream)
+			staticUpstream.healthCheck()
+			for _, host := range staticUpstream.Hosts {
+				if unhealthy := atomic.LoadInt32(&host.Unhealthy) != 0; unhealthy == test.healthy {
+					t.Errorf("Test %d: expected healthy=%v, got %v", i, test.healthy, !unhealthy)
+				}
+			}
+			if err := upstream.Stop(); err != nil {
+				t.Errorf("Test %d: failed to stop upstream: %v", i, err)
+			}
+		}
+	}
+}
+
+func TestHealthCheckRiseFall(t *testing.T) {
+	var healthy int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	upstream := &staticUpstream{MaxFails: 1}
+	c := casketfile.NewDispenser("Testfile", strings.NewReader("health_check /health\n health_check_rise 2\n health_check_fall 3"))
+	for c.Next() {
+		if err := parseBlock(&c, upstream, false); err != nil {
+			t.Fatalf("Expected no error. Got: %s", err.Error())
+		}
+	}
+	host, err := upstream.NewHost(server.URL)
+	if err != nil {
+		t.Fatalf("Expected no error. Got: %s", err.Error())
+	}
+	upstream.Hosts = HostPool{host}
+
+	steps := []struct {
+		backendHealthy bool
+		expectDown     bool
+	}{
+		{false, false},
+		{false, false},
+		{true, false}, // a pass resets the failure streak
+		{false, false},
+		{false, false},
+		{false, true}, // third consecutive failure
+		{true, true},
+		{false, true}, // a failure resets the pass streak
+		{true, true},
+		{true, false}, // second consecutive pass
+	}
+
+	for i, step := range steps {
+		if step.backendHealthy {
+			atomic.StoreInt32(&healthy, 1)
+		} else {
+			atomic.StoreInt32(&healthy, 0)
+		}
+		upstream.healthCheck()
+		if host.Down() != step.expectDown {
+			t.Errorf("Step %d: expected down=%v, got %v", i, step.expectDown, host.Down())
+		}
+	}
+
+	for i, config := range []string{"health_check_rise 0", "health_check_fall many"} {
+		c := casketfile.NewDispenser("Testfile", strings.NewReader(config))
+		c.Next()
+		if err := parseBlock(&c, &staticUpstream{}, false); err == nil || !strings.HasPrefix(err.Error(), "Testfile:1 - ") {
+			t.Errorf("Test %d: expected error with the config location, got %v", i, err)
+		}
+	}
+}
+
 func TestQuicHost(t *testing.T) {
 	// tests for QUIC proxy
 	tests := []struct {
@@ -895,3 +1061,82 @@ func TestSRVHealthCheck(t *testing.T) {
 		}
 	}
 }
+
+func TestTransportConfig(t *testing.T) {
+	config := `proxy / https://localhost:8443 {
+		idle_conn_timeout 90s
+		max_conns_per_host 16
+		dial_timeout 2s
+		response_header_timeout 5s
+		http2 on
+		tls_session_resumption 32
+	}`
+	upstreams, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+	if err != nil {
+		t.Fatalf("Expected no error. Got: %s", err.Error())
+	}
+	host := upstreams[0].(*staticUpstream).Hosts[0]
+	transport, ok := host.ReverseProxy.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("Expected *http.Transport, got %T", host.ReverseProxy.Transport)
+	}
+	if transport.IdleConnTimeout != 90*time.Second {
+		t.Errorf("Expected idle timeout 90s, got %v", transport.IdleConnTimeout)
+	}
+	if transport.MaxConnsPerHost != 16 {
+		t.Errorf("Expected 16 max conns per host, got %d", transport.MaxConnsPerHost)
+	}
+	if transport.ResponseHeaderTimeout != 5*time.Second {
+		t.Errorf("Expected response header timeout 5s, got %v", transport.ResponseHeaderTimeout)
+	}
+	if host.ReverseProxy.dialer.Timeout != 2*time.Second {
+		t.Errorf("Expected dial timeout 2s, got %v", host.ReverseProxy.dialer.Timeout)
+	}
+	if _, ok := transport.TLSNextProto["h2"]; !ok {
+		t.Error("Expected HTTP/2 to be enabled")
+	}
+	if transport.TLSClientConfig == nil || transport.TLSClientConfig.ClientSessionCache == nil {
+		t.Error("Expected a TLS session cache")
+	}
+
+	// disabling HTTP/2 must also stop advertising it
+	config = "proxy / https://localhost:8443 {\n http2 on\n http2 off\n}"
+	upstreams, err = NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+	if err != nil {
+		t.Fatalf("Expected no error. Got: %s", err.Error())
+	}
+	host = upstreams[0].(*staticUpstream).Hosts[0]
+	transport = host.ReverseProxy.Transport.(*http.Transport)
+	if _, ok := transport.TLSNextProto["h2"]; ok {
+		t.Error("Expected HTTP/2 to be disabled")
+	}
+	if transport.TLSClientConfig != nil {
+		for _, proto := range transport.TLSClientConfig.NextProtos {
+			if proto == "h2" {
+				t.Error("Expected h2 not to be advertised")
+			}
+		}
+	}
+
+	for _, config := range []string{
+		"proxy / localhost {\n idle_conn_timeout -1s\n}",
+		"proxy / localhost {\n max_conns_per_host -1\n}",
+		"proxy / localhost {\n http2 maybe\n}",
+		"proxy / localhost {\n tls_session_resumption 0\n}",
+		"proxy / localhost {\n dial_timeout\n}",
+	} {
+		if _, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(config)), ""); err == nil {
+			t.Errorf("Expected error for config %q", config)
+		}
+	}
+
+	for _, config := range []string{
+		"proxy / localhost {\n response_header_timeout soon\n}",
+		"proxy / localhost {\n max_conns_per_host many\n}",
+		"proxy / localhost {\n tls_session_resumption lots\n}",
+	} {
+		if _, err := NewStaticUpstreams(casketfile.NewDispenser("Testfile", strings.NewReader(config)), ""); err == nil || !strings.HasPrefix(err.Error(), "Testfile:2 - ") {
+			t.Errorf("Expected error with the config location for config %q, got %v", config, err)
+		}
+	}
+}
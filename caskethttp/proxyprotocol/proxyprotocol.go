@@ -0,0 +1,247 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package proxyprotocol implements accepting connections that
+// start with a HAProxy PROXY protocol header, version 1 or 2,
+// so that the client address the proxy received the connection
+// from is used instead of the address of the proxy.
+package proxyprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+// DefaultTimeout is how long to wait for the PROXY header by default.
+const DefaultTimeout = 5 * time.Second
+
+// v2Signature starts every version 2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1MaxLength is the maximum length of a version 1 header.
+const v1MaxLength = 107
+
+// Listener wraps a listener to read the PROXY header of the
+// connections accepted from trusted sources.
+type Listener struct {
+	casket.Listener
+
+	// Trusted lists the sources that send a PROXY header.
+	// Connections from other sources are used as they are.
+	// If it is empty, all connections must send one.
+	Trusted []*net.IPNet
+
+	// Timeout is how long to wait for the PROXY header.
+	Timeout time.Duration
+}
+
+// Accept waits for and returns the next connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+	if len(l.Trusted) > 0 {
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok || !httpserver.NetworksContain(l.Trusted, addr.IP) {
+			return conn, nil
+		}
+	}
+	return &Conn{Conn: conn, reader: bufio.NewReader(conn), timeout: l.Timeout}, nil
+}
+
+// Conn is a connection that starts with a PROXY header. The header
+// is read on the first call to Read, RemoteAddr or LocalAddr rather
+// than in Accept, so that a slow client doesn't block the listener.
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+// Read reads data from the connection, after the PROXY header.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY header, or
+// the address of the peer if the header didn't include one.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to according
+// to the PROXY header, or the local address if it didn't include one.
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *Conn) readHeader() {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+
+	first, err := c.reader.Peek(1)
+	if err != nil {
+		c.err = err
+		return
+	}
+	switch first[0] {
+	case 'P':
+		c.err = c.readV1()
+	case v2Signature[0]:
+		c.err = c.readV2()
+	default:
+		c.err = errors.New("proxyprotocol: connection did not start with a PROXY header")
+	}
+	if c.err != nil {
+		c.Conn.Close()
+	}
+}
+
+// readV1 reads a header like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func (c *Conn) readV1() error {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= v1MaxLength {
+			return errors.New("proxyprotocol: version 1 header too long")
+		}
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return fmt.Errorf("proxyprotocol: invalid version 1 header %q", line)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return fmt.Errorf("proxyprotocol: invalid version 1 header %q", line)
+		}
+	default:
+		return fmt.Errorf("proxyprotocol: unknown protocol %s", fields[1])
+	}
+
+	src, err := parseV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	c.remoteAddr, c.localAddr = src, dst
+	return nil
+}
+
+func parseV1Addr(protocol, ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil || (addr.IP.To4() != nil) != (protocol == "TCP4") {
+		return nil, fmt.Errorf("proxyprotocol: invalid %s address %s", protocol, ip)
+	}
+	var err error
+	addr.Port, err = strconv.Atoi(port)
+	if err != nil || addr.Port < 0 || addr.Port > 65535 || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("proxyprotocol: invalid port %s", port)
+	}
+	return addr, nil
+}
+
+// readV2 reads a binary header.
+func (c *Conn) readV2() error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:12], v2Signature) {
+		return errors.New("proxyprotocol: invalid version 2 signature")
+	}
+	if header[12]>>4 != 2 {
+		return fmt.Errorf("proxyprotocol: unsupported version %d", header[12]>>4)
+	}
+	command, family := header[12]&0x0f, header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return err
+	}
+
+	switch command {
+	case 0x0: // LOCAL: the proxy's own connection, like a health check
+		return nil
+	case 0x1: // PROXY
+	default:
+		return fmt.Errorf("proxyprotocol: unknown command %d", command)
+	}
+
+	var ipLen int
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		ipLen = net.IPv4len
+	case 0x2: // AF_INET6
+		ipLen = net.IPv6len
+	default:
+		// AF_UNSPEC or AF_UNIX; keep the addresses of the connection
+		return nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return errors.New("proxyprotocol: version 2 addresses too short")
+	}
+	// the source and destination IPs and ports;
+	// any TLVs after them are ignored
+	c.remoteAddr = &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	c.localAddr = &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+	return nil
+}
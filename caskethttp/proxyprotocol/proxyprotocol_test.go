@@ -0,0 +1,143 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyprotocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+// v2Header builds a version 2 header of command and family with payload.
+func v2Header(command, family byte, payload []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestConn(t *testing.T) {
+	v4Payload := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	v6Payload := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xdc, 0x04, 0x01, 0xbb)
+	tlvPayload := append(append([]byte{}, v4Payload...), 0x04, 0x00, 0x01, 0x00) // a PP2_TYPE_NOOP TLV
+
+	for i, test := range []struct {
+		header         []byte
+		shouldErr      bool
+		expectedRemote string
+		expectedLocal  string
+	}{
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), false, "192.0.2.1:56324", "198.51.100.1:443"},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), false, "[2001:db8::1]:56324", "[2001:db8::2]:443"},
+		{[]byte("PROXY UNKNOWN\r\n"), false, "pipe", "pipe"},
+		{[]byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"), false, "pipe", "pipe"},
+		{v2Header(0x1, 0x11, v4Payload), false, "192.0.2.1:56324", "198.51.100.1:443"},
+		{v2Header(0x1, 0x21, v6Payload), false, "[2001:db8::1]:56324", "[2001:db8::2]:443"},
+		{v2Header(0x1, 0x11, tlvPayload), false, "192.0.2.1:56324", "198.51.100.1:443"},
+		{v2Header(0x0, 0x00, nil), false, "pipe", "pipe"},
+		{v2Header(0x1, 0x00, nil), false, "pipe", "pipe"},
+		{[]byte("GET / HTTP/1.1\r\n"), true, "", ""},
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"), true, "", ""},
+		{[]byte("PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n"), true, "", ""},
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n"), true, "", ""},
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 056324 443\r\n"), true, "", ""},
+		{[]byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n"), true, "", ""},
+		{append([]byte("PROXY UNKNOWN "), make([]byte, 100)...), true, "", ""},
+		{v2Header(0x1, 0x11, v4Payload[:8]), true, "", ""},
+		{v2Header(0x2, 0x11, v4Payload), true, "", ""},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(test.header)
+			client.Write([]byte("hello"))
+			client.Close()
+		}()
+		conn := &Conn{Conn: server, reader: bufio.NewReader(server), timeout: time.Second}
+
+		data, err := ioutil.ReadAll(conn)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, got %q", i, data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+			continue
+		}
+		if string(data) != "hello" {
+			t.Errorf("Test %d: Expected data after the header to be read, got %q", i, data)
+		}
+		if remote := conn.RemoteAddr().String(); remote != test.expectedRemote {
+			t.Errorf("Test %d: Expected remote address %s, got %s", i, test.expectedRemote, remote)
+		}
+		if local := conn.LocalAddr().String(); local != test.expectedLocal {
+			t.Errorf("Test %d: Expected local address %s, got %s", i, test.expectedLocal, local)
+		}
+	}
+}
+
+func TestConnTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &Conn{Conn: server, reader: bufio.NewReader(server), timeout: 10 * time.Millisecond}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected an error when the header isn't sent in time")
+	}
+	if remote := conn.RemoteAddr().String(); remote != "pipe" {
+		t.Errorf("Expected the address of the connection, got %s", remote)
+	}
+}
+
+func TestListener(t *testing.T) {
+	for i, test := range []struct {
+		trusted  string
+		expected string
+	}{
+		{"127.0.0.0/8", "192.0.2.1"},
+		{"10.0.0.0/8", "127.0.0.1"},
+	} {
+		tcpLn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		trusted, _ := httpserver.ParseNetworks([]string{test.trusted})
+		ln := &Listener{Listener: tcpLn, Trusted: trusted, Timeout: time.Second}
+
+		go func() {
+			client, err := net.Dial("tcp", tcpLn.Addr().String())
+			if err != nil {
+				return
+			}
+			defer client.Close()
+			client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+		}()
+
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != test.expected {
+			t.Errorf("Test %d: Expected remote address %s, got %s", i, test.expected, host)
+		}
+		conn.Close()
+		ln.Close()
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyprotocol
+
+import (
+	"time"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func init() {
+	casket.RegisterPlugin("proxyprotocol", casket.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures the PROXY protocol listener middleware.
+func setup(c *casket.Controller) error {
+	config, err := proxyProtocolParse(c)
+	if err != nil {
+		return err
+	}
+
+	httpserver.GetConfig(c).AddListenerMiddleware(func(ln casket.Listener) casket.Listener {
+		// sites that share the listener all wrap it,
+		// but the header can only be read once
+		if _, ok := ln.(*Listener); ok {
+			return ln
+		}
+		return &Listener{Listener: ln, Trusted: config.Trusted, Timeout: config.Timeout}
+	})
+	return nil
+}
+
+func proxyProtocolParse(c *casket.Controller) (Listener, error) {
+	config := Listener{Timeout: DefaultTimeout}
+
+	for c.Next() {
+		networks, err := httpserver.ParseNetworks(c.RemainingArgs())
+		if err != nil {
+			return config, c.Err(err.Error())
+		}
+		config.Trusted = append(config.Trusted, networks...)
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "timeout":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				timeout, err := time.ParseDuration(c.Val())
+				if err != nil || timeout < 0 {
+					return config, c.Errf("invalid timeout: %s", c.Val())
+				}
+				config.Timeout = timeout
+				if c.NextArg() {
+					return config, c.ArgErr()
+				}
+			default:
+				return config, c.Errf("unknown subdirective: %s", c.Val())
+			}
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyprotocol
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := casket.NewTestController("http", `proxyprotocol 10.0.0.0/8`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).ListenerMiddleware()
+	if len(mids) != 1 {
+		t.Fatalf("Expected 1 listener middleware, got %d", len(mids))
+	}
+
+	tcpLn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpLn.Close()
+	ln, ok := mids[0](tcpLn).(*Listener)
+	if !ok {
+		t.Fatalf("Expected listener to be type *Listener, got: %#v", ln)
+	}
+	if len(ln.Trusted) != 1 || ln.Timeout != DefaultTimeout {
+		t.Errorf("Unexpected listener config: %+v", ln)
+	}
+	if wrapped := mids[0](ln); wrapped != ln {
+		t.Error("Expected a listener to be wrapped only once")
+	}
+}
+
+func TestProxyProtocolParse(t *testing.T) {
+	tests := []struct {
+		input           string
+		shouldErr       bool
+		expectedTrusted int
+		expectedTimeout time.Duration
+	}{
+		{`proxyprotocol`, false, 0, DefaultTimeout},
+		{`proxyprotocol 10.0.0.0/8 192.168.0.1`, false, 2, DefaultTimeout},
+		{`proxyprotocol 10.0.0.0/8 {
+			timeout 2s
+		}`, false, 1, 2 * time.Second},
+		{`proxyprotocol {
+			timeout 0
+		}`, false, 0, 0},
+		{`proxyprotocol 10.0.0.0/33`, true, 0, 0},
+		{`proxyprotocol {
+			timeout soon
+		}`, true, 0, 0},
+		{`proxyprotocol {
+			timeout 1s 2s
+		}`, true, 0, 0},
+		{`proxyprotocol {
+			version 2
+		}`, true, 0, 0},
+	}
+
+	for i, test := range tests {
+		actual, err := proxyProtocolParse(casket.NewTestController("http", test.input))
+
+		if err == nil && test.shouldErr {
+			t.Errorf("Test %d didn't error, but it should have", i)
+		} else if err != nil && !test.shouldErr {
+			t.Errorf("Test %d errored, but it shouldn't have; got '%v'", i, err)
+		}
+		if err != nil {
+			continue
+		}
+		if len(actual.Trusted) != test.expectedTrusted {
+			t.Errorf("Test %d: Expected %d trusted networks, got %v", i, test.expectedTrusted, actual.Trusted)
+		}
+		if actual.Timeout != test.expectedTimeout {
+			t.Errorf("Test %d: Expected timeout %v, got %v", i, test.expectedTimeout, actual.Timeout)
+		}
+	}
+}
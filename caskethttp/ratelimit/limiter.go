@@ -0,0 +1,180 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+)
+
+// Algorithms that can be used to limit requests.
+const (
+	TokenBucket   = "token_bucket"
+	SlidingWindow = "sliding_window"
+)
+
+// decision is the outcome of taking a request from a limiter.
+type decision struct {
+	allowed    bool
+	limit      int
+	remaining  int
+	reset      time.Duration // until the limiter is back to full capacity
+	retryAfter time.Duration // until the next request will be allowed
+}
+
+// limiter limits the requests of a single key.
+// It is not safe for concurrent use.
+type limiter interface {
+	take(now time.Time) decision
+}
+
+// tokenBucket allows bursts of up to burst requests and
+// refills at rate tokens per second.
+type tokenBucket struct {
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) take(now time.Time) decision {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(b.burst), b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+
+	d := decision{limit: b.burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.allowed = true
+	} else {
+		d.retryAfter = seconds((1 - b.tokens) / b.rate)
+	}
+	d.remaining = int(b.tokens)
+	d.reset = seconds((float64(b.burst) - b.tokens) / b.rate)
+	return d
+}
+
+// slidingWindow allows limit requests in any window, estimating
+// the requests in the sliding window from the counts of the
+// current and the previous fixed window.
+type slidingWindow struct {
+	limit    int
+	window   time.Duration
+	start    time.Time // of the current window
+	current  int
+	previous int
+}
+
+func newSlidingWindow(limit int, window time.Duration, now time.Time) *slidingWindow {
+	return &slidingWindow{limit: limit, window: window, start: now}
+}
+
+func (s *slidingWindow) take(now time.Time) decision {
+	if elapsed := now.Sub(s.start); elapsed >= 2*s.window {
+		s.previous, s.current = 0, 0
+		s.start = now
+	} else if elapsed >= s.window {
+		s.previous, s.current = s.current, 0
+		s.start = s.start.Add(s.window)
+	}
+
+	elapsed := now.Sub(s.start)
+	weight := 1 - float64(elapsed)/float64(s.window)
+	estimate := float64(s.previous)*weight + float64(s.current)
+
+	d := decision{limit: s.limit}
+	if estimate+1 <= float64(s.limit) {
+		s.current++
+		estimate++
+		d.allowed = true
+	} else if s.current+1 > s.limit {
+		// even once the previous window has slid out,
+		// the current one is full until it ends
+		d.retryAfter = s.window - elapsed
+	} else {
+		// wait until enough of the previous window has slid out
+		fraction := 1 - float64(s.limit-1-s.current)/float64(s.previous)
+		d.retryAfter = time.Duration(fraction*float64(s.window)) - elapsed
+	}
+	d.remaining = int(math.Max(0, math.Floor(float64(s.limit)-estimate)))
+	d.reset = s.window - elapsed
+	if s.current > 0 {
+		d.reset += s.window
+	}
+	return d
+}
+
+// seconds converts s seconds to a duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// store keeps the limiters of up to max keys, evicting
+// the least recently used ones when it is full.
+type store struct {
+	mu         sync.Mutex
+	max        int
+	entries    map[string]*list.Element
+	lru        *list.List
+	newLimiter func(now time.Time) limiter
+}
+
+type storeEntry struct {
+	key     string
+	limiter limiter
+}
+
+func newStore(max int, newLimiter func(now time.Time) limiter) *store {
+	return &store{
+		max:        max,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		newLimiter: newLimiter,
+	}
+}
+
+// take takes a request from the limiter of key.
+func (s *store) take(key string, now time.Time) decision {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[key]
+	if ok {
+		s.lru.MoveToFront(elem)
+	} else {
+		if s.lru.Len() >= s.max {
+			oldest := s.lru.Back()
+			s.lru.Remove(oldest)
+			delete(s.entries, oldest.Value.(*storeEntry).key)
+		}
+		elem = s.lru.PushFront(&storeEntry{key: key, limiter: s.newLimiter(now)})
+		s.entries[key] = elem
+	}
+	return elem.Value.(*storeEntry).limiter.take(now)
+}
+
+// len returns the number of keys in s.
+func (s *store) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
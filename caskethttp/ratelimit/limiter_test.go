@@ -0,0 +1,109 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Unix(1000, 0)
+	b := newTokenBucket(1, 3, start) // 1 per second, bursts of 3
+
+	for i := 0; i < 3; i++ {
+		if d := b.take(start); !d.allowed || d.remaining != 2-i {
+			t.Fatalf("Request %d: Expected to be allowed with %d remaining, got %+v", i, 2-i, d)
+		}
+	}
+	d := b.take(start)
+	if d.allowed {
+		t.Fatal("Expected fourth request in a burst to be limited")
+	}
+	if d.retryAfter != time.Second || d.reset != 3*time.Second || d.limit != 3 {
+		t.Errorf("Expected retry after 1s and reset in 3s, got %+v", d)
+	}
+
+	if d := b.take(start.Add(1500 * time.Millisecond)); !d.allowed {
+		t.Error("Expected request to be allowed once a token was refilled")
+	}
+	if d := b.take(start.Add(1500 * time.Millisecond)); d.allowed || d.retryAfter != 500*time.Millisecond {
+		t.Errorf("Expected request to be limited for 500ms, got %+v", d)
+	}
+
+	// tokens don't accumulate beyond the burst
+	later := start.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		b.take(later)
+	}
+	if d := b.take(later); d.allowed {
+		t.Error("Expected bucket to be capped at its burst")
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	start := time.Unix(1000, 0)
+	s := newSlidingWindow(4, time.Minute, start)
+
+	for i := 0; i < 4; i++ {
+		if d := s.take(start.Add(time.Duration(i) * time.Second)); !d.allowed || d.remaining != 3-i {
+			t.Fatalf("Request %d: Expected to be allowed with %d remaining, got %+v", i, 3-i, d)
+		}
+	}
+	d := s.take(start.Add(10 * time.Second))
+	if d.allowed || d.retryAfter != 50*time.Second {
+		t.Fatalf("Expected request to be limited until the window ends, got %+v", d)
+	}
+
+	// a quarter into the next window, 3 of the 4 previous requests still count
+	d = s.take(start.Add(75 * time.Second))
+	if !d.allowed || d.remaining != 0 {
+		t.Fatalf("Expected request to be allowed with none remaining, got %+v", d)
+	}
+	d = s.take(start.Add(75 * time.Second))
+	if d.allowed || d.retryAfter != 15*time.Second {
+		t.Errorf("Expected request to be limited until half of the previous window slid out, got %+v", d)
+	}
+	if d := s.take(start.Add(105 * time.Second)); !d.allowed {
+		t.Errorf("Expected request to be allowed, got %+v", d)
+	}
+
+	// idle for more than a window
+	if d := s.take(start.Add(time.Hour)); !d.allowed || d.remaining != 3 {
+		t.Errorf("Expected counts to be reset after being idle, got %+v", d)
+	}
+}
+
+func TestStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	start := time.Unix(1000, 0)
+	s := newStore(2, func(now time.Time) limiter {
+		return newTokenBucket(1, 1, now)
+	})
+
+	s.take("a", start)
+	s.take("b", start)
+	s.take("a", start) // a is now the most recently used
+	s.take("c", start) // evicts b
+
+	if s.len() != 2 {
+		t.Fatalf("Expected 2 keys, got %d", s.len())
+	}
+	if d := s.take("b", start); !d.allowed {
+		t.Error("Expected evicted key to start with a new limiter")
+	}
+	if d := s.take("c", start); d.allowed {
+		t.Error("Expected key c to have been kept")
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ratelimit implements HTTP request rate limiting.
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+// DefaultMaxKeys is the default number of keys whose
+// limiters are kept in memory for each rule.
+const DefaultMaxKeys = 100000
+
+// now is the clock used by the limiters; tests replace it.
+var now = time.Now
+
+// RateLimit is middleware that limits the rate of requests.
+type RateLimit struct {
+	Next  httpserver.Handler
+	Rules []*Rule
+}
+
+// Rule limits the requests to a set of paths.
+type Rule struct {
+	// Paths are the paths the rule applies to.
+	Paths []string
+
+	// Rate is the number of requests allowed per Window.
+	Rate   int
+	Window time.Duration
+
+	// Burst is the number of requests a token bucket
+	// allows at once; it defaults to Rate.
+	Burst int
+
+	// Algorithm is either TokenBucket or SlidingWindow.
+	Algorithm string
+
+	// Key is a placeholder format that identifies a client,
+	// like {remote} or {>Authorization}. Requests with the
+	// same key share their limit.
+	Key string
+
+	// Whitelist lists the networks that are never limited.
+	Whitelist []*net.IPNet
+
+	// MaxKeys is the number of keys whose limiters are kept.
+	// Once it is reached, the least recently used is evicted.
+	MaxKeys int
+
+	store *store
+}
+
+// init sets up the limiter store of r.
+func (r *Rule) init() {
+	maxKeys := r.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = DefaultMaxKeys
+	}
+	r.store = newStore(maxKeys, r.newLimiter)
+}
+
+func (r *Rule) newLimiter(now time.Time) limiter {
+	if r.Algorithm == SlidingWindow {
+		return newSlidingWindow(r.Rate, r.Window, now)
+	}
+	burst := r.Burst
+	if burst <= 0 {
+		burst = r.Rate
+	}
+	return newTokenBucket(float64(r.Rate)/r.Window.Seconds(), burst, now)
+}
+
+// whitelisted returns true if the client of req is in a whitelisted network.
+func (r *Rule) whitelisted(req *http.Request) bool {
+	if len(r.Whitelist) == 0 {
+		return false
+	}
+	ip := httpserver.ClientIP(req, nil, "")
+	return ip != nil && httpserver.NetworksContain(r.Whitelist, ip)
+}
+
+// match returns the rule with the longest path matching r,
+// or nil if none does.
+func (rl RateLimit) match(r *http.Request) *Rule {
+	i := httpserver.Path(r.URL.Path).LongestMatch(len(rl.Rules), func(i int) []string {
+		return rl.Rules[i].Paths
+	})
+	if i < 0 {
+		return nil
+	}
+	return rl.Rules[i]
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (rl RateLimit) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	rule := rl.match(r)
+	if rule == nil || rule.whitelisted(r) {
+		return rl.Next.ServeHTTP(w, r)
+	}
+
+	key := httpserver.NewReplacer(r, nil, "").Replace(rule.Key)
+	d := rule.store.take(key, now())
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(d.limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.remaining))
+	w.Header().Set("RateLimit-Reset", ceilSeconds(d.reset))
+	if !d.allowed {
+		w.Header().Set("Retry-After", ceilSeconds(d.retryAfter))
+		return http.StatusTooManyRequests, nil
+	}
+
+	return rl.Next.ServeHTTP(w, r)
+}
+
+// ceilSeconds formats d as a whole number of seconds, rounded up.
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
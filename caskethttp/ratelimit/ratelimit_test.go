@@ -0,0 +1,97 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestRateLimit(t *testing.T) {
+	current := time.Unix(1000, 0)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	rules, err := rateLimitParse(casket.NewTestController("http", `
+	ratelimit / 100 100 second
+	ratelimit /api {
+		rate 2 minute
+		key {>Authorization}
+		whitelist 10.0.0.0/8
+	}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	rl := RateLimit{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Rules: rules,
+	}
+
+	serve := func(path, remote, auth string) (int, http.Header) {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = remote
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		status, err := rl.ServeHTTP(w, r)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return status, w.Header()
+	}
+
+	for i := 0; i < 2; i++ {
+		if status, _ := serve("/api/items", "1.2.3.4:1234", "alice"); status != http.StatusOK {
+			t.Fatalf("Request %d: Expected status 200, got %d", i, status)
+		}
+	}
+	status, header := serve("/api/items", "5.6.7.8:1234", "alice")
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("Expected requests with the same key to share a limit, got status %d", status)
+	}
+	for name, expected := range map[string]string{
+		"RateLimit-Limit":     "2",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "60",
+		"Retry-After":         "30",
+	} {
+		if actual := header.Get(name); actual != expected {
+			t.Errorf("Expected %s header %s, got %q", name, expected, actual)
+		}
+	}
+
+	if status, header := serve("/api/items", "1.2.3.4:1234", "bob"); status != http.StatusOK || header.Get("RateLimit-Remaining") != "1" {
+		t.Errorf("Expected a different key to have its own limit, got status %d and headers %v", status, header)
+	}
+	if status, header := serve("/api/items", "10.1.1.1:1234", "alice"); status != http.StatusOK || header.Get("RateLimit-Limit") != "" {
+		t.Errorf("Expected whitelisted client not to be limited, got status %d and headers %v", status, header)
+	}
+	if status, header := serve("/index.html", "1.2.3.4:1234", "alice"); status != http.StatusOK || header.Get("RateLimit-Limit") != "100" {
+		t.Errorf("Expected other paths to use the site-wide rule, got status %d and headers %v", status, header)
+	}
+
+	current = current.Add(30 * time.Second)
+	if status, _ := serve("/api/items", "1.2.3.4:1234", "alice"); status != http.StatusOK {
+		t.Errorf("Expected request to be allowed after Retry-After, got status %d", status)
+	}
+}
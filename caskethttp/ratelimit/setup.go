@@ -0,0 +1,172 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func init() {
+	casket.RegisterPlugin("ratelimit", casket.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new RateLimit middleware instance.
+func setup(c *casket.Controller) error {
+	rules, err := rateLimitParse(c)
+	if err != nil {
+		return err
+	}
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return RateLimit{Next: next, Rules: rules}
+	})
+	return nil
+}
+
+// windows maps the units a rate can be given in to their duration.
+var windows = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+}
+
+func rateLimitParse(c *casket.Controller) ([]*Rule, error) {
+	var rules []*Rule
+
+	for c.Next() {
+		rule := &Rule{Algorithm: TokenBucket, Key: "{remote}"}
+
+		args := c.RemainingArgs()
+		if len(args) == 4 && isNumber(args[1]) {
+			// ratelimit <path> <rate> <burst> <unit>
+			rule.Paths = args[:1]
+			if err := parseRate(c, rule, args[1], args[3]); err != nil {
+				return nil, err
+			}
+			burst, err := strconv.Atoi(args[2])
+			if err != nil || burst < 1 {
+				return nil, c.Errf("invalid burst: %s", args[2])
+			}
+			rule.Burst = burst
+		} else {
+			// ratelimit [paths...] { ... }
+			rule.Paths = args
+		}
+		if len(rule.Paths) == 0 {
+			rule.Paths = []string{"/"}
+		}
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "rate":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, c.ArgErr()
+				}
+				if err := parseRate(c, rule, args[0], args[1]); err != nil {
+					return nil, err
+				}
+			case "burst":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				burst, err := strconv.Atoi(c.Val())
+				if err != nil || burst < 1 {
+					return nil, c.Errf("invalid burst: %s", c.Val())
+				}
+				rule.Burst = burst
+			case "algorithm":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case TokenBucket, SlidingWindow:
+					rule.Algorithm = c.Val()
+				default:
+					return nil, c.Errf("unknown algorithm: %s", c.Val())
+				}
+			case "key":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				rule.Key = strings.Join(args, " ")
+			case "whitelist":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				networks, err := httpserver.ParseNetworks(args)
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				rule.Whitelist = append(rule.Whitelist, networks...)
+			case "max_keys":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				maxKeys, err := strconv.Atoi(c.Val())
+				if err != nil || maxKeys < 1 {
+					return nil, c.Errf("invalid max_keys: %s", c.Val())
+				}
+				rule.MaxKeys = maxKeys
+			default:
+				return nil, c.Errf("unknown subdirective: %s", c.Val())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+		}
+
+		if rule.Rate == 0 {
+			return nil, c.Err("ratelimit needs a rate")
+		}
+		if rule.Algorithm == SlidingWindow && rule.Burst != 0 {
+			return nil, c.Err("burst only applies to the token_bucket algorithm")
+		}
+		rule.init()
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// parseRate sets the rate of rule to count requests per unit.
+func parseRate(c *casket.Controller, rule *Rule, count, unit string) error {
+	rate, err := strconv.Atoi(count)
+	if err != nil || rate < 1 {
+		return c.Errf("invalid rate: %s", count)
+	}
+	window, ok := windows[unit]
+	if !ok {
+		return c.Errf("invalid rate unit: %s (must be second, minute, hour or day)", unit)
+	}
+	rule.Rate, rule.Window = rate, window
+	return nil
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
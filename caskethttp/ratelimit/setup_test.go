@@ -0,0 +1,137 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := casket.NewTestController("http", `ratelimit /api 10 20 second`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(RateLimit)
+	if !ok {
+		t.Fatalf("Expected handler to be type RateLimit, got: %#v", handler)
+	}
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+}
+
+func TestRateLimitParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  []Rule
+	}{
+		{`ratelimit /api 10 20 second`, false, []Rule{
+			{Paths: []string{"/api"}, Rate: 10, Window: time.Second, Burst: 20, Algorithm: TokenBucket, Key: "{remote}"},
+		}},
+		{`ratelimit {
+			rate 100 minute
+		}`, false, []Rule{
+			{Paths: []string{"/"}, Rate: 100, Window: time.Minute, Algorithm: TokenBucket, Key: "{remote}"},
+		}},
+		{`ratelimit /login /register {
+			rate 5 hour
+			algorithm sliding_window
+			key {remote} {>User-Agent}
+			whitelist 10.0.0.0/8 127.0.0.1
+			max_keys 1000
+		}`, false, []Rule{
+			{Paths: []string{"/login", "/register"}, Rate: 5, Window: time.Hour, Algorithm: SlidingWindow,
+				Key: "{remote} {>User-Agent}", MaxKeys: 1000},
+		}},
+		{`ratelimit /api 10 20 second {
+			key {>Authorization}
+		}
+		ratelimit /static {
+			rate 1000 day
+			burst 50
+		}`, false, []Rule{
+			{Paths: []string{"/api"}, Rate: 10, Window: time.Second, Burst: 20, Algorithm: TokenBucket, Key: "{>Authorization}"},
+			{Paths: []string{"/static"}, Rate: 1000, Window: 24 * time.Hour, Burst: 50, Algorithm: TokenBucket, Key: "{remote}"},
+		}},
+		{`ratelimit`, true, nil},
+		{`ratelimit /api`, true, nil},
+		{`ratelimit /api 10 20 week`, true, nil},
+		{`ratelimit /api 0 20 second`, true, nil},
+		{`ratelimit /api 10 x second`, true, nil},
+		{`ratelimit {
+			rate 10
+		}`, true, nil},
+		{`ratelimit {
+			rate 10 second
+			algorithm leaky_bucket
+		}`, true, nil},
+		{`ratelimit {
+			rate 10 second
+			algorithm sliding_window
+			burst 20
+		}`, true, nil},
+		{`ratelimit {
+			rate 10 second
+			whitelist 10.0.0.0/33
+		}`, true, nil},
+		{`ratelimit {
+			rate 10 second
+			burst 5 6
+		}`, true, nil},
+		{`ratelimit {
+			rate 10 second
+			unknown
+		}`, true, nil},
+	}
+
+	for i, test := range tests {
+		actual, err := rateLimitParse(casket.NewTestController("http", test.input))
+
+		if err == nil && test.shouldErr {
+			t.Errorf("Test %d didn't error, but it should have", i)
+		} else if err != nil && !test.shouldErr {
+			t.Errorf("Test %d errored, but it shouldn't have; got '%v'", i, err)
+		}
+		if len(actual) != len(test.expected) {
+			t.Fatalf("Test %d expected %d rules, but got %d", i, len(test.expected), len(actual))
+		}
+
+		for j, rule := range actual {
+			if rule.store == nil {
+				t.Errorf("Test %d, rule %d: Expected limiter store to be set up", i, j)
+			}
+			if len(rule.Whitelist) > 0 && len(rule.Whitelist) != 2 {
+				t.Errorf("Test %d, rule %d: Expected 2 whitelisted networks, got %v", i, j, rule.Whitelist)
+			}
+			got := *rule
+			got.store, got.Whitelist = nil, nil
+			if !reflect.DeepEqual(got, test.expected[j]) {
+				t.Errorf("Test %d, rule %d: Expected %+v, got %+v", i, j, test.expected[j], got)
+			}
+		}
+	}
+}
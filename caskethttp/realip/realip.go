@@ -0,0 +1,51 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package realip implements resolving the address of clients
+// that connect through trusted proxies.
+package realip
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+// RealIP is middleware that sets the remote address of requests
+// from trusted proxies to the client address the proxies forwarded,
+// so that later middleware, logs and placeholders like {remote}
+// see the real client.
+type RealIP struct {
+	Next httpserver.Handler
+
+	// From lists the trusted proxies.
+	From []*net.IPNet
+
+	// Header is the header the proxies forward the client
+	// address in, like X-Forwarded-For or Forwarded.
+	Header string
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (rip RealIP) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host, port = r.RemoteAddr, "0"
+	}
+	if ip := httpserver.ClientIP(r, rip.From, rip.Header); ip != nil && ip.String() != host {
+		r.RemoteAddr = net.JoinHostPort(ip.String(), port)
+	}
+	return rip.Next.ServeHTTP(w, r)
+}
@@ -0,0 +1,66 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package realip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestRealIP(t *testing.T) {
+	trusted, _ := httpserver.ParseNetworks([]string{"10.0.0.0/8", "::1"})
+
+	for i, test := range []struct {
+		header, remote, value string
+		expected              string
+	}{
+		{"X-Forwarded-For", "10.0.0.1:1234", "5.6.7.8", "5.6.7.8:1234"},
+		{"X-Forwarded-For", "10.0.0.1:1234", "", "10.0.0.1:1234"},
+		{"X-Forwarded-For", "9.9.9.9:1234", "5.6.7.8", "9.9.9.9:1234"},
+		{"X-Forwarded-For", "[::1]:1234", "2001:db8::1", "[2001:db8::1]:1234"},
+		{"Forwarded", "10.0.0.1:1234", `for="[2001:db8::1]:4711"`, "[2001:db8::1]:1234"},
+		{"X-Real-IP", "10.0.0.1:1234", "5.6.7.8", "5.6.7.8:1234"},
+		{"X-Real-IP", "10.0.0.1", "5.6.7.8", "5.6.7.8:0"},
+	} {
+		var remote, placeholder string
+		rip := RealIP{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				remote = r.RemoteAddr
+				placeholder = httpserver.NewReplacer(r, nil, "").Replace("{remote}")
+				return http.StatusOK, nil
+			}),
+			From:   trusted,
+			Header: test.header,
+		}
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		if test.value != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		if _, err := rip.ServeHTTP(httptest.NewRecorder(), r); err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		if remote != test.expected {
+			t.Errorf("Test %d: Expected remote address %s, got %s", i, test.expected, remote)
+		}
+		if ip := httpserver.ClientIP(r, nil, ""); placeholder != ip.String() {
+			t.Errorf("Test %d: Expected {remote} to be %s, got %s", i, ip, placeholder)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package realip
+
+import (
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func init() {
+	casket.RegisterPlugin("realip", casket.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new RealIP middleware instance.
+func setup(c *casket.Controller) error {
+	rip, err := realIPParse(c)
+	if err != nil {
+		return err
+	}
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		rip.Next = next
+		return rip
+	})
+	return nil
+}
+
+func realIPParse(c *casket.Controller) (RealIP, error) {
+	rip := RealIP{Header: "X-Forwarded-For"}
+
+	for c.Next() {
+		networks, err := httpserver.ParseNetworks(c.RemainingArgs())
+		if err != nil {
+			return rip, c.Err(err.Error())
+		}
+		rip.From = append(rip.From, networks...)
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "from":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return rip, c.ArgErr()
+				}
+				networks, err := httpserver.ParseNetworks(args)
+				if err != nil {
+					return rip, c.Err(err.Error())
+				}
+				rip.From = append(rip.From, networks...)
+			case "header":
+				if !c.NextArg() {
+					return rip, c.ArgErr()
+				}
+				rip.Header = c.Val()
+				if c.NextArg() {
+					return rip, c.ArgErr()
+				}
+			default:
+				return rip, c.Errf("unknown subdirective: %s", c.Val())
+			}
+		}
+	}
+
+	if len(rip.From) == 0 {
+		return rip, c.Err("realip needs the networks of the trusted proxies")
+	}
+	return rip, nil
+}
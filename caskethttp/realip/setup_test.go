@@ -0,0 +1,94 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package realip
+
+import (
+	"testing"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := casket.NewTestController("http", `realip 10.0.0.0/8`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(RealIP)
+	if !ok {
+		t.Fatalf("Expected handler to be type RealIP, got: %#v", handler)
+	}
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+}
+
+func TestRealIPParse(t *testing.T) {
+	tests := []struct {
+		input          string
+		shouldErr      bool
+		expectedFrom   int
+		expectedHeader string
+	}{
+		{`realip 10.0.0.0/8`, false, 1, "X-Forwarded-For"},
+		{`realip 10.0.0.0/8 ::1 {
+			from 172.16.0.0/12
+			header Forwarded
+		}`, false, 3, "Forwarded"},
+		{`realip {
+			from 127.0.0.1
+			header X-Real-IP
+		}`, false, 1, "X-Real-IP"},
+		{`realip`, true, 0, ""},
+		{`realip {
+			header X-Real-IP
+		}`, true, 0, ""},
+		{`realip 10.0.0.0/33`, true, 0, ""},
+		{`realip {
+			from
+		}`, true, 0, ""},
+		{`realip 10.0.0.0/8 {
+			header A B
+		}`, true, 0, ""},
+		{`realip 10.0.0.0/8 {
+			strict
+		}`, true, 0, ""},
+	}
+
+	for i, test := range tests {
+		actual, err := realIPParse(casket.NewTestController("http", test.input))
+
+		if err == nil && test.shouldErr {
+			t.Errorf("Test %d didn't error, but it should have", i)
+		} else if err != nil && !test.shouldErr {
+			t.Errorf("Test %d errored, but it shouldn't have; got '%v'", i, err)
+		}
+		if err != nil {
+			continue
+		}
+		if len(actual.From) != test.expectedFrom {
+			t.Errorf("Test %d: Expected %d trusted networks, got %v", i, test.expectedFrom, actual.From)
+		}
+		if actual.Header != test.expectedHeader {
+			t.Errorf("Test %d: Expected header %s, got %s", i, test.expectedHeader, actual.Header)
+		}
+	}
+}
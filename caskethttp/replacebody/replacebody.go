@@ -0,0 +1,147 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package replacebody provides a middleware layer that rewrites
+// response bodies using literal or regular expression replacements.
+//
+// Encoded bodies can't be rewritten, so the handlers behind it are
+// asked for unencoded responses by removing the Accept-Encoding
+// header of the request. Encoded responses sent regardless, like
+// precompressed files, are passed on unchanged; compressing the
+// response for the client is left to the gzip directive.
+package replacebody
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+// ReplaceBody is middleware that rewrites response bodies.
+type ReplaceBody struct {
+	Next  httpserver.Handler
+	Rules []*Rule
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (rb ReplaceBody) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	rule := rb.match(r)
+	if rule == nil || r.Method == http.MethodHead {
+		return rb.Next.ServeHTTP(w, r)
+	}
+
+	// a copy of the request, so that the client's
+	// Accept-Encoding is still seen by others, e.g. log
+	req := r.WithContext(r.Context())
+	req.Header = r.Header.Clone()
+	req.Header.Del("Accept-Encoding")
+
+	rw := &responseWriter{
+		ResponseWriterWrapper: &httpserver.ResponseWriterWrapper{ResponseWriter: w},
+		rule:                  rule,
+		repl:                  httpserver.NewReplacer(r, nil, ""),
+	}
+	status, err := rb.Next.ServeHTTP(rw, req)
+	if closeErr := rw.close(); err == nil {
+		err = closeErr
+	}
+	return status, err
+}
+
+// match returns the rule with the longest path matching r,
+// or nil if none does.
+func (rb ReplaceBody) match(r *http.Request) *Rule {
+	i := httpserver.Path(r.URL.Path).LongestMatch(len(rb.Rules), func(i int) []string {
+		return []string{rb.Rules[i].Path}
+	})
+	if i < 0 {
+		return nil
+	}
+	return rb.Rules[i]
+}
+
+// Rewritable returns true if a response with
+// status has a body that can be rewritten.
+func Rewritable(status int) bool {
+	switch {
+	case status < 200,
+		status == http.StatusNoContent,
+		status == http.StatusPartialContent,
+		status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// PrepareHeader updates header for a body that will be rewritten.
+// Since the length of the body will change, Content-Length is
+// removed and a strong ETag is weakened.
+func PrepareHeader(header http.Header) {
+	header.Del("Content-Length")
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// responseWriter rewrites the body of matching responses.
+type responseWriter struct {
+	*httpserver.ResponseWriterWrapper
+	rule        *Rule
+	repl        httpserver.Replacer
+	body        io.WriteCloser // nil if the body isn't rewritten
+	wroteHeader bool
+}
+
+// WriteHeader decides whether the body is rewritten, based on
+// the status and response headers. Encoded bodies are not.
+func (w *responseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	encoding := w.Header().Get("Content-Encoding")
+	if Rewritable(status) && (encoding == "" || encoding == "identity") &&
+		w.rule.MatchesType(w.Header().Get("Content-Type")) {
+		PrepareHeader(w.Header())
+		w.body = NewWriter(w.ResponseWriterWrapper, w.rule.Replacements, w.repl)
+	}
+	w.ResponseWriterWrapper.WriteHeader(status)
+}
+
+// Write writes b through the replacements, if the body is rewritten.
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.body != nil {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriterWrapper.Write(b)
+}
+
+// close writes the rest of a rewritten body.
+func (w *responseWriter) close() error {
+	if w.body != nil {
+		return w.body.Close()
+	}
+	return nil
+}
+
+// Interface guards
+var _ httpserver.HTTPInterfaces = (*responseWriter)(nil)
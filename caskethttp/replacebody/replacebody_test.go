@@ -0,0 +1,100 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replacebody
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestReplaceBody(t *testing.T) {
+	rb := ReplaceBody{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			switch r.URL.Path {
+			case "/missing":
+				return http.StatusNotFound, nil
+			case "/json":
+				w.Header().Set("Content-Type", "application/json")
+			case "/gzip":
+				// encoded regardless of Accept-Encoding
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("Content-Encoding", "gzip")
+			case "/negotiated":
+				w.Header().Set("Content-Type", "text/html")
+				if r.Header.Get("Accept-Encoding") != "" {
+					w.Header().Set("Content-Encoding", "gzip")
+				}
+			case "/nocontent":
+				w.WriteHeader(http.StatusNoContent)
+				return 0, nil
+			}
+			w.Header().Set("Content-Length", "26")
+			w.Header().Set("ETag", `"abc"`)
+			fmt.Fprint(w, "<p>http://old.example</p>\n")
+			return 0, nil
+		}),
+		Rules: []*Rule{
+			{Path: "/", Replacements: []Replacement{{Search: "old.example", Replace: "new.example"}}},
+			{Path: "/api", Replacements: []Replacement{{Search: "http://old.example", Replace: "{method}"}}},
+		},
+	}
+
+	tests := []struct {
+		path     string
+		status   int
+		body     string
+		rewrited bool
+	}{
+		{"/", 0, "<p>http://new.example</p>\n", true},
+		{"/api/x", 0, "<p>GET</p>\n", true},
+		{"/json", 0, "<p>http://old.example</p>\n", false},
+		{"/gzip", 0, "<p>http://old.example</p>\n", false},
+		{"/negotiated", 0, "<p>http://new.example</p>\n", true},
+		{"/nocontent", 0, "", false},
+		{"/missing", http.StatusNotFound, "", false},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		status, err := rb.ServeHTTP(w, r)
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("Test %d: Expected the request header to be kept", i)
+		}
+		if status != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, status)
+		}
+		if w.Body.String() != test.body {
+			t.Errorf("Test %d: Expected body %q, got %q", i, test.body, w.Body.String())
+		}
+		if test.rewrited {
+			if cl := w.Header().Get("Content-Length"); cl != "" {
+				t.Errorf("Test %d: Expected Content-Length to be removed, got %s", i, cl)
+			}
+			if etag := w.Header().Get("ETag"); etag != `W/"abc"` {
+				t.Errorf("Test %d: Expected weak ETag, got %s", i, etag)
+			}
+		} else if test.body != "" && w.Header().Get("Content-Length") != "26" {
+			t.Errorf("Test %d: Expected Content-Length to be kept", i)
+		}
+	}
+}
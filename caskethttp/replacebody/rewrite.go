@@ -0,0 +1,207 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replacebody
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"regexp"
+	"strings"
+
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+// maxLineLength is the length after which an unterminated line is
+// rewritten anyway, so that memory use stays bounded. Matches that
+// span such a line break are not replaced.
+const maxLineLength = 64 * 1024
+
+// DefaultTypes are the media types whose bodies are rewritten
+// if a rule doesn't list any.
+var DefaultTypes = []string{"text/*"}
+
+// Replacement is a single replacement made in a body.
+type Replacement struct {
+	// Search is the literal text to replace. It may contain
+	// placeholders. It is ignored if Regexp is set.
+	Search string
+
+	// Regexp matches the text to replace. Replace may
+	// refer to its submatches as in regexp.Expand.
+	Regexp *regexp.Regexp
+
+	// Replace is the replacement text. It may contain placeholders.
+	Replace string
+}
+
+// Rule is a list of replacements applied to responses
+// of the given media types.
+type Rule struct {
+	Path         string
+	Replacements []Replacement
+	Types        []string // e.g. "text/html" or "text/*"
+}
+
+// MatchesType returns true if bodies with contentType are rewritten by the rule.
+func (r *Rule) MatchesType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	types := r.Types
+	if len(types) == 0 {
+		types = DefaultTypes
+	}
+	for _, t := range types {
+		if t == mediaType || strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// replacement is a Replacement with its placeholders replaced.
+type replacement struct {
+	search  []byte
+	re      *regexp.Regexp
+	replace []byte
+}
+
+// rewriter applies replacements to a body line by line.
+type rewriter struct {
+	replacements []replacement
+	buf          []byte // incomplete line
+	out          []byte
+}
+
+func newRewriter(replacements []Replacement, repl httpserver.Replacer) *rewriter {
+	expand := func(s string) string {
+		if repl == nil {
+			return s
+		}
+		return repl.Replace(s)
+	}
+	rw := &rewriter{}
+	for _, r := range replacements {
+		rw.replacements = append(rw.replacements, replacement{
+			search:  []byte(expand(r.Search)),
+			re:      r.Regexp,
+			replace: []byte(expand(r.Replace)),
+		})
+	}
+	return rw
+}
+
+// write adds p to the body and returns the rewritten output for all
+// lines completed by it. If final is true, the rest of the body is
+// rewritten too. The returned slice is only valid until the next call.
+func (rw *rewriter) write(p []byte, final bool) []byte {
+	rw.out = rw.out[:0]
+	rw.buf = append(rw.buf, p...)
+	start := 0
+	for {
+		i := bytes.IndexByte(rw.buf[start:], '\n')
+		if i < 0 {
+			break
+		}
+		rw.out = rw.replace(rw.out, rw.buf[start:start+i+1])
+		start += i + 1
+	}
+	if final || len(rw.buf)-start >= maxLineLength {
+		rw.out = rw.replace(rw.out, rw.buf[start:])
+		start = len(rw.buf)
+	}
+	rw.buf = rw.buf[:copy(rw.buf, rw.buf[start:])]
+	return rw.out
+}
+
+// replace appends line to dst with all replacements applied.
+func (rw *rewriter) replace(dst, line []byte) []byte {
+	if len(line) == 0 {
+		return dst
+	}
+	for _, r := range rw.replacements {
+		if r.re != nil {
+			line = r.re.ReplaceAll(line, r.replace)
+		} else if len(r.search) > 0 {
+			line = bytes.Replace(line, r.search, r.replace, -1)
+		}
+	}
+	return append(dst, line...)
+}
+
+type reader struct {
+	src   io.Reader
+	rw    *rewriter
+	chunk []byte
+	out   []byte
+	err   error
+}
+
+// NewReader returns a reader that reads src with the replacements
+// applied. Replacements are made within single lines of the body.
+func NewReader(src io.Reader, replacements []Replacement, repl httpserver.Replacer) io.Reader {
+	return &reader{
+		src:   src,
+		rw:    newRewriter(replacements, repl),
+		chunk: make([]byte, 32*1024),
+	}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 && r.err == nil {
+		var n int
+		n, r.err = r.src.Read(r.chunk)
+		r.out = r.rw.write(r.chunk[:n], r.err != nil)
+	}
+	if len(r.out) > 0 {
+		n := copy(p, r.out)
+		r.out = r.out[n:]
+		return n, nil
+	}
+	return 0, r.err
+}
+
+type writer struct {
+	dst io.Writer
+	rw  *rewriter
+}
+
+// NewWriter returns a writer that writes to dst with the
+// replacements applied. Replacements are made within single
+// lines of the body, so the rest of the body is only written
+// once the writer is closed.
+func NewWriter(dst io.Writer, replacements []Replacement, repl httpserver.Replacer) io.WriteCloser {
+	return &writer{dst: dst, rw: newRewriter(replacements, repl)}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if out := w.rw.write(p, false); len(out) > 0 {
+		if _, err := w.dst.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close writes the rest of the body. It doesn't close dst.
+func (w *writer) Close() error {
+	if out := w.rw.write(nil, true); len(out) > 0 {
+		_, err := w.dst.Write(out)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replacebody
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestRewrite(t *testing.T) {
+	replacements := []Replacement{
+		{Search: "http://backend.internal", Replace: "https://{host}"},
+		{Regexp: regexp.MustCompile(`href="/(\w+)"`), Replace: `href="/app/$1"`},
+	}
+	input := "<a href=\"http://backend.internal/x\">\n<a href=\"/docs\">\nhttp://backend.internal"
+	expected := "<a href=\"https://example.com/x\">\n<a href=\"/app/docs\">\nhttps://example.com"
+
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	repl := httpserver.NewReplacer(r, nil, "")
+
+	// reading one byte at a time splits every match
+	out, err := ioutil.ReadAll(NewReader(iotest.OneByteReader(strings.NewReader(input)), replacements, repl))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if string(out) != expected {
+		t.Errorf("Expected reader output %q, got %q", expected, out)
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf, replacements, repl)
+	for i := 0; i < len(input); i++ {
+		if _, err := w.Write([]byte{input[i]}); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if strings.Contains(buf.String(), "\nhttp") {
+		t.Errorf("Expected incomplete line to be held back, got %q", buf.String())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if buf.String() != expected {
+		t.Errorf("Expected writer output %q, got %q", expected, buf.String())
+	}
+}
+
+func TestRewriteLongLine(t *testing.T) {
+	input := strings.Repeat("a", maxLineLength*2+10)
+	replacements := []Replacement{{Search: "a", Replace: "b"}}
+	out, err := ioutil.ReadAll(NewReader(strings.NewReader(input), replacements, nil))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if string(out) != strings.Repeat("b", len(input)) {
+		t.Errorf("Expected all of a long line to be rewritten")
+	}
+
+	// long lines are flushed before the body ends
+	pr, pw := io.Pipe()
+	reader := NewReader(pr, replacements, nil)
+	go pw.Write([]byte(input[:maxLineLength]))
+	if n, err := reader.Read(make([]byte, 10)); n != 10 || err != nil {
+		t.Errorf("Expected long line to be readable before EOF, got %d bytes and %v", n, err)
+	}
+	pw.Close()
+}
+
+func TestMatchesType(t *testing.T) {
+	tests := []struct {
+		types       []string
+		contentType string
+		matches     bool
+	}{
+		{nil, "text/html; charset=utf-8", true},
+		{nil, "text/plain", true},
+		{nil, "application/json", false},
+		{nil, "", false},
+		{[]string{"application/javascript", "text/html"}, "application/javascript", true},
+		{[]string{"application/javascript", "text/html"}, "text/css", false},
+		{[]string{"application/*"}, "application/xml", true},
+	}
+	for i, test := range tests {
+		rule := &Rule{Types: test.types}
+		if got := rule.MatchesType(test.contentType); got != test.matches {
+			t.Errorf("Test %d: Expected %s to match %v, got %v", i, test.contentType, test.matches, got)
+		}
+	}
+}
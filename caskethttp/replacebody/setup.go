@@ -0,0 +1,118 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replacebody
+
+import (
+	"regexp"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func init() {
+	casket.RegisterPlugin("replace_body", casket.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new ReplaceBody middleware instance.
+func setup(c *casket.Controller) error {
+	rules, err := replaceBodyParse(c)
+	if err != nil {
+		return err
+	}
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return ReplaceBody{Next: next, Rules: rules}
+	})
+
+	return nil
+}
+
+func replaceBodyParse(c *casket.Controller) ([]*Rule, error) {
+	var rules []*Rule
+
+	for c.Next() {
+		args := c.RemainingArgs()
+		path := "/"
+		switch len(args) {
+		case 0, 2:
+		case 1, 3:
+			path = args[0]
+			args = args[1:]
+		default:
+			return nil, c.ArgErr()
+		}
+
+		// merge with an existing rule for the same path
+		var rule *Rule
+		for _, r := range rules {
+			if r.Path == path {
+				rule = r
+				break
+			}
+		}
+		if rule == nil {
+			rule = &Rule{Path: path}
+			rules = append(rules, rule)
+		}
+
+		if len(args) == 2 {
+			if args[0] == "" {
+				return nil, c.Err("search text must not be empty")
+			}
+			rule.Replacements = append(rule.Replacements, Replacement{Search: args[0], Replace: args[1]})
+		}
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "literal":
+				var search, replace string
+				if !c.Args(&search, &replace) || c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if search == "" {
+					return nil, c.Err("search text must not be empty")
+				}
+				rule.Replacements = append(rule.Replacements, Replacement{Search: search, Replace: replace})
+			case "regexp":
+				var pattern, replace string
+				if !c.Args(&pattern, &replace) || c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				re, err := regexp.Compile(pattern)
+				if err != nil {
+					return nil, c.Errf("invalid regexp '%s': %v", pattern, err)
+				}
+				rule.Replacements = append(rule.Replacements, Replacement{Regexp: re, Replace: replace})
+			case "types":
+				types := c.RemainingArgs()
+				if len(types) == 0 {
+					return nil, c.ArgErr()
+				}
+				rule.Types = append(rule.Types, types...)
+			default:
+				return nil, c.Errf("unknown property '%s'", c.Val())
+			}
+		}
+
+		if len(rule.Replacements) == 0 {
+			return nil, c.Err("no replacements specified")
+		}
+	}
+
+	return rules, nil
+}
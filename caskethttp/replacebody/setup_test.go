@@ -0,0 +1,119 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replacebody
+
+import (
+	"testing"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := casket.NewTestController("http", `replace_body old new`)
+	err := setup(c)
+	if err != nil {
+		t.Errorf("Expected no errors, got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(ReplaceBody)
+	if !ok {
+		t.Fatalf("Expected handler to be type ReplaceBody, got: %#v", handler)
+	}
+
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+}
+
+func TestReplaceBodyParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  []Rule
+	}{
+		{`replace_body old new`, false, []Rule{
+			{Path: "/", Replacements: []Replacement{{Search: "old", Replace: "new"}}},
+		}},
+		{`replace_body /app old new
+		  replace_body /app {
+			literal foo bar
+			types text/html application/javascript
+		  }`, false, []Rule{
+			{Path: "/app", Replacements: []Replacement{{Search: "old", Replace: "new"}, {Search: "foo", Replace: "bar"}},
+				Types: []string{"text/html", "application/javascript"}},
+		}},
+		{`replace_body {
+			regexp "href=\"/(\w+)\"" "href=\"/app/$1\""
+		  }`, false, []Rule{
+			{Path: "/", Replacements: []Replacement{{Replace: `href="/app/$1"`}}},
+		}},
+		{`replace_body`, true, nil},
+		{`replace_body /app`, true, nil},
+		{`replace_body "" new`, true, nil},
+		{`replace_body a b c d`, true, nil},
+		{`replace_body {
+			regexp ( x
+		  }`, true, nil},
+		{`replace_body {
+			literal x
+		  }`, true, nil},
+		{`replace_body {
+			types
+		  }`, true, nil},
+		{`replace_body {
+			unknown x
+		  }`, true, nil},
+	}
+	for i, test := range tests {
+		rules, err := replaceBodyParse(casket.NewTestController("http", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+			continue
+		}
+		if len(rules) != len(test.expected) {
+			t.Fatalf("Test %d: Expected %d rules, got %d", i, len(test.expected), len(rules))
+		}
+		for j, expected := range test.expected {
+			rule := rules[j]
+			if rule.Path != expected.Path {
+				t.Errorf("Test %d: Expected path %s, got %s", i, expected.Path, rule.Path)
+			}
+			if len(rule.Types) != len(expected.Types) {
+				t.Errorf("Test %d: Expected types %v, got %v", i, expected.Types, rule.Types)
+			}
+			if len(rule.Replacements) != len(expected.Replacements) {
+				t.Fatalf("Test %d: Expected %d replacements, got %d", i, len(expected.Replacements), len(rule.Replacements))
+			}
+			for k, r := range expected.Replacements {
+				got := rule.Replacements[k]
+				if got.Search != r.Search || got.Replace != r.Replace || (got.Regexp == nil) != (r.Search != "") {
+					t.Errorf("Test %d: Expected replacement %d to be %+v, got %+v", i, k, r, got)
+				}
+			}
+		}
+	}
+}
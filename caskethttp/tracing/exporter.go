@@ -0,0 +1,302 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing exports the request spans of a site to
+// an OpenTelemetry collector using OTLP over HTTP.
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+// Exporter batches spans and sends them to an OTLP/HTTP
+// endpoint. Spans are queued without blocking requests;
+// once the queue is full, new spans are dropped.
+type Exporter struct {
+	// Endpoint is the URL spans are POSTed to.
+	Endpoint string
+
+	// ServiceName is the service.name resource attribute.
+	ServiceName string
+
+	// Headers are added to each export request.
+	Headers http.Header
+
+	// BatchSize is the most spans sent in one request.
+	BatchSize int
+
+	// FlushInterval is the longest a span waits
+	// in the queue before it is sent.
+	FlushInterval time.Duration
+
+	// Client sends the export requests.
+	Client *http.Client
+
+	queue    chan *httpserver.Span
+	dropped  int64
+	done     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// NewExporter returns an exporter to endpoint with
+// room for queueSize spans awaiting export.
+func NewExporter(endpoint string, queueSize int) *Exporter {
+	return &Exporter{
+		Endpoint:      endpoint,
+		ServiceName:   defaultServiceName,
+		Headers:       make(http.Header),
+		BatchSize:     defaultBatchSize,
+		FlushInterval: defaultFlushInterval,
+		Client:        &http.Client{Timeout: 10 * time.Second},
+		queue:         make(chan *httpserver.Span, queueSize),
+		done:          make(chan struct{}),
+	}
+}
+
+// Start starts sending the queued spans.
+func (e *Exporter) Start() error {
+	e.wg.Add(1)
+	go e.run()
+	return nil
+}
+
+// Stop sends the spans that are still queued and stops
+// the exporter. Spans exported afterwards are discarded.
+func (e *Exporter) Stop() error {
+	e.stopOnce.Do(func() { close(e.done) })
+	e.wg.Wait()
+	return nil
+}
+
+// ExportSpan queues span for export. It implements
+// httpserver.SpanExporter.
+func (e *Exporter) ExportSpan(span *httpserver.Span) {
+	select {
+	case e.queue <- span:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+}
+
+// Dropped returns the number of spans that were
+// dropped because the queue was full.
+func (e *Exporter) Dropped() int64 {
+	return atomic.LoadInt64(&e.dropped)
+}
+
+func (e *Exporter) run() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(e.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*httpserver.Span, 0, e.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			log.Printf("[ERROR] Exporting %d spans to %s: %v", len(batch), e.Endpoint, err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) >= e.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.done:
+			for {
+				select {
+				case span := <-e.queue:
+					batch = append(batch, span)
+					if len(batch) >= e.BatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// send POSTs spans to the endpoint as an OTLP JSON request.
+func (e *Exporter) send(spans []*httpserver.Span) error {
+	body, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range e.Headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// The following types are the OTLP/JSON encoding of spans, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope  `json:"scope"`
+	Spans []span `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type span struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	TraceState        string     `json:"traceState,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            status     `json:"status"`
+}
+
+type status struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// statusError is the OTLP status code of a failed span.
+const statusError = 2
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func (e *Exporter) encode(spans []*httpserver.Span) exportRequest {
+	encoded := make([]span, len(spans))
+	for i, s := range spans {
+		encoded[i] = span{
+			TraceID:           hex.EncodeToString(s.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.SpanID[:]),
+			TraceState:        s.TraceState,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        encodeAttributes(s.Attributes),
+		}
+		if s.ParentSpanID != [8]byte{} {
+			encoded[i].ParentSpanID = hex.EncodeToString(s.ParentSpanID[:])
+		}
+		if s.Error {
+			encoded[i].Status = status{Code: statusError, Message: s.Message}
+		}
+	}
+	return exportRequest{
+		ResourceSpans: []resourceSpans{{
+			Resource: resource{
+				Attributes: encodeAttributes(map[string]interface{}{"service.name": e.ServiceName}),
+			},
+			ScopeSpans: []scopeSpans{{
+				Scope: scope{Name: "casket"},
+				Spans: encoded,
+			}},
+		}},
+	}
+}
+
+func encodeAttributes(attrs map[string]interface{}) []keyValue {
+	if len(attrs) == 0 {
+		return nil
+	}
+	kvs := make([]keyValue, 0, len(attrs))
+	for key, value := range attrs {
+		var v anyValue
+		switch value := value.(type) {
+		case string:
+			v.StringValue = &value
+		case bool:
+			v.BoolValue = &value
+		case int:
+			s := strconv.Itoa(value)
+			v.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(value, 10)
+			v.IntValue = &s
+		case float64:
+			v.DoubleValue = &value
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		kvs = append(kvs, keyValue{Key: key, Value: v})
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+// collector is a stand-in for an OTLP/HTTP collector.
+type collector struct {
+	sync.Mutex
+	requests []exportRequest
+	headers  []http.Header
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req exportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.Lock()
+	c.requests = append(c.requests, req)
+	c.headers = append(c.headers, r.Header)
+	c.Unlock()
+}
+
+func (c *collector) spans() []span {
+	c.Lock()
+	defer c.Unlock()
+	var spans []span
+	for _, req := range c.requests {
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+func TestExporter(t *testing.T) {
+	coll := new(collector)
+	srv := httptest.NewServer(coll)
+	defer srv.Close()
+
+	exporter := NewExporter(srv.URL+"/v1/traces", 10)
+	exporter.ServiceName = "test"
+	exporter.BatchSize = 2
+	exporter.FlushInterval = time.Hour
+	exporter.Headers.Set("Authorization", "Bearer token")
+	exporter.Start()
+
+	tracer := &httpserver.Tracer{Exporter: exporter, SampleRatio: 1}
+	r, server := tracer.StartServerSpan(httptest.NewRequest("GET", "/", nil))
+	client := httpserver.StartSpan(r.Context(), "backend", httpserver.SpanKindClient)
+	client.SetStatus(http.StatusBadGateway)
+	client.Finish()
+	server.Finish()
+
+	// a third span is only sent once the exporter stops
+	other := httpserver.StartSpan(context.WithValue(context.Background(), httpserver.TraceSpanCtxKey, server), "other", httpserver.SpanKindClient)
+	other.Finish()
+	exporter.Stop()
+
+	coll.Lock()
+	if len(coll.requests) != 2 {
+		t.Fatalf("Expected 2 export requests, got %d", len(coll.requests))
+	}
+	if got := coll.headers[0].Get("Authorization"); got != "Bearer token" {
+		t.Errorf("Expected configured header, got '%s'", got)
+	}
+	attrs := coll.requests[0].ResourceSpans[0].Resource.Attributes
+	if len(attrs) != 1 || attrs[0].Key != "service.name" || *attrs[0].Value.StringValue != "test" {
+		t.Errorf("Expected service.name resource attribute, got %+v", attrs)
+	}
+	coll.Unlock()
+
+	spans := coll.spans()
+	if len(spans) != 3 {
+		t.Fatalf("Expected 3 spans, got %d", len(spans))
+	}
+	c, s := spans[0], spans[1]
+	if c.TraceID != server.TraceIDString() || c.ParentSpanID != s.SpanID || s.ParentSpanID != "" {
+		t.Errorf("Expected client span to be a child of the root server span, got %+v and %+v", c, s)
+	}
+	if c.Kind != httpserver.SpanKindClient || s.Kind != httpserver.SpanKindServer {
+		t.Errorf("Expected span kinds 3 and 2, got %d and %d", c.Kind, s.Kind)
+	}
+	if c.Status.Code != statusError || s.Status.Code != 0 {
+		t.Errorf("Expected only the client span to be an error, got %+v and %+v", c.Status, s.Status)
+	}
+	var status string
+	for _, kv := range c.Attributes {
+		if kv.Key == "http.response.status_code" && kv.Value.IntValue != nil {
+			status = *kv.Value.IntValue
+		}
+	}
+	if status != "502" {
+		t.Errorf("Expected status code attribute 502, got '%s'", status)
+	}
+
+	// spans are discarded once the exporter is stopped
+	client = httpserver.StartSpan(r.Context(), "late", httpserver.SpanKindClient)
+	client.Finish()
+	if len(coll.spans()) != 3 {
+		t.Error("Expected no spans to be sent after stopping")
+	}
+}
+
+func TestExporterDrops(t *testing.T) {
+	exporter := NewExporter("http://localhost:4318/v1/traces", 1)
+	span := new(httpserver.Span)
+	exporter.ExportSpan(span)
+	exporter.ExportSpan(span)
+	exporter.ExportSpan(span)
+	if got := exporter.Dropped(); got != 2 {
+		t.Errorf("Expected 2 dropped spans, got %d", got)
+	}
+}
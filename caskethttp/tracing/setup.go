@@ -0,0 +1,140 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func init() {
+	casket.RegisterPlugin("tracing", casket.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+const (
+	defaultEndpoint      = "http://localhost:4318/v1/traces"
+	defaultServiceName   = "casket"
+	defaultBatchSize     = 512
+	defaultFlushInterval = 5 * time.Second
+	defaultQueueSize     = 2048
+)
+
+// setup configures tracing of the requests to a site.
+func setup(c *casket.Controller) error {
+	tracer, exporter, err := tracingParse(c)
+	if err != nil {
+		return err
+	}
+
+	c.OnStartup(exporter.Start)
+	c.OnShutdown(exporter.Stop)
+
+	httpserver.GetConfig(c).Tracer = tracer
+	return nil
+}
+
+func tracingParse(c *casket.Controller) (*httpserver.Tracer, *Exporter, error) {
+	tracer := &httpserver.Tracer{SampleRatio: 1}
+	endpoint, queueSize := defaultEndpoint, defaultQueueSize
+	exporter := NewExporter(endpoint, queueSize)
+
+	var parsed bool
+	for c.Next() {
+		if parsed {
+			return nil, nil, c.Err("tracing can only be specified once per site")
+		}
+		parsed = true
+
+		args := c.RemainingArgs()
+		switch len(args) {
+		case 0:
+		case 1:
+			endpoint = args[0]
+		default:
+			return nil, nil, c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "endpoint":
+				if !c.NextArg() {
+					return nil, nil, c.ArgErr()
+				}
+				endpoint = c.Val()
+			case "service_name":
+				if !c.NextArg() {
+					return nil, nil, c.ArgErr()
+				}
+				exporter.ServiceName = c.Val()
+			case "sample_ratio":
+				if !c.NextArg() {
+					return nil, nil, c.ArgErr()
+				}
+				ratio, err := strconv.ParseFloat(c.Val(), 64)
+				if err != nil || ratio < 0 || ratio > 1 {
+					return nil, nil, c.Errf("invalid sample ratio '%s', must be between 0 and 1", c.Val())
+				}
+				tracer.SampleRatio = ratio
+			case "header":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, nil, c.ArgErr()
+				}
+				exporter.Headers.Add(args[0], args[1])
+			case "batch_size", "queue_size":
+				name := c.Val()
+				if !c.NextArg() {
+					return nil, nil, c.ArgErr()
+				}
+				n, err := strconv.Atoi(c.Val())
+				if err != nil || n < 1 {
+					return nil, nil, c.Errf("invalid %s '%s'", name, c.Val())
+				}
+				if name == "batch_size" {
+					exporter.BatchSize = n
+				} else {
+					queueSize = n
+				}
+			case "flush_interval":
+				if !c.NextArg() {
+					return nil, nil, c.ArgErr()
+				}
+				interval, err := time.ParseDuration(c.Val())
+				if err != nil || interval <= 0 {
+					return nil, nil, c.Errf("invalid flush interval '%s'", c.Val())
+				}
+				exporter.FlushInterval = interval
+			default:
+				return nil, nil, c.Errf("unknown property '%s'", c.Val())
+			}
+		}
+	}
+
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, nil, c.Errf("invalid endpoint '%s', must be an http or https URL", endpoint)
+	}
+	exporter.Endpoint = endpoint
+	exporter.queue = make(chan *httpserver.Span, queueSize)
+
+	tracer.Exporter = exporter
+	return tracer, exporter, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tmpim/casket"
+	"github.com/tmpim/casket/caskethttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := casket.NewTestController("http", `tracing`)
+	err := setup(c)
+	if err != nil {
+		t.Errorf("Expected no errors, got: %v", err)
+	}
+	tracer := httpserver.GetConfig(c).Tracer
+	if tracer == nil {
+		t.Fatal("Expected tracer to be set")
+	}
+	exporter, ok := tracer.Exporter.(*Exporter)
+	if !ok {
+		t.Fatalf("Expected exporter to be type *Exporter, got: %#v", tracer.Exporter)
+	}
+	if exporter.Endpoint != defaultEndpoint {
+		t.Errorf("Expected default endpoint, got %s", exporter.Endpoint)
+	}
+	if len(httpserver.GetConfig(c).Middleware()) != 0 {
+		t.Error("Expected no middleware")
+	}
+}
+
+func TestTracingParse(t *testing.T) {
+	tests := []struct {
+		input         string
+		shouldErr     bool
+		endpoint      string
+		serviceName   string
+		sampleRatio   float64
+		headers       http.Header
+		batchSize     int
+		flushInterval time.Duration
+		queueSize     int
+	}{
+		{`tracing`, false, defaultEndpoint, defaultServiceName, 1, http.Header{}, defaultBatchSize, defaultFlushInterval, defaultQueueSize},
+		{`tracing https://collector:4318/v1/traces`, false, "https://collector:4318/v1/traces", defaultServiceName, 1, http.Header{}, defaultBatchSize, defaultFlushInterval, defaultQueueSize},
+		{`tracing {
+			endpoint http://collector/v1/traces
+			service_name web
+			sample_ratio 0.25
+			header Authorization "Bearer token"
+			batch_size 100
+			flush_interval 1s
+			queue_size 10
+		}`, false, "http://collector/v1/traces", "web", 0.25, http.Header{"Authorization": {"Bearer token"}}, 100, time.Second, 10},
+		{`tracing a b`, true, "", "", 0, nil, 0, 0, 0},
+		{`tracing collector:4318`, true, "", "", 0, nil, 0, 0, 0},
+		{`tracing {
+			sample_ratio 2
+		}`, true, "", "", 0, nil, 0, 0, 0},
+		{`tracing {
+			batch_size 0
+		}`, true, "", "", 0, nil, 0, 0, 0},
+		{`tracing {
+			flush_interval soon
+		}`, true, "", "", 0, nil, 0, 0, 0},
+		{`tracing {
+			header Authorization
+		}`, true, "", "", 0, nil, 0, 0, 0},
+		{`tracing {
+			unknown
+		}`, true, "", "", 0, nil, 0, 0, 0},
+		{`tracing
+		tracing`, true, "", "", 0, nil, 0, 0, 0},
+	}
+	for i, test := range tests {
+		c := casket.NewTestController("http", test.input)
+		tracer, exporter, err := tracingParse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error, got %v", i, err)
+			continue
+		}
+		if tracer.Exporter != exporter {
+			t.Errorf("Test %d: expected tracer to use the exporter", i)
+		}
+		if tracer.SampleRatio != test.sampleRatio {
+			t.Errorf("Test %d: expected sample ratio %v, got %v", i, test.sampleRatio, tracer.SampleRatio)
+		}
+		if exporter.Endpoint != test.endpoint {
+			t.Errorf("Test %d: expected endpoint %s, got %s", i, test.endpoint, exporter.Endpoint)
+		}
+		if exporter.ServiceName != test.serviceName {
+			t.Errorf("Test %d: expected service name %s, got %s", i, test.serviceName, exporter.ServiceName)
+		}
+		if !reflect.DeepEqual(exporter.Headers, test.headers) {
+			t.Errorf("Test %d: expected headers %v, got %v", i, test.headers, exporter.Headers)
+		}
+		if exporter.BatchSize != test.batchSize {
+			t.Errorf("Test %d: expected batch size %d, got %d", i, test.batchSize, exporter.BatchSize)
+		}
+		if exporter.FlushInterval != test.flushInterval {
+			t.Errorf("Test %d: expected flush interval %v, got %v", i, test.flushInterval, exporter.FlushInterval)
+		}
+		if cap(exporter.queue) != test.queueSize {
+			t.Errorf("Test %d: expected queue size %d, got %d", i, test.queueSize, cap(exporter.queue))
+		}
+	}
+}
@@ -612,3 +612,34 @@ var clusterPluginSetup int32 // access atomically
 // CertCacheInstStorageKey is the name of the key for
 // accessing the certificate storage on the *casket.Instance.
 const CertCacheInstStorageKey = "tls_cert_cache"
+
+// CertificateExpirations returns the expiration times of the
+// certificates in inst's cache, keyed by the names they cover,
+// for the hostnames configured in inst.
+func CertificateExpirations(inst *casket.Instance) map[string]time.Time {
+	inst.StorageMu.RLock()
+	certCache, _ := inst.Storage[CertCacheInstStorageKey].(*certmagic.Cache)
+	cfgMap, _ := inst.Storage[configMapKey].(map[string]*Config)
+	inst.StorageMu.RUnlock()
+
+	expirations := make(map[string]time.Time)
+	if certCache == nil {
+		return expirations
+	}
+	for hostname := range cfgMap {
+		if hostname == "" {
+			continue
+		}
+		for _, cert := range certCache.AllMatchingCertificates(hostname) {
+			if cert.Leaf == nil {
+				continue
+			}
+			for _, name := range cert.Names {
+				if expires, ok := expirations[name]; !ok || cert.Leaf.NotAfter.After(expires) {
+					expirations[name] = cert.Leaf.NotAfter
+				}
+			}
+		}
+	}
+	return expirations
+}
@@ -15,11 +15,15 @@
 package caskettls
 
 import (
+	"context"
 	"crypto/tls"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/caddyserver/certmagic"
 	"github.com/klauspost/cpuid"
+	"github.com/tmpim/casket"
 )
 
 func TestConvertTLSConfigProtocolVersions(t *testing.T) {
@@ -130,3 +134,39 @@ func TestAssertTLSConfigCompatibleClientCert(t *testing.T) {
 		t.Fatalf("Expected no error, but got %v", err)
 	}
 }
+
+func TestCertificateExpirations(t *testing.T) {
+	inst := &casket.Instance{Storage: make(map[interface{}]interface{})}
+	if len(CertificateExpirations(inst)) != 0 {
+		t.Error("Expected no expirations without a certificate cache")
+	}
+
+	cfg, err := NewConfig(inst, certmagic.ACMEIssuer{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	cfg.Hostname = "example.com"
+	expire := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	cert, err := newSelfSignedCertificate(selfSignedConfig{
+		SAN:     []string{"example.com"},
+		KeyType: certmagic.P256,
+		Expire:  expire,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := cfg.Manager.CacheUnmanagedTLSCertificate(context.TODO(), cert, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	inst.Storage[configMapKey] = map[string]*Config{"example.com": cfg}
+	defer func() {
+		for _, fn := range inst.OnShutdown {
+			fn()
+		}
+	}()
+
+	expirations := CertificateExpirations(inst)
+	if len(expirations) != 1 || !expirations["example.com"].Equal(expire) {
+		t.Errorf("Expected example.com to expire at %v, got %v", expire, expirations)
+	}
+}
@@ -153,6 +153,11 @@ type ServerListener struct {
 	packet   net.PacketConn
 }
 
+// Server returns the server that is listening.
+func (s ServerListener) Server() Server {
+	return s.server
+}
+
 // LocalAddr returns the local network address of the packetconn. It returns
 // nil when it is not set.
 func (s ServerListener) LocalAddr() net.Addr {
@@ -79,18 +79,9 @@ func trapSignalsPosix() {
 					casketfileToUse = newCasketfile
 				}
 
-				// Backup old event hooks
-				oldEventHooks := cloneEventHooks()
-
-				// Purge the old event hooks
-				purgeEventHooks()
-
 				// Kick off the restart; our work is done
-				EmitEvent(InstanceRestartEvent, nil)
-				_, err = inst.Restart(casketfileToUse)
+				_, err = inst.Reload(casketfileToUse)
 				if err != nil {
-					restoreEventHooks(oldEventHooks)
-
 					log.Printf("[ERROR] SIGUSR1: %v", err)
 				}
 